@@ -0,0 +1,67 @@
+// containership_authorized_keys is the sshd AuthorizedKeysCommand helper. It
+// asks the agent for the keys to authorize for the account being logged in to
+// and prints them in authorized_keys format. sshd reads the keys from stdout,
+// so nothing else may be printed there. It intentionally only uses the
+// standard library to stay small and self-contained on the host.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// defaultSocket must match the socket the agent serves on
+const defaultSocket = "/etc/containership/agent.sock"
+
+// sshd gives up on the command eventually, but it's better to fail fast
+const requestTimeout = 5 * time.Second
+
+func main() {
+	socket := flag.String("socket", defaultSocket, "agent socket to request keys from")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s [-socket path] <username>\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	if err := printAuthorizedKeys(*socket, flag.Arg(0)); err != nil {
+		fmt.Fprintln(os.Stderr, "could not get authorized keys:", err)
+		os.Exit(1)
+	}
+}
+
+// printAuthorizedKeys requests the keys of the account from the agent and
+// prints them
+func printAuthorizedKeys(socket, account string) error {
+	client := &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	// The host is ignored since the connection always goes to the socket
+	resp, err := client.Get("http://agent/authorized_keys?account=" + url.QueryEscape(account))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("agent responded with %s", resp.Status)
+	}
+
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
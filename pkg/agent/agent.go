@@ -5,10 +5,16 @@ import (
 	"os/signal"
 	"syscall"
 
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/scheme"
 
 	csscheme "github.com/containership/cluster-manager/pkg/client/clientset/versioned/scheme"
 	csinformers "github.com/containership/cluster-manager/pkg/client/informers/externalversions"
+	"github.com/containership/cluster-manager/pkg/constants"
 	"github.com/containership/cluster-manager/pkg/env"
 	"github.com/containership/cluster-manager/pkg/k8sutil"
 	"github.com/containership/cluster-manager/pkg/log"
@@ -16,9 +22,15 @@ import (
 )
 
 var (
-	csInformerFactory csinformers.SharedInformerFactory
-	userController    *UserController
-	cupController     *UpgradeController
+	nodeInformerFactory      kubeinformers.SharedInformerFactory
+	usernamesInformerFactory kubeinformers.SharedInformerFactory
+	csInformerFactory        csinformers.SharedInformerFactory
+	userController           *UserController
+	cupController            *UpgradeController
+	mirrorController         *RegistryMirrorController
+	sshAuditController       *SSHAuditController
+	sshStatusController      *SSHStatusController
+	authorizedKeysServer     *AuthorizedKeysServer
 )
 
 // Initialize creates the informer factories and controllers.
@@ -40,13 +52,46 @@ func Initialize() {
 		log.Info("SSH feature will not work without manual intervention")
 	}
 
+	if env.IsSSHAuthorizedKeysCommandEnabled() {
+		if err := sysuser.InstallAuthorizedKeysCommand(); err != nil {
+			log.Info("Could not install AuthorizedKeysCommand helper:", err.Error())
+			log.Info("SSH feature will not work without manual intervention")
+		}
+	}
+
 	// Create Informer factories. All Informers should be created from these
 	// factories in order to share the same underlying caches.
 	interval := env.AgentInformerSyncInterval()
 	csInformerFactory = k8sutil.CSAPI().NewCSSharedInformerFactory(interval)
 
+	// The agent only cares about the node it runs on
+	nodeInformerFactory = kubeinformers.NewFilteredSharedInformerFactory(
+		k8sutil.API().Client(), interval, metav1.NamespaceAll,
+		func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", env.NodeName()).String()
+		})
+
+	// Nor does it care about any ConfigMap other than the usernames one
+	usernamesInformerFactory = kubeinformers.NewFilteredSharedInformerFactory(
+		k8sutil.API().Client(), interval, constants.ContainershipNamespace,
+		func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", sysuser.UsernamesConfigMapName).String()
+		})
+
 	userController = NewUserController(
-		k8sutil.CSAPI().Client(), csInformerFactory)
+		k8sutil.API().Client(), k8sutil.CSAPI().Client(),
+		nodeInformerFactory, usernamesInformerFactory, csInformerFactory)
+
+	mirrorController = NewRegistryMirrorController(csInformerFactory)
+
+	sshAuditController = NewSSHAuditController(k8sutil.API().Client(), userController)
+
+	sshStatusController = NewSSHStatusController(
+		k8sutil.API().Client(), userController, sshAuditController)
+
+	if env.IsSSHAuthorizedKeysCommandEnabled() {
+		authorizedKeysServer = NewAuthorizedKeysServer(userController)
+	}
 
 	if env.IsClusterUpgradeEnabled() {
 		cupController = NewUpgradeController(k8sutil.API().Client(), csInformerFactory)
@@ -65,9 +110,18 @@ func Run() {
 	signal.Notify(signals, syscall.SIGTERM)
 	go signalHandler(signals, stopCh)
 
+	nodeInformerFactory.Start(stopCh)
+	usernamesInformerFactory.Start(stopCh)
 	csInformerFactory.Start(stopCh)
 
 	go userController.Run(1, stopCh)
+	go mirrorController.Run(1, stopCh)
+	go sshAuditController.Run(stopCh)
+	go sshStatusController.Run(stopCh)
+
+	if env.IsSSHAuthorizedKeysCommandEnabled() {
+		go authorizedKeysServer.Run(stopCh)
+	}
 
 	if env.IsClusterUpgradeEnabled() {
 		go cupController.Run(1, stopCh)
@@ -94,3 +148,14 @@ func signalHandler(signals chan os.Signal, stopCh chan struct{}) {
 		}
 	}
 }
+
+// nodeReference returns a reference to the node the agent runs on for
+// emitting events on it
+func nodeReference() *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		Kind: "Node",
+		Name: env.NodeName(),
+		// Nodes are referenced by name like the kubelet does
+		UID: types.UID(env.NodeName()),
+	}
+}
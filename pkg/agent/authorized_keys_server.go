@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+
+	"k8s.io/apimachinery/pkg/util/runtime"
+
+	"github.com/containership/cluster-manager/pkg/log"
+	"github.com/containership/cluster-manager/pkg/resources/sysuser"
+)
+
+const (
+	// Only root may connect, since the helper runs as root
+	agentSocketPermissions = os.FileMode(0600)
+)
+
+// AuthorizedKeysServer serves the keys sshd should accept to the
+// AuthorizedKeysCommand helper over the agent socket. The keys are those last
+// written by the user controller, so sshd doesn't need a shared
+// authorized_keys file.
+type AuthorizedKeysServer struct {
+	userController *UserController
+	socket         string
+}
+
+// NewAuthorizedKeysServer returns a new server for the keys of the users
+// written by the user controller
+func NewAuthorizedKeysServer(userController *UserController) *AuthorizedKeysServer {
+	return &AuthorizedKeysServer{
+		userController: userController,
+		socket:         sysuser.GetAgentSocketPath(),
+	}
+}
+
+// Run serves requests until stopCh is closed
+func (s *AuthorizedKeysServer) Run(stopCh <-chan struct{}) {
+	defer runtime.HandleCrash()
+
+	// A socket left behind by a previous agent would make listening fail
+	if err := os.Remove(s.socket); err != nil && !os.IsNotExist(err) {
+		log.Error("Could not remove old agent socket: ", err)
+		return
+	}
+
+	// The socket is only writable by root when created, so nobody else can
+	// connect before the permissions are set
+	listener, err := net.Listen("unix", s.socket)
+	if err != nil {
+		log.Error("Could not listen on agent socket: ", err)
+		return
+	}
+
+	if err := os.Chmod(s.socket, agentSocketPermissions); err != nil {
+		log.Error("Could not set agent socket permissions: ", err)
+		listener.Close()
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authorized_keys", s.getAuthorizedKeys)
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		<-stopCh
+		server.Close()
+	}()
+
+	log.Info("Serving authorized keys on ", s.socket)
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		log.Error("Error serving authorized keys: ", err)
+	}
+
+	log.Info("Shutting down authorized keys server")
+}
+
+// getAuthorizedKeys responds with the keys to accept for the account in
+// authorized_keys format
+func (s *AuthorizedKeysServer) getAuthorizedKeys(w http.ResponseWriter, r *http.Request) {
+	account := r.URL.Query().Get("account")
+	if account == "" {
+		http.Error(w, "account is required", http.StatusBadRequest)
+		return
+	}
+
+	keys, ok := s.userController.AuthorizedKeys(account)
+	if !ok {
+		// Failing makes sshd deny the login until users are written
+		http.Error(w, "users haven't been written yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	log.Debugf("Serving authorized keys for account %s", account)
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, keys)
+}
@@ -0,0 +1,198 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	csinformers "github.com/containership/cluster-manager/pkg/client/informers/externalversions"
+	cslisters "github.com/containership/cluster-manager/pkg/client/listers/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/log"
+	"github.com/containership/cluster-manager/pkg/resources/registrymirror"
+)
+
+const (
+	registryMirrorControllerName = "RegistryMirrorAgentController"
+
+	maxRetriesRegistryMirrorController = 5
+
+	// All mirrors are written to the host together, so there is only ever
+	// one thing to sync
+	registryMirrorSyncKey = "registry-mirrors"
+)
+
+// RegistryMirrorController is the agent controller which watches for Registry
+// changes and writes the container runtime mirror configuration for registries
+// with the mirror role to the host
+type RegistryMirrorController struct {
+	registriesLister cslisters.RegistryLister
+	registriesSynced cache.InformerSynced
+
+	workqueue workqueue.RateLimitingInterface
+}
+
+// NewRegistryMirrorController creates a new agent RegistryMirrorController
+func NewRegistryMirrorController(
+	csInformerFactory csinformers.SharedInformerFactory) *RegistryMirrorController {
+
+	c := &RegistryMirrorController{
+		workqueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), registryMirrorControllerName),
+	}
+
+	// Create an informer from the factory so that we share the underlying
+	// cache with other controllers
+	registryInformer := csInformerFactory.Containership().V3().Registries()
+
+	// All event handlers simply add to a workqueue to be processed by a worker
+	registryInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueRegistry,
+		UpdateFunc: func(old, new interface{}) {
+			oldRegistry := old.(*csv3.Registry)
+			newRegistry := new.(*csv3.Registry)
+			if oldRegistry.ResourceVersion == newRegistry.ResourceVersion {
+				// Just a syncInterval update
+				return
+			}
+			c.enqueueRegistry(new)
+		},
+		DeleteFunc: c.enqueueRegistry,
+	})
+
+	c.registriesLister = registryInformer.Lister()
+	c.registriesSynced = registryInformer.Informer().HasSynced
+
+	return c
+}
+
+// Run kicks off the Controller with the given number of workers to process the
+// workqueue
+func (c *RegistryMirrorController) Run(numWorkers int, stopCh <-chan struct{}) error {
+	defer runtime.HandleCrash()
+	defer c.workqueue.ShutDown()
+
+	log.Info("Starting Registry Mirror controller")
+
+	log.Info("Waiting for informer caches to sync")
+	if ok := cache.WaitForCacheSync(stopCh, c.registriesSynced); !ok {
+		return fmt.Errorf("Failed to wait for caches to sync")
+	}
+
+	// Always sync once on startup so that mirrors removed while the agent
+	// was not running are cleaned up
+	c.workqueue.Add(registryMirrorSyncKey)
+
+	log.Info("Starting registry mirror workers")
+	for i := 0; i < numWorkers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+
+	log.Info("Started registry mirror workers")
+	<-stopCh
+	log.Info("Shutting down registry mirror controller")
+
+	return nil
+}
+
+// runWorker continually requests that the next queue item be processed
+func (c *RegistryMirrorController) runWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+// processNextWorkItem continually pops items off of the workqueue and handles
+// them
+func (c *RegistryMirrorController) processNextWorkItem() bool {
+	obj, shutdown := c.workqueue.Get()
+
+	if shutdown {
+		return false
+	}
+
+	err := func(obj interface{}) error {
+		defer c.workqueue.Done(obj)
+		var key string
+		var ok bool
+		if key, ok = obj.(string); !ok {
+			// As the item in the workqueue is actually invalid, we call
+			// Forget here else we'd go into a loop of attempting to
+			// process a work item that is invalid.
+			c.workqueue.Forget(obj)
+			log.Errorf("expected string in workqueue but got %#v", obj)
+			return nil
+		}
+
+		err := c.syncHandler(key)
+		return c.handleErr(err, key)
+	}(obj)
+
+	if err != nil {
+		log.Error(err)
+		return true
+	}
+
+	return true
+}
+
+// handleErr looks to see if the resource sync event returned with an error,
+// if it did the resource gets requeued up to as many times as is set for
+// the max retries. If retry count is hit, or the resource is synced successfully
+// the resource is moved off the queue
+func (c *RegistryMirrorController) handleErr(err error, key interface{}) error {
+	if err == nil {
+		c.workqueue.Forget(key)
+		return nil
+	}
+
+	if c.workqueue.NumRequeues(key) < maxRetriesRegistryMirrorController {
+		c.workqueue.AddRateLimited(key)
+		return fmt.Errorf("error syncing '%v': %s. Has been resynced %v times", key, err.Error(), c.workqueue.NumRequeues(key))
+	}
+
+	c.workqueue.Forget(key)
+	log.Infof("Dropping %v out of the queue: %v", key, err)
+	return err
+}
+
+// enqueueRegistry enqueues a sync of all mirrors. The registry itself doesn't
+// matter since the complete mirror configuration is rewritten on every sync.
+func (c *RegistryMirrorController) enqueueRegistry(obj interface{}) {
+	c.workqueue.AddRateLimited(registryMirrorSyncKey)
+}
+
+// syncHandler writes the mirror configuration for all registries with the
+// mirror role to the host
+func (c *RegistryMirrorController) syncHandler(key string) error {
+	log.Debugf("%s: processing key=%q", registryMirrorControllerName, key)
+
+	registries, err := c.registriesLister.Registries(constants.ContainershipNamespace).List(labels.NewSelector())
+	if err != nil {
+		return err
+	}
+
+	return registrymirror.Write(mirrorsFromRegistries(registries))
+}
+
+// mirrorsFromRegistries returns the mirrors described by registries with the
+// mirror role
+func mirrorsFromRegistries(registries []*csv3.Registry) []registrymirror.Mirror {
+	mirrors := make([]registrymirror.Mirror, 0)
+	for _, r := range registries {
+		if r.Spec.Role != csv3.RegistryRoleMirror {
+			continue
+		}
+
+		mirrors = append(mirrors, registrymirror.Mirror{
+			Upstream: r.Spec.MirrorOf,
+			Endpoint: r.Spec.Serveraddress,
+		})
+	}
+
+	return mirrors
+}
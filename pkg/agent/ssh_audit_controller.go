@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/containership/cluster-manager/pkg/env"
+	"github.com/containership/cluster-manager/pkg/log"
+	"github.com/containership/cluster-manager/pkg/resources/sysuser"
+	"github.com/containership/cluster-manager/pkg/tools"
+)
+
+const (
+	sshAuditControllerName = "SSHAuditController"
+
+	// How often the session records spooled by the login script are picked up
+	sshAuditInterval = 5 * time.Second
+)
+
+// SSHAuditController is the agent controller which picks up the SSH session
+// records spooled by the login script and emits them as events on the node,
+// and optionally appends them to an audit log file. Note that events are
+// rate limited per node, so the audit log file is the complete record.
+type SSHAuditController struct {
+	recorder record.EventRecorder
+	node     *corev1.ObjectReference
+
+	// Session records are attributed to users using the usernames last
+	// written by the user controller
+	userController *UserController
+
+	auditLogFile string
+
+	// Sessions older than this are no longer active, in case their end
+	// was never recorded
+	sessionMaxAge time.Duration
+
+	// activeSessions are the start records of the sessions that haven't
+	// ended yet by session ID, protected by sessionsMutex
+	sessionsMutex  sync.Mutex
+	activeSessions map[string]sysuser.SessionRecord
+}
+
+// NewSSHAuditController returns a new SSH audit controller
+func NewSSHAuditController(kubeclientset kubernetes.Interface, userController *UserController) *SSHAuditController {
+	return &SSHAuditController{
+		recorder:       tools.CreateAndStartRecorder(kubeclientset, sshAuditControllerName),
+		node:           nodeReference(),
+		userController: userController,
+		auditLogFile:   env.SSHAuditLogFile(),
+		sessionMaxAge:  env.SSHSessionMaxAge(),
+
+		activeSessions: make(map[string]sysuser.SessionRecord),
+	}
+}
+
+// Run periodically picks up session records until stopCh is closed
+func (c *SSHAuditController) Run(stopCh <-chan struct{}) {
+	defer runtime.HandleCrash()
+
+	log.Info("Starting SSH audit controller")
+
+	wait.Until(c.auditSessions, sshAuditInterval, stopCh)
+
+	log.Info("Shutting down SSH audit controller")
+}
+
+// auditSessions audits and removes each spooled session record. Records that
+// can't be written to the audit log file are kept to be retried.
+func (c *SSHAuditController) auditSessions() {
+	usernames := c.userController.Usernames()
+	if usernames == nil {
+		// Records are kept until they can be attributed
+		log.Debug("Not reading SSH session records until users are written")
+		return
+	}
+
+	records, err := sysuser.ReadSessionRecords(usernames)
+	if err != nil {
+		log.Errorf("Error reading SSH session records: %s", err)
+		return
+	}
+
+	for _, r := range records {
+		r.Node = env.NodeName()
+
+		if c.auditLogFile != "" {
+			if err := sysuser.AppendSessionRecord(c.auditLogFile, r); err != nil {
+				log.Errorf("Error writing SSH session %s to audit log: %s", r.SessionID, err)
+				return
+			}
+		}
+
+		c.recordSessionEvent(r)
+		c.trackSession(r)
+
+		if err := sysuser.RemoveSessionRecord(r); err != nil {
+			log.Errorf("Error removing SSH session record %s: %s", r.SessionID, err)
+		}
+	}
+
+	c.pruneSessions(time.Now())
+}
+
+// recordSessionEvent emits an event on the node for the session record
+func (c *SSHAuditController) recordSessionEvent(r sysuser.SessionRecord) {
+	switch r.Event {
+	case sysuser.SessionStart:
+		c.recorder.Eventf(c.node, corev1.EventTypeNormal, "SSHSessionStarted",
+			"User %s started SSH session %s from %s with key %s at %s",
+			r.UserID, r.SessionID, r.SourceIP, r.Fingerprint, r.Time.Format(time.RFC3339))
+
+	case sysuser.SessionEnd:
+		c.recorder.Eventf(c.node, corev1.EventTypeNormal, "SSHSessionEnded",
+			"User %s ended SSH session %s from %s with key %s at %s",
+			r.UserID, r.SessionID, r.SourceIP, r.Fingerprint, r.Time.Format(time.RFC3339))
+	}
+}
+
+// trackSession adds or removes the session of the record from the active
+// sessions
+func (c *SSHAuditController) trackSession(r sysuser.SessionRecord) {
+	c.sessionsMutex.Lock()
+	defer c.sessionsMutex.Unlock()
+
+	switch r.Event {
+	case sysuser.SessionStart:
+		c.activeSessions[r.SessionID] = r
+
+	case sysuser.SessionEnd:
+		delete(c.activeSessions, r.SessionID)
+	}
+}
+
+// pruneSessions removes the sessions that ended without their end being
+// recorded from the active sessions. That's the case if the login script
+// process is gone, e.g. because it was killed or the node rebooted, or if the
+// session is older than the max age.
+func (c *SSHAuditController) pruneSessions(now time.Time) {
+	c.sessionsMutex.Lock()
+	defer c.sessionsMutex.Unlock()
+
+	for id, r := range c.activeSessions {
+		if now.Sub(r.Time) < c.sessionMaxAge && sysuser.SessionProcessExists(r) {
+			continue
+		}
+
+		log.Infof("SSH session %s of user %s is no longer active", id, r.UserID)
+		delete(c.activeSessions, id)
+	}
+}
+
+// ActiveSessions returns the start records of the sessions that haven't
+// ended yet, oldest first. Sessions started before the agent started aren't
+// known.
+func (c *SSHAuditController) ActiveSessions() []sysuser.SessionRecord {
+	c.sessionsMutex.Lock()
+	defer c.sessionsMutex.Unlock()
+
+	sessions := make([]sysuser.SessionRecord, 0, len(c.activeSessions))
+	for _, r := range c.activeSessions {
+		sessions = append(sessions, r)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Time.Before(sessions[j].Time)
+	})
+
+	return sessions
+}
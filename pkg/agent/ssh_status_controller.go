@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"encoding/json"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/env"
+	"github.com/containership/cluster-manager/pkg/log"
+	"github.com/containership/cluster-manager/pkg/resources/sysuser"
+)
+
+const (
+	// How often the SSH status of the node is reported
+	sshStatusInterval = 30 * time.Second
+
+	// At most this many of the most recent sessions are listed in the
+	// node annotation, to keep the node object small
+	maxReportedSessions = 50
+)
+
+// SSHStatusController is the agent controller which reports the SSH status of
+// the node in an annotation on the node, for the coordinator to aggregate.
+// The node is only patched when the status changes.
+type SSHStatusController struct {
+	kubeclientset kubernetes.Interface
+
+	userController     *UserController
+	sshAuditController *SSHAuditController
+
+	// lastStatus is the last status successfully reported
+	lastStatus string
+}
+
+// NewSSHStatusController returns a new SSH status controller reporting the
+// users written by the user controller and the sessions seen by the SSH audit
+// controller
+func NewSSHStatusController(
+	kubeclientset kubernetes.Interface,
+	userController *UserController,
+	sshAuditController *SSHAuditController) *SSHStatusController {
+
+	return &SSHStatusController{
+		kubeclientset:      kubeclientset,
+		userController:     userController,
+		sshAuditController: sshAuditController,
+	}
+}
+
+// Run periodically reports the SSH status until stopCh is closed
+func (c *SSHStatusController) Run(stopCh <-chan struct{}) {
+	defer runtime.HandleCrash()
+
+	log.Info("Starting SSH status controller")
+
+	wait.Until(c.reportStatus, sshStatusInterval, stopCh)
+
+	log.Info("Shutting down SSH status controller")
+}
+
+// reportStatus annotates the node with its SSH status if it changed
+func (c *SSHStatusController) reportStatus() {
+	userIDs, writtenAt := c.userController.ConfiguredUsers()
+	sessions := c.sshAuditController.ActiveSessions()
+	status := sysuser.SSHStatus{
+		UserIDs:                 userIDs,
+		AuthorizedKeysWrittenAt: writtenAt,
+		ActiveSessions:          sessions,
+		ActiveSessionCount:      len(sessions),
+	}
+
+	if len(sessions) > maxReportedSessions {
+		status.ActiveSessions = sessions[len(sessions)-maxReportedSessions:]
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		log.Error("Error marshaling SSH status: ", err)
+		return
+	}
+
+	if string(data) == c.lastStatus {
+		return
+	}
+
+	patch, err := buildSSHStatusPatch(string(data))
+	if err != nil {
+		log.Error("Error building SSH status patch: ", err)
+		return
+	}
+
+	_, err = c.kubeclientset.CoreV1().Nodes().Patch(env.NodeName(), types.MergePatchType, patch)
+	if err != nil {
+		log.Error("Error reporting SSH status: ", err)
+		return
+	}
+
+	c.lastStatus = string(data)
+}
+
+// buildSSHStatusPatch builds a merge patch setting the SSH status annotation
+func buildSSHStatusPatch(status string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				constants.SSHStatusAnnotation: status,
+			},
+		},
+	})
+}
@@ -2,14 +2,23 @@ package agent
 
 import (
 	"fmt"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelistersv1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 
 	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
@@ -19,7 +28,9 @@ import (
 	"github.com/containership/cluster-manager/pkg/constants"
 	"github.com/containership/cluster-manager/pkg/env"
 	"github.com/containership/cluster-manager/pkg/log"
+	"github.com/containership/cluster-manager/pkg/resources/sshca"
 	"github.com/containership/cluster-manager/pkg/resources/sysuser"
+	"github.com/containership/cluster-manager/pkg/tools"
 )
 
 const (
@@ -31,30 +42,75 @@ const (
 )
 
 const (
+	userControllerName       = "UserController"
 	maxRetriesUserController = 5
+
+	// sshAccessChangeKey is the workqueue key for changes to what users are
+	// allowed on the node
+	sshAccessChangeKey = "ssh-access"
 )
 
 // UserController is the agent controller which watches for CRD changes and reports
 // back when a write to host is needed
 // TODO this needs to be able to be instantiated with a different resource type
 type UserController struct {
-	clientset   csclientset.Interface
-	usersLister cslisters.UserLister
-	usersSynced cache.InformerSynced
-	workqueue   workqueue.RateLimitingInterface
+	kubeclientset kubernetes.Interface
+	clientset     csclientset.Interface
+	usersLister   cslisters.UserLister
+	usersSynced   cache.InformerSynced
+	workqueue     workqueue.RateLimitingInterface
+
+	policiesLister cslisters.SSHAccessPolicyLister
+	policiesSynced cache.InformerSynced
+
+	nodesLister corelistersv1.NodeLister
+	nodesSynced cache.InformerSynced
+
+	configMapsLister corelistersv1.ConfigMapLister
+	configMapsSynced cache.InformerSynced
+
+	// Certificates are only watched in SSH CA mode
+	certificatesLister cslisters.SSHCertificateLister
+	certificatesSynced cache.InformerSynced
+
+	recorder record.EventRecorder
+	node     *corev1.ObjectReference
+
+	// sshCAUntrusted is true if sshd didn't trust the SSH CA on the last
+	// write in SSH CA mode
+	sshCAUntrusted bool
+
+	// usernamesMissing is true if the usernames ConfigMap didn't exist on
+	// the last write
+	usernamesMissing bool
+
+	// What was last written to the host, protected by statusMutex
+	statusMutex             sync.Mutex
+	configuredUserIDs       []string
+	keyUsers                []csv3.UserSpec
+	usernames               *sysuser.UsernameMapping
+	authorizedKeysWrittenAt time.Time
 
 	requestWriteCh chan bool
 	fileWatchCmdCh chan int
 }
 
-// NewUserController creates a new agent UserController
+// NewUserController creates a new agent UserController. The node informer
+// factory should only watch the node the agent runs on, and the usernames
+// informer factory should only watch the usernames ConfigMap.
 func NewUserController(
+	kubeclientset kubernetes.Interface,
 	clientset csclientset.Interface,
+	nodeInformerFactory kubeinformers.SharedInformerFactory,
+	usernamesInformerFactory kubeinformers.SharedInformerFactory,
 	csInformerFactory csinformers.SharedInformerFactory) *UserController {
 
 	c := &UserController{
+		kubeclientset:  kubeclientset,
 		clientset:      clientset,
 		workqueue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Users"),
+		recorder:       tools.CreateAndStartRecorder(kubeclientset, userControllerName),
+		node:           nodeReference(),
 		requestWriteCh: make(chan bool),
 		fileWatchCmdCh: make(chan int),
 	}
@@ -79,8 +135,75 @@ func NewUserController(
 		DeleteFunc: c.enqueueUser,
 	})
 
+	// Changes to policies or to the labels of the node may change which users
+	// are allowed on the node. There's nothing to sync for them, so a write
+	// is requested using a key that is never a User key.
+	policyInformer := csInformerFactory.Containership().V3().SSHAccessPolicies()
+	policyInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueAccessChange,
+		UpdateFunc: func(old, new interface{}) {
+			if old.(*csv3.SSHAccessPolicy).ResourceVersion == new.(*csv3.SSHAccessPolicy).ResourceVersion {
+				return
+			}
+			c.enqueueAccessChange(new)
+		},
+		DeleteFunc: c.enqueueAccessChange,
+	})
+
+	nodeInformer := nodeInformerFactory.Core().V1().Nodes()
+	nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueAccessChange,
+		UpdateFunc: func(old, new interface{}) {
+			if labels.Equals(old.(*corev1.Node).Labels, new.(*corev1.Node).Labels) {
+				return
+			}
+			c.enqueueAccessChange(new)
+		},
+	})
+
+	// Users are written with the usernames the coordinator gave them
+	configMapInformer := usernamesInformerFactory.Core().V1().ConfigMaps()
+	configMapInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueAccessChange,
+		UpdateFunc: func(old, new interface{}) {
+			if old.(*corev1.ConfigMap).ResourceVersion == new.(*corev1.ConfigMap).ResourceVersion {
+				return
+			}
+			c.enqueueAccessChange(new)
+		},
+		DeleteFunc: c.enqueueAccessChange,
+	})
+
+	// Revoking a certificate changes which keys are allowed just like a
+	// policy change does
+	if env.IsSSHCAModeEnabled() {
+		certificateInformer := csInformerFactory.Containership().V3().SSHCertificates()
+		certificateInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: c.enqueueAccessChange,
+			UpdateFunc: func(old, new interface{}) {
+				oldCert := old.(*csv3.SSHCertificate)
+				newCert := new.(*csv3.SSHCertificate)
+				if oldCert.Spec.Revoked == newCert.Spec.Revoked &&
+					reflect.DeepEqual(oldCert.Status.RevokedSerials, newCert.Status.RevokedSerials) {
+					return
+				}
+				c.enqueueAccessChange(new)
+			},
+			DeleteFunc: c.enqueueAccessChange,
+		})
+
+		c.certificatesLister = certificateInformer.Lister()
+		c.certificatesSynced = certificateInformer.Informer().HasSynced
+	}
+
 	c.usersLister = userInformer.Lister()
 	c.usersSynced = userInformer.Informer().HasSynced
+	c.policiesLister = policyInformer.Lister()
+	c.policiesSynced = policyInformer.Informer().HasSynced
+	c.nodesLister = nodeInformer.Lister()
+	c.nodesSynced = nodeInformer.Informer().HasSynced
+	c.configMapsLister = configMapInformer.Lister()
+	c.configMapsSynced = configMapInformer.Informer().HasSynced
 
 	return c
 }
@@ -95,7 +218,12 @@ func (c *UserController) Run(numWorkers int, stopCh <-chan struct{}) error {
 	log.Info("Starting User controller")
 
 	log.Info("Waiting for informer caches to sync")
-	if ok := cache.WaitForCacheSync(stopCh, c.usersSynced); !ok {
+	synced := []cache.InformerSynced{c.usersSynced, c.policiesSynced, c.nodesSynced, c.configMapsSynced}
+	if c.certificatesSynced != nil {
+		synced = append(synced, c.certificatesSynced)
+	}
+
+	if ok := cache.WaitForCacheSync(stopCh, synced...); !ok {
 		return fmt.Errorf("Failed to wait for caches to sync")
 	}
 
@@ -196,6 +324,12 @@ func (c *UserController) enqueueUser(obj interface{}) {
 	c.workqueue.AddRateLimited(key)
 }
 
+// enqueueAccessChange enqueues a write for a change to an SSHAccessPolicy, an
+// SSHCertificate, the usernames ConfigMap or to the node
+func (c *UserController) enqueueAccessChange(obj interface{}) {
+	c.workqueue.AddRateLimited(sshAccessChangeKey)
+}
+
 // syncHandler looks at the current state of the system and decides how to act.
 // For the agent, this means just requesting a write since something
 // interesting must have happened for us to get to this point. Note that write
@@ -223,6 +357,13 @@ func (c *UserController) handleWriteRequests(stopCh <-chan struct{}) {
 	for {
 		select {
 		case <-ticker.C:
+			// Nothing else changes when sshd starts trusting the SSH CA
+			if c.sshCAUntrusted {
+				if trusted, _ := sysuser.SSHDTrustsCA(); trusted {
+					writeRequested = true
+				}
+			}
+
 			if writeRequested {
 				log.Debug("Writing resource to host...")
 				err := c.writeAuthorizedUsers()
@@ -239,40 +380,341 @@ func (c *UserController) handleWriteRequests(stopCh <-chan struct{}) {
 			log.Info("Write request handler stopping")
 			ticker.Stop()
 			// Everything else should be shut down by this point, so just
-			// call sysuser package directly to clear out authorized_keys
-			err := sysuser.WriteAuthorizedKeys(nil)
+			// call sysuser package directly to clear out authorized_keys.
+			// No usernames are needed since there are no users.
+			usernames, _ := sysuser.NewUsernameMapping(nil)
+			err := sysuser.WriteAuthorizedKeys(nil, usernames)
 			if err != nil {
 				log.Error("Error cleaning up authorized keys: ", err.Error())
 			}
+			err = sysuser.WritePrivileges(nil, usernames)
+			if err != nil {
+				log.Error("Error cleaning up user privileges: ", err.Error())
+			}
+			if env.IsSSHCAModeEnabled() {
+				err = sysuser.WriteSSHCAConfig(nil, usernames, "", nil)
+				if err != nil {
+					log.Error("Error cleaning up SSH CA configuration: ", err.Error())
+				}
+			}
 			return
 		}
 	}
 }
 
 func (c *UserController) writeAuthorizedUsers() error {
-	// TODO for users this must filter on `ssh_access=true` once
-	// RBAC is integrated on coordinator side (RBAC CRD Controller
-	// adds the label)
-	userPointers, err := c.usersLister.Users(constants.ContainershipNamespace).List(labels.NewSelector())
+	usernames, err := c.usernameMapping()
 	if err != nil {
 		return err
 	}
 
-	// Convert Users to UserSpecs
-	users := make([]csv3.UserSpec, 0)
-	for _, u := range userPointers {
-		users = append(users, u.Spec)
+	users, err := c.authorizedUsers()
+	if err != nil {
+		return err
 	}
 
 	log.Debugf("Users: %+v", users)
 
+	// In SSH CA mode users log in with certificates, so no keys are
+	// authorized directly. Keys stay authorized until sshd trusts the CA
+	// though, or nobody could log in.
+	keyUsers := users
+	if env.IsSSHCAModeEnabled() && c.sshTrustsCA() {
+		keyUsers = nil
+	}
+
+	// In AuthorizedKeysCommand mode keys are served to sshd by the agent
+	// instead of being kept in the shared file
+	fileUsers := keyUsers
+	if env.IsSSHAuthorizedKeysCommandEnabled() {
+		fileUsers = nil
+	}
+
 	// Stop file notifications while we write
 	c.sendCmdToFileWatcher(fileWatchStop)
 	log.Info("Writing authorized_keys")
-	err = sysuser.WriteAuthorizedKeys(users)
+	err = sysuser.WriteAuthorizedKeys(fileUsers, usernames)
 	c.sendCmdToFileWatcher(fileWatchStart)
+	if err != nil {
+		return err
+	}
 
-	return err
+	if env.IsSSHCAModeEnabled() {
+		log.Info("Writing SSH CA configuration")
+		if err := c.writeSSHCAConfig(users, usernames); err != nil {
+			return err
+		}
+	}
+
+	log.Info("Writing user privileges")
+	if err := sysuser.WritePrivileges(users, usernames); err != nil {
+		return err
+	}
+
+	c.writeHostSudoers(users, usernames)
+
+	c.setConfiguredUsers(users, keyUsers, usernames)
+
+	c.cleanupHostUsers(usernames)
+	return nil
+}
+
+// usernameMapping returns the usernames the coordinator gave users. Until
+// the coordinator has created the usernames ConfigMap, e.g. when agents are
+// upgraded before the coordinator, usernames are built from user IDs as they
+// were before usernames were mapped so that nobody is locked out.
+func (c *UserController) usernameMapping() (*sysuser.UsernameMapping, error) {
+	cm, err := c.configMapsLister.ConfigMaps(constants.ContainershipNamespace).Get(sysuser.UsernamesConfigMapName)
+	if errors.IsNotFound(err) {
+		if !c.usernamesMissing {
+			log.Infof("ConfigMap %s not found, building usernames from user IDs until the coordinator creates it",
+				sysuser.UsernamesConfigMapName)
+		}
+		c.usernamesMissing = true
+		return c.uidUsernameMapping()
+	} else if err != nil {
+		return nil, err
+	}
+
+	if c.usernamesMissing {
+		log.Infof("ConfigMap %s found, using the usernames it maps", sysuser.UsernamesConfigMapName)
+	}
+	c.usernamesMissing = false
+
+	return sysuser.NewUsernameMapping(cm.Data)
+}
+
+// uidUsernameMapping returns a mapping in which every user has the username
+// built from its ID
+func (c *UserController) uidUsernameMapping() (*sysuser.UsernameMapping, error) {
+	allUsers, err := c.usersLister.Users(constants.ContainershipNamespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]csv3.UserSpec, 0, len(allUsers))
+	for _, u := range allUsers {
+		users = append(users, u.Spec)
+	}
+
+	empty, err := sysuser.NewUsernameMapping(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	usernames, failed := empty.Assign(users, sysuser.UsernameStrategyUID)
+	for id, err := range failed {
+		log.Errorf("Could not build a username for user %s: %s", id, err)
+	}
+
+	return usernames, nil
+}
+
+// sshTrustsCA returns true if the host sshd is configured to trust the SSH
+// CA. A warning is emitted on the node whenever it stops being true, since
+// SSH CA mode requires the host sshd_config to include the SSH CA
+// configuration.
+func (c *UserController) sshTrustsCA() bool {
+	trusted, err := sysuser.SSHDTrustsCA()
+	if err != nil {
+		log.Error("Could not check whether sshd trusts the SSH CA: ", err)
+	}
+
+	if trusted {
+		if c.sshCAUntrusted {
+			log.Info("sshd trusts the SSH CA, no longer authorizing SSH keys directly")
+		}
+		c.sshCAUntrusted = false
+		return true
+	}
+
+	if !c.sshCAUntrusted {
+		log.Errorf("sshd does not trust the SSH CA, so SSH keys stay authorized directly. "+
+			"Include %s from the host sshd_config and reload sshd to use SSH CA mode.", sysuser.GetSSHCASSHDConfigFullPath())
+		c.recorder.Eventf(c.node, corev1.EventTypeWarning, "SSHCANotTrusted",
+			"SSH CA mode is enabled but sshd does not trust the SSH CA: include %s from the host sshd_config",
+			sysuser.GetSSHCASSHDConfigFullPath())
+	}
+	c.sshCAUntrusted = true
+	return false
+}
+
+// setConfiguredUsers records the users that were written to the host, the
+// users whose keys are authorized and the usernames they were written with
+func (c *UserController) setConfiguredUsers(users []csv3.UserSpec, keyUsers []csv3.UserSpec, usernames *sysuser.UsernameMapping) {
+	ids := make([]string, 0, len(users))
+	for _, u := range users {
+		ids = append(ids, u.ID)
+	}
+
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+
+	c.configuredUserIDs = ids
+	c.keyUsers = keyUsers
+	c.usernames = usernames
+	c.authorizedKeysWrittenAt = time.Now().UTC()
+}
+
+// AuthorizedKeys returns the keys sshd should accept for logging in as the
+// host account, or false if users weren't written to the host yet
+func (c *UserController) AuthorizedKeys(account string) (string, bool) {
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+
+	if c.authorizedKeysWrittenAt.IsZero() {
+		return "", false
+	}
+
+	return sysuser.AuthorizedKeysForAccount(c.keyUsers, c.usernames, env.SSHLoginAccount(), account), true
+}
+
+// Usernames returns the usernames users were last written to the host with,
+// or nil if users weren't written to the host yet
+func (c *UserController) Usernames() *sysuser.UsernameMapping {
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+
+	return c.usernames
+}
+
+// ConfiguredUsers returns the IDs of the users last written to the host and
+// when they were written
+func (c *UserController) ConfiguredUsers() ([]string, time.Time) {
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+
+	return append([]string(nil), c.configuredUserIDs...), c.authorizedKeysWrittenAt
+}
+
+// writeSSHCAConfig writes the principals of the users along with the CA
+// public key published by the coordinator and the public keys of revoked
+// certificates
+func (c *UserController) writeSSHCAConfig(users []csv3.UserSpec, usernames *sysuser.UsernameMapping) error {
+	cm, err := c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace).Get(sshca.ConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	certificates, err := c.certificatesLister.SSHCertificates(constants.ContainershipNamespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	// Certificates are revoked by serial so that new certificates for the
+	// same public keys aren't refused
+	revoked := make([]uint64, 0)
+	for _, cert := range certificates {
+		for _, s := range cert.Status.RevokedSerials {
+			revoked = append(revoked, s.Serial)
+		}
+
+		if !cert.Spec.Revoked {
+			continue
+		}
+
+		revoked = append(revoked, cert.Status.Serial)
+		for _, s := range cert.Status.Serials {
+			revoked = append(revoked, s.Serial)
+		}
+	}
+
+	return sysuser.WriteSSHCAConfig(users, usernames, cm.Data[sshca.PublicKeyKey], revoked)
+}
+
+// writeHostSudoers updates the sudoers drop-ins the login script installed
+// on the host. Failing to do so doesn't fail the write since the login script
+// installs them again on the next login.
+func (c *UserController) writeHostSudoers(users []csv3.UserSpec, usernames *sysuser.UsernameMapping) {
+	err := sysuser.WriteHostSudoers(users, usernames)
+	if err == sysuser.ErrHostEtcNotMounted {
+		log.Debug("Not updating host sudoers: ", err.Error())
+	} else if err != nil {
+		log.Error("Error updating host sudoers: ", err.Error())
+	}
+}
+
+// cleanupHostUsers locks or deletes the host users of users that no longer
+// exist, depending on the configured policy. Failing to do so doesn't fail
+// the write since users can't log in without their keys anyway.
+func (c *UserController) cleanupHostUsers(usernames *sysuser.UsernameMapping) {
+	allUsers, err := c.usersLister.Users(constants.ContainershipNamespace).List(labels.Everything())
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	users := make([]csv3.UserSpec, 0)
+	for _, u := range allUsers {
+		users = append(users, u.Spec)
+	}
+
+	policy := sysuser.HostUserCleanupPolicy(env.HostUserCleanup())
+	cleaned, err := sysuser.CleanupHostUsers(users, usernames, policy, env.HostUserCleanupGracePeriod())
+	if err == sysuser.ErrHostEtcNotMounted {
+		log.Debug("Not cleaning up host users: ", err.Error())
+		return
+	} else if err != nil {
+		log.Error("Error cleaning up host users: ", err.Error())
+	}
+
+	for _, name := range cleaned {
+		log.Infof("Host user %s was cleaned up (%s) since its User no longer exists", name, policy)
+	}
+}
+
+// authorizedUsers returns the users that are allowed on the node. Users are
+// allowed if the coordinator labeled them with a policy whose node selector
+// matches the node. If there are no policies at all, every user is allowed as
+// before policies existed.
+func (c *UserController) authorizedUsers() ([]csv3.UserSpec, error) {
+	allUsers, err := c.usersLister.Users(constants.ContainershipNamespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	policies, err := c.policiesLister.SSHAccessPolicies(constants.ContainershipNamespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]csv3.UserSpec, 0)
+	if len(policies) == 0 {
+		for _, u := range allUsers {
+			users = append(users, u.Spec)
+		}
+
+		return users, nil
+	}
+
+	node, err := c.nodesLister.Get(env.NodeName())
+	if err != nil {
+		return nil, err
+	}
+
+	allowedBy := make([]string, 0)
+	for _, policy := range policies {
+		selector, err := metav1.LabelSelectorAsSelector(&policy.Spec.NodeSelector)
+		if err != nil {
+			log.Errorf("Ignoring SSH access policy %s with invalid node selector: %s", policy.Name, err)
+			continue
+		}
+
+		if selector.Matches(labels.Set(node.Labels)) {
+			allowedBy = append(allowedBy, constants.SSHAccessPolicyLabelPrefix+policy.Name)
+		}
+	}
+
+	for _, u := range allUsers {
+		for _, key := range allowedBy {
+			if u.Labels[key] == "true" {
+				users = append(users, u.Spec)
+				break
+			}
+		}
+	}
+
+	return users, nil
 }
 
 // sendCmdToFileWatcher sends a command to the file watcher routine and
@@ -283,9 +725,11 @@ func (c *UserController) sendCmdToFileWatcher(cmd int) {
 }
 
 // authorizedKeysWatcher spins up an fsnotify watcher on the
-// authorized_keys file and waits for events. If any events occur,
-// we assume that there was an unauthorized change to the file and
-// we send a write request on the write request channel. Note that
+// authorized_keys file and waits for events. If an event occurs and
+// the file no longer matches what we last wrote, we assume that there
+// was an unauthorized change to the file, emit an event on the node
+// and send a write request on the write request channel. Events that
+// didn't change the file (e.g. a touch) are ignored. Note that
 // when we write to the file ourselves, we must disable the file
 // watcher by sending a Stop command and re-enable it with a Start
 // command after writing.
@@ -302,8 +746,18 @@ func (c *UserController) authorizedKeysWatcher() {
 	for {
 		select {
 		case event := <-fileWatcher.Events:
-			// We don't care what kind of event - always request a write
-			log.Info("Unexpected authorized_key file event detected: ", event)
+			tampered, err := sysuser.AuthorizedKeysTampered()
+			if err != nil {
+				// Rewrite the file to be safe
+				log.Error("Could not check authorized_keys: ", err)
+			} else if !tampered {
+				log.Debug("Ignoring benign authorized_keys file event: ", event)
+				continue
+			}
+
+			log.Info("Unexpected authorized_keys file change detected: ", event)
+			c.recorder.Event(c.node, corev1.EventTypeWarning, "AuthorizedKeysTampered",
+				"authorized_keys was changed outside of the agent and will be restored")
 			c.requestWriteCh <- true
 
 		case err := <-fileWatcher.Errors:
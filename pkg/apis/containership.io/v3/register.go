@@ -38,6 +38,10 @@ func addKnownTypes(scheme *runtime.Scheme) error {
 		&PluginList{},
 		&Registry{},
 		&RegistryList{},
+		&SSHAccessPolicy{},
+		&SSHAccessPolicyList{},
+		&SSHCertificate{},
+		&SSHCertificateList{},
 		&User{},
 		&UserList{},
 	)
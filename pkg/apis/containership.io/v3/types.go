@@ -1,6 +1,7 @@
 package v3
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -23,8 +24,34 @@ type UserSpec struct {
 	AvatarURL string       `json:"avatar_url"`
 	AddedAt   string       `json:"added_at"`
 	SSHKeys   []SSHKeySpec `json:"ssh_keys"`
+	// Teams are the IDs of the teams the user is a member of
+	Teams []string `json:"teams,omitempty"`
+	// Sudo is the sudo access the user has on nodes. It defaults to full
+	// access.
+	Sudo SudoLevel `json:"sudo,omitempty"`
+	// SudoCommands are the only commands the user may run with sudo if Sudo
+	// is restricted. They must be absolute paths, optionally followed by
+	// arguments.
+	SudoCommands []string `json:"sudo_commands,omitempty"`
+	// Groups are the supplementary groups of the user on nodes, e.g. docker.
+	// Groups that don't exist on a node are ignored. Groups that give root
+	// or near-root access, like sudo, wheel, disk or docker, are only
+	// allowed if Sudo is full.
+	Groups []string `json:"groups,omitempty"`
 }
 
+// SudoLevel is the sudo access of a user
+type SudoLevel string
+
+const (
+	// SudoFull lets the user run any command as any user without a password
+	SudoFull SudoLevel = "full"
+	// SudoRestricted lets the user run only the sudo commands of the user
+	SudoRestricted SudoLevel = "restricted"
+	// SudoNone doesn't let the user run sudo
+	SudoNone SudoLevel = "none"
+)
+
 // SSHKeySpec is the spec for an SSH Key.
 type SSHKeySpec struct {
 	ID          string `json:"id"`
@@ -47,12 +74,117 @@ type UserList struct {
 // +genclient:noStatus
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
+// SSHAccessPolicy grants Containership Cloud users SSH access to the nodes
+// matching its node selector. Unlike the other types it is created in the
+// cluster rather than synced from Containership Cloud.
+type SSHAccessPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec SSHAccessPolicySpec `json:"spec"`
+}
+
+// SSHAccessPolicySpec is the spec for an SSHAccessPolicy.
+type SSHAccessPolicySpec struct {
+	// Users are the IDs of the users that are granted access
+	Users []string `json:"users,omitempty"`
+	// Teams are the IDs of the teams whose members are granted access
+	Teams []string `json:"teams,omitempty"`
+	// NodeSelector selects the nodes access is granted to. An empty selector
+	// selects every node.
+	NodeSelector metav1.LabelSelector `json:"nodeSelector"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// SSHAccessPolicyList is a list of SSHAccessPolicies.
+type SSHAccessPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []SSHAccessPolicy `json:"items"`
+}
+
+// +genclient
+// +genclient:noStatus
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// SSHCertificate is a short-lived certificate signed by the cluster SSH CA for
+// a single SSH key of a user. When SSH CA mode is enabled, the coordinator
+// creates one for each SSH key and re-signs it before it expires until it's
+// revoked. Like SSHAccessPolicy it is created in the cluster rather than
+// synced from Containership Cloud. The CRD has no status subresource, so
+// Status is written along with the rest of the object.
+type SSHCertificate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SSHCertificateSpec   `json:"spec"`
+	Status SSHCertificateStatus `json:"status,omitempty"`
+}
+
+// SSHCertificateSpec is the spec for an SSHCertificate.
+type SSHCertificateSpec struct {
+	// UserID is the ID of the user the key belongs to
+	UserID string `json:"userID"`
+	// KeyID is the ID of the SSH key of the user
+	KeyID string `json:"keyID"`
+	// PublicKey is the certified public key in authorized_keys format
+	PublicKey string `json:"publicKey"`
+	// TTL is how long each certificate is valid for. The default TTL is used
+	// if it's not set.
+	TTL metav1.Duration `json:"ttl,omitempty"`
+	// Revoked certificates are no longer signed and every certificate
+	// signed for them is refused by every node until it expires
+	Revoked bool `json:"revoked,omitempty"`
+}
+
+// SSHCertificateStatus is the last certificate the coordinator signed.
+type SSHCertificateStatus struct {
+	// Certificate is the certificate in authorized_keys format
+	Certificate string      `json:"certificate,omitempty"`
+	Serial      uint64      `json:"serial,omitempty"`
+	ValidAfter  metav1.Time `json:"validAfter,omitempty"`
+	ValidBefore metav1.Time `json:"validBefore,omitempty"`
+	// Serials are the certificates signed for the public key that haven't
+	// expired yet, including the last one. They're all refused once the
+	// SSHCertificate is revoked.
+	Serials []SSHCertificateSerial `json:"serials,omitempty"`
+	// RevokedSerials are the certificates signed for previous public keys
+	// of the key that haven't expired yet. They're always refused.
+	RevokedSerials []SSHCertificateSerial `json:"revokedSerials,omitempty"`
+}
+
+// SSHCertificateSerial is the serial of a signed certificate along with when
+// it expires
+type SSHCertificateSerial struct {
+	Serial      uint64      `json:"serial"`
+	ValidBefore metav1.Time `json:"validBefore"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// SSHCertificateList is a list of SSHCertificates.
+type SSHCertificateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []SSHCertificate `json:"items"`
+}
+
+// +genclient
+// +genclient:noStatus
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
 // Registry describes a registry attached to Containership Cloud.
+// The CRD has no status subresource, so Status is written along with the
+// rest of the object.
 type Registry struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Spec RegistrySpec `json:"spec"`
+	Spec   RegistrySpec   `json:"spec"`
+	Status RegistryStatus `json:"status,omitempty"`
 }
 
 // RegistrySpec is the spec for a Containership Cloud Registry.
@@ -66,9 +198,27 @@ type RegistrySpec struct {
 	Provider      string            `json:"provider"`
 	Credentials   map[string]string `json:"credentials"`
 	Owner         string            `json:"owner"`
+	Role          RegistryRole      `json:"role,omitempty"`
+	MirrorOf      string            `json:"mirror_of,omitempty"`
 	AuthToken     AuthTokenDef      `json:"authToken,omitempty"`
+	// CredentialsSecret is the name of the Secret in the Registry namespace
+	// holding Credentials and AuthToken.Token. If it is set, neither is
+	// stored in the Registry itself.
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
 }
 
+// RegistryRole determines how a registry is used in the cluster
+type RegistryRole string
+
+const (
+	// RegistryRolePullSecret registries are only used for image pull secrets.
+	// This is the default if no role is set.
+	RegistryRolePullSecret RegistryRole = "pull_secret"
+	// RegistryRoleMirror registries are configured on every node as a
+	// pull-through mirror of the registry named by MirrorOf
+	RegistryRoleMirror RegistryRole = "mirror"
+)
+
 // AuthTokenDef is the def for an auth token
 type AuthTokenDef struct {
 	Token    string `json:"token"`
@@ -77,6 +227,30 @@ type AuthTokenDef struct {
 	Expires  string `json:"expires"`
 }
 
+// RegistryStatus is the status of a Registry as observed by the coordinator.
+// It is never modified by Cloud.
+type RegistryStatus struct {
+	Conditions []RegistryCondition `json:"conditions,omitempty"`
+}
+
+// RegistryConditionType is the type of a Registry condition
+type RegistryConditionType string
+
+const (
+	// RegistryCredentialsValid is true if the registry accepted the auth token
+	// generated from the Registry credentials
+	RegistryCredentialsValid RegistryConditionType = "CredentialsValid"
+)
+
+// RegistryCondition describes the state of a Registry at a certain point
+type RegistryCondition struct {
+	Type               RegistryConditionType  `json:"type"`
+	Status             corev1.ConditionStatus `json:"status"`
+	LastTransitionTime string                 `json:"lastTransitionTime"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+}
+
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
 // RegistryList is a list of Registries.
@@ -88,7 +262,6 @@ type RegistryList struct {
 }
 
 // +genclient
-// +genclient:noStatus
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
 // Plugin describes a plugin added by Containership Cloud.
@@ -96,7 +269,8 @@ type Plugin struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Spec PluginSpec `json:"spec"`
+	Spec   PluginSpec   `json:"spec"`
+	Status PluginStatus `json:"status,omitempty"`
 }
 
 // PluginSpec is the spec for a Containership Cloud Plugin.
@@ -107,6 +281,9 @@ type PluginSpec struct {
 	Type           PluginType `json:"type"`
 	Version        string     `json:"version"`
 	Implementation string     `json:"implementation"`
+	// DependsOn lists the types or IDs of plugins that must be ready before
+	// this plugin is applied
+	DependsOn []string `json:"depends_on,omitempty"`
 }
 
 // PluginType lets us group together plugins of different implentations
@@ -127,6 +304,64 @@ const (
 	Events PluginType = "events"
 )
 
+// PluginStatus is the status of a Plugin as observed by the coordinator. It
+// is never modified by Cloud.
+type PluginStatus struct {
+	Phase PluginPhase `json:"phase,omitempty"`
+	// Version is the version of the plugin that is currently applied. It
+	// differs from the spec version if the plugin was rolled back.
+	Version string `json:"version,omitempty"`
+	// RolledBackFrom is the version that was rolled back from if the plugin
+	// was rolled back
+	RolledBackFrom string `json:"rolledBackFrom,omitempty"`
+	Message        string `json:"message,omitempty"`
+	// LastApplyTime is when the plugin manifests were last applied
+	LastApplyTime string `json:"lastApplyTime,omitempty"`
+	// Objects are the results of the last apply for each object
+	Objects []PluginObjectStatus `json:"objects,omitempty"`
+	// Workloads is the readiness of the workloads the plugin applied
+	Workloads PluginWorkloadStatus `json:"workloads"`
+	// Drift lists the objects that no longer match what was applied and
+	// weren't re-applied, either because the plugin is observe only or
+	// because re-applying them failed
+	Drift []PluginObjectStatus `json:"drift,omitempty"`
+}
+
+// PluginObjectStatus is the result of applying a single plugin object
+type PluginObjectStatus struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	// Action is what applying did to the object, e.g. created or failed
+	Action  string `json:"action"`
+	Message string `json:"message,omitempty"`
+}
+
+// PluginWorkloadStatus is the aggregated readiness of the Deployments,
+// DaemonSets and StatefulSets of a plugin
+type PluginWorkloadStatus struct {
+	Total int `json:"total"`
+	Ready int `json:"ready"`
+	// NotReady lists the workloads that aren't ready as "Kind namespace/name"
+	NotReady []string `json:"notReady,omitempty"`
+}
+
+// PluginPhase is the state a Plugin is in after the coordinator last acted on
+// it
+type PluginPhase string
+
+const (
+	// PluginPhaseApplied means the spec version of the plugin was applied
+	PluginPhaseApplied PluginPhase = "Applied"
+	// PluginPhaseFailed means the plugin failed to apply and could not be
+	// rolled back
+	PluginPhaseFailed PluginPhase = "Failed"
+	// PluginPhaseRolledBack means a previous version of the plugin was
+	// applied instead of the spec version, either because the spec version
+	// failed to apply or because a rollback was requested
+	PluginPhaseRolledBack PluginPhase = "RolledBack"
+)
+
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
 // PluginList is a list of Plugins.
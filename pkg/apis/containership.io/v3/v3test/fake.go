@@ -11,9 +11,9 @@ var keyCounter int
 
 const (
 	// KeyString is the fake key string for all keys
-	KeyString = "ssh-rsa ABCDEF"
+	KeyString = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMcHJZYtwl35ECewWUX5JChxpUxfvRr6ic+dML+iGuW"
 	// FingerprintString is the fake fingerprint string for all keys
-	FingerprintString = "00:11:22"
+	FingerprintString = "9f:38:c4:ba:d2:e6:c6:5f:32:0f:aa:17:c7:c1:de:89"
 )
 
 // uuidFromCounter generates a UUID from a counter
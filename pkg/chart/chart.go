@@ -0,0 +1,316 @@
+package chart
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/hooks"
+	hapichart "k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/releaseutil"
+	"k8s.io/helm/pkg/renderutil"
+
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// installOrder is the order kinds are applied in, the same as Tiller uses.
+// Kinds not listed are applied after all of these.
+var installOrder = []string{
+	"Namespace",
+	"ResourceQuota",
+	"LimitRange",
+	"PodSecurityPolicy",
+	"Secret",
+	"ConfigMap",
+	"StorageClass",
+	"PersistentVolume",
+	"PersistentVolumeClaim",
+	"ServiceAccount",
+	"CustomResourceDefinition",
+	"ClusterRole",
+	"ClusterRoleBinding",
+	"Role",
+	"RoleBinding",
+	"Service",
+	"DaemonSet",
+	"Pod",
+	"ReplicationController",
+	"ReplicaSet",
+	"Deployment",
+	"StatefulSet",
+	"Job",
+	"CronJob",
+	"Ingress",
+	"APIService",
+}
+
+// Release describes the release of a chart being rendered
+type Release struct {
+	Name      string
+	Namespace string
+	// Revision starts at 1 for the first install and increases with every
+	// upgrade
+	Revision int
+	// IsUpgrade is true if a previous revision has been installed
+	IsUpgrade bool
+}
+
+// Rendered is a chart rendered for a release
+type Rendered struct {
+	// Manifests are the objects to apply, grouped the same way plugin
+	// manifests are. Namespaces and CRDs are in the first group so that
+	// everything else can be applied once they exist.
+	Manifests [][]interface{}
+	// PreApply are the Job hooks to run before applying for the release,
+	// i.e. the pre-install or pre-upgrade hooks
+	PreApply []*batchv1.Job
+	// PostApply are the Job hooks to run after applying for the release
+	PostApply []*batchv1.Job
+}
+
+// manifest is a single rendered object
+type manifest struct {
+	kind   string
+	object map[string]interface{}
+}
+
+// Render renders the gzipped chart archive with the values document for the
+// release. Rendering happens entirely locally, without Tiller.
+func Render(archive []byte, values string, release Release) (*Rendered, error) {
+	c, err := chartutil.LoadArchive(bytes.NewReader(archive))
+	if err != nil {
+		return nil, errors.Wrap(err, "loading chart archive failed")
+	}
+
+	return render(c, values, release)
+}
+
+func render(c *hapichart.Chart, values string, release Release) (*Rendered, error) {
+	// An empty config would ignore the chart's default values entirely
+	if strings.TrimSpace(values) == "" {
+		values = "{}"
+	}
+
+	files, err := renderutil.Render(c, &hapichart.Config{Raw: values}, renderutil.Options{
+		ReleaseOptions: chartutil.ReleaseOptions{
+			Name:      release.Name,
+			Namespace: release.Namespace,
+			Revision:  release.Revision,
+			IsInstall: !release.IsUpgrade,
+			IsUpgrade: release.IsUpgrade,
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "rendering chart failed")
+	}
+
+	preEvent, postEvent := hooks.PreInstall, hooks.PostInstall
+	if release.IsUpgrade {
+		preEvent, postEvent = hooks.PreUpgrade, hooks.PostUpgrade
+	}
+
+	rendered := &Rendered{
+		PreApply:  make([]*batchv1.Job, 0),
+		PostApply: make([]*batchv1.Job, 0),
+	}
+	first := make([]manifest, 0)
+	rest := make([]manifest, 0)
+
+	// Sort the files so the result doesn't depend on map ordering
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if path.Base(name) == "NOTES.txt" {
+			continue
+		}
+
+		manifests, err := parseManifests(files[name], release.Namespace)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing %s failed", name)
+		}
+
+		for _, m := range manifests {
+			events := hookEvents(m)
+			switch {
+			case len(events) == 0:
+				if m.kind == "Namespace" || m.kind == "CustomResourceDefinition" {
+					first = append(first, m)
+				} else {
+					rest = append(rest, m)
+				}
+			case events[hooks.CRDInstall]:
+				first = append(first, m)
+			case events[preEvent]:
+				job, err := hookJob(m)
+				if err != nil {
+					return nil, errors.Wrapf(err, "%s hook in %s is invalid", preEvent, name)
+				}
+				rendered.PreApply = append(rendered.PreApply, job)
+			case events[postEvent]:
+				job, err := hookJob(m)
+				if err != nil {
+					return nil, errors.Wrapf(err, "%s hook in %s is invalid", postEvent, name)
+				}
+				rendered.PostApply = append(rendered.PostApply, job)
+			default:
+				// Hooks for other events, e.g. tests or deletion, are
+				// never run
+			}
+		}
+	}
+
+	rendered.Manifests = make([][]interface{}, 0, 2)
+	for _, group := range [][]manifest{first, rest} {
+		if len(group) == 0 {
+			continue
+		}
+
+		sortByInstallOrder(group)
+
+		objects := make([]interface{}, 0, len(group))
+		for _, m := range group {
+			objects = append(objects, m.object)
+		}
+
+		rendered.Manifests = append(rendered.Manifests, objects)
+	}
+
+	return rendered, nil
+}
+
+// parseManifests splits a rendered file into its objects. Objects without a
+// namespace are put in the release namespace like Tiller does; the namespace
+// is ignored for cluster scoped objects when they're applied.
+func parseManifests(file, namespace string) ([]manifest, error) {
+	manifests := make([]manifest, 0)
+
+	// Split on document separators in a predictable order
+	docs := releaseutil.SplitManifests(file)
+	keys := make([]string, 0, len(docs))
+	for key := range docs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return manifestIndex(keys[i]) < manifestIndex(keys[j])
+	})
+
+	for _, key := range keys {
+		data, err := yaml.YAMLToJSON([]byte(docs[key]))
+		if err != nil {
+			return nil, err
+		}
+
+		var object map[string]interface{}
+		if err := json.Unmarshal(data, &object); err != nil {
+			return nil, err
+		}
+
+		// Templates commonly render to nothing when disabled
+		if len(object) == 0 {
+			continue
+		}
+
+		kind, _ := object["kind"].(string)
+		if kind == "" {
+			return nil, fmt.Errorf("object has no kind")
+		}
+
+		metadata, ok := object["metadata"].(map[string]interface{})
+		if !ok {
+			metadata = make(map[string]interface{})
+			object["metadata"] = metadata
+		}
+
+		if ns, _ := metadata["namespace"].(string); ns == "" && namespace != "" {
+			metadata["namespace"] = namespace
+		}
+
+		manifests = append(manifests, manifest{kind: kind, object: object})
+	}
+
+	return manifests, nil
+}
+
+// manifestIndex returns the index of a key returned by SplitManifests, which
+// are of the form "manifest-<index>"
+func manifestIndex(key string) int {
+	var index int
+	fmt.Sscanf(key, "manifest-%d", &index)
+	return index
+}
+
+// hookEvents returns the hook events the manifest is annotated with
+func hookEvents(m manifest) map[string]bool {
+	events := make(map[string]bool)
+
+	metadata, _ := m.object["metadata"].(map[string]interface{})
+	annotations, _ := metadata["annotations"].(map[string]interface{})
+	value, _ := annotations[hooks.HookAnno].(string)
+	for _, event := range strings.Split(value, ",") {
+		event = strings.TrimSpace(event)
+		if event != "" {
+			events[event] = true
+		}
+	}
+
+	return events
+}
+
+// hookJob converts a hook manifest to a Job. Only Jobs are supported as
+// hooks since the hooks are run as plugin jobs.
+func hookJob(m manifest) (*batchv1.Job, error) {
+	if m.kind != "Job" {
+		return nil, fmt.Errorf("hooks of kind %s are not supported, only Jobs are", m.kind)
+	}
+
+	data, err := json.Marshal(m.object)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &batchv1.Job{}
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, err
+	}
+
+	// Plugin jobs always run in the same namespace
+	job.ObjectMeta = metav1.ObjectMeta{
+		Name:        job.Name,
+		Labels:      job.Labels,
+		Annotations: job.Annotations,
+	}
+
+	return job, nil
+}
+
+// sortByInstallOrder stably sorts manifests by their kind in install order
+func sortByInstallOrder(manifests []manifest) {
+	rank := make(map[string]int, len(installOrder))
+	for i, kind := range installOrder {
+		rank[kind] = i
+	}
+
+	rankOf := func(kind string) int {
+		if r, ok := rank[kind]; ok {
+			return r
+		}
+
+		return len(installOrder)
+	}
+
+	sort.SliceStable(manifests, func(i, j int) bool {
+		return rankOf(manifests[i].kind) < rankOf(manifests[j].kind)
+	})
+}
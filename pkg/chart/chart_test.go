@@ -0,0 +1,115 @@
+package chart
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/helm/pkg/chartutil"
+)
+
+// loadArchive packages the chart fixture the same way it's sent by Cloud
+func loadArchive(t *testing.T, name string) []byte {
+	c, err := chartutil.LoadDir("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "chart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename, err := chartutil.Save(c, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return archive
+}
+
+func kinds(objects []interface{}) []string {
+	result := make([]string, 0, len(objects))
+	for _, o := range objects {
+		result = append(result, o.(map[string]interface{})["kind"].(string))
+	}
+
+	return result
+}
+
+func metadata(object interface{}) map[string]interface{} {
+	return object.(map[string]interface{})["metadata"].(map[string]interface{})
+}
+
+func TestRenderInstall(t *testing.T) {
+	rendered, err := Render(loadArchive(t, "testchart"), "", Release{
+		Name:      "test",
+		Namespace: "containership-core",
+		Revision:  1,
+	})
+	assert.Nil(t, err)
+
+	assert.Len(t, rendered.Manifests, 2)
+	assert.Equal(t, []string{"CustomResourceDefinition"}, kinds(rendered.Manifests[0]))
+	// Sorted in install order
+	assert.Equal(t, []string{"ConfigMap", "Deployment"}, kinds(rendered.Manifests[1]))
+
+	configMap := rendered.Manifests[1][0].(map[string]interface{})
+	assert.Equal(t, "test-testchart", metadata(configMap)["name"])
+	// Explicit namespaces are kept
+	assert.Equal(t, "kube-system", metadata(configMap)["namespace"])
+	assert.Equal(t, "false", configMap["data"].(map[string]interface{})["upgrade"])
+
+	deployment := rendered.Manifests[1][1]
+	assert.Equal(t, "containership-core", metadata(deployment)["namespace"])
+	assert.Equal(t, "1", metadata(deployment)["labels"].(map[string]interface{})["revision"])
+
+	// Only install hooks are run, and test hooks never are
+	assert.Len(t, rendered.PreApply, 0)
+	assert.Len(t, rendered.PostApply, 1)
+	assert.Equal(t, "test-testchart-setup", rendered.PostApply[0].Name)
+	assert.Equal(t, int64(60), *rendered.PostApply[0].Spec.ActiveDeadlineSeconds)
+}
+
+func TestRenderUpgrade(t *testing.T) {
+	rendered, err := Render(loadArchive(t, "testchart"), "config:\n  enabled: false\n", Release{
+		Name:      "test",
+		Namespace: "containership-core",
+		Revision:  2,
+		IsUpgrade: true,
+	})
+	assert.Nil(t, err)
+
+	// The values disable the config map
+	assert.Equal(t, []string{"Deployment"}, kinds(rendered.Manifests[1]))
+	assert.Equal(t, "2", metadata(rendered.Manifests[1][0])["labels"].(map[string]interface{})["revision"])
+
+	assert.Len(t, rendered.PreApply, 1)
+	assert.Equal(t, "test-testchart-migrate", rendered.PreApply[0].Name)
+	// Plugin jobs always run in the same namespace
+	assert.Equal(t, "", rendered.PreApply[0].Namespace)
+	assert.Len(t, rendered.PostApply, 1)
+}
+
+func TestRenderUnsupportedHook(t *testing.T) {
+	_, err := Render(loadArchive(t, "badhook"), "", Release{Name: "test", Revision: 1})
+	assert.NotNil(t, err)
+}
+
+func TestRenderInvalidArchive(t *testing.T) {
+	_, err := Render([]byte("not a chart"), "", Release{Name: "test", Revision: 1})
+	assert.NotNil(t, err)
+}
+
+func TestRenderInvalidValues(t *testing.T) {
+	_, err := Render(loadArchive(t, "testchart"), "replicas: [", Release{Name: "test", Revision: 1})
+	assert.NotNil(t, err)
+}
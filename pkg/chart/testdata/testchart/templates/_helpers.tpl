@@ -0,0 +1,3 @@
+{{- define "testchart.fullname" -}}
+{{ .Release.Name }}-{{ .Chart.Name }}
+{{- end -}}
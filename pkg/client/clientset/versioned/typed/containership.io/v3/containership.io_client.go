@@ -29,6 +29,8 @@ type ContainershipV3Interface interface {
 	RESTClient() rest.Interface
 	PluginsGetter
 	RegistriesGetter
+	SSHAccessPoliciesGetter
+	SSHCertificatesGetter
 	UsersGetter
 }
 
@@ -45,6 +47,14 @@ func (c *ContainershipV3Client) Registries(namespace string) RegistryInterface {
 	return newRegistries(c, namespace)
 }
 
+func (c *ContainershipV3Client) SSHAccessPolicies(namespace string) SSHAccessPolicyInterface {
+	return newSSHAccessPolicies(c, namespace)
+}
+
+func (c *ContainershipV3Client) SSHCertificates(namespace string) SSHCertificateInterface {
+	return newSSHCertificates(c, namespace)
+}
+
 func (c *ContainershipV3Client) Users(namespace string) UserInterface {
 	return newUsers(c, namespace)
 }
@@ -36,6 +36,14 @@ func (c *FakeContainershipV3) Registries(namespace string) v3.RegistryInterface
 	return &FakeRegistries{c, namespace}
 }
 
+func (c *FakeContainershipV3) SSHAccessPolicies(namespace string) v3.SSHAccessPolicyInterface {
+	return &FakeSSHAccessPolicies{c, namespace}
+}
+
+func (c *FakeContainershipV3) SSHCertificates(namespace string) v3.SSHCertificateInterface {
+	return &FakeSSHCertificates{c, namespace}
+}
+
 func (c *FakeContainershipV3) Users(namespace string) v3.UserInterface {
 	return &FakeUsers{c, namespace}
 }
@@ -100,6 +100,18 @@ func (c *FakePlugins) Update(plugin *v3.Plugin) (result *v3.Plugin, err error) {
 	return obj.(*v3.Plugin), err
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+func (c *FakePlugins) UpdateStatus(plugin *v3.Plugin) (*v3.Plugin, error) {
+	obj, err := c.Fake.
+		Invokes(testing.NewUpdateSubresourceAction(pluginsResource, "status", c.ns, plugin), &v3.Plugin{})
+
+	if obj == nil {
+		return nil, err
+	}
+	return obj.(*v3.Plugin), err
+}
+
 // Delete takes name of the plugin and deletes it. Returns an error if one occurs.
 func (c *FakePlugins) Delete(name string, options *v1.DeleteOptions) error {
 	_, err := c.Fake.
@@ -22,4 +22,8 @@ type PluginExpansion interface{}
 
 type RegistryExpansion interface{}
 
+type SSHAccessPolicyExpansion interface{}
+
+type SSHCertificateExpansion interface{}
+
 type UserExpansion interface{}
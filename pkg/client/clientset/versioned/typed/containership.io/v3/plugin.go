@@ -37,6 +37,7 @@ type PluginsGetter interface {
 type PluginInterface interface {
 	Create(*v3.Plugin) (*v3.Plugin, error)
 	Update(*v3.Plugin) (*v3.Plugin, error)
+	UpdateStatus(*v3.Plugin) (*v3.Plugin, error)
 	Delete(name string, options *v1.DeleteOptions) error
 	DeleteCollection(options *v1.DeleteOptions, listOptions v1.ListOptions) error
 	Get(name string, options v1.GetOptions) (*v3.Plugin, error)
@@ -120,6 +121,22 @@ func (c *plugins) Update(plugin *v3.Plugin) (result *v3.Plugin, err error) {
 	return
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+
+func (c *plugins) UpdateStatus(plugin *v3.Plugin) (result *v3.Plugin, err error) {
+	result = &v3.Plugin{}
+	err = c.client.Put().
+		Namespace(c.ns).
+		Resource("plugins").
+		Name(plugin.Name).
+		SubResource("status").
+		Body(plugin).
+		Do().
+		Into(result)
+	return
+}
+
 // Delete takes name of the plugin and deletes it. Returns an error if one occurs.
 func (c *plugins) Delete(name string, options *v1.DeleteOptions) error {
 	return c.client.Delete().
@@ -28,6 +28,10 @@ type Interface interface {
 	Plugins() PluginInformer
 	// Registries returns a RegistryInformer.
 	Registries() RegistryInformer
+	// SSHAccessPolicies returns a SSHAccessPolicyInformer.
+	SSHAccessPolicies() SSHAccessPolicyInformer
+	// SSHCertificates returns a SSHCertificateInformer.
+	SSHCertificates() SSHCertificateInformer
 	// Users returns a UserInformer.
 	Users() UserInformer
 }
@@ -53,6 +57,16 @@ func (v *version) Registries() RegistryInformer {
 	return &registryInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
 }
 
+// SSHAccessPolicies returns a SSHAccessPolicyInformer.
+func (v *version) SSHAccessPolicies() SSHAccessPolicyInformer {
+	return &sSHAccessPolicyInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
+
+// SSHCertificates returns a SSHCertificateInformer.
+func (v *version) SSHCertificates() SSHCertificateInformer {
+	return &sSHCertificateInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
+
 // Users returns a UserInformer.
 func (v *version) Users() UserInformer {
 	return &userInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
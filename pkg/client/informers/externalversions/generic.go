@@ -58,6 +58,10 @@ func (f *sharedInformerFactory) ForResource(resource schema.GroupVersionResource
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Containership().V3().Plugins().Informer()}, nil
 	case v3.SchemeGroupVersion.WithResource("registries"):
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Containership().V3().Registries().Informer()}, nil
+	case v3.SchemeGroupVersion.WithResource("sshaccesspolicies"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Containership().V3().SSHAccessPolicies().Informer()}, nil
+	case v3.SchemeGroupVersion.WithResource("sshcertificates"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Containership().V3().SSHCertificates().Informer()}, nil
 	case v3.SchemeGroupVersion.WithResource("users"):
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Containership().V3().Users().Informer()}, nil
 
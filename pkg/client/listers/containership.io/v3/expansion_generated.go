@@ -34,6 +34,22 @@ type RegistryListerExpansion interface{}
 // RegistryNamespaceLister.
 type RegistryNamespaceListerExpansion interface{}
 
+// SSHAccessPolicyListerExpansion allows custom methods to be added to
+// SSHAccessPolicyLister.
+type SSHAccessPolicyListerExpansion interface{}
+
+// SSHAccessPolicyNamespaceListerExpansion allows custom methods to be added to
+// SSHAccessPolicyNamespaceLister.
+type SSHAccessPolicyNamespaceListerExpansion interface{}
+
+// SSHCertificateListerExpansion allows custom methods to be added to
+// SSHCertificateLister.
+type SSHCertificateListerExpansion interface{}
+
+// SSHCertificateNamespaceListerExpansion allows custom methods to be added to
+// SSHCertificateNamespaceLister.
+type SSHCertificateNamespaceListerExpansion interface{}
+
 // UserListerExpansion allows custom methods to be added to
 // UserLister.
 type UserListerExpansion interface{}
@@ -27,6 +27,13 @@ const (
 	ContainershipNodeIDLabelKey = "containership.io/node-id"
 )
 
+const (
+	// SSHAccessPolicyLabelPrefix prefixes the label the coordinator sets on a
+	// User for each SSHAccessPolicy that grants the user access. The rest of
+	// the key is the name of the policy.
+	SSHAccessPolicyLabelPrefix = "sshaccess.containership.io/"
+)
+
 const (
 	// ClusterManagementPluginType is the name of the cluster management plugin type
 	ClusterManagementPluginType = "cluster_management"
@@ -64,6 +71,30 @@ const (
 const (
 	// PluginHistoryAnnotation is used to keep track of previous versions of a plugin
 	PluginHistoryAnnotation = "containership.io/plugin-history"
+	// PluginRollbackAnnotation requests a rollback of a plugin to the version
+	// in its value, or to the previous version if the value is empty. It is
+	// removed once the rollback is handled.
+	PluginRollbackAnnotation = "containership.io/plugin-rollback"
+	// PluginObserveOnlyAnnotation marks a plugin whose objects are only
+	// checked for drift from what was applied, without re-applying them,
+	// when its value is "true"
+	PluginObserveOnlyAnnotation = "containership.io/plugin-observe-only"
+	// PluginJobIndependentAnnotation marks a plugin job that doesn't depend
+	// on the jobs around it when its value is "true", so that it may run at
+	// the same time as neighbouring independent jobs
+	PluginJobIndependentAnnotation = "containership.io/plugin-job-independent"
+	// PluginBundleAnnotation marks a plugin that was imported from a local
+	// plugin bundle instead of being synced from Cloud. Its value is where
+	// the bundle was read from.
+	PluginBundleAnnotation = "containership.io/plugin-bundle"
+	// SSHCertificateKeyRemovedAnnotation marks an SSHCertificate that was
+	// revoked because its key was removed, as opposed to being revoked
+	// explicitly. It's signed again if the key is added back.
+	SSHCertificateKeyRemovedAnnotation = "containership.io/ssh-key-removed"
+	// SSHStatusAnnotation is set on each node by its agent. Its value is the
+	// JSON SSH status of the node: the users configured on it, when
+	// authorized_keys was last written and the active SSH sessions.
+	SSHStatusAnnotation = "containership.io/ssh-status"
 )
 
 // BaseContainershipManagedLabelString is the containership
@@ -3,6 +3,8 @@ package coordinator
 import (
 	"time"
 
+	kubeinformers "k8s.io/client-go/informers"
+
 	csinformers "github.com/containership/cluster-manager/pkg/client/informers/externalversions"
 	"github.com/containership/cluster-manager/pkg/k8sutil"
 	"github.com/containership/cluster-manager/pkg/log"
@@ -20,7 +22,7 @@ type CloudSynchronizer struct {
 }
 
 // NewCloudSynchronizer constructs a new CloudSynchronizer.
-func NewCloudSynchronizer(csInformerFactory csinformers.SharedInformerFactory) *CloudSynchronizer {
+func NewCloudSynchronizer(kubeInformerFactory kubeinformers.SharedInformerFactory, csInformerFactory csinformers.SharedInformerFactory) *CloudSynchronizer {
 	return &CloudSynchronizer{
 		userSyncController: synccontroller.NewUser(
 			k8sutil.API().Client(),
@@ -31,6 +33,7 @@ func NewCloudSynchronizer(csInformerFactory csinformers.SharedInformerFactory) *
 		registrySyncController: synccontroller.NewRegistry(
 			k8sutil.API().Client(),
 			k8sutil.CSAPI().Client(),
+			kubeInformerFactory,
 			csInformerFactory,
 		),
 
@@ -3,6 +3,7 @@ package coordinator
 import (
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/scheme"
+	corelistersv1 "k8s.io/client-go/listers/core/v1"
 
 	csscheme "github.com/containership/cluster-manager/pkg/client/clientset/versioned/scheme"
 	csinformers "github.com/containership/cluster-manager/pkg/client/informers/externalversions"
@@ -18,7 +19,11 @@ var (
 	csController        *ContainershipController
 	plgnController      *PluginController
 	cupController       *UpgradeController
+	sshController       *SSHAccessController
+	sshCertController   *SSHCertificateController
+	usernameController  *UsernameController
 	cloudSynchronizer   *CloudSynchronizer
+	nodesLister         corelistersv1.NodeLister
 )
 
 // Initialize creates the informer factories, controller, and synchronizer.
@@ -44,8 +49,22 @@ func Initialize() {
 		k8sutil.API().Client(), kubeInformerFactory)
 
 	plgnController = NewPluginController(
+		k8sutil.API().Client(), k8sutil.CSAPI().Client(), k8sutil.DynamicAPI().Client(),
+		kubeInformerFactory, csInformerFactory)
+
+	sshController = NewSSHAccessController(
 		k8sutil.API().Client(), k8sutil.CSAPI().Client(), csInformerFactory)
 
+	usernameController = NewUsernameController(k8sutil.API().Client(), csInformerFactory)
+
+	// Nodes are listed to aggregate the SSH status reported by the agents
+	nodesLister = kubeInformerFactory.Core().V1().Nodes().Lister()
+
+	if env.IsSSHCAModeEnabled() {
+		sshCertController = NewSSHCertificateController(
+			k8sutil.API().Client(), k8sutil.CSAPI().Client(), csInformerFactory)
+	}
+
 	if env.IsClusterUpgradeEnabled() {
 		cupController = NewUpgradeController(
 			k8sutil.API().Client(), k8sutil.CSAPI().Client(), kubeInformerFactory, csInformerFactory)
@@ -54,7 +73,7 @@ func Initialize() {
 	// Synchronizer needs to be created before any jobs start so
 	// that all needed index functions can be added to the
 	// informers
-	cloudSynchronizer = NewCloudSynchronizer(csInformerFactory)
+	cloudSynchronizer = NewCloudSynchronizer(kubeInformerFactory, csInformerFactory)
 }
 
 // Run kicks off the informer factories, controller, and synchronizer.
@@ -69,6 +88,12 @@ func Run() {
 	go csController.Run(1, stopCh)
 	go plgnController.Run(1, stopCh)
 	go regController.Run(1, stopCh)
+	go sshController.Run(1, stopCh)
+	go usernameController.Run(1, stopCh)
+
+	if env.IsSSHCAModeEnabled() {
+		go sshCertController.Run(1, stopCh)
+	}
 
 	if env.IsClusterUpgradeEnabled() {
 		go cupController.Run(1, stopCh)
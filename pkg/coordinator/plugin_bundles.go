@@ -0,0 +1,345 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/env"
+	"github.com/containership/cluster-manager/pkg/log"
+	synccontroller "github.com/containership/cluster-manager/pkg/resources/sync_controller"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+const (
+	// pluginBundleLabelKey marks a ConfigMap in the containership namespace
+	// as holding plugin bundles, one per key
+	pluginBundleLabelKey = "containership.io/plugin-bundle"
+
+	// pluginBundleSyncInterval is how often plugins are imported from bundles
+	pluginBundleSyncInterval = 30 * time.Second
+)
+
+// jsonPluginBundle is a plugin that's imported locally instead of from Cloud.
+// It's the same as what Cloud returns for a plugin, along with the spec of
+// the plugin that Cloud would otherwise sync.
+type jsonPluginBundle struct {
+	jsonPluginsResponse
+	Metadata csv3.PluginSpec `json:"metadata"`
+
+	// source is where the bundle was read from
+	source string
+}
+
+// pluginBundles holds every version of each plugin seen in a bundle since
+// the coordinator started. Versions that can be rolled back to are also
+// stored in the plugin versions ConfigMap, which is used after a restart.
+type pluginBundles struct {
+	sync.Mutex
+	versions map[string]map[string]*jsonPluginsResponse
+}
+
+// add remembers the bundle
+func (b *pluginBundles) add(bundle *jsonPluginBundle) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.versions == nil {
+		b.versions = make(map[string]map[string]*jsonPluginsResponse)
+	}
+
+	id := bundle.Metadata.ID
+	if b.versions[id] == nil {
+		b.versions[id] = make(map[string]*jsonPluginsResponse)
+	}
+
+	details := bundle.jsonPluginsResponse
+	b.versions[id][bundle.Metadata.Version] = &details
+}
+
+// details returns the manifests and jobs of the version of the plugin
+func (b *pluginBundles) details(id, version string) (*jsonPluginsResponse, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	details, ok := b.versions[id][version]
+	if !ok {
+		return nil, fmt.Errorf("version %s of plugin %s was not imported from a bundle", version, id)
+	}
+
+	return copyPluginDetails(details)
+}
+
+// parseBundle parses and validates a plugin bundle
+func parseBundle(data []byte, source string) (*jsonPluginBundle, error) {
+	bundle := &jsonPluginBundle{source: source}
+	if err := json.Unmarshal(data, bundle); err != nil {
+		return nil, err
+	}
+
+	if bundle.Metadata.ID == "" {
+		return nil, fmt.Errorf("metadata.id is required")
+	}
+
+	if bundle.Metadata.Version == "" {
+		return nil, fmt.Errorf("metadata.version is required")
+	}
+
+	return bundle, nil
+}
+
+// loadBundleDir reads the plugin bundles from the directory. It returns
+// false if any bundle could not be read.
+func loadBundleDir(dir string) ([]*jsonPluginBundle, bool) {
+	bundles := make([]*jsonPluginBundle, 0)
+	complete := true
+
+	// A directory that isn't mounted would otherwise look like every
+	// bundle in it was removed
+	var files []string
+	info, err := os.Stat(dir)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("not a directory")
+	}
+	if err == nil {
+		files, err = filepath.Glob(filepath.Join(dir, "*.json"))
+	}
+	if err != nil {
+		log.Errorf("%s: listing plugin bundles in %s failed: %s", pluginControllerName, dir, err)
+		complete = false
+	}
+
+	sort.Strings(files)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Errorf("%s: reading plugin bundle %s failed: %s", pluginControllerName, file, err)
+			complete = false
+			continue
+		}
+
+		bundle, err := parseBundle(data, "file/"+file)
+		if err != nil {
+			log.Errorf("%s: plugin bundle %s is invalid: %s", pluginControllerName, file, err)
+			complete = false
+			continue
+		}
+
+		bundles = append(bundles, bundle)
+	}
+
+	return bundles, complete
+}
+
+// loadBundles reads the plugin bundles from the bundle directory, if one is
+// set, and from the bundle ConfigMaps. It returns false if any bundle could
+// not be read, in which case plugins whose bundle is missing must be kept
+// since their bundle may be the one that failed.
+func (c *PluginController) loadBundles() ([]*jsonPluginBundle, bool) {
+	bundles := make([]*jsonPluginBundle, 0)
+	complete := true
+
+	if dir := env.PluginBundleDir(); dir != "" {
+		bundles, complete = loadBundleDir(dir)
+	}
+
+	requirement, err := labels.NewRequirement(pluginBundleLabelKey, selection.Exists, nil)
+	if err != nil {
+		log.Error(err)
+		return bundles, false
+	}
+
+	configMaps, err := c.configMapLister.ConfigMaps(constants.ContainershipNamespace).List(
+		labels.NewSelector().Add(*requirement))
+	if err != nil {
+		log.Errorf("%s: listing plugin bundle ConfigMaps failed: %s", pluginControllerName, err)
+		return bundles, false
+	}
+
+	sort.Slice(configMaps, func(i, j int) bool {
+		return configMaps[i].Name < configMaps[j].Name
+	})
+
+	for _, configMap := range configMaps {
+		keys := make([]string, 0, len(configMap.Data))
+		for key := range configMap.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			source := fmt.Sprintf("configmap/%s/%s", configMap.Name, key)
+			bundle, err := parseBundle([]byte(configMap.Data[key]), source)
+			if err != nil {
+				log.Errorf("%s: plugin bundle in ConfigMap %s key %s is invalid: %s",
+					pluginControllerName, configMap.Name, key, err)
+				complete = false
+				continue
+			}
+
+			bundles = append(bundles, bundle)
+		}
+	}
+
+	return bundles, complete
+}
+
+// importBundles creates or updates a Plugin for each plugin bundle, and
+// deletes Plugins that were imported from bundles that no longer exist. The
+// Plugins are then applied and deleted like any other Plugin.
+func (c *PluginController) importBundles() {
+	bundles, complete := c.loadBundles()
+
+	plugins, err := c.pluginLister.Plugins(constants.ContainershipNamespace).List(labels.Everything())
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	existing := make(map[string]*csv3.Plugin, len(plugins))
+	for _, plugin := range plugins {
+		existing[plugin.Name] = plugin
+	}
+
+	imported := make(map[string]bool)
+	for _, bundle := range bundles {
+		id := bundle.Metadata.ID
+		if imported[id] {
+			log.Errorf("%s: ignoring plugin bundle %s since plugin %s was already imported",
+				pluginControllerName, bundle.source, id)
+			continue
+		}
+		imported[id] = true
+
+		c.bundles.add(bundle)
+
+		if err := c.saveBundleVersion(bundle, existing[id]); err != nil {
+			log.Errorf("%s: storing plugin bundle %s failed: %s", pluginControllerName, bundle.source, err)
+		}
+
+		if err := c.importBundle(bundle, existing[id]); err != nil {
+			log.Errorf("%s: importing plugin bundle %s failed: %s", pluginControllerName, bundle.source, err)
+		}
+	}
+
+	if !complete {
+		return
+	}
+
+	for _, plugin := range plugins {
+		if _, ok := plugin.Annotations[constants.PluginBundleAnnotation]; !ok || imported[plugin.Name] {
+			continue
+		}
+
+		log.Infof("%s: deleting plugin %s since its bundle no longer exists", pluginControllerName, plugin.Name)
+		err := c.clientset.ContainershipV3().Plugins(plugin.Namespace).Delete(plugin.Name, &metav1.DeleteOptions{})
+		if err != nil {
+			log.Errorf("%s: deleting plugin %s failed: %s", pluginControllerName, plugin.Name, err)
+		}
+	}
+}
+
+// saveBundleVersion stores the version of the plugin in the bundle, keeping
+// the versions the plugin can be rolled back to once it's imported
+func (c *PluginController) saveBundleVersion(bundle *jsonPluginBundle, existing *csv3.Plugin) error {
+	var keep []string
+	if existing != nil {
+		keep = append(rollbackVersions(existing), existing.Spec.Version)
+	}
+
+	details := bundle.jsonPluginsResponse
+	return c.savePluginVersion(bundle.Metadata.ID, bundle.Metadata.Version, &details, keep)
+}
+
+// importBundle creates the Plugin for the bundle, or updates the existing
+// Plugin if it differs from the bundle. A Plugin synced from Cloud with the
+// same ID is taken over by the bundle.
+func (c *PluginController) importBundle(bundle *jsonPluginBundle, existing *csv3.Plugin) error {
+	plugins := c.clientset.ContainershipV3().Plugins(constants.ContainershipNamespace)
+
+	if existing == nil {
+		plugin, err := plugins.Create(&csv3.Plugin{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: bundle.Metadata.ID,
+				Annotations: map[string]string{
+					constants.PluginBundleAnnotation: bundle.source,
+				},
+			},
+			Spec: bundle.Metadata,
+		})
+		if err != nil {
+			return err
+		}
+
+		c.recorder.Eventf(plugin, corev1.EventTypeNormal, "BundleImport",
+			"Imported version %s from bundle %s", bundle.Metadata.Version, bundle.source)
+		return nil
+	}
+
+	if existing.Annotations[constants.PluginBundleAnnotation] == bundle.source &&
+		reflect.DeepEqual(existing.Spec, bundle.Metadata) {
+		return nil
+	}
+
+	pCopy := existing.DeepCopy()
+	if pCopy.Annotations == nil {
+		pCopy.Annotations = make(map[string]string)
+	}
+	pCopy.Annotations[constants.PluginBundleAnnotation] = bundle.source
+
+	if !reflect.DeepEqual(existing.Spec, bundle.Metadata) {
+		pCopy.Spec = bundle.Metadata
+		synccontroller.SetPluginHistoryAnnotation(existing, pCopy)
+	}
+
+	_, err := plugins.Update(pCopy)
+	if err != nil {
+		return errors.Wrap(err, "updating plugin failed")
+	}
+
+	c.recorder.Eventf(existing, corev1.EventTypeNormal, "BundleImport",
+		"Imported version %s from bundle %s", bundle.Metadata.Version, bundle.source)
+	return nil
+}
+
+// getPluginDetails returns the manifests and jobs of the version of the
+// plugin, from its bundle if it was imported from one and from Cloud
+// otherwise. Cloud only serves the spec version, so other versions are read
+// from the versions stored when they were applied.
+func (c *PluginController) getPluginDetails(plugin *csv3.Plugin, version string) (*jsonPluginsResponse, error) {
+	if _, ok := plugin.Annotations[constants.PluginBundleAnnotation]; ok {
+		details, err := c.bundles.details(plugin.Spec.ID, version)
+		if err == nil {
+			return details, nil
+		}
+
+		// The version may have been imported before a restart
+		stored, storedErr := c.loadPluginVersion(plugin.Name, version)
+		if storedErr != nil {
+			return nil, err
+		}
+
+		return stored, nil
+	}
+
+	if version == plugin.Spec.Version {
+		return c.getPlugin(getPluginEndpoint(plugin))
+	}
+
+	return c.loadPluginVersion(plugin.Name, version)
+}
@@ -0,0 +1,300 @@
+package coordinator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	csfake "github.com/containership/cluster-manager/pkg/client/clientset/versioned/fake"
+	csinformers "github.com/containership/cluster-manager/pkg/client/informers/externalversions"
+	"github.com/containership/cluster-manager/pkg/constants"
+
+	corev1 "k8s.io/api/core/v1"
+	kubeerror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+const testBundle = `{
+	"metadata": {
+		"id": "cni-id",
+		"type": "cni",
+		"implementation": "calico",
+		"version": "3.1.0"
+	},
+	"manifests": [[{
+		"apiVersion": "v1",
+		"kind": "ConfigMap",
+		"metadata": {"name": "calico-config", "namespace": "kube-system"}
+	}]],
+	"jobs": {
+		"pre_apply": [{"metadata": {"name": "calico-migrate"}}]
+	}
+}`
+
+func TestParseBundle(t *testing.T) {
+	bundle, err := parseBundle([]byte(testBundle), "configmap/bundles/cni.json")
+	assert.Nil(t, err)
+	assert.Equal(t, csv3.PluginSpec{
+		ID:             "cni-id",
+		Type:           csv3.CNI,
+		Implementation: "calico",
+		Version:        "3.1.0",
+	}, bundle.Metadata)
+	assert.Len(t, bundle.Manifests, 1)
+	assert.Len(t, bundle.Jobs.PreApply, 1)
+	assert.Equal(t, "configmap/bundles/cni.json", bundle.source)
+
+	_, err = parseBundle([]byte(`{"metadata": {"version": "1.0.0"}}`), "")
+	assert.NotNil(t, err, "ID is required")
+
+	_, err = parseBundle([]byte(`{"metadata": {"id": "cni-id"}}`), "")
+	assert.NotNil(t, err, "version is required")
+
+	_, err = parseBundle([]byte(`{`), "")
+	assert.NotNil(t, err, "invalid JSON")
+}
+
+func TestPluginBundlesDetails(t *testing.T) {
+	bundles := pluginBundles{}
+
+	v1, _ := parseBundle([]byte(testBundle), "")
+	bundles.add(v1)
+	v2, _ := parseBundle([]byte(testBundle), "")
+	v2.Metadata.Version = "3.2.0"
+	v2.Manifests = nil
+	bundles.add(v2)
+
+	// Previous versions are kept for rolling back
+	details, err := bundles.details("cni-id", "3.1.0")
+	assert.Nil(t, err)
+	assert.Len(t, details.Manifests, 1)
+
+	// Changing the details doesn't change the bundle
+	details.Jobs.PreApply[0].Name = "changed"
+	details, _ = bundles.details("cni-id", "3.1.0")
+	assert.Equal(t, "calico-migrate", details.Jobs.PreApply[0].Name)
+
+	details, err = bundles.details("cni-id", "3.2.0")
+	assert.Nil(t, err)
+	assert.Empty(t, details.Manifests)
+
+	_, err = bundles.details("cni-id", "1.0.0")
+	assert.NotNil(t, err)
+
+	_, err = bundles.details("csi-id", "3.1.0")
+	assert.NotNil(t, err)
+}
+
+func newBundleTestController(configMaps []*corev1.ConfigMap, plugins ...*csv3.Plugin) (*PluginController, *csfake.Clientset) {
+	kubeclient := fake.NewSimpleClientset()
+	kubeFactory := kubeinformers.NewSharedInformerFactory(kubeclient, 0)
+	c := &PluginController{
+		kubeclientset: kubeclient,
+		recorder:      record.NewFakeRecorder(10),
+	}
+	c.watchOverrides(kubeFactory)
+	for _, configMap := range configMaps {
+		kubeclient.CoreV1().ConfigMaps(configMap.Namespace).Create(configMap)
+		kubeFactory.Core().V1().ConfigMaps().Informer().GetIndexer().Add(configMap)
+	}
+
+	client := csfake.NewSimpleClientset()
+	informer := csinformers.NewSharedInformerFactory(client, 0).Containership().V3().Plugins()
+	for _, plugin := range plugins {
+		client.ContainershipV3().Plugins(plugin.Namespace).Create(plugin)
+		informer.Informer().GetIndexer().Add(plugin)
+	}
+
+	c.clientset = client
+	c.pluginLister = informer.Lister()
+
+	return c, client
+}
+
+func newBundleConfigMap(data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundles",
+			Namespace: constants.ContainershipNamespace,
+			Labels:    map[string]string{pluginBundleLabelKey: ""},
+		},
+		Data: data,
+	}
+}
+
+func TestImportBundles(t *testing.T) {
+	// Synced from Cloud before the cluster was cut off
+	cloudPlugin := &csv3.Plugin{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "cni-id",
+			Namespace: constants.ContainershipNamespace,
+		},
+		Spec: csv3.PluginSpec{ID: "cni-id", Type: csv3.CNI, Version: "3.0.0"},
+	}
+	// Imported from a bundle that was removed
+	orphan := &csv3.Plugin{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "metrics-id",
+			Namespace:   constants.ContainershipNamespace,
+			Annotations: map[string]string{constants.PluginBundleAnnotation: "configmap/bundles/metrics.json"},
+		},
+		Spec: csv3.PluginSpec{ID: "metrics-id", Type: csv3.Metrics, Version: "1.0.0"},
+	}
+
+	csiBundle := `{"metadata": {"id": "csi-id", "type": "csi", "version": "1.0.0"}, "manifests": []}`
+	c, client := newBundleTestController([]*corev1.ConfigMap{newBundleConfigMap(map[string]string{
+		"cni.json": testBundle,
+		"csi.json": csiBundle,
+		// Duplicates are ignored
+		"duplicate.json": testBundle,
+	})}, cloudPlugin, orphan)
+
+	c.importBundles()
+
+	plugins := client.ContainershipV3().Plugins(constants.ContainershipNamespace)
+
+	cni, err := plugins.Get("cni-id", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "3.1.0", cni.Spec.Version)
+	assert.Equal(t, "calico", cni.Spec.Implementation)
+	assert.Equal(t, "configmap/bundles/cni.json", cni.Annotations[constants.PluginBundleAnnotation])
+	// The previous version is kept in the history like for Cloud updates
+	assert.Equal(t, "3.0.0", getPreviousVersion(cni))
+
+	csi, err := plugins.Get("csi-id", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, csv3.CSI, csi.Spec.Type)
+	assert.Equal(t, "configmap/bundles/csi.json", csi.Annotations[constants.PluginBundleAnnotation])
+
+	_, err = plugins.Get("metrics-id", metav1.GetOptions{})
+	assert.True(t, kubeerror.IsNotFound(err))
+
+	// The imported manifests are used instead of Cloud
+	details, err := c.getPluginDetails(cni, "3.1.0")
+	assert.Nil(t, err)
+	assert.Len(t, details.Manifests, 1)
+}
+
+func TestImportBundlesUnchanged(t *testing.T) {
+	bundle, _ := parseBundle([]byte(testBundle), "configmap/bundles/cni.json")
+	plugin := &csv3.Plugin{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "cni-id",
+			Namespace:   constants.ContainershipNamespace,
+			Annotations: map[string]string{constants.PluginBundleAnnotation: bundle.source},
+		},
+		Spec: bundle.Metadata,
+	}
+
+	c, client := newBundleTestController([]*corev1.ConfigMap{
+		newBundleConfigMap(map[string]string{"cni.json": testBundle}),
+	}, plugin)
+	client.ClearActions()
+
+	c.importBundles()
+	assert.Len(t, client.Actions(), 0)
+}
+
+func TestImportBundlesKeepsPluginsIfBundlesAreInvalid(t *testing.T) {
+	plugin := &csv3.Plugin{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "csi-id",
+			Namespace:   constants.ContainershipNamespace,
+			Annotations: map[string]string{constants.PluginBundleAnnotation: "configmap/bundles/csi.json"},
+		},
+		Spec: csv3.PluginSpec{ID: "csi-id", Version: "1.0.0"},
+	}
+
+	c, client := newBundleTestController([]*corev1.ConfigMap{
+		// The bundle of the plugin may be the invalid one
+		newBundleConfigMap(map[string]string{"csi.json": `{"metadata": {}}`}),
+	}, plugin)
+
+	c.importBundles()
+
+	_, err := client.ContainershipV3().Plugins(constants.ContainershipNamespace).Get("csi-id", metav1.GetOptions{})
+	assert.Nil(t, err)
+}
+
+func TestLoadBundleDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundles")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "cni.json"), []byte(testBundle), 0644))
+
+	bundles, complete := loadBundleDir(dir)
+	assert.True(t, complete)
+	assert.Len(t, bundles, 1)
+
+	// A missing directory may just not be mounted, so its bundles can't be
+	// considered removed
+	bundles, complete = loadBundleDir(filepath.Join(dir, "missing"))
+	assert.False(t, complete)
+	assert.Empty(t, bundles)
+
+	_, complete = loadBundleDir(filepath.Join(dir, "cni.json"))
+	assert.False(t, complete)
+}
+
+func TestImportBundlesStoresVersions(t *testing.T) {
+	plugin := &csv3.Plugin{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "cni-id",
+			Namespace:   constants.ContainershipNamespace,
+			Annotations: map[string]string{constants.PluginBundleAnnotation: "configmap/bundles/cni.json"},
+		},
+		Spec: csv3.PluginSpec{ID: "cni-id", Version: "3.0.0"},
+	}
+	// Stored the way older coordinators stored versions
+	stored := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      legacyPluginVersionsConfigMapName("cni-id"),
+			Namespace: constants.ContainershipNamespace,
+			Labels:    map[string]string{pluginVersionsLabelKey: "cni-id"},
+		},
+		Data: map[string]string{
+			"2.0.0": `{"manifests": []}`,
+			"3.0.0": `{"manifests": [[{"kind": "ConfigMap"}]]}`,
+		},
+	}
+
+	c, _ := newBundleTestController([]*corev1.ConfigMap{
+		newBundleConfigMap(map[string]string{"cni.json": testBundle}),
+		stored,
+	}, plugin)
+
+	c.importBundles()
+
+	// Only the imported version and the versions it can be rolled back to
+	// are kept, each in its own ConfigMap
+	list, err := c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace).List(metav1.ListOptions{
+		LabelSelector: pluginVersionsLabelKey + "=cni-id",
+	})
+	assert.Nil(t, err)
+	versions := make([]string, 0)
+	for _, cm := range list.Items {
+		versions = append(versions, cm.Annotations[pluginVersionAnnotation])
+	}
+	assert.ElementsMatch(t, []string{"3.0.0", "3.1.0"}, versions, "the legacy ConfigMap is migrated and deleted")
+
+	// After a restart the previous version is read from its ConfigMap
+	configMaps := make([]*corev1.ConfigMap, 0)
+	for i := range list.Items {
+		configMaps = append(configMaps, &list.Items[i])
+	}
+	c, _ = newBundleTestController(configMaps, plugin)
+	details, err := c.getPluginDetails(plugin, "3.0.0")
+	assert.Nil(t, err)
+	assert.Len(t, details.Manifests, 1)
+
+	_, err = c.getPluginDetails(plugin, "1.0.0")
+	assert.NotNil(t, err)
+}
@@ -3,21 +3,21 @@ package coordinator
 import (
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
-	"os"
-	"path"
+	"reflect"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/spf13/afero"
 
+	"github.com/containership/cluster-manager/pkg/chart"
 	"github.com/containership/cluster-manager/pkg/constants"
 	"github.com/containership/cluster-manager/pkg/env"
-	"github.com/containership/cluster-manager/pkg/k8sutil/kubectl"
+	"github.com/containership/cluster-manager/pkg/k8sutil/apply"
 	"github.com/containership/cluster-manager/pkg/log"
 	"github.com/containership/cluster-manager/pkg/request"
 	"github.com/containership/cluster-manager/pkg/tools"
-	"github.com/containership/cluster-manager/pkg/tools/fsutil"
 
 	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
 	csclientset "github.com/containership/cluster-manager/pkg/client/clientset/versioned"
@@ -25,11 +25,16 @@ import (
 	cslisters "github.com/containership/cluster-manager/pkg/client/listers/containership.io/v3"
 
 	kubeerror "k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 
+	"k8s.io/client-go/dynamic"
+	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
@@ -37,7 +42,6 @@ import (
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	watch "k8s.io/apimachinery/pkg/watch"
 )
 
 const (
@@ -45,6 +49,9 @@ const (
 	pluginControllerName = "PluginController"
 
 	pluginLabelKey = "containership.io/plugin-id"
+	// pluginRevisionLabelKey identifies the set of manifests an object was
+	// last applied from, so objects no longer in the set can be pruned
+	pluginRevisionLabelKey = "containership.io/plugin-revision"
 
 	pluginDelayBetweenRetries = 30 * time.Second
 
@@ -62,30 +69,70 @@ type PluginController struct {
 	pluginLister  cslisters.PluginLister
 	pluginsSynced cache.InformerSynced
 
+	// Workload listers are used to determine the readiness of plugins
+	deploymentLister   appslisters.DeploymentLister
+	deploymentsSynced  cache.InformerSynced
+	daemonSetLister    appslisters.DaemonSetLister
+	daemonSetsSynced   cache.InformerSynced
+	statefulSetLister  appslisters.StatefulSetLister
+	statefulSetsSynced cache.InformerSynced
+
+	// ConfigMaps hold overrides for the plugin objects
+	configMapLister  corelisters.ConfigMapLister
+	configMapsSynced cache.InformerSynced
+
+	// applier applies and deletes plugin objects
+	applier *apply.Applier
+
+	// deleted holds plugins that were deleted until their objects are
+	deleted deletedPlugins
+	// waiting holds the dependencies plugins are waiting for
+	waiting waitingPlugins
+	// applied holds the objects each plugin was last applied with
+	applied appliedPlugins
+	// locks keeps a plugin from being applied while its drift is corrected
+	locks pluginLocks
+
+	// bundles holds the plugins imported from local bundles
+	bundles pluginBundles
+
+	// getPodLogs returns the last lines of logs of a pod container
+	getPodLogs func(pod *corev1.Pod, container string, tailLines int64) ([]byte, error)
+
 	// workqueue is a rate limited work queue. This is used to queue work to be
 	// processed instead of performing it as soon as a change happens. This
 	// means we can ensure we only process a fixed amount of resources at a
 	// time, and makes it easy to ensure we are never processing the same item
 	// simultaneously in two different workers.
 	workqueue workqueue.RateLimitingInterface
+	// statusWorkqueue holds plugins whose workload readiness should be
+	// refreshed. It's separate from workqueue since refreshing the status
+	// must not apply the plugin again.
+	statusWorkqueue workqueue.RateLimitingInterface
+	// driftWorkqueue holds plugins whose objects should be compared with
+	// what they were last applied with
+	driftWorkqueue workqueue.RateLimitingInterface
 	// recorder is an event recorder for recording Event resources to the
 	// Kubernetes API.
 	recorder record.EventRecorder
 }
 
-// used for writing and deleting manifest files
-var osFs = afero.NewOsFs()
-
 // NewPluginController returns a new containership controller
-func NewPluginController(kubeclientset kubernetes.Interface, clientset csclientset.Interface, csInformerFactory csinformers.SharedInformerFactory) *PluginController {
+func NewPluginController(kubeclientset kubernetes.Interface, clientset csclientset.Interface, dynamicclient dynamic.Interface, kubeInformerFactory kubeinformers.SharedInformerFactory, csInformerFactory csinformers.SharedInformerFactory) *PluginController {
 	rateLimiter := workqueue.NewItemExponentialFailureRateLimiter(pluginDelayBetweenRetries, pluginDelayBetweenRetries)
 
 	pc := &PluginController{
 		kubeclientset: kubeclientset,
 		clientset:     clientset,
+		applier:       apply.NewApplier(dynamicclient, kubeclientset.Discovery()),
 		workqueue:     workqueue.NewNamedRateLimitingQueue(rateLimiter, "Plugin"),
-		recorder:      tools.CreateAndStartRecorder(kubeclientset, pluginControllerName),
+		statusWorkqueue: workqueue.NewNamedRateLimitingQueue(
+			workqueue.DefaultControllerRateLimiter(), "PluginStatus"),
+		driftWorkqueue: workqueue.NewNamedRateLimitingQueue(
+			workqueue.DefaultControllerRateLimiter(), "PluginDrift"),
+		recorder: tools.CreateAndStartRecorder(kubeclientset, pluginControllerName),
 	}
+	pc.getPodLogs = pc.kubePodLogs
 
 	// Instantiate resource informers
 	pluginInformer := csInformerFactory.Containership().V3().Plugins()
@@ -102,9 +149,19 @@ func NewPluginController(kubeclientset kubernetes.Interface, clientset csclients
 				return
 			}
 
+			if !needsApply(oldPlugin, newPlugin) {
+				// The status is written by this controller, so reacting
+				// to every change would apply the plugin again after
+				// every sync
+				return
+			}
+
 			pc.enqueuePlugin(newPlugin)
 		},
-		DeleteFunc: pc.enqueuePlugin,
+		DeleteFunc: func(obj interface{}) {
+			pc.trackDeletedPlugin(obj)
+			pc.enqueuePlugin(obj)
+		},
 	})
 
 	// Listers are used for cache inspection and Synced functions
@@ -112,6 +169,9 @@ func NewPluginController(kubeclientset kubernetes.Interface, clientset csclients
 	pc.pluginLister = pluginInformer.Lister()
 	pc.pluginsSynced = pluginInformer.Informer().HasSynced
 
+	pc.watchWorkloads(kubeInformerFactory)
+	pc.watchOverrides(kubeInformerFactory)
+
 	log.Info(pluginControllerName, ": Setting up event handlers")
 
 	return pc
@@ -122,15 +182,21 @@ func NewPluginController(kubeclientset kubernetes.Interface, clientset csclients
 // is closed, at which point it will shutdown the workqueue and wait for
 // workers to finish processing their current work items.
 func (c *PluginController) Run(numWorkers int, stopCh chan struct{}) {
-	defer runtime.HandleCrash()
+	defer utilruntime.HandleCrash()
 	defer c.workqueue.ShutDown()
+	defer c.statusWorkqueue.ShutDown()
+	defer c.driftWorkqueue.ShutDown()
 
 	// Start the informer factories to begin populating the informer caches
 	log.Info(pluginControllerName, ": Starting controller")
 
 	if ok := cache.WaitForCacheSync(
 		stopCh,
-		c.pluginsSynced); !ok {
+		c.pluginsSynced,
+		c.deploymentsSynced,
+		c.daemonSetsSynced,
+		c.statefulSetsSynced,
+		c.configMapsSynced); !ok {
 		// If this channel is unable to wait for caches to sync we stop both
 		// the containership controller, and the plugin controller
 		close(stopCh)
@@ -141,8 +207,16 @@ func (c *PluginController) Run(numWorkers int, stopCh chan struct{}) {
 	// Launch numWorkers amount of workers to process resources
 	for i := 0; i < numWorkers; i++ {
 		go wait.Until(c.runWorker, time.Second, stopCh)
+		go wait.Until(c.runStatusWorker, time.Second, stopCh)
+		go wait.Until(c.runDriftWorker, time.Second, stopCh)
 	}
 
+	// Workloads are watched for drift, everything else is checked
+	// periodically
+	go wait.Until(c.enqueueAllDriftChecks, pluginDriftCheckInterval, stopCh)
+
+	go wait.Until(c.importBundles, pluginBundleSyncInterval, stopCh)
+
 	log.Info(pluginControllerName, ": Started workers")
 	<-stopCh
 	log.Info(pluginControllerName, ": Shutting down workers")
@@ -209,29 +283,222 @@ func (c *PluginController) handleErr(err error, key interface{}) error {
 	return errors.Wrap(err, "syncing plugin failed")
 }
 
-// pluginSyncHandler uses kubectl to apply the plugin manifest if a plugin CRD
-// exists, if the plugin CRD does not exist delete the associated plugin
-// manifest files
+// pluginSyncHandler applies the plugin manifests if a plugin CRD exists, if
+// the plugin CRD does not exist delete the objects belonging to the plugin
 func (c *PluginController) pluginSyncHandler(key string) error {
 	_, name, _ := cache.SplitMetaNamespaceKey(key)
+
+	unlock := c.locks.lock(name)
+	defer unlock()
+
 	plugin, err := c.pluginLister.Plugins(constants.ContainershipNamespace).Get(name)
 
 	if err != nil {
-		// If the plugin CRD does not exist delete the plugin manifest files
+		// If the plugin CRD does not exist delete the plugin objects
 		if kubeerror.IsNotFound(err) {
-			return c.deletePlugin(name)
+			c.setWaiting(name, nil)
+			return c.deletePluginInOrder(key, name)
 		}
 
 		return errors.Wrap(err, "getting plugin failed with error other than not found")
 	}
 
+	// The plugin may have been deleted and created again
+	c.forgetDeletedPlugin(name)
+
 	if plugin.Spec.Type == constants.ClusterManagementPluginType && env.IsClusterManagementPluginSyncDisabled() {
 		return nil
 	}
 
+	if version, ok := plugin.Annotations[constants.PluginRollbackAnnotation]; ok {
+		return c.requestedRollback(plugin, version)
+	}
+
+	if plugin.Status.Phase == csv3.PluginPhaseRolledBack && plugin.Status.RolledBackFrom == plugin.Spec.Version {
+		// Applying the same version again would most likely fail again,
+		// so the plugin stays rolled back until Cloud changes the version
+		log.Debugf("%s: plugin %s stays rolled back from version %s", pluginControllerName, plugin.Name, plugin.Spec.Version)
+		return nil
+	}
+
+	unmet, err := c.unmetDependencies(plugin)
+	if err != nil {
+		return errors.Wrap(err, "checking plugin dependencies failed")
+	}
+
+	// Dependencies are checked again and again while waiting, so the
+	// event is only emitted when what is waited for changes
+	if c.setWaiting(name, unmet) {
+		c.recorder.Eventf(plugin, corev1.EventTypeNormal, "WaitingForDependencies",
+			"Waiting for dependencies to be ready: %s", strings.Join(unmet, ", "))
+	}
+
+	if len(unmet) > 0 {
+		c.workqueue.AddAfter(key, pluginDependencyRecheckInterval)
+		return nil
+	}
+
 	log.Debugf("%s syncing plugin of type %q with implementation %q", pluginControllerName, plugin.Spec.Type, plugin.Spec.Implementation)
-	// Create the plugin manifest files
-	return c.applyPlugin(plugin)
+	pluginDetails, err := c.getPluginDetails(plugin, plugin.Spec.Version)
+	if err != nil {
+		return errors.Wrap(err, "getting plugin manifests failed")
+	}
+
+	// The plugin was applied whether or not its status can be written, so
+	// failing to write it never fails the sync. Otherwise the whole plugin
+	// would be applied again, jobs included.
+	// The details are copied before they're modified by applying them
+	applied, err := copyPluginDetails(pluginDetails)
+	if err != nil {
+		return errors.Wrap(err, "copying plugin manifests failed")
+	}
+
+	results, err := c.applyPlugin(plugin, pluginDetails)
+	if err == nil {
+		// Only versions that applied are rolled back to
+		err := c.savePluginVersion(plugin.Name, plugin.Spec.Version, applied, rollbackVersions(plugin))
+		if err != nil {
+			log.Errorf("%s: storing version %s of plugin %s failed: %s",
+				pluginControllerName, plugin.Spec.Version, plugin.Name, err)
+			c.recorder.Eventf(plugin, corev1.EventTypeWarning, "StoreVersionFailed",
+				"Version %s can't be rolled back to since storing it failed: %s", plugin.Spec.Version, err)
+		}
+
+		statusErr := c.updateStatus(plugin, func(status *csv3.PluginStatus) {
+			setApplyResults(status, results)
+			status.Phase = csv3.PluginPhaseApplied
+			status.Version = plugin.Spec.Version
+			status.RolledBackFrom = ""
+			status.Message = ""
+		})
+		if statusErr != nil {
+			log.Error(statusErr)
+		}
+
+		return nil
+	}
+
+	c.recorder.Eventf(plugin, corev1.EventTypeWarning, "ApplyFailed",
+		"Applying version %s failed: %s", plugin.Spec.Version, err)
+
+	version := rollbackVersion(plugin)
+	if version == "" {
+		statusErr := c.updateStatus(plugin, func(status *csv3.PluginStatus) {
+			setApplyResults(status, results)
+			status.Phase = csv3.PluginPhaseFailed
+			status.Message = err.Error()
+		})
+		if statusErr != nil {
+			log.Error(statusErr)
+		}
+
+		return err
+	}
+
+	return c.rollback(plugin, version, err.Error())
+}
+
+// needsApply returns true if the plugin changed in a way that requires it to
+// be applied again, which is if the spec changed or a rollback was requested
+func needsApply(old, new *csv3.Plugin) bool {
+	if !reflect.DeepEqual(old.Spec, new.Spec) {
+		return true
+	}
+
+	oldVersion, oldRequested := old.Annotations[constants.PluginRollbackAnnotation]
+	version, requested := new.Annotations[constants.PluginRollbackAnnotation]
+
+	return requested && (!oldRequested || version != oldVersion)
+}
+
+// rollbackVersion returns the version to roll back to after the spec version
+// of the plugin failed to apply. This is the version that was applied before
+// it, or if that isn't known the previous version from the plugin history.
+// An empty string is returned if there is nothing to roll back to.
+func rollbackVersion(plugin *csv3.Plugin) string {
+	version := plugin.Status.Version
+	if version == "" {
+		version = getPreviousVersion(plugin)
+	}
+
+	if version == plugin.Spec.Version {
+		return ""
+	}
+
+	return version
+}
+
+// requestedRollback handles a rollback requested using the rollback
+// annotation. The annotation is removed before rolling back so that a failed
+// rollback isn't attempted again and again.
+func (c *PluginController) requestedRollback(plugin *csv3.Plugin, version string) error {
+	pCopy := plugin.DeepCopy()
+	delete(pCopy.Annotations, constants.PluginRollbackAnnotation)
+
+	plugin, err := c.clientset.ContainershipV3().Plugins(plugin.Namespace).Update(pCopy)
+	if err != nil {
+		return errors.Wrap(err, "removing rollback annotation failed")
+	}
+
+	if version == "" {
+		version = getPreviousVersion(plugin)
+	}
+
+	if !inPluginHistory(plugin, version) {
+		c.recorder.Eventf(plugin, corev1.EventTypeWarning, "RollbackError",
+			"Version %q to roll back to is not a previous version of the plugin", version)
+		return nil
+	}
+
+	return c.rollback(plugin, version, "rollback was requested")
+}
+
+// rollback fetches the given version of the plugin and applies it
+// in place of the spec version, updating the status with the result
+func (c *PluginController) rollback(plugin *csv3.Plugin, version string, reason string) error {
+	var results []apply.Result
+	applied := false
+	pluginDetails, err := c.getPluginDetails(plugin, version)
+	if err == nil {
+		applied = true
+		results, err = c.applyPlugin(plugin, pluginDetails)
+	}
+
+	if err != nil {
+		c.recorder.Eventf(plugin, corev1.EventTypeWarning, "RollbackError",
+			"Rolling back to version %s failed: %s", version, err)
+
+		statusErr := c.updateStatus(plugin, func(status *csv3.PluginStatus) {
+			if applied {
+				setApplyResults(status, results)
+			}
+			status.Phase = csv3.PluginPhaseFailed
+			status.Message = fmt.Sprintf("%s; rolling back to version %s failed: %s", reason, version, err)
+		})
+		if statusErr != nil {
+			log.Error(statusErr)
+		}
+
+		return errors.Wrapf(err, "rolling back to version %s failed", version)
+	}
+
+	c.recorder.Eventf(plugin, corev1.EventTypeNormal, "RolledBack",
+		"Rolled back from version %s to %s: %s", plugin.Spec.Version, version, reason)
+
+	// Like after applying, failing to write the status doesn't fail the
+	// rollback
+	statusErr := c.updateStatus(plugin, func(status *csv3.PluginStatus) {
+		setApplyResults(status, results)
+		status.Phase = csv3.PluginPhaseRolledBack
+		status.Version = version
+		status.RolledBackFrom = plugin.Spec.Version
+		status.Message = reason
+	})
+	if statusErr != nil {
+		log.Error(statusErr)
+	}
+
+	return nil
 }
 
 func getPluginEndpoint(plugin *csv3.Plugin) string {
@@ -239,16 +506,38 @@ func getPluginEndpoint(plugin *csv3.Plugin) string {
 	return fmt.Sprintf("/organizations/{{.OrganizationID}}/clusters/{{.ClusterID}}/plugins/%s?previous_version=%s", plugin.Spec.ID, previousVersion)
 }
 
-func getPreviousVersion(plugin *csv3.Plugin) string {
+func getPluginHistory(plugin *csv3.Plugin) []csv3.PluginSpec {
 	annotation, ok := plugin.Annotations[constants.PluginHistoryAnnotation]
 	if !ok {
-		return ""
+		return nil
 	}
 
 	history := make([]csv3.PluginSpec, 0)
 	err := json.Unmarshal([]byte(annotation), &history)
+	if err != nil {
+		return nil
+	}
+
+	return history
+}
+
+func inPluginHistory(plugin *csv3.Plugin, version string) bool {
+	if version == "" {
+		return false
+	}
+
+	for _, spec := range getPluginHistory(plugin) {
+		if spec.Version == version {
+			return true
+		}
+	}
+
+	return false
+}
 
-	if err != nil || len(history) == 0 {
+func getPreviousVersion(plugin *csv3.Plugin) string {
+	history := getPluginHistory(plugin)
+	if len(history) == 0 {
 		return ""
 	}
 
@@ -276,100 +565,111 @@ func makeRequest(path string) ([]byte, error) {
 	return bytes, nil
 }
 
-func runAndLogFromKubectl(kc *kubectl.Kubectl) error {
-	err := kc.Run()
+// deletePluginInOrder deletes the objects of the deleted plugin once the
+// objects of every deleted plugin depending on it have been deleted.
+// Otherwise the plugin is checked again later.
+func (c *PluginController) deletePluginInOrder(key, name string) error {
+	if dependents := c.deletedDependents(name); len(dependents) > 0 {
+		log.Infof("%s: waiting for plugins %s to be deleted before deleting plugin %s",
+			pluginControllerName, strings.Join(dependents, ", "), name)
+		c.workqueue.AddAfter(key, pluginDependencyRecheckInterval)
+		return nil
+	}
 
-	log.Debug("Kubectl output: ", string(kc.Output))
-	if err != nil || len(kc.Error) != 0 {
-		e := string(kc.Error)
+	// Ordering is best effort, so even if deleting fails the plugins that
+	// this plugin depends on aren't held back any longer
+	defer c.forgetDeletedPlugin(name)
 
-		log.Error("Kubectl error: ", e)
-		return fmt.Errorf("Kubectl error: %s", e)
-	}
+	c.forgetAppliedObjects(name)
 
-	return nil
+	return c.deletePlugin(name)
 }
 
-// deletePluginUsingFiles takes in a plugin id and the plugin path.
-// It then looks at each file in the file directory and if it is a text file
-// it will take the url that is written in the file, and delete using the url.
-// If it is a json file it will use the file to delete the plugin.
-func deletePluginUsingFiles(pluginID, pluginPath string, fileManager pluginFileManager) error {
-	files, err := ioutil.ReadDir(pluginPath)
+// deletePlugin deletes every object labeled as belonging to the plugin in
+// the scopes it applied objects to. The Plugin itself is already gone so the
+// results can only be logged.
+func (c *PluginController) deletePlugin(name string) error {
+	scopes, err := c.pluginScopes(name)
 	if err != nil {
-		return errors.Wrap(err, "unable to read plugin path directory")
+		return errors.Wrap(err, "getting plugin scopes failed")
 	}
 
-	for _, f := range files {
-		fullFilename := fileManager.pluginManifestsFilePath(f.Name())
-
-		var kc *kubectl.Kubectl
-		kc = kubectl.NewDeleteCmd(fullFilename)
-
-		err = runAndLogFromKubectl(kc)
-		if err != nil {
-			return errors.Wrap(err, "deleting plugin using files failed")
-		}
+	results, err := c.applier.DeleteByLabel(pluginLabelKey+"="+name, scopes)
+	for _, r := range results {
+		log.Debugf("%s: deleting plugin %s: %s", pluginControllerName, name, r)
 	}
 
-	return nil
-}
-
-func (c *PluginController) deletePlugin(name string) error {
-	fileManager := pluginFileManager{
-		name,
+	if err != nil {
+		return errors.Wrap(err, "deleting plugin using labels failed")
 	}
-	pluginPath := fileManager.pluginDir()
 
-	var kc *kubectl.Kubectl
-	if stat, err := os.Stat(pluginPath); os.IsNotExist(err) || !stat.IsDir() {
-		// Covers edge case that if plugin does not have a directory with manifests
-		// it will try and delete by the containership.io/plugin-id label
-		label := pluginLabelKey + "=" + name
-		kc = kubectl.NewDeleteByLabelCmd(constants.ContainershipNamespace, label)
-
-		err := runAndLogFromKubectl(kc)
-		if err != nil {
-			return errors.Wrap(err, "deleting plugin using labels failed")
-		}
+	// The logs of the plugin jobs are kept until the plugin is deleted
+	err = c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace).DeleteCollection(
+		&metav1.DeleteOptions{}, metav1.ListOptions{
+			LabelSelector: pluginJobLogsLabelKey + "=" + name,
+		})
+	if err != nil {
+		return errors.Wrap(err, "deleting plugin job logs failed")
+	}
 
-		return nil
+	err = c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace).DeleteCollection(
+		&metav1.DeleteOptions{}, metav1.ListOptions{
+			LabelSelector: pluginVersionsLabelKey + "=" + name,
+		})
+	if err != nil {
+		return errors.Wrap(err, "deleting plugin versions failed")
 	}
 
-	err := deletePluginUsingFiles(name, pluginPath, fileManager)
+	// The scopes are only deleted once every object in them is
+	err = c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace).DeleteCollection(
+		&metav1.DeleteOptions{}, metav1.ListOptions{
+			LabelSelector: pluginScopesLabelKey + "=" + name,
+		})
 	if err != nil {
-		return errors.Wrap(err, "delete plugin failed")
+		return errors.Wrap(err, "deleting plugin scopes failed")
 	}
 
-	// attempts to clean up the manifest directory that was created,
-	// if there is an error it's ignored
-	fileManager.cleanUpPluginManifests()
 	return nil
 }
 
 type jsonPluginsResponse struct {
 	Manifests [][]interface{} `json:"manifests"`
+	Chart     *jsonChart      `json:"chart,omitempty"`
 	Jobs      jobs            `json:"jobs,omitempty"`
 }
 
+// jsonChart is a Helm chart that is rendered into manifests for the plugin
+type jsonChart struct {
+	// Archive is the gzipped chart tarball, base64 encoded in JSON
+	Archive []byte `json:"archive"`
+	// Values is the YAML values document to render the chart with
+	Values string `json:"values,omitempty"`
+	// Namespace is the release namespace
+	Namespace string `json:"namespace,omitempty"`
+}
+
 type jobs struct {
 	PreApply  []*batchv1.Job `json:"pre_apply,omitempty"`
 	PostApply []*batchv1.Job `json:"post_apply,omitempty"`
 }
 
-// getPlugin gets the plugin spec from cloud, or returns an error
-func (c *PluginController) getPlugin(p *csv3.Plugin) (*jsonPluginsResponse, error) {
-	path := getPluginEndpoint(p)
+// getPlugin gets the plugin spec from the cloud endpoint, or returns an error
+func (c *PluginController) getPlugin(path string) (*jsonPluginsResponse, error) {
 	bytes, err := makeRequest(path)
 	if err != nil {
 		return nil, err
 	}
 
+	return parsePluginDetails(bytes)
+}
+
+// parsePluginDetails parses the manifests and jobs of a plugin
+func parsePluginDetails(bytes []byte) (*jsonPluginsResponse, error) {
 	var plugin jsonPluginsResponse
 	plugin.Jobs.PreApply = make([]*batchv1.Job, 0)
 	plugin.Jobs.PostApply = make([]*batchv1.Job, 0)
 
-	err = json.Unmarshal(bytes, &plugin)
+	err := json.Unmarshal(bytes, &plugin)
 	if err != nil {
 		return nil, err
 	}
@@ -377,237 +677,264 @@ func (c *PluginController) getPlugin(p *csv3.Plugin) (*jsonPluginsResponse, erro
 	return &plugin, nil
 }
 
-// formatPlugin takes the manifests from the plugin spec returned from cloud
-// and splits them up to be written to files under the plugins/:plugin_id. It
-// then returns an array of strings, which are the file paths.
-func formatPlugin(spec csv3.PluginSpec, pluginDetails *jsonPluginsResponse, fileManager pluginFileManager) ([]string, error) {
-	manifests := make([]string, 0)
-
-	for index, resources := range pluginDetails.Manifests {
-		manifestBundle := make([]byte, 0)
-		for _, r := range resources {
-			// Re-Marshal the generic object so we can have each
-			// as []byte
-			unstructuredBytes, _ := json.Marshal(r)
-			manifestBundle = append(manifestBundle, unstructuredBytes...)
-		}
+// manifestRevision returns a revision identifying the set of manifests. It
+// only changes if the manifests change, and is short enough to be used as a
+// label value.
+func manifestRevision(manifests [][]interface{}) (string, error) {
+	data, err := json.Marshal(manifests)
+	if err != nil {
+		return "", err
+	}
 
-		filename := fileManager.pluginManifestsFilePath(buildPluginFilename(index, "json"))
+	h := fnv.New64a()
+	h.Write(data)
 
-		err := writePluginManifests(filename, manifestBundle)
-		// we only want to short circuit and return if there was an error
-		// else continue processing the manifests
-		if err != nil {
-			return nil, err
-		}
+	return fmt.Sprintf("%x", h.Sum64()), nil
+}
 
-		manifests = append(manifests, filename)
+// renderChart renders the chart of the plugin for the current release of the
+// plugin. The rendered manifests are applied before any other manifests, and
+// the chart hooks are run along with any other jobs.
+func renderChart(plugin *csv3.Plugin, pluginDetails *jsonPluginsResponse) (*jsonPluginsResponse, error) {
+	release := chart.Release{
+		Name:      plugin.Spec.Implementation,
+		Namespace: pluginDetails.Chart.Namespace,
+		// Every change to the plugin spec is a new revision
+		Revision: len(getPluginHistory(plugin)) + 1,
+		// Anything applied before means this is an upgrade
+		IsUpgrade: plugin.Status.Version != "",
 	}
 
-	return manifests, nil
-}
-
-func pluginBaseDir() string {
-	return "/plugins"
-}
+	if release.Name == "" {
+		release.Name = plugin.Spec.ID
+	}
 
-// pluginFileManager uses the plugins id to create and mantain the plugin
-// directory for applying and updating plugins
-type pluginFileManager struct {
-	ID string
-}
+	if release.Namespace == "" {
+		release.Namespace = metav1.NamespaceDefault
+	}
 
-func (p pluginFileManager) initializePluginDirectories() error {
-	md := p.pluginManifestsDir()
-	err := osFs.MkdirAll(md, os.ModePerm)
+	rendered, err := chart.Render(pluginDetails.Chart.Archive, pluginDetails.Chart.Values, release)
 	if err != nil {
-		return errors.Wrap(err, "initializing plugin directories failed")
+		return nil, err
 	}
 
-	return nil
+	return &jsonPluginsResponse{
+		Manifests: append(rendered.Manifests, pluginDetails.Manifests...),
+		Jobs: jobs{
+			PreApply:  append(pluginDetails.Jobs.PreApply, rendered.PreApply...),
+			PostApply: append(rendered.PostApply, pluginDetails.Jobs.PostApply...),
+		},
+	}, nil
 }
 
-func (p pluginFileManager) pluginDir() string {
-	return path.Join(pluginBaseDir(), p.ID)
-}
+// formatPlugin takes the manifests from the plugin spec returned from cloud
+// and converts them to objects, keeping them in the groups they should be
+// applied in. Every object is labeled with the plugin ID so that it can be
+// found again when the plugin is deleted, and with the revision of the
+// manifests so that it can be pruned once it's no longer part of the plugin.
+// The overrides are applied to the objects before they're labeled; an error
+// is returned for each override that failed to apply, without failing the
+// formatting.
+func formatPlugin(spec csv3.PluginSpec, revision string, pluginDetails *jsonPluginsResponse, overrides []pluginOverride) ([][]*unstructured.Unstructured, []error, error) {
+	groups := make([][]*unstructured.Unstructured, 0)
+	overrideErrs := make([]error, 0)
 
-func (p pluginFileManager) pluginManifestsDir() string {
-	return path.Join(p.pluginDir(), "manifests")
-}
+	for index, resources := range pluginDetails.Manifests {
+		group := make([]*unstructured.Unstructured, 0)
+		for _, r := range resources {
+			// Re-Marshal the generic object so it can be decoded as an
+			// unstructured object
+			unstructuredBytes, err := json.Marshal(r)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "manifest group %d is invalid", index)
+			}
 
-func (p pluginFileManager) pluginManifestsFilePath(name string) string {
-	return path.Join(p.pluginManifestsDir(), name)
-}
+			obj := &unstructured.Unstructured{}
+			if err := obj.UnmarshalJSON(unstructuredBytes); err != nil {
+				return nil, nil, errors.Wrapf(err, "manifest group %d is invalid", index)
+			}
 
-func buildPluginFilename(name int, fileType string) string {
-	return fmt.Sprintf("%d.%s", name, fileType)
-}
+			// Lists are applied as their individual items, like kubectl
+			// does
+			if obj.IsList() {
+				err = obj.EachListItem(func(item runtime.Object) error {
+					group = append(group, item.(*unstructured.Unstructured))
+					return nil
+				})
+				if err != nil {
+					return nil, nil, errors.Wrapf(err, "manifest group %d is invalid", index)
+				}
 
-// writePluginManifests takes the manifests and writes them to a .json file.
-// They are named as their index so that if `kubectl apply -f` is run on
-// the directory they will be applied in the correct order, since kubectl apply
-// runs files in alphanumeric order
-func writePluginManifests(filename string, manifest []byte) error {
-	return ioutil.WriteFile(filename, manifest, 0644)
-}
+				continue
+			}
 
-// cleanUpPluginManifests is a best effort function to clean up a plugins
-// directory by removing all manifests written for the plugin.
-// we log the error but don't return it, or retry
-func (p pluginFileManager) cleanUpPluginManifests() {
-	err := osFs.RemoveAll(p.pluginDir())
-	if err != nil {
-		log.Error(err)
-	}
-}
+			group = append(group, obj)
+		}
 
-// applyPlugin takes the manifests under the plugins id and runs them through
-// kubectl apply
-func (c *PluginController) applyPlugin(plugin *csv3.Plugin) error {
-	pluginDetails, err := c.getPlugin(plugin)
-	if err != nil {
-		return errors.Wrap(err, "get request to Containership api failed")
-	}
+		overrideErrs = append(overrideErrs, applyOverrides(group, overrides)...)
+
+		for _, obj := range group {
+			labels := obj.GetLabels()
+			if labels == nil {
+				labels = make(map[string]string)
+			}
+			labels[pluginLabelKey] = spec.ID
+			labels[pluginRevisionLabelKey] = revision
+			obj.SetLabels(labels)
+		}
 
-	fileManager := pluginFileManager{
-		plugin.Spec.ID,
+		groups = append(groups, group)
 	}
-	fileManager.cleanUpPluginManifests()
-	fileManager.initializePluginDirectories()
 
-	if pluginDetails.Manifests != nil {
-		_, err := formatPlugin(plugin.Spec, pluginDetails, fileManager)
+	return groups, overrideErrs, nil
+}
 
+// applyPlugin applies the plugin manifests from cloud between the pre and post
+// apply jobs. Once every manifest is applied, objects left over from other
+// versions of the plugin are pruned.
+func (c *PluginController) applyPlugin(plugin *csv3.Plugin, pluginDetails *jsonPluginsResponse) ([]apply.Result, error) {
+	if pluginDetails.Chart != nil {
+		var err error
+		pluginDetails, err = renderChart(plugin, pluginDetails)
 		if err != nil {
-			return errors.Wrap(err, "formatting manifests for plugin failed")
+			return nil, errors.Wrap(err, "rendering chart for plugin failed")
 		}
 	}
 
-	// apply jobs for applying before manifests
-	err = c.runJob(pluginDetails.Jobs.PreApply, plugin)
+	revision, err := manifestRevision(pluginDetails.Manifests)
 	if err != nil {
-		return errors.Wrap(err, "running pre apply jobs failed")
+		return nil, errors.Wrap(err, "computing manifest revision failed")
 	}
 
-	err = c.applyManifests(fileManager, plugin)
+	overrides, err := c.pluginOverrides(plugin)
 	if err != nil {
-		return errors.Wrap(err, "applying manifests failed")
+		return nil, errors.Wrap(err, "listing plugin overrides failed")
 	}
 
-	// apply jobs for clean up after manifests
-	err = c.runJob(pluginDetails.Jobs.PostApply, plugin)
+	groups, overrideErrs, err := formatPlugin(plugin.Spec, revision, pluginDetails, overrides)
 	if err != nil {
-		return errors.Wrap(err, "running post apply jobs failed")
+		return nil, errors.Wrap(err, "formatting manifests for plugin failed")
 	}
 
-	return nil
-}
+	for _, overrideErr := range overrideErrs {
+		c.recorder.Event(plugin, corev1.EventTypeWarning, "InvalidOverride", overrideErr.Error())
+	}
 
-func (c *PluginController) applyManifests(fileManager pluginFileManager, plugin *csv3.Plugin) error {
-	manifests := fileManager.pluginManifestsDir()
-	if empty, err := fsutil.IsEmpty(manifests); err != nil {
-		return errors.Wrap(err, "checking plugin directory for is empty failed")
-	} else if empty {
-		return nil
+	// apply jobs for applying before manifests
+	err = c.runJob(pluginDetails.Jobs.PreApply, plugin)
+	if err != nil {
+		return nil, errors.Wrap(err, "running pre apply jobs failed")
 	}
 
-	kc := kubectl.NewApplyCmd(manifests)
+	scopes, err := c.pluginScopes(plugin.Name)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting plugin scopes failed")
+	}
 
-	err := kc.Run()
+	results, err := c.applyManifests(groups, plugin)
 
-	c.recorder.Event(plugin, corev1.EventTypeNormal, "Apply", string(kc.Output))
+	// Objects may have been applied even if applying failed, so where they
+	// were applied is recorded either way. Plugins whose scopes were never
+	// recorded may have objects anywhere, so nothing is recorded for them
+	// until they are pruned.
+	applied := c.applier.ScopesOf(flattenGroups(groups))
+	if scopes != nil {
+		scopes = apply.MergeScopes(scopes, applied)
+		c.logSavePluginScopes(plugin, scopes)
+	}
 
 	if err != nil {
-		errMsg := fmt.Sprintf("Error creating plugin: %s", err)
-		if e := string(kc.Error); e != "" {
-			errMsg = fmt.Sprintf("%s, kubectl stderr: %s", errMsg, e)
-		}
-
-		c.recorder.Event(plugin, corev1.EventTypeWarning, "ApplyError", errMsg)
-		return fmt.Errorf("Error creating plugin: %s", errMsg)
+		// The objects are a mix of versions now, so there's nothing
+		// to compare them with until the plugin is applied again
+		c.forgetAppliedObjects(plugin.Name)
+		return results, errors.Wrap(err, "applying manifests failed")
 	}
 
-	return nil
-}
+	c.setAppliedObjects(plugin.Name, groups)
 
-func (c *PluginController) runJob(jobs []*batchv1.Job, plugin *csv3.Plugin) error {
-	if len(jobs) <= 0 {
-		return nil
+	err = c.pruneManifests(plugin, revision, scopes)
+	if err != nil {
+		return results, errors.Wrap(err, "pruning manifests failed")
 	}
 
-	var jobErr error
-	for _, job := range jobs {
-		if job.Spec.ActiveDeadlineSeconds == nil {
-			return fmt.Errorf("ActiveDeadlineSeconds needs to be specified for any plugin job")
-		}
-
-		if job.Spec.BackoffLimit == nil {
-			limit := int32(1)
-			job.Spec.BackoffLimit = &limit
-		}
+	// Only the objects that were just applied are left
+	c.logSavePluginScopes(plugin, applied)
 
-		_, err := c.kubeclientset.BatchV1().Jobs(constants.ContainershipNamespace).Create(job)
-		if err != nil {
-			return errors.Wrap(err, "creating job failed")
-		}
+	// apply jobs for clean up after manifests
+	err = c.runJob(pluginDetails.Jobs.PostApply, plugin)
+	if err != nil {
+		return results, errors.Wrap(err, "running post apply jobs failed")
+	}
 
-		w, err := c.kubeclientset.BatchV1().Jobs(constants.ContainershipNamespace).Watch(metav1.ListOptions{
-			FieldSelector: fields.OneTermEqualSelector("metadata.name", job.Name).String(),
-		})
-		if err != nil {
-			return errors.Wrap(err, "getting watcher for job failed")
-		}
+	return results, nil
+}
 
-		ch := w.ResultChan()
-		for event := range ch {
-			j, ok := event.Object.(*batchv1.Job)
-			if !ok {
+// applyManifests applies the manifest groups in order, recording the result
+// for each object as an event. Later groups may depend on objects in earlier
+// ones (e.g. CRDs and their custom resources), so a group is only applied
+// once every object in the groups before it was applied. The results of all
+// groups that were applied are returned.
+func (c *PluginController) applyManifests(groups [][]*unstructured.Unstructured, plugin *csv3.Plugin) ([]apply.Result, error) {
+	allResults := make([]apply.Result, 0)
+	for index, group := range groups {
+		results, err := c.applier.ApplyAll(group)
+		allResults = append(allResults, results...)
+
+		for _, r := range results {
+			if r.Err != nil {
+				c.recorder.Event(plugin, corev1.EventTypeWarning, "ApplyError", r.String())
 				continue
 			}
 
-			switch event.Type {
-			case watch.Modified:
-				if len(j.Status.Conditions) > 0 {
-					failed, reason, _ := jobDidFail(j)
-					// If a job is not able to finish from exceeding BackoffLimit or ActiveDeadlineSeconds
-					// it will change its status to failed
-					if failed {
-						jobErr = fmt.Errorf("Job finished with failed status %s", reason)
-					}
-
-					w.Stop()
-				}
-			case watch.Deleted:
-				// if job is deleted we should stop watching
-				w.Stop()
-			default:
-				log.Debugf("Plugin job '%s' received event of type %q", job.Name, event.Type)
-			}
+			c.recorder.Event(plugin, corev1.EventTypeNormal, "Apply", r.String())
 		}
 
-		// deleting is best effort, if it fails that's fine, also
-		// the process shouldn't be blocking
-		propagationPolicy := metav1.DeletePropagationForeground
-		go c.kubeclientset.BatchV1().Jobs(constants.ContainershipNamespace).Delete(job.Name, &metav1.DeleteOptions{
-			PropagationPolicy: &propagationPolicy,
-		})
+		if err != nil {
+			return allResults, errors.Wrapf(err, "applying manifest group %d failed", index)
+		}
 	}
 
-	return jobErr
+	return allResults, nil
+}
+
+// logSavePluginScopes records the scopes of the plugin. Failing to record
+// them doesn't fail applying the plugin, since that would run its jobs again.
+func (c *PluginController) logSavePluginScopes(plugin *csv3.Plugin, scopes []apply.Scope) {
+	if err := c.savePluginScopes(plugin.Name, scopes); err != nil {
+		log.Errorf("%s: recording scopes of plugin %s failed: %s", pluginControllerName, plugin.Name, err)
+	}
 }
 
-func jobDidFail(job *batchv1.Job) (bool, string, error) {
-	if len(job.Status.Conditions) == 0 {
-		return false, "", fmt.Errorf("Job must have at least one status condition to check to determine failure")
+// flattenGroups returns the objects of all manifest groups
+func flattenGroups(groups [][]*unstructured.Unstructured) []*unstructured.Unstructured {
+	objs := make([]*unstructured.Unstructured, 0)
+	for _, group := range groups {
+		objs = append(objs, group...)
 	}
 
-	for _, condition := range job.Status.Conditions {
-		if condition.Type == batchv1.JobFailed {
-			return true, condition.Reason, nil
+	return objs
+}
+
+// pruneManifests deletes every object belonging to the plugin in the given
+// scopes that was not applied from the given revision of its manifests,
+// recording the result for each object as an event. Objects applied before
+// revisions were introduced have no revision label and are pruned as well.
+// If scopes is nil every scope is searched.
+func (c *PluginController) pruneManifests(plugin *csv3.Plugin, revision string, scopes []apply.Scope) error {
+	selector := fmt.Sprintf("%s=%s,%s!=%s",
+		pluginLabelKey, plugin.Spec.ID, pluginRevisionLabelKey, revision)
+
+	results, err := c.applier.DeleteByLabel(selector, scopes)
+	for _, r := range results {
+		if r.Err != nil {
+			c.recorder.Event(plugin, corev1.EventTypeWarning, "PruneError", r.String())
+			continue
 		}
+
+		c.recorder.Event(plugin, corev1.EventTypeNormal, "Prune", r.String())
 	}
 
-	return false, "", nil
+	return err
 }
 
 // enqueuePlugin enqueues the plugin on add or delete
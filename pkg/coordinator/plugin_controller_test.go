@@ -1,13 +1,30 @@
 package coordinator
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
 	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	csfake "github.com/containership/cluster-manager/pkg/client/clientset/versioned/fake"
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/k8sutil/apply"
 
+	batchv1 "k8s.io/api/batch/v1"
+	kubeerror "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/helm/pkg/chartutil"
 )
 
 type previousVersionTest struct {
@@ -55,3 +72,515 @@ func TestGetPreviousVersion(t *testing.T) {
 		assert.Equal(t, test.expected, result)
 	}
 }
+
+var testPluginDetails = &jsonPluginsResponse{
+	Manifests: [][]interface{}{
+		{
+			map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata": map[string]interface{}{
+					"name":      "first",
+					"namespace": "containership-core",
+				},
+			},
+		},
+		{
+			map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "List",
+				"items": []interface{}{
+					map[string]interface{}{
+						"apiVersion": "v1",
+						"kind":       "ConfigMap",
+						"metadata": map[string]interface{}{
+							"name":      "second",
+							"namespace": "containership-core",
+							"labels": map[string]interface{}{
+								"app": "test",
+							},
+						},
+					},
+					map[string]interface{}{
+						"apiVersion": "v1",
+						"kind":       "ConfigMap",
+						"metadata": map[string]interface{}{
+							"name":      "third",
+							"namespace": "containership-core",
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+func newTestPluginController(objects ...runtime.Object) *PluginController {
+	discovery := &fakediscovery.FakeDiscovery{
+		Fake: &k8stesting.Fake{
+			Resources: []*metav1.APIResourceList{{
+				GroupVersion: "v1",
+				APIResources: []metav1.APIResource{
+					{Name: "configmaps", Namespaced: true, Kind: "ConfigMap", Verbs: []string{"get", "list", "create", "update", "delete"}},
+				},
+			}},
+		},
+	}
+
+	client := fakedynamic.NewSimpleDynamicClient(runtime.NewScheme(), objects...)
+	kubeclient := fake.NewSimpleClientset()
+
+	c := &PluginController{
+		kubeclientset: kubeclient,
+		applier:       apply.NewApplier(client, discovery),
+		recorder:      record.NewFakeRecorder(10),
+	}
+	c.watchOverrides(kubeinformers.NewSharedInformerFactory(kubeclient, 0))
+
+	return c
+}
+
+func TestFormatPlugin(t *testing.T) {
+	groups, overrideErrs, err := formatPlugin(csv3.PluginSpec{ID: "1234"}, "1", testPluginDetails, nil)
+	assert.Empty(t, overrideErrs)
+	assert.Nil(t, err)
+	assert.Len(t, groups, 2)
+	assert.Len(t, groups[0], 1)
+	// The list is expanded into its items
+	assert.Len(t, groups[1], 2)
+
+	for _, group := range groups {
+		for _, obj := range group {
+			assert.Equal(t, "1234", obj.GetLabels()[pluginLabelKey])
+			assert.Equal(t, "1", obj.GetLabels()[pluginRevisionLabelKey])
+		}
+	}
+
+	// Existing labels are kept
+	assert.Equal(t, "test", groups[1][0].GetLabels()["app"])
+}
+
+func TestManifestRevision(t *testing.T) {
+	revision, err := manifestRevision(testPluginDetails.Manifests)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, revision)
+
+	same, _ := manifestRevision(testPluginDetails.Manifests)
+	assert.Equal(t, revision, same)
+
+	different, _ := manifestRevision(testPluginDetails.Manifests[:1])
+	assert.NotEqual(t, revision, different)
+}
+
+// testChartArchive packages the chart fixture of the chart package
+func testChartArchive(t *testing.T) []byte {
+	c, err := chartutil.LoadDir("../chart/testdata/testchart")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "chart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename, err := chartutil.Save(c, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return archive
+}
+
+func TestRenderChart(t *testing.T) {
+	plugin := &csv3.Plugin{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				"containership.io/plugin-history": `[{"id":"1234","version":"1.0.0"}]`,
+			},
+		},
+		Spec: csv3.PluginSpec{
+			ID:             "1234",
+			Implementation: "test",
+			Version:        "1.0.0",
+		},
+	}
+	preApply := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "cloud-pre"}}
+
+	details, err := renderChart(plugin, &jsonPluginsResponse{
+		Manifests: testPluginDetails.Manifests[:1],
+		Chart: &jsonChart{
+			Archive: testChartArchive(t),
+		},
+		Jobs: jobs{PreApply: []*batchv1.Job{preApply}},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, details.Chart)
+
+	// The chart manifests come before the manifests from Cloud
+	assert.Len(t, details.Manifests, 3)
+	assert.Equal(t, testPluginDetails.Manifests[0], details.Manifests[2])
+
+	deployment := details.Manifests[1][1].(map[string]interface{})
+	metadata := deployment["metadata"].(map[string]interface{})
+	assert.Equal(t, "test-testchart", metadata["name"])
+	assert.Equal(t, metav1.NamespaceDefault, metadata["namespace"])
+	assert.Equal(t, "2", metadata["labels"].(map[string]interface{})["revision"])
+
+	// Nothing was applied yet, so only install hooks run
+	assert.Equal(t, []*batchv1.Job{preApply}, details.Jobs.PreApply)
+	assert.Len(t, details.Jobs.PostApply, 1)
+
+	plugin.Status.Version = "1.0.0"
+	details, err = renderChart(plugin, &jsonPluginsResponse{
+		Chart: &jsonChart{
+			Archive:   testChartArchive(t),
+			Namespace: "containership-core",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, details.Jobs.PreApply, 1)
+	assert.Equal(t, "test-testchart-migrate", details.Jobs.PreApply[0].Name)
+
+	_, err = renderChart(plugin, &jsonPluginsResponse{
+		Chart: &jsonChart{Archive: []byte("invalid")},
+	})
+	assert.NotNil(t, err)
+}
+
+// drainEvents returns the events recorded so far
+func drainEvents(recorder *record.FakeRecorder) []string {
+	events := make([]string, 0)
+	for {
+		select {
+		case e := <-recorder.Events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestApplyManifests(t *testing.T) {
+	c := newTestPluginController()
+	recorder := c.recorder.(*record.FakeRecorder)
+	plugin := &csv3.Plugin{ObjectMeta: metav1.ObjectMeta{Name: "1234"}}
+
+	groups, _, _ := formatPlugin(csv3.PluginSpec{ID: "1234"}, "1", testPluginDetails, nil)
+	_, err := c.applyManifests(groups, plugin)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"Normal Apply ConfigMap containership-core/first created",
+		"Normal Apply ConfigMap containership-core/second created",
+		"Normal Apply ConfigMap containership-core/third created",
+	}, drainEvents(recorder))
+
+	// Applying again changes nothing
+	_, err = c.applyManifests(groups, plugin)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"Normal Apply ConfigMap containership-core/first unchanged",
+		"Normal Apply ConfigMap containership-core/second unchanged",
+		"Normal Apply ConfigMap containership-core/third unchanged",
+	}, drainEvents(recorder))
+
+	err = c.deletePlugin("1234")
+	assert.Nil(t, err)
+
+	// Everything is gone, so applying creates it all again
+	_, err = c.applyManifests(groups, plugin)
+	assert.Nil(t, err)
+	assert.Contains(t, drainEvents(recorder), "Normal Apply ConfigMap containership-core/first created")
+}
+
+func TestApplyManifestsStopsOnFailedGroup(t *testing.T) {
+	c := newTestPluginController()
+	recorder := c.recorder.(*record.FakeRecorder)
+	plugin := &csv3.Plugin{ObjectMeta: metav1.ObjectMeta{Name: "1234"}}
+
+	groups := [][]*unstructured.Unstructured{
+		{{
+			Object: map[string]interface{}{
+				"apiVersion": "example.com/v1",
+				"kind":       "Unknown",
+				"metadata": map[string]interface{}{
+					"name": "unknown",
+				},
+			},
+		}},
+		{{
+			Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata": map[string]interface{}{
+					"name": "never-applied",
+				},
+			},
+		}},
+	}
+
+	_, err := c.applyManifests(groups, plugin)
+	assert.NotNil(t, err)
+
+	events := drainEvents(recorder)
+	assert.Len(t, events, 1)
+	assert.Contains(t, events[0], "Warning ApplyError Unknown unknown failed")
+}
+
+func TestPruneManifests(t *testing.T) {
+	// Not in any scope the plugin applied objects to
+	elsewhere := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata": map[string]interface{}{
+				"name":      "elsewhere",
+				"namespace": "other",
+				"labels": map[string]interface{}{
+					pluginLabelKey: "1234",
+				},
+			},
+		},
+	}
+
+	c := newTestPluginController(elsewhere)
+	recorder := c.recorder.(*record.FakeRecorder)
+	plugin := &csv3.Plugin{
+		ObjectMeta: metav1.ObjectMeta{Name: "1234"},
+		Spec:       csv3.PluginSpec{ID: "1234"},
+	}
+
+	groups, _, _ := formatPlugin(plugin.Spec, "1", testPluginDetails, nil)
+	_, err := c.applyManifests(groups, plugin)
+	assert.Nil(t, err)
+
+	scopes := c.applier.ScopesOf(flattenGroups(groups))
+	err = c.pruneManifests(plugin, "1", scopes)
+	assert.Nil(t, err)
+
+	drainEvents(recorder)
+
+	// The new revision only has the first group
+	upgraded := &jsonPluginsResponse{Manifests: testPluginDetails.Manifests[:1]}
+	groups, _, _ = formatPlugin(plugin.Spec, "2", upgraded, nil)
+	_, err = c.applyManifests(groups, plugin)
+	assert.Nil(t, err)
+
+	err = c.pruneManifests(plugin, "2", scopes)
+	assert.Nil(t, err)
+
+	events := drainEvents(recorder)
+	assert.Contains(t, events, "Normal Apply ConfigMap containership-core/first configured")
+	assert.Contains(t, events, "Normal Prune ConfigMap containership-core/second deleted")
+	assert.Contains(t, events, "Normal Prune ConfigMap containership-core/third deleted")
+	assert.NotContains(t, events, "Normal Prune ConfigMap containership-core/first deleted")
+	assert.NotContains(t, events, "Normal Prune ConfigMap other/elsewhere deleted")
+
+	// Without scopes every namespace is searched
+	err = c.pruneManifests(plugin, "2", nil)
+	assert.Nil(t, err)
+	assert.Contains(t, drainEvents(recorder), "Normal Prune ConfigMap other/elsewhere deleted")
+}
+
+const testPluginHistory = `[{"id":"1234","version":"1.0.0"},{"id":"1234","version":"1.1.0"}]`
+
+func TestRollbackVersion(t *testing.T) {
+	tests := []struct {
+		status   csv3.PluginStatus
+		history  string
+		expected string
+	}{{
+		// Nothing to roll back to
+		expected: "",
+	}, {
+		// Falls back to history if the applied version isn't known
+		history:  testPluginHistory,
+		expected: "1.1.0",
+	}, {
+		status:   csv3.PluginStatus{Version: "1.0.0"},
+		history:  testPluginHistory,
+		expected: "1.0.0",
+	}, {
+		// The version that failed was already applied before
+		status:   csv3.PluginStatus{Version: "2.0.0"},
+		history:  testPluginHistory,
+		expected: "",
+	}}
+
+	for _, test := range tests {
+		plugin := &csv3.Plugin{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					constants.PluginHistoryAnnotation: test.history,
+				},
+			},
+			Spec:   csv3.PluginSpec{ID: "1234", Version: "2.0.0"},
+			Status: test.status,
+		}
+
+		assert.Equal(t, test.expected, rollbackVersion(plugin))
+	}
+}
+
+func TestInPluginHistory(t *testing.T) {
+	plugin := &csv3.Plugin{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				constants.PluginHistoryAnnotation: testPluginHistory,
+			},
+		},
+	}
+
+	assert.True(t, inPluginHistory(plugin, "1.0.0"))
+	assert.False(t, inPluginHistory(plugin, "3.0.0"))
+	assert.False(t, inPluginHistory(plugin, ""))
+	assert.False(t, inPluginHistory(&csv3.Plugin{}, "1.0.0"))
+}
+
+func TestNeedsApply(t *testing.T) {
+	old := &csv3.Plugin{Spec: csv3.PluginSpec{Version: "1.0.0"}}
+
+	statusChanged := old.DeepCopy()
+	statusChanged.Status.Phase = csv3.PluginPhaseApplied
+	assert.False(t, needsApply(old, statusChanged))
+
+	specChanged := statusChanged.DeepCopy()
+	specChanged.Spec.Version = "1.1.0"
+	assert.True(t, needsApply(old, specChanged))
+
+	rollbackRequested := statusChanged.DeepCopy()
+	rollbackRequested.Annotations = map[string]string{
+		constants.PluginRollbackAnnotation: "",
+	}
+	assert.True(t, needsApply(old, rollbackRequested))
+
+	// Removing the request once it's handled doesn't need anything applied
+	assert.False(t, needsApply(rollbackRequested, statusChanged))
+
+	otherRollbackRequested := rollbackRequested.DeepCopy()
+	otherRollbackRequested.Annotations[constants.PluginRollbackAnnotation] = "1.0.0"
+	assert.True(t, needsApply(rollbackRequested, otherRollbackRequested))
+}
+
+func TestRequestedRollbackOfUnknownVersion(t *testing.T) {
+	plugin := &csv3.Plugin{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "1234",
+			Namespace: constants.ContainershipNamespace,
+			Annotations: map[string]string{
+				constants.PluginHistoryAnnotation:  testPluginHistory,
+				constants.PluginRollbackAnnotation: "0.1.0",
+			},
+		},
+		Spec: csv3.PluginSpec{ID: "1234", Version: "2.0.0"},
+	}
+
+	c := newTestPluginController()
+	c.clientset = csfake.NewSimpleClientset(plugin)
+	recorder := c.recorder.(*record.FakeRecorder)
+
+	err := c.requestedRollback(plugin, "0.1.0")
+	assert.Nil(t, err)
+
+	events := drainEvents(recorder)
+	assert.Len(t, events, 1)
+	assert.Contains(t, events[0], "RollbackError")
+
+	// The request is removed so it isn't handled again
+	updated, err := c.clientset.ContainershipV3().Plugins(constants.ContainershipNamespace).Get("1234", metav1.GetOptions{})
+	assert.Nil(t, err)
+	_, ok := updated.Annotations[constants.PluginRollbackAnnotation]
+	assert.False(t, ok)
+	assert.Equal(t, testPluginHistory, updated.Annotations[constants.PluginHistoryAnnotation])
+}
+
+func TestUpdateStatus(t *testing.T) {
+	plugin := &csv3.Plugin{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "1234",
+			Namespace: constants.ContainershipNamespace,
+		},
+		Spec: csv3.PluginSpec{ID: "1234", Version: "2.0.0"},
+	}
+
+	client := csfake.NewSimpleClientset(plugin)
+	c := &PluginController{clientset: client}
+
+	status := csv3.PluginStatus{
+		Phase:          csv3.PluginPhaseRolledBack,
+		Version:        "1.0.0",
+		RolledBackFrom: "2.0.0",
+		Message:        "error",
+		LastApplyTime:  "2018-10-01T12:00:00Z",
+	}
+
+	err := c.updateStatus(plugin, func(s *csv3.PluginStatus) { *s = status })
+	assert.Nil(t, err)
+
+	updated, err := client.ContainershipV3().Plugins(constants.ContainershipNamespace).Get("1234", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, status, updated.Status)
+
+	// Nothing is written if the status didn't change
+	client.ClearActions()
+	err = c.updateStatus(updated, func(s *csv3.PluginStatus) {})
+	assert.Nil(t, err)
+	assert.Len(t, client.Actions(), 0)
+
+	// Applying again without changing anything still records when the
+	// plugin was last applied
+	err = c.updateStatus(updated, func(s *csv3.PluginStatus) {
+		s.LastApplyTime = "2018-10-01T12:05:00Z"
+	})
+	assert.Nil(t, err)
+
+	updated, err = client.ContainershipV3().Plugins(constants.ContainershipNamespace).Get("1234", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "2018-10-01T12:05:00Z", updated.Status.LastApplyTime)
+}
+
+func TestUpdateStatusConflict(t *testing.T) {
+	plugin := &csv3.Plugin{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "1234",
+			Namespace: constants.ContainershipNamespace,
+		},
+		Spec: csv3.PluginSpec{ID: "1234", Version: "2.0.0"},
+	}
+
+	client := csfake.NewSimpleClientset(plugin)
+	c := &PluginController{clientset: client}
+
+	// Another worker wrote the workloads after the plugin was listed
+	latest := plugin.DeepCopy()
+	latest.Status.Workloads = csv3.PluginWorkloadStatus{Ready: 1, Total: 1}
+	_, err := client.ContainershipV3().Plugins(constants.ContainershipNamespace).UpdateStatus(latest)
+	assert.Nil(t, err)
+
+	conflicted := false
+	client.PrependReactor("update", "plugins", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "status" || conflicted {
+			return false, nil, nil
+		}
+
+		conflicted = true
+		return true, nil, kubeerror.NewConflict(schema.GroupResource{Resource: "plugins"}, "1234", nil)
+	})
+
+	err = c.updateStatus(plugin, func(s *csv3.PluginStatus) {
+		s.Phase = csv3.PluginPhaseApplied
+	})
+	assert.Nil(t, err, "conflicts are retried")
+	assert.True(t, conflicted)
+
+	updated, err := client.ContainershipV3().Plugins(constants.ContainershipNamespace).Get("1234", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, csv3.PluginPhaseApplied, updated.Status.Phase)
+	assert.Equal(t, 1, updated.Status.Workloads.Ready, "the latest status is changed")
+}
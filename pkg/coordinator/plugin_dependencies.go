@@ -0,0 +1,232 @@
+package coordinator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/log"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// pluginDependencyRecheckInterval is how long a plugin waits in the queue
+// before its dependencies, or its dependents when deleting, are checked again
+const pluginDependencyRecheckInterval = 10 * time.Second
+
+// deletedPlugins keeps the last known spec of plugins that were deleted but
+// whose objects haven't been deleted yet, so that plugins can be torn down in
+// reverse dependency order
+type deletedPlugins struct {
+	sync.Mutex
+	plugins map[string]*csv3.Plugin
+}
+
+// waitingPlugins keeps the dependencies each plugin was last reported to be
+// waiting for, so that it's only reported again when they change
+type waitingPlugins struct {
+	sync.Mutex
+	unmet map[string]string
+}
+
+// setWaiting records the unmet dependencies of the plugin. It returns true if
+// they changed since the plugin was last checked.
+func (c *PluginController) setWaiting(name string, unmet []string) bool {
+	c.waiting.Lock()
+	defer c.waiting.Unlock()
+
+	if len(unmet) == 0 {
+		delete(c.waiting.unmet, name)
+		return false
+	}
+
+	if c.waiting.unmet == nil {
+		c.waiting.unmet = make(map[string]string)
+	}
+
+	s := strings.Join(unmet, ", ")
+	if previous, ok := c.waiting.unmet[name]; ok && previous == s {
+		return false
+	}
+
+	c.waiting.unmet[name] = s
+	return true
+}
+
+// satisfies returns true if the plugin is the dependency, which is either a
+// plugin type or ID
+func satisfies(plugin *csv3.Plugin, dependency string) bool {
+	return dependency == plugin.Spec.ID || dependency == string(plugin.Spec.Type)
+}
+
+// dependsOn returns true if the plugin directly depends on the other plugin
+func dependsOn(plugin, other *csv3.Plugin) bool {
+	if plugin.Spec.ID == other.Spec.ID {
+		return false
+	}
+
+	for _, dependency := range plugin.Spec.DependsOn {
+		if satisfies(other, dependency) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dependsOnTransitively returns true if the plugin depends on the other plugin
+// through any chain of the given plugins
+func dependsOnTransitively(plugin, other *csv3.Plugin, plugins []*csv3.Plugin) bool {
+	visited := make(map[string]bool)
+
+	var visit func(p *csv3.Plugin) bool
+	visit = func(p *csv3.Plugin) bool {
+		if visited[p.Spec.ID] {
+			return false
+		}
+		visited[p.Spec.ID] = true
+
+		if dependsOn(p, other) {
+			return true
+		}
+
+		for _, next := range plugins {
+			if dependsOn(p, next) && visit(next) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return visit(plugin)
+}
+
+// pluginReady returns true if the plugin has been applied and it has
+// workloads that are all ready. Readiness is read from the workloads rather
+// than the status, which is only refreshed periodically. A plugin that was
+// rolled back is still running, so it counts as ready as well.
+func (c *PluginController) pluginReady(plugin *csv3.Plugin) (bool, error) {
+	switch plugin.Status.Phase {
+	case csv3.PluginPhaseApplied, csv3.PluginPhaseRolledBack:
+	default:
+		return false, nil
+	}
+
+	status, err := c.workloadStatus(plugin.Spec.ID)
+	if err != nil {
+		return false, err
+	}
+
+	return status.Total > 0 && status.Ready == status.Total, nil
+}
+
+// unmetDependencies returns a description of each dependency of the plugin
+// that isn't ready yet. Dependencies that depend on the plugin in turn are
+// ignored, since waiting for them would never finish.
+func (c *PluginController) unmetDependencies(plugin *csv3.Plugin) ([]string, error) {
+	if len(plugin.Spec.DependsOn) == 0 {
+		return nil, nil
+	}
+
+	plugins, err := c.pluginLister.Plugins(constants.ContainershipNamespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	unmet := make([]string, 0)
+	for _, dependency := range plugin.Spec.DependsOn {
+		found := false
+		for _, other := range plugins {
+			if other.Spec.ID == plugin.Spec.ID || !satisfies(other, dependency) {
+				continue
+			}
+			found = true
+
+			if dependsOnTransitively(other, plugin, plugins) {
+				log.Infof("%s: ignoring dependency of plugin %s on %s since they depend on each other",
+					pluginControllerName, plugin.Name, other.Name)
+				continue
+			}
+
+			ready, err := c.pluginReady(other)
+			if err != nil {
+				return nil, err
+			}
+
+			if !ready {
+				unmet = append(unmet, fmt.Sprintf("%s (%s)", other.Name, other.Spec.Type))
+			}
+		}
+
+		if !found {
+			unmet = append(unmet, fmt.Sprintf("%s (not found)", dependency))
+		}
+	}
+
+	return unmet, nil
+}
+
+// trackDeletedPlugin remembers a deleted plugin until its objects are deleted
+func (c *PluginController) trackDeletedPlugin(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	plugin, ok := obj.(*csv3.Plugin)
+	if !ok {
+		return
+	}
+
+	c.deleted.Lock()
+	defer c.deleted.Unlock()
+
+	if c.deleted.plugins == nil {
+		c.deleted.plugins = make(map[string]*csv3.Plugin)
+	}
+
+	c.deleted.plugins[plugin.Name] = plugin
+}
+
+// forgetDeletedPlugin stops tracking a deleted plugin
+func (c *PluginController) forgetDeletedPlugin(name string) {
+	c.deleted.Lock()
+	defer c.deleted.Unlock()
+
+	delete(c.deleted.plugins, name)
+}
+
+// deletedDependents returns the names of the other deleted plugins whose
+// objects still exist and that depend on the deleted plugin with the given
+// name. Those must be torn down first.
+func (c *PluginController) deletedDependents(name string) []string {
+	c.deleted.Lock()
+	defer c.deleted.Unlock()
+
+	plugin, ok := c.deleted.plugins[name]
+	if !ok {
+		return nil
+	}
+
+	plugins := make([]*csv3.Plugin, 0, len(c.deleted.plugins))
+	for _, p := range c.deleted.plugins {
+		plugins = append(plugins, p)
+	}
+
+	dependents := make([]string, 0)
+	for _, other := range plugins {
+		if dependsOn(other, plugin) && !dependsOnTransitively(plugin, other, plugins) {
+			dependents = append(dependents, other.Name)
+		}
+	}
+
+	sort.Strings(dependents)
+
+	return dependents
+}
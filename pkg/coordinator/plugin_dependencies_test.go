@@ -0,0 +1,204 @@
+package coordinator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	csfake "github.com/containership/cluster-manager/pkg/client/clientset/versioned/fake"
+	csinformers "github.com/containership/cluster-manager/pkg/client/informers/externalversions"
+	"github.com/containership/cluster-manager/pkg/constants"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newDependencyTestPlugin(id string, pluginType csv3.PluginType, phase csv3.PluginPhase, dependsOn ...string) *csv3.Plugin {
+	return &csv3.Plugin{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      id,
+			Namespace: constants.ContainershipNamespace,
+		},
+		Spec: csv3.PluginSpec{
+			ID:        id,
+			Type:      pluginType,
+			DependsOn: dependsOn,
+		},
+		Status: csv3.PluginStatus{
+			Phase: phase,
+		},
+	}
+}
+
+func newDependencyTestController(deployments []*appsv1.Deployment, plugins ...*csv3.Plugin) *PluginController {
+	factory := csinformers.NewSharedInformerFactory(csfake.NewSimpleClientset(), 0)
+	informer := factory.Containership().V3().Plugins()
+	for _, p := range plugins {
+		informer.Informer().GetIndexer().Add(p)
+	}
+
+	c := &PluginController{
+		pluginLister: informer.Lister(),
+	}
+
+	kubeFactory := kubeinformers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	c.watchWorkloads(kubeFactory)
+	for _, d := range deployments {
+		kubeFactory.Apps().V1().Deployments().Informer().GetIndexer().Add(d)
+	}
+
+	return c
+}
+
+// newDependencyTestDeployment returns a deployment of the plugin
+func newDependencyTestDeployment(name, pluginID string, ready bool) *appsv1.Deployment {
+	d := &appsv1.Deployment{
+		ObjectMeta: workloadMeta(name, pluginID),
+		Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(1)},
+	}
+	if ready {
+		d.Status = appsv1.DeploymentStatus{
+			ObservedGeneration: 2,
+			UpdatedReplicas:    1,
+			AvailableReplicas:  1,
+		}
+	}
+
+	return d
+}
+
+func TestDependsOn(t *testing.T) {
+	cni := newDependencyTestPlugin("cni-id", csv3.CNI, "")
+
+	assert.True(t, dependsOn(newDependencyTestPlugin("csi-id", csv3.CSI, "", "cni"), cni))
+	assert.True(t, dependsOn(newDependencyTestPlugin("csi-id", csv3.CSI, "", "cni-id"), cni))
+	assert.False(t, dependsOn(newDependencyTestPlugin("csi-id", csv3.CSI, "", "logs"), cni))
+	assert.False(t, dependsOn(newDependencyTestPlugin("csi-id", csv3.CSI, ""), cni))
+
+	// A plugin never depends on itself, even if it has the type it depends on
+	assert.False(t, dependsOn(newDependencyTestPlugin("cni-id", csv3.CNI, "", "cni"), cni))
+}
+
+func TestDependsOnTransitively(t *testing.T) {
+	a := newDependencyTestPlugin("a", csv3.CNI, "")
+	b := newDependencyTestPlugin("b", csv3.CSI, "", "a")
+	c := newDependencyTestPlugin("c", csv3.Logs, "", "b")
+	plugins := []*csv3.Plugin{a, b, c}
+
+	assert.True(t, dependsOnTransitively(c, a, plugins))
+	assert.False(t, dependsOnTransitively(a, c, plugins))
+
+	// Cycles terminate
+	a.Spec.DependsOn = []string{"c"}
+	assert.True(t, dependsOnTransitively(a, c, plugins))
+	assert.True(t, dependsOnTransitively(c, a, plugins))
+}
+
+func TestPluginReady(t *testing.T) {
+	plugin := newDependencyTestPlugin("a", csv3.CNI, csv3.PluginPhaseApplied)
+
+	ready, err := newDependencyTestController(nil).pluginReady(plugin)
+	assert.Nil(t, err)
+	assert.False(t, ready, "plugins without workloads aren't known to be ready")
+
+	c := newDependencyTestController([]*appsv1.Deployment{
+		newDependencyTestDeployment("ready", "a", true),
+		newDependencyTestDeployment("not-ready", "a", false),
+	})
+	ready, err = c.pluginReady(plugin)
+	assert.Nil(t, err)
+	assert.False(t, ready)
+
+	// The status isn't used since it may be outdated
+	plugin.Status.Workloads = csv3.PluginWorkloadStatus{Total: 1, Ready: 1}
+	c = newDependencyTestController([]*appsv1.Deployment{
+		newDependencyTestDeployment("ready", "a", true),
+	})
+	ready, err = c.pluginReady(plugin)
+	assert.Nil(t, err)
+	assert.True(t, ready)
+
+	plugin.Status.Phase = csv3.PluginPhaseRolledBack
+	ready, _ = c.pluginReady(plugin)
+	assert.True(t, ready)
+
+	plugin.Status.Phase = csv3.PluginPhaseFailed
+	ready, _ = c.pluginReady(plugin)
+	assert.False(t, ready)
+
+	ready, _ = c.pluginReady(newDependencyTestPlugin("a", csv3.CNI, ""))
+	assert.False(t, ready)
+}
+
+func TestUnmetDependencies(t *testing.T) {
+	cni := newDependencyTestPlugin("cni-id", csv3.CNI, "")
+	csi := newDependencyTestPlugin("csi-id", csv3.CSI, "", "cni", "metrics")
+	c := newDependencyTestController(nil, cni, csi)
+
+	unmet, err := c.unmetDependencies(csi)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"cni-id (cni)", "metrics (not found)"}, unmet)
+
+	cni = cni.DeepCopy()
+	cni.Status.Phase = csv3.PluginPhaseApplied
+	metrics := newDependencyTestPlugin("metrics-id", csv3.Metrics, csv3.PluginPhaseApplied)
+	c = newDependencyTestController([]*appsv1.Deployment{
+		newDependencyTestDeployment("cni", "cni-id", true),
+		newDependencyTestDeployment("metrics", "metrics-id", true),
+	}, cni, csi, metrics)
+
+	unmet, err = c.unmetDependencies(csi)
+	assert.Nil(t, err)
+	assert.Empty(t, unmet)
+
+	// Plugins without dependencies never wait
+	unmet, err = c.unmetDependencies(cni)
+	assert.Nil(t, err)
+	assert.Empty(t, unmet)
+}
+
+func TestUnmetDependenciesIgnoresCycles(t *testing.T) {
+	a := newDependencyTestPlugin("a", csv3.CNI, "", "b")
+	b := newDependencyTestPlugin("b", csv3.CSI, "", "a")
+	c := newDependencyTestController(nil, a, b)
+
+	unmet, err := c.unmetDependencies(a)
+	assert.Nil(t, err)
+	assert.Empty(t, unmet)
+}
+
+func TestSetWaiting(t *testing.T) {
+	c := &PluginController{}
+
+	assert.True(t, c.setWaiting("csi-id", []string{"cni-id (cni)"}))
+	assert.False(t, c.setWaiting("csi-id", []string{"cni-id (cni)"}), "rechecks aren't reported again")
+	assert.True(t, c.setWaiting("csi-id", []string{"cni-id (cni)", "metrics (not found)"}))
+
+	assert.False(t, c.setWaiting("csi-id", nil))
+	assert.True(t, c.setWaiting("csi-id", []string{"cni-id (cni)"}), "waiting again is reported")
+}
+
+func TestDeletedDependents(t *testing.T) {
+	c := &PluginController{}
+
+	cni := newDependencyTestPlugin("cni-id", csv3.CNI, "")
+	csi := newDependencyTestPlugin("csi-id", csv3.CSI, "", "cni")
+	logs := newDependencyTestPlugin("logs-id", csv3.Logs, "", "cni-id")
+
+	c.trackDeletedPlugin(cni)
+	c.trackDeletedPlugin(csi)
+	c.trackDeletedPlugin(cache.DeletedFinalStateUnknown{Obj: logs})
+
+	assert.Equal(t, []string{"csi-id", "logs-id"}, c.deletedDependents("cni-id"))
+	assert.Empty(t, c.deletedDependents("csi-id"))
+	// Untracked plugins don't wait for anything
+	assert.Empty(t, c.deletedDependents("unknown"))
+
+	c.forgetDeletedPlugin("csi-id")
+	c.forgetDeletedPlugin("logs-id")
+	assert.Empty(t, c.deletedDependents("cni-id"))
+}
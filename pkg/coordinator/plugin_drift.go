@@ -0,0 +1,303 @@
+package coordinator
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/k8sutil/apply"
+	"github.com/containership/cluster-manager/pkg/log"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+
+	corev1 "k8s.io/api/core/v1"
+	kubeerror "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// pluginDriftCheckInterval is how often every plugin is checked for drift.
+// Changes to workloads are checked as soon as they happen, but other objects
+// aren't watched.
+const pluginDriftCheckInterval = 5 * time.Minute
+
+// appliedPlugins keeps the objects each plugin was last applied with so that
+// they can be compared with the live objects. After the coordinator restarts
+// they are rebuilt from the live objects.
+type appliedPlugins struct {
+	sync.Mutex
+	objects map[string][]*unstructured.Unstructured
+}
+
+// pluginLocks serializes applying a plugin and correcting its drift, since
+// they're handled by different workers
+type pluginLocks struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock locks the plugin with the given name, returning the function that
+// unlocks it
+func (l *pluginLocks) lock(name string) func() {
+	l.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*sync.Mutex)
+	}
+
+	m, ok := l.locks[name]
+	if !ok {
+		m = &sync.Mutex{}
+		l.locks[name] = m
+	}
+	l.Unlock()
+
+	m.Lock()
+	return m.Unlock
+}
+
+// observeOnly returns true if drift of the plugin should only be reported
+func observeOnly(plugin *csv3.Plugin) bool {
+	return plugin.Annotations[constants.PluginObserveOnlyAnnotation] == "true"
+}
+
+// setAppliedObjects remembers the objects the plugin was applied with
+func (c *PluginController) setAppliedObjects(name string, groups [][]*unstructured.Unstructured) {
+	objects := make([]*unstructured.Unstructured, 0)
+	for _, group := range groups {
+		for _, obj := range group {
+			objects = append(objects, obj.DeepCopy())
+		}
+	}
+
+	c.applied.Lock()
+	defer c.applied.Unlock()
+
+	if c.applied.objects == nil {
+		c.applied.objects = make(map[string][]*unstructured.Unstructured)
+	}
+
+	c.applied.objects[name] = objects
+}
+
+// appliedObjects returns copies of the objects the plugin was last applied
+// with, or nil if it hasn't been applied since the coordinator started
+func (c *PluginController) appliedObjects(name string) []*unstructured.Unstructured {
+	c.applied.Lock()
+	defer c.applied.Unlock()
+
+	objects, ok := c.applied.objects[name]
+	if !ok {
+		return nil
+	}
+
+	result := make([]*unstructured.Unstructured, 0, len(objects))
+	for _, obj := range objects {
+		result = append(result, obj.DeepCopy())
+	}
+
+	return result
+}
+
+// forgetAppliedObjects stops checking the plugin for drift
+func (c *PluginController) forgetAppliedObjects(name string) {
+	c.applied.Lock()
+	defer c.applied.Unlock()
+
+	delete(c.applied.objects, name)
+}
+
+// enqueueDriftCheck queues a drift check of the plugin with the given name
+func (c *PluginController) enqueueDriftCheck(name string) {
+	c.driftWorkqueue.Add(constants.ContainershipNamespace + "/" + name)
+}
+
+// enqueueAllDriftChecks queues a drift check of every plugin
+func (c *PluginController) enqueueAllDriftChecks() {
+	plugins, err := c.pluginLister.Plugins(constants.ContainershipNamespace).List(labels.Everything())
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, plugin := range plugins {
+		c.enqueueDriftCheck(plugin.Name)
+	}
+}
+
+// runDriftWorker continually processes drift checks from the drift workqueue
+func (c *PluginController) runDriftWorker() {
+	for c.processNextDriftItem() {
+	}
+}
+
+func (c *PluginController) processNextDriftItem() bool {
+	obj, shutdown := c.driftWorkqueue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.driftWorkqueue.Done(obj)
+
+	key, ok := obj.(string)
+	if !ok {
+		c.driftWorkqueue.Forget(obj)
+		log.Errorf("expected string in drift workqueue but got %#v", obj)
+		return true
+	}
+
+	err := c.driftSyncHandler(key)
+	if err == nil {
+		c.driftWorkqueue.Forget(key)
+		return true
+	}
+
+	if c.driftWorkqueue.NumRequeues(key) < maxPluginControllerRetries {
+		c.driftWorkqueue.AddRateLimited(key)
+		return true
+	}
+
+	c.driftWorkqueue.Forget(key)
+	log.Infof("Dropping Plugin %q out of the drift queue: %v", key, err)
+	return true
+}
+
+// driftSyncHandler compares the objects the plugin was last applied with to
+// the live objects. Objects that are missing or were changed are applied
+// again, unless the plugin is observe only in which case the drift is only
+// reported. Drift that wasn't corrected is kept in the plugin status.
+func (c *PluginController) driftSyncHandler(key string) error {
+	_, name, _ := cache.SplitMetaNamespaceKey(key)
+
+	unlock := c.locks.lock(name)
+	defer unlock()
+
+	plugin, err := c.pluginLister.Plugins(constants.ContainershipNamespace).Get(name)
+	if kubeerror.IsNotFound(err) {
+		// The objects are being deleted along with the plugin
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "getting plugin failed with error other than not found")
+	}
+
+	objects := c.appliedObjects(name)
+	if objects == nil {
+		objects, err = c.rebuildAppliedObjects(plugin)
+		if err != nil {
+			return errors.Wrap(err, "rebuilding applied plugin objects failed")
+		}
+	}
+
+	if len(objects) == 0 {
+		// Nothing was applied yet, or applying failed before any
+		// objects were applied
+		return nil
+	}
+
+	reported := make(map[csv3.PluginObjectStatus]bool)
+	for _, o := range plugin.Status.Drift {
+		reported[o] = true
+	}
+
+	drift := make([]csv3.PluginObjectStatus, 0)
+	for _, obj := range objects {
+		result := c.applier.Diff(obj)
+		if result.Err != nil {
+			log.Errorf("%s: checking drift of plugin %s failed: %s", pluginControllerName, name, result)
+			continue
+		}
+
+		if result.Action == apply.ActionUnchanged {
+			continue
+		}
+
+		object := objectStatus(result)
+		if !observeOnly(plugin) {
+			result = c.applier.Apply(obj)
+			if result.Err == nil {
+				c.recorder.Eventf(plugin, corev1.EventTypeNormal, "DriftCorrected",
+					"%s %s/%s was %s and is %s again", object.Kind, object.Namespace, object.Name, object.Action, result.Action)
+				continue
+			}
+
+			c.recorder.Eventf(plugin, corev1.EventTypeWarning, "DriftCorrectionError",
+				"%s %s/%s was %s: %s", object.Kind, object.Namespace, object.Name, object.Action, result.Err)
+			object.Message = result.Err.Error()
+		} else if !reported[object] {
+			// Drift that's observed is reported once instead of on
+			// every check
+			c.recorder.Eventf(plugin, corev1.EventTypeWarning, "Drift",
+				"%s %s/%s was %s", object.Kind, object.Namespace, object.Name, object.Action)
+		}
+
+		drift = append(drift, object)
+	}
+
+	return c.updateStatus(plugin, func(status *csv3.PluginStatus) {
+		status.Drift = nil
+		if len(drift) > 0 {
+			status.Drift = drift
+		}
+	})
+}
+
+// rebuildAppliedObjects recovers the objects the plugin was last applied
+// with from the configuration its live objects were last applied with, e.g.
+// after the coordinator restarted. Objects that were deleted since can't be
+// recovered, so they're only detected as missing once the plugin is applied
+// again. Plugins that failed to apply are a mix of versions, so there's
+// nothing to recover for them.
+func (c *PluginController) rebuildAppliedObjects(plugin *csv3.Plugin) ([]*unstructured.Unstructured, error) {
+	if plugin.Status.Phase != csv3.PluginPhaseApplied && plugin.Status.Phase != csv3.PluginPhaseRolledBack {
+		return nil, nil
+	}
+
+	scopes, err := c.pluginScopes(plugin.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	live, err := c.applier.ListByLabel(pluginLabelKey+"="+plugin.Spec.ID, scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]*unstructured.Unstructured, 0, len(live))
+	for _, obj := range live {
+		config, ok := obj.GetAnnotations()[apply.LastAppliedConfigAnnotation]
+		if !ok {
+			continue
+		}
+
+		applied := &unstructured.Unstructured{}
+		if err := applied.UnmarshalJSON([]byte(config)); err != nil {
+			log.Errorf("%s: %s %s/%s of plugin %s has an invalid %s annotation: %s", pluginControllerName,
+				obj.GetKind(), obj.GetNamespace(), obj.GetName(), plugin.Name, apply.LastAppliedConfigAnnotation, err)
+			continue
+		}
+
+		objects = append(objects, applied)
+	}
+
+	// Rebuilding is only needed once, even if nothing was found
+	c.setAppliedObjects(plugin.Name, [][]*unstructured.Unstructured{objects})
+	return objects, nil
+}
+
+// objectStatus converts the result of applying or comparing an object to its
+// status
+func objectStatus(r apply.Result) csv3.PluginObjectStatus {
+	object := csv3.PluginObjectStatus{
+		Kind:      r.Kind,
+		Namespace: r.Namespace,
+		Name:      r.Name,
+		Action:    string(r.Action),
+	}
+
+	if r.Err != nil {
+		object.Message = r.Err.Error()
+	}
+
+	return object
+}
@@ -0,0 +1,184 @@
+package coordinator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	csfake "github.com/containership/cluster-manager/pkg/client/clientset/versioned/fake"
+	csinformers "github.com/containership/cluster-manager/pkg/client/informers/externalversions"
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/k8sutil/apply"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/record"
+)
+
+// newDriftTestController returns a controller that applied the test plugin
+// manifests for the plugin
+func newDriftTestController(t *testing.T, plugin *csv3.Plugin) (*PluginController, *csfake.Clientset) {
+	c := newTestPluginController()
+
+	client := csfake.NewSimpleClientset(plugin)
+	factory := csinformers.NewSharedInformerFactory(client, 0)
+	informer := factory.Containership().V3().Plugins()
+	informer.Informer().GetIndexer().Add(plugin)
+	c.clientset = client
+	c.pluginLister = informer.Lister()
+
+	groups, _, _ := formatPlugin(plugin.Spec, "1", testPluginDetails, nil)
+	_, err := c.applyManifests(groups, plugin)
+	assert.Nil(t, err)
+	c.setAppliedObjects(plugin.Name, groups)
+	drainEvents(c.recorder.(*record.FakeRecorder))
+
+	return c, client
+}
+
+func newDriftTestPlugin(annotations map[string]string) *csv3.Plugin {
+	return &csv3.Plugin{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "1234",
+			Namespace:   constants.ContainershipNamespace,
+			Annotations: annotations,
+		},
+		Spec: csv3.PluginSpec{ID: "1234"},
+	}
+}
+
+// changedConfigMap returns the config map with the given name as if someone
+// else changed it
+func changedConfigMap(name string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": "containership-core",
+			"labels": map[string]interface{}{
+				"app": "changed",
+			},
+		},
+	}}
+}
+
+func TestDriftSyncHandlerCorrectsDrift(t *testing.T) {
+	plugin := newDriftTestPlugin(nil)
+	c, client := newDriftTestController(t, plugin)
+	recorder := c.recorder.(*record.FakeRecorder)
+
+	// No drift
+	err := c.driftSyncHandler("containership-core/1234")
+	assert.Nil(t, err)
+	assert.Empty(t, drainEvents(recorder))
+
+	c.applier.Apply(changedConfigMap("second"))
+	c.applier.Delete(changedConfigMap("third"))
+
+	err = c.driftSyncHandler("containership-core/1234")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"Normal DriftCorrected ConfigMap containership-core/second was drifted and is configured again",
+		"Normal DriftCorrected ConfigMap containership-core/third was missing and is created again",
+	}, drainEvents(recorder))
+
+	// Everything matches again
+	err = c.driftSyncHandler("containership-core/1234")
+	assert.Nil(t, err)
+	assert.Empty(t, drainEvents(recorder))
+
+	// Nothing was left over to report
+	updated, _ := client.ContainershipV3().Plugins(constants.ContainershipNamespace).Get("1234", metav1.GetOptions{})
+	assert.Empty(t, updated.Status.Drift)
+}
+
+func TestDriftSyncHandlerObserveOnly(t *testing.T) {
+	plugin := newDriftTestPlugin(map[string]string{
+		constants.PluginObserveOnlyAnnotation: "true",
+	})
+	c, client := newDriftTestController(t, plugin)
+	recorder := c.recorder.(*record.FakeRecorder)
+
+	c.applier.Delete(changedConfigMap("first"))
+
+	err := c.driftSyncHandler("containership-core/1234")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"Warning Drift ConfigMap containership-core/first was missing",
+	}, drainEvents(recorder))
+
+	updated, err := client.ContainershipV3().Plugins(constants.ContainershipNamespace).Get("1234", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []csv3.PluginObjectStatus{{
+		Kind:      "ConfigMap",
+		Namespace: "containership-core",
+		Name:      "first",
+		Action:    "missing",
+	}}, updated.Status.Drift)
+
+	// The object wasn't created again
+	assert.Equal(t, "missing", string(c.applier.Diff(changedConfigMap("first")).Action))
+
+	// Drift that was already reported isn't reported again
+	informer := csinformers.NewSharedInformerFactory(client, 0).Containership().V3().Plugins()
+	informer.Informer().GetIndexer().Add(updated)
+	c.pluginLister = informer.Lister()
+
+	err = c.driftSyncHandler("containership-core/1234")
+	assert.Nil(t, err)
+	assert.Empty(t, drainEvents(recorder))
+}
+
+func TestDriftSyncHandlerNotApplied(t *testing.T) {
+	plugin := newDriftTestPlugin(nil)
+	c, _ := newDriftTestController(t, plugin)
+	recorder := c.recorder.(*record.FakeRecorder)
+
+	c.forgetAppliedObjects("1234")
+	c.applier.Delete(changedConfigMap("first"))
+
+	err := c.driftSyncHandler("containership-core/1234")
+	assert.Nil(t, err)
+	assert.Empty(t, drainEvents(recorder))
+
+	// Unknown plugins are ignored
+	err = c.driftSyncHandler("containership-core/5678")
+	assert.Nil(t, err)
+}
+
+func TestDriftSyncHandlerRebuildsAppliedObjects(t *testing.T) {
+	applied := changedConfigMap("second")
+	applied.SetLabels(map[string]string{pluginLabelKey: "1234", "app": "changed"})
+	config, _ := applied.MarshalJSON()
+
+	// Edited by someone else since it was applied
+	live := applied.DeepCopy()
+	live.SetAnnotations(map[string]string{apply.LastAppliedConfigAnnotation: string(config)})
+	live.SetLabels(map[string]string{pluginLabelKey: "1234", "app": "edited"})
+
+	plugin := newDriftTestPlugin(nil)
+	plugin.Status.Phase = csv3.PluginPhaseApplied
+
+	// As if the coordinator restarted, so nothing was applied by it
+	c := newTestPluginController(live)
+	client := csfake.NewSimpleClientset(plugin)
+	informer := csinformers.NewSharedInformerFactory(client, 0).Containership().V3().Plugins()
+	informer.Informer().GetIndexer().Add(plugin)
+	c.clientset = client
+	c.pluginLister = informer.Lister()
+	recorder := c.recorder.(*record.FakeRecorder)
+
+	err := c.driftSyncHandler("containership-core/1234")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"Normal DriftCorrected ConfigMap containership-core/second was drifted and is configured again",
+	}, drainEvents(recorder))
+	assert.Len(t, c.appliedObjects("1234"), 1)
+
+	// Everything matches again
+	err = c.driftSyncHandler("containership-core/1234")
+	assert.Nil(t, err)
+	assert.Empty(t, drainEvents(recorder))
+}
@@ -0,0 +1,426 @@
+package coordinator
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/env"
+	"github.com/containership/cluster-manager/pkg/log"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	kubeerror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	watch "k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	// pluginJobStartGrace is how much longer than its active deadline a job
+	// is waited for, since the deadline only starts once the job is started
+	pluginJobStartGrace = 2 * time.Minute
+	// pluginJobWatchRetryInterval is how long to wait before watching a job
+	// again after the watch failed
+	pluginJobWatchRetryInterval = 5 * time.Second
+
+	// pluginJobLogsLabelKey labels the ConfigMaps holding the logs of the
+	// jobs of the plugin with the ID in its value. It's separate from the
+	// plugin label so the logs aren't pruned when the plugin is applied.
+	pluginJobLogsLabelKey = "containership.io/plugin-job-logs"
+	// pluginJobEventLogLines is how many lines of logs of each container are
+	// recorded in an event
+	pluginJobEventLogLines = int64(20)
+	// pluginJobConfigMapLogLines is how many lines of logs of each container
+	// are kept in the logs ConfigMap
+	pluginJobConfigMapLogLines = int64(1000)
+	// pluginJobMaxLogBytes caps the logs kept for each container, keeping the
+	// end of the logs
+	pluginJobMaxLogBytes = 64 * 1024
+)
+
+// runJob runs the jobs in order and waits for them to finish, returning an
+// error if any of them failed. Consecutive jobs that are marked independent
+// run at the same time, up to the configured parallelism. Every job runs even
+// if an earlier one failed, as long as the total deadline of the jobs hasn't
+// passed.
+func (c *PluginController) runJob(jobs []*batchv1.Job, plugin *csv3.Plugin) error {
+	if len(jobs) <= 0 {
+		return nil
+	}
+
+	for _, job := range jobs {
+		if job.Spec.ActiveDeadlineSeconds == nil {
+			return fmt.Errorf("ActiveDeadlineSeconds needs to be specified for any plugin job")
+		}
+
+		if job.Spec.BackoffLimit == nil {
+			limit := int32(1)
+			job.Spec.BackoffLimit = &limit
+		}
+	}
+
+	batches := jobBatches(jobs, env.PluginJobParallelism())
+	deadline := jobsDeadline(batches, time.Now())
+
+	errs := make([]error, 0)
+	for _, batch := range batches {
+		if time.Now().After(deadline) {
+			for _, job := range batch {
+				errs = append(errs, fmt.Errorf("job %s was not run since the total deadline of the jobs passed", job.Name))
+			}
+			continue
+		}
+
+		errs = append(errs, c.runJobBatch(batch, plugin, deadline)...)
+	}
+
+	if len(errs) > 0 {
+		return errors.Wrapf(errs[0], "%d of %d jobs failed", len(errs), len(jobs))
+	}
+
+	return nil
+}
+
+// jobBatches splits the jobs into batches that run one after the other. Jobs
+// in the same batch run at the same time, so only consecutive independent
+// jobs are batched together.
+func jobBatches(jobs []*batchv1.Job, parallelism int) [][]*batchv1.Job {
+	batches := make([][]*batchv1.Job, 0)
+	batch := make([]*batchv1.Job, 0)
+	for _, job := range jobs {
+		independent := job.Annotations[constants.PluginJobIndependentAnnotation] == "true"
+		if len(batch) > 0 && (!independent || len(batch) >= parallelism) {
+			batches = append(batches, batch)
+			batch = make([]*batchv1.Job, 0)
+		}
+
+		batch = append(batch, job)
+
+		if !independent {
+			batches = append(batches, batch)
+			batch = make([]*batchv1.Job, 0)
+		}
+	}
+
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	return batches
+}
+
+// jobsDeadline returns when the batches of jobs starting now must have
+// finished. Each batch may take as long as the longest active deadline of its
+// jobs, and the time jobs take to start is only allowed for once, rather than
+// for every job.
+func jobsDeadline(batches [][]*batchv1.Job, now time.Time) time.Time {
+	total := pluginJobStartGrace
+	for _, batch := range batches {
+		longest := int64(0)
+		for _, job := range batch {
+			if *job.Spec.ActiveDeadlineSeconds > longest {
+				longest = *job.Spec.ActiveDeadlineSeconds
+			}
+		}
+
+		total += time.Duration(longest) * time.Second
+	}
+
+	return now.Add(total)
+}
+
+// runJobBatch runs the jobs at the same time, returning the errors of the
+// jobs that failed in the order of the jobs. No job is waited for past the
+// deadline.
+func (c *PluginController) runJobBatch(jobs []*batchv1.Job, plugin *csv3.Plugin, deadline time.Time) []error {
+	results := make([]error, len(jobs))
+
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		wg.Add(1)
+		go func(i int, job *batchv1.Job) {
+			defer wg.Done()
+			results[i] = c.runSingleJob(job, plugin, deadline)
+		}(i, job)
+	}
+	wg.Wait()
+
+	errs := make([]error, 0)
+	for i, err := range results {
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "job %s", jobs[i].Name))
+		}
+	}
+
+	return errs
+}
+
+// runSingleJob creates the job, waits for it to finish and keeps its logs
+// before deleting it. The job is waited for until its own deadline or the
+// given deadline, whichever is earlier.
+func (c *PluginController) runSingleJob(job *batchv1.Job, plugin *csv3.Plugin, deadline time.Time) error {
+	jobs := c.kubeclientset.BatchV1().Jobs(constants.ContainershipNamespace)
+
+	_, err := jobs.Create(job)
+	if err != nil {
+		return errors.Wrap(err, "creating job failed")
+	}
+
+	jobDeadline := time.Now().Add(time.Duration(*job.Spec.ActiveDeadlineSeconds)*time.Second + pluginJobStartGrace)
+	if jobDeadline.After(deadline) {
+		jobDeadline = deadline
+	}
+
+	finished, jobErr := c.waitForJob(job.Name, jobDeadline)
+	if jobErr == nil {
+		if failed, reason, _ := jobDidFail(finished); failed {
+			// If a job is not able to finish from exceeding BackoffLimit or ActiveDeadlineSeconds
+			// it will change its status to failed
+			jobErr = fmt.Errorf("Job finished with failed status %s", reason)
+		}
+	}
+
+	c.keepJobLogs(job.Name, plugin, jobErr != nil, env.IsPluginJobLogsToConfigMapEnabled())
+
+	// deleting is best effort, if it fails that's fine, also
+	// the process shouldn't be blocking
+	propagationPolicy := metav1.DeletePropagationForeground
+	go jobs.Delete(job.Name, &metav1.DeleteOptions{
+		PropagationPolicy: &propagationPolicy,
+	})
+
+	return jobErr
+}
+
+// waitForJob waits until the job finishes or the deadline passes. The job is
+// watched for changes, and if the watch is closed early, e.g. because the
+// connection to the API server was dropped, it's watched again starting from
+// the latest state of the job.
+func (c *PluginController) waitForJob(name string, deadline time.Time) (*batchv1.Job, error) {
+	jobs := c.kubeclientset.BatchV1().Jobs(constants.ContainershipNamespace)
+
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("timed out waiting for job to finish")
+		}
+
+		job, err := jobs.Get(name, metav1.GetOptions{})
+		if kubeerror.IsNotFound(err) {
+			return nil, fmt.Errorf("job was deleted before finishing")
+		} else if err != nil {
+			log.Errorf("%s: getting job %s failed: %s", pluginControllerName, name, err)
+			time.Sleep(minDuration(pluginJobWatchRetryInterval, remaining))
+			continue
+		}
+
+		if jobFinished(job) {
+			return job, nil
+		}
+
+		timeoutSeconds := int64(remaining/time.Second) + 1
+		w, err := jobs.Watch(metav1.ListOptions{
+			FieldSelector:   fields.OneTermEqualSelector("metadata.name", name).String(),
+			ResourceVersion: job.ResourceVersion,
+			TimeoutSeconds:  &timeoutSeconds,
+		})
+		if err != nil {
+			log.Errorf("%s: watching job %s failed: %s", pluginControllerName, name, err)
+			time.Sleep(minDuration(pluginJobWatchRetryInterval, remaining))
+			continue
+		}
+
+		job, err = watchJob(w, name, remaining)
+		if err != nil || job != nil {
+			return job, err
+		}
+
+		log.Debugf("%s: watch of job %s ended before it finished, watching again", pluginControllerName, name)
+	}
+}
+
+// watchJob reads events from the watch until the job finishes, the watch is
+// closed or the timeout passes. A nil job and error mean the job should be
+// watched again.
+func watchJob(w watch.Interface, name string, timeout time.Duration) (*batchv1.Job, error) {
+	defer w.Stop()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return nil, nil
+			}
+
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				j, ok := event.Object.(*batchv1.Job)
+				if !ok || j.Name != name {
+					continue
+				}
+
+				if jobFinished(j) {
+					return j, nil
+				}
+			case watch.Deleted:
+				return nil, fmt.Errorf("job was deleted before finishing")
+			case watch.Error:
+				// e.g. the resource version is too old, which is
+				// recovered from by getting the job again
+				log.Debugf("%s: watch of job %s failed: %v", pluginControllerName, name, event.Object)
+				return nil, nil
+			}
+		case <-timer.C:
+			return nil, fmt.Errorf("timed out waiting for job to finish")
+		}
+	}
+}
+
+// jobFinished returns true if the job completed or failed
+func jobFinished(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if (condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed) &&
+			condition.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+
+	return false
+}
+
+func jobDidFail(job *batchv1.Job) (bool, string, error) {
+	if len(job.Status.Conditions) == 0 {
+		return false, "", fmt.Errorf("Job must have at least one status condition to check to determine failure")
+	}
+
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed {
+			return true, condition.Reason, nil
+		}
+	}
+
+	return false, "", nil
+}
+
+// keepJobLogs keeps the logs of every container of the pods of the job,
+// either in a ConfigMap named after the job or as events on the plugin.
+// Keeping the logs is best effort, so failures are only logged.
+func (c *PluginController) keepJobLogs(name string, plugin *csv3.Plugin, failed, toConfigMap bool) {
+	pods, err := c.kubeclientset.CoreV1().Pods(constants.ContainershipNamespace).List(metav1.ListOptions{
+		// The job controller labels the pods it creates with the job name
+		LabelSelector: labels.SelectorFromSet(labels.Set{"job-name": name}).String(),
+	})
+	if err != nil {
+		log.Errorf("%s: listing pods of job %s failed: %s", pluginControllerName, name, err)
+		return
+	}
+
+	// Retried pods are kept in the order they were created
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[i].CreationTimestamp.Before(&pods.Items[j].CreationTimestamp)
+	})
+
+	tailLines := pluginJobEventLogLines
+	if toConfigMap {
+		tailLines = pluginJobConfigMapLogLines
+	}
+
+	logs := make(map[string]string)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		for _, container := range pod.Spec.Containers {
+			data, err := c.getPodLogs(pod, container.Name, tailLines)
+			if err != nil {
+				data = []byte(fmt.Sprintf("logs unavailable: %s", err))
+			}
+
+			if len(data) > pluginJobMaxLogBytes {
+				data = data[len(data)-pluginJobMaxLogBytes:]
+			}
+
+			if !toConfigMap {
+				eventType := corev1.EventTypeNormal
+				if failed {
+					eventType = corev1.EventTypeWarning
+				}
+
+				c.recorder.Eventf(plugin, eventType, "JobLogs", "Job %s pod %s container %s:\n%s",
+					name, pod.Name, container.Name, data)
+				continue
+			}
+
+			logs[pod.Name+"."+container.Name] = string(data)
+		}
+	}
+
+	if toConfigMap {
+		if err := c.saveJobLogs(name, plugin, logs); err != nil {
+			log.Errorf("%s: saving logs of job %s failed: %s", pluginControllerName, name, err)
+			return
+		}
+
+		c.recorder.Eventf(plugin, corev1.EventTypeNormal, "JobLogs",
+			"Logs of job %s are in ConfigMap %s", name, jobLogsConfigMapName(name))
+	}
+}
+
+// jobLogsConfigMapName returns the name of the ConfigMap holding the logs of
+// the job
+func jobLogsConfigMapName(job string) string {
+	return job + "-logs"
+}
+
+// saveJobLogs creates or replaces the ConfigMap holding the logs of the job,
+// with a key for each container of each pod
+func (c *PluginController) saveJobLogs(name string, plugin *csv3.Plugin, logs map[string]string) error {
+	configMaps := c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace)
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobLogsConfigMapName(name),
+			Namespace: constants.ContainershipNamespace,
+			Labels: map[string]string{
+				pluginJobLogsLabelKey: plugin.Spec.ID,
+			},
+		},
+		Data: logs,
+	}
+
+	existing, err := configMaps.Get(configMap.Name, metav1.GetOptions{})
+	if kubeerror.IsNotFound(err) {
+		_, err = configMaps.Create(configMap)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	configMap.ResourceVersion = existing.ResourceVersion
+	_, err = configMaps.Update(configMap)
+	return err
+}
+
+// kubePodLogs returns the last lines of the logs of the pod container
+func (c *PluginController) kubePodLogs(pod *corev1.Pod, container string, tailLines int64) ([]byte, error) {
+	return c.kubeclientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: container,
+		TailLines: &tailLines,
+	}).Do().Raw()
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,259 @@
+package coordinator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/constants"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func newTestJob(name string, independent bool) *batchv1.Job {
+	deadline := int64(60)
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: constants.ContainershipNamespace,
+		},
+		Spec: batchv1.JobSpec{
+			ActiveDeadlineSeconds: &deadline,
+		},
+	}
+
+	if independent {
+		job.Annotations = map[string]string{
+			constants.PluginJobIndependentAnnotation: "true",
+		}
+	}
+
+	return job
+}
+
+func withCondition(job *batchv1.Job, conditionType batchv1.JobConditionType) *batchv1.Job {
+	job = job.DeepCopy()
+	job.Status.Conditions = []batchv1.JobCondition{{
+		Type:   conditionType,
+		Status: corev1.ConditionTrue,
+		Reason: "Reason",
+	}}
+
+	return job
+}
+
+func jobNames(batches [][]*batchv1.Job) [][]string {
+	result := make([][]string, 0)
+	for _, batch := range batches {
+		names := make([]string, 0)
+		for _, job := range batch {
+			names = append(names, job.Name)
+		}
+		result = append(result, names)
+	}
+
+	return result
+}
+
+func TestJobBatches(t *testing.T) {
+	jobs := []*batchv1.Job{
+		newTestJob("a", true),
+		newTestJob("b", true),
+		newTestJob("c", true),
+		newTestJob("d", false),
+		newTestJob("e", true),
+		newTestJob("f", false),
+	}
+
+	// Everything runs serially by default
+	assert.Equal(t, [][]string{{"a"}, {"b"}, {"c"}, {"d"}, {"e"}, {"f"}},
+		jobNames(jobBatches(jobs, 1)))
+
+	assert.Equal(t, [][]string{{"a", "b"}, {"c"}, {"d"}, {"e"}, {"f"}},
+		jobNames(jobBatches(jobs, 2)))
+
+	assert.Equal(t, [][]string{{"a", "b", "c"}, {"d"}, {"e"}, {"f"}},
+		jobNames(jobBatches(jobs, 10)))
+
+	assert.Empty(t, jobBatches(nil, 2))
+}
+
+func TestJobsDeadline(t *testing.T) {
+	long := newTestJob("long", true)
+	longDeadline := int64(300)
+	long.Spec.ActiveDeadlineSeconds = &longDeadline
+
+	batches := [][]*batchv1.Job{
+		{newTestJob("a", true), long},
+		{newTestJob("b", false)},
+	}
+
+	now := time.Now()
+	// The start grace is only allowed for once
+	assert.Equal(t, now.Add(6*time.Minute+pluginJobStartGrace), jobsDeadline(batches, now))
+	assert.Equal(t, now.Add(pluginJobStartGrace), jobsDeadline(nil, now))
+}
+
+func TestJobFinished(t *testing.T) {
+	job := newTestJob("job", false)
+	assert.False(t, jobFinished(job))
+	assert.True(t, jobFinished(withCondition(job, batchv1.JobComplete)))
+	assert.True(t, jobFinished(withCondition(job, batchv1.JobFailed)))
+
+	notFailed := withCondition(job, batchv1.JobFailed)
+	notFailed.Status.Conditions[0].Status = corev1.ConditionFalse
+	assert.False(t, jobFinished(notFailed))
+}
+
+func TestWatchJob(t *testing.T) {
+	job := newTestJob("job", false)
+
+	w := watch.NewFakeWithChanSize(3, false)
+	w.Modify(job)
+	w.Modify(withCondition(newTestJob("other", false), batchv1.JobComplete))
+	w.Modify(withCondition(job, batchv1.JobComplete))
+	finished, err := watchJob(w, "job", time.Second)
+	assert.Nil(t, err)
+	assert.True(t, jobFinished(finished))
+
+	// A closed watch needs to be watched again
+	w = watch.NewFakeWithChanSize(1, false)
+	w.Stop()
+	finished, err = watchJob(w, "job", time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, finished)
+
+	w = watch.NewFakeWithChanSize(1, false)
+	w.Delete(job)
+	_, err = watchJob(w, "job", time.Second)
+	assert.NotNil(t, err)
+
+	w = watch.NewFakeWithChanSize(1, false)
+	_, err = watchJob(w, "job", 10*time.Millisecond)
+	assert.NotNil(t, err, "the job never finishes")
+}
+
+func TestWaitForJobRecoversFromClosedWatch(t *testing.T) {
+	job := newTestJob("job", false)
+	client := fake.NewSimpleClientset()
+
+	gets := 0
+	client.PrependReactor("get", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		if gets == 1 {
+			return true, job, nil
+		}
+
+		return true, withCondition(job, batchv1.JobComplete), nil
+	})
+
+	watches := 0
+	client.PrependWatchReactor("jobs", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		watches++
+		// The connection is dropped right away
+		w := watch.NewFake()
+		w.Stop()
+		return true, w, nil
+	})
+
+	c := &PluginController{kubeclientset: client}
+	finished, err := c.waitForJob("job", time.Now().Add(time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, jobFinished(finished))
+	assert.Equal(t, 2, gets)
+	assert.Equal(t, 1, watches)
+}
+
+func newJobTestController(finished *batchv1.Job, pods ...runtime.Object) *PluginController {
+	client := fake.NewSimpleClientset(pods...)
+	client.PrependReactor("get", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, finished, nil
+	})
+
+	return &PluginController{
+		kubeclientset: client,
+		recorder:      record.NewFakeRecorder(10),
+		getPodLogs: func(pod *corev1.Pod, container string, tailLines int64) ([]byte, error) {
+			return []byte(pod.Name + " " + container + " output"), nil
+		},
+	}
+}
+
+func newJobPod(name, job string, created time.Time) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         constants.ContainershipNamespace,
+			Labels:            map[string]string{"job-name": job},
+			CreationTimestamp: metav1.NewTime(created),
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "main"}},
+		},
+	}
+}
+
+func TestRunJobRecordsLogsAsEvents(t *testing.T) {
+	job := newTestJob("job", false)
+	now := time.Now()
+	c := newJobTestController(withCondition(job, batchv1.JobFailed),
+		newJobPod("job-2", "job", now),
+		newJobPod("job-1", "job", now.Add(-time.Minute)),
+		newJobPod("other", "other", now))
+	plugin := &csv3.Plugin{ObjectMeta: metav1.ObjectMeta{Name: "1234"}}
+
+	err := c.runJob([]*batchv1.Job{job}, plugin)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "1 of 1 jobs failed")
+
+	// The backoff limit is defaulted
+	assert.Equal(t, int32(1), *job.Spec.BackoffLimit)
+
+	assert.Equal(t, []string{
+		"Warning JobLogs Job job pod job-1 container main:\njob-1 main output",
+		"Warning JobLogs Job job pod job-2 container main:\njob-2 main output",
+	}, drainEvents(c.recorder.(*record.FakeRecorder)))
+}
+
+func TestKeepJobLogsInConfigMap(t *testing.T) {
+	job := newTestJob("job", false)
+	c := newJobTestController(withCondition(job, batchv1.JobComplete),
+		newJobPod("job-1", "job", time.Now()))
+	plugin := &csv3.Plugin{
+		ObjectMeta: metav1.ObjectMeta{Name: "1234"},
+		Spec:       csv3.PluginSpec{ID: "1234"},
+	}
+
+	c.keepJobLogs("job", plugin, false, true)
+	// Running the job again replaces the logs
+	c.keepJobLogs("job", plugin, false, true)
+
+	configMap, err := c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace).
+		Get("job-logs", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "1234", configMap.Labels[pluginJobLogsLabelKey])
+	assert.Equal(t, map[string]string{"job-1.main": "job-1 main output"}, configMap.Data)
+
+	assert.Equal(t, []string{
+		"Normal JobLogs Logs of job job are in ConfigMap job-logs",
+		"Normal JobLogs Logs of job job are in ConfigMap job-logs",
+	}, drainEvents(c.recorder.(*record.FakeRecorder)))
+}
+
+func TestRunJobRequiresDeadline(t *testing.T) {
+	job := newTestJob("job", false)
+	job.Spec.ActiveDeadlineSeconds = nil
+
+	c := newJobTestController(withCondition(job, batchv1.JobComplete))
+	err := c.runJob([]*batchv1.Job{job}, &csv3.Plugin{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,306 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/evanphx/json-patch"
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/log"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/cache"
+)
+
+// pluginOverrideLabelKey marks a ConfigMap in the containership namespace as
+// holding overrides for the plugins with the ID or type in the label value.
+// Each key of the ConfigMap is a single override document.
+const pluginOverrideLabelKey = "containership.io/plugin-override"
+
+// pluginOverridePatchType is the kind of patch an override holds
+type pluginOverridePatchType string
+
+const (
+	// pluginOverrideStrategic is a strategic merge patch. Kinds unknown to
+	// the Kubernetes scheme, e.g. custom resources, are patched with a JSON
+	// merge patch instead.
+	pluginOverrideStrategic pluginOverridePatchType = "strategic"
+	// pluginOverrideJSON is a JSON patch (RFC 6902)
+	pluginOverrideJSON pluginOverridePatchType = "json"
+)
+
+// pluginOverride is a patch to apply to matching plugin objects before they
+// are applied, e.g.
+//
+//	kind: DaemonSet
+//	name: fluentd
+//	type: strategic
+//	patch:
+//	  spec:
+//	    template:
+//	      spec:
+//	        nodeSelector:
+//	          logging: enabled
+type pluginOverride struct {
+	// Source is the ConfigMap and key the override was read from
+	Source string `json:"-"`
+
+	// Kind of the objects to patch
+	Kind string `json:"kind"`
+	// Name of the object to patch. Every object of the kind is patched if
+	// it's empty.
+	Name string `json:"name,omitempty"`
+	// Namespace of the object to patch. Objects in any namespace are
+	// patched if it's empty.
+	Namespace string `json:"namespace,omitempty"`
+	// Type of the patch, defaulting to strategic
+	Type pluginOverridePatchType `json:"type,omitempty"`
+	// Patch is the patch document, an object for strategic merge patches
+	// or a list of operations for JSON patches
+	Patch json.RawMessage `json:"patch"`
+}
+
+// watchOverrides sets up the ConfigMap informer for plugin overrides. Any
+// change to overrides queues the plugins they're for so they're applied
+// again with the changed overrides.
+func (c *PluginController) watchOverrides(kubeInformerFactory kubeinformers.SharedInformerFactory) {
+	configMapInformer := kubeInformerFactory.Core().V1().ConfigMaps()
+	configMapInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueOverriddenPlugins,
+		UpdateFunc: func(old, new interface{}) {
+			newConfigMap := new.(*corev1.ConfigMap)
+			oldConfigMap := old.(*corev1.ConfigMap)
+			if newConfigMap.ResourceVersion == oldConfigMap.ResourceVersion {
+				return
+			}
+
+			// The label may have changed, in which case the plugins
+			// it was for no longer have the override
+			if oldConfigMap.Labels[pluginOverrideLabelKey] != newConfigMap.Labels[pluginOverrideLabelKey] {
+				c.enqueueOverriddenPlugins(oldConfigMap)
+			}
+
+			if !reflect.DeepEqual(oldConfigMap.Data, newConfigMap.Data) ||
+				oldConfigMap.Labels[pluginOverrideLabelKey] != newConfigMap.Labels[pluginOverrideLabelKey] {
+				c.enqueueOverriddenPlugins(newConfigMap)
+			}
+		},
+		DeleteFunc: c.enqueueOverriddenPlugins,
+	})
+
+	c.configMapLister = configMapInformer.Lister()
+	c.configMapsSynced = configMapInformer.Informer().HasSynced
+}
+
+// enqueueOverriddenPlugins queues the plugins the ConfigMap holds overrides
+// for, if any
+func (c *PluginController) enqueueOverriddenPlugins(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	configMap, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		log.Errorf("%s: expected ConfigMap but got %#v", pluginControllerName, obj)
+		return
+	}
+
+	if configMap.Namespace != constants.ContainershipNamespace {
+		return
+	}
+
+	target, ok := configMap.Labels[pluginOverrideLabelKey]
+	if !ok {
+		return
+	}
+
+	plugins, err := c.pluginLister.Plugins(constants.ContainershipNamespace).List(labels.Everything())
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, plugin := range plugins {
+		if satisfies(plugin, target) {
+			c.enqueuePlugin(plugin)
+		}
+	}
+}
+
+// pluginOverrides returns the overrides for the plugin in the order they are
+// applied. Overrides for the plugin type come before overrides for the plugin
+// ID so the more specific ones win, and otherwise they're ordered by
+// ConfigMap name and key. Invalid override documents are skipped and
+// recorded as events.
+func (c *PluginController) pluginOverrides(plugin *csv3.Plugin) ([]pluginOverride, error) {
+	requirement, err := labels.NewRequirement(pluginOverrideLabelKey, selection.In,
+		[]string{plugin.Spec.ID, string(plugin.Spec.Type)})
+	if err != nil {
+		// The type or ID isn't a valid label value, so nothing can
+		// override the plugin
+		log.Debugf("%s: plugin %s can't have overrides: %s", pluginControllerName, plugin.Name, err)
+		return nil, nil
+	}
+
+	configMaps, err := c.configMapLister.ConfigMaps(constants.ContainershipNamespace).List(
+		labels.NewSelector().Add(*requirement))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(configMaps, func(i, j int) bool {
+		iByID := configMaps[i].Labels[pluginOverrideLabelKey] == plugin.Spec.ID
+		jByID := configMaps[j].Labels[pluginOverrideLabelKey] == plugin.Spec.ID
+		if iByID != jByID {
+			return jByID
+		}
+
+		return configMaps[i].Name < configMaps[j].Name
+	})
+
+	overrides := make([]pluginOverride, 0)
+	for _, configMap := range configMaps {
+		keys := make([]string, 0, len(configMap.Data))
+		for key := range configMap.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			source := fmt.Sprintf("ConfigMap %s key %s", configMap.Name, key)
+			override, err := parsePluginOverride(configMap.Data[key])
+			if err != nil {
+				c.recorder.Eventf(plugin, corev1.EventTypeWarning, "InvalidOverride",
+					"Ignoring override in %s: %s", source, err)
+				continue
+			}
+
+			override.Source = source
+			overrides = append(overrides, *override)
+		}
+	}
+
+	return overrides, nil
+}
+
+// parsePluginOverride parses a YAML or JSON override document
+func parsePluginOverride(data string) (*pluginOverride, error) {
+	override := &pluginOverride{}
+	if err := yaml.Unmarshal([]byte(data), override); err != nil {
+		return nil, err
+	}
+
+	if override.Kind == "" {
+		return nil, fmt.Errorf("kind is required")
+	}
+
+	if len(override.Patch) == 0 {
+		return nil, fmt.Errorf("patch is required")
+	}
+
+	switch override.Type {
+	case "":
+		override.Type = pluginOverrideStrategic
+	case pluginOverrideStrategic, pluginOverrideJSON:
+	default:
+		return nil, fmt.Errorf("unknown patch type %q", override.Type)
+	}
+
+	return override, nil
+}
+
+// matches returns true if the override applies to the object
+func (o *pluginOverride) matches(obj *unstructured.Unstructured) bool {
+	return o.Kind == obj.GetKind() &&
+		(o.Name == "" || o.Name == obj.GetName()) &&
+		(o.Namespace == "" || o.Namespace == obj.GetNamespace())
+}
+
+// apply patches the object with the override
+func (o *pluginOverride) apply(obj *unstructured.Unstructured) error {
+	original, err := obj.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	var patched []byte
+	switch o.Type {
+	case pluginOverrideJSON:
+		patch, err := jsonpatch.DecodePatch(o.Patch)
+		if err != nil {
+			return err
+		}
+
+		patched, err = patch.Apply(original)
+		if err != nil {
+			return err
+		}
+	default:
+		schema, err := scheme.Scheme.New(obj.GroupVersionKind())
+		if err != nil {
+			// Strategic merge patches need the schema of the object,
+			// which only built in kinds have
+			patched, err = jsonpatch.MergePatch(original, o.Patch)
+		} else {
+			patched, err = strategicpatch.StrategicMergePatch(original, o.Patch, schema)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	result := &unstructured.Unstructured{}
+	if err := result.UnmarshalJSON(patched); err != nil {
+		return err
+	}
+
+	if result.GetKind() != obj.GetKind() || result.GetName() != obj.GetName() ||
+		result.GetNamespace() != obj.GetNamespace() {
+		return fmt.Errorf("patch must not change the kind, name or namespace")
+	}
+
+	obj.Object = result.Object
+
+	return nil
+}
+
+// applyOverrides applies the overrides to every object they match in order.
+// Overrides that fail to apply are skipped and an error is returned for each
+// of them, leaving the objects as they were before that override.
+func applyOverrides(objects []*unstructured.Unstructured, overrides []pluginOverride) []error {
+	errs := make([]error, 0)
+	for _, override := range overrides {
+		for _, obj := range objects {
+			if !override.matches(obj) {
+				continue
+			}
+
+			// Patch a copy so a failed patch doesn't leave the object
+			// partially modified
+			patched := obj.DeepCopy()
+			if err := override.apply(patched); err != nil {
+				errs = append(errs, errors.Wrapf(err, "override in %s failed to patch %s %s",
+					override.Source, obj.GetKind(), obj.GetName()))
+				continue
+			}
+
+			obj.Object = patched.Object
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,261 @@
+package coordinator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/constants"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func newTestDaemonSet() *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "DaemonSet",
+		"metadata": map[string]interface{}{
+			"name":      "fluentd",
+			"namespace": "containership-core",
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{
+							"name":  "fluentd",
+							"image": "fluentd:1",
+						},
+						map[string]interface{}{
+							"name":  "sidecar",
+							"image": "sidecar:1",
+						},
+					},
+				},
+			},
+		},
+	}}
+}
+
+func containers(obj *unstructured.Unstructured) []interface{} {
+	result, _, _ := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+	return result
+}
+
+func TestParsePluginOverride(t *testing.T) {
+	override, err := parsePluginOverride("kind: DaemonSet\npatch:\n  spec: {}\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "DaemonSet", override.Kind)
+	assert.Equal(t, pluginOverrideStrategic, override.Type)
+	assert.JSONEq(t, `{"spec":{}}`, string(override.Patch))
+
+	override, err = parsePluginOverride(`{"kind":"DaemonSet","type":"json","patch":[{"op":"remove","path":"/spec"}]}`)
+	assert.Nil(t, err)
+	assert.Equal(t, pluginOverrideJSON, override.Type)
+
+	_, err = parsePluginOverride("patch:\n  spec: {}\n")
+	assert.NotNil(t, err, "kind is required")
+
+	_, err = parsePluginOverride("kind: DaemonSet\n")
+	assert.NotNil(t, err, "patch is required")
+
+	_, err = parsePluginOverride("kind: DaemonSet\ntype: merge\npatch: {}\n")
+	assert.NotNil(t, err, "unknown type")
+
+	_, err = parsePluginOverride("kind: [")
+	assert.NotNil(t, err, "invalid YAML")
+}
+
+func TestPluginOverrideMatches(t *testing.T) {
+	obj := newTestDaemonSet()
+
+	assert.True(t, (&pluginOverride{Kind: "DaemonSet"}).matches(obj))
+	assert.True(t, (&pluginOverride{Kind: "DaemonSet", Name: "fluentd", Namespace: "containership-core"}).matches(obj))
+	assert.False(t, (&pluginOverride{Kind: "Deployment"}).matches(obj))
+	assert.False(t, (&pluginOverride{Kind: "DaemonSet", Name: "other"}).matches(obj))
+	assert.False(t, (&pluginOverride{Kind: "DaemonSet", Namespace: "kube-system"}).matches(obj))
+}
+
+func TestPluginOverrideStrategic(t *testing.T) {
+	obj := newTestDaemonSet()
+	override := &pluginOverride{
+		Kind: "DaemonSet",
+		Type: pluginOverrideStrategic,
+		Patch: []byte(`{"spec":{"template":{"spec":{
+			"nodeSelector":{"logging":"enabled"},
+			"containers":[{"name":"fluentd","resources":{"limits":{"memory":"200Mi"}}}]}}}}`),
+	}
+
+	assert.Nil(t, override.apply(obj))
+
+	selector, _, _ := unstructured.NestedStringMap(obj.Object, "spec", "template", "spec", "nodeSelector")
+	assert.Equal(t, map[string]string{"logging": "enabled"}, selector)
+
+	// Containers are merged by name instead of being replaced
+	result := containers(obj)
+	assert.Len(t, result, 2)
+	fluentd := result[0].(map[string]interface{})
+	assert.Equal(t, "fluentd:1", fluentd["image"])
+	assert.Equal(t, "200Mi", fluentd["resources"].(map[string]interface{})["limits"].(map[string]interface{})["memory"])
+}
+
+func TestPluginOverrideMergePatchForUnknownKinds(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1",
+		"kind":       "Widget",
+		"metadata": map[string]interface{}{
+			"name": "widget",
+		},
+		"spec": map[string]interface{}{
+			"items": []interface{}{"a", "b"},
+		},
+	}}
+	override := &pluginOverride{
+		Kind:  "Widget",
+		Type:  pluginOverrideStrategic,
+		Patch: []byte(`{"spec":{"items":["c"]}}`),
+	}
+
+	assert.Nil(t, override.apply(obj))
+
+	items, _, _ := unstructured.NestedStringSlice(obj.Object, "spec", "items")
+	assert.Equal(t, []string{"c"}, items)
+}
+
+func TestPluginOverrideJSON(t *testing.T) {
+	obj := newTestDaemonSet()
+	override := &pluginOverride{
+		Kind:  "DaemonSet",
+		Type:  pluginOverrideJSON,
+		Patch: []byte(`[{"op":"remove","path":"/spec/template/spec/containers/1"}]`),
+	}
+
+	assert.Nil(t, override.apply(obj))
+	assert.Len(t, containers(obj), 1)
+
+	override.Patch = []byte(`[{"op":"replace","path":"/metadata/name","value":"renamed"}]`)
+	assert.NotNil(t, override.apply(obj), "the name must not change")
+}
+
+func TestApplyOverrides(t *testing.T) {
+	obj := newTestDaemonSet()
+	overrides := []pluginOverride{{
+		Source: "ConfigMap invalid key patch",
+		Kind:   "DaemonSet",
+		Type:   pluginOverrideJSON,
+		Patch:  []byte(`[{"op":"remove","path":"/spec/missing"}]`),
+	}, {
+		Source: "ConfigMap valid key patch",
+		Kind:   "DaemonSet",
+		Type:   pluginOverrideJSON,
+		Patch:  []byte(`[{"op":"add","path":"/metadata/labels","value":{"patched":"true"}}]`),
+	}}
+
+	errs := applyOverrides([]*unstructured.Unstructured{obj}, overrides)
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "ConfigMap invalid key patch")
+
+	// The valid override is still applied
+	assert.Equal(t, "true", obj.GetLabels()["patched"])
+}
+
+func TestFormatPluginWithOverrides(t *testing.T) {
+	overrides := []pluginOverride{{
+		Kind:  "ConfigMap",
+		Name:  "second",
+		Type:  pluginOverrideStrategic,
+		Patch: []byte(`{"metadata":{"labels":{"app":"overridden"}},"data":{"key":"value"}}`),
+	}, {
+		// Overrides can't remove the plugin labels
+		Kind:  "ConfigMap",
+		Name:  "third",
+		Type:  pluginOverrideJSON,
+		Patch: []byte(`[{"op":"add","path":"/metadata/labels","value":{}}]`),
+	}}
+
+	groups, overrideErrs, err := formatPlugin(csv3.PluginSpec{ID: "1234"}, "1", testPluginDetails, overrides)
+	assert.Nil(t, err)
+	assert.Empty(t, overrideErrs)
+
+	second := groups[1][0]
+	assert.Equal(t, "overridden", second.GetLabels()["app"])
+	assert.Equal(t, "1234", second.GetLabels()[pluginLabelKey])
+	data, _, _ := unstructured.NestedStringMap(second.Object, "data")
+	assert.Equal(t, map[string]string{"key": "value"}, data)
+
+	assert.Equal(t, "1234", groups[1][1].GetLabels()[pluginLabelKey])
+
+	// The first object isn't matched
+	assert.Equal(t, "1234", groups[0][0].GetLabels()[pluginLabelKey])
+	assert.Empty(t, groups[0][0].GetLabels()["app"])
+}
+
+func newOverrideConfigMap(name, target string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: constants.ContainershipNamespace,
+			Labels:    map[string]string{pluginOverrideLabelKey: target},
+		},
+		Data: data,
+	}
+}
+
+func TestPluginOverrides(t *testing.T) {
+	factory := kubeinformers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	recorder := record.NewFakeRecorder(10)
+	c := &PluginController{recorder: recorder}
+	c.watchOverrides(factory)
+
+	configMaps := factory.Core().V1().ConfigMaps().Informer().GetIndexer()
+	configMaps.Add(newOverrideConfigMap("a-by-id", "1234", map[string]string{
+		"b": "kind: DaemonSet\npatch: {}\n",
+		"a": "kind: Deployment\npatch: {}\n",
+	}))
+	configMaps.Add(newOverrideConfigMap("b-by-type", "logs", map[string]string{
+		"patch": "kind: DaemonSet\npatch: {}\n",
+	}))
+	configMaps.Add(newOverrideConfigMap("invalid", "logs", map[string]string{
+		"patch": "patch: {}\n",
+	}))
+	configMaps.Add(newOverrideConfigMap("other", "5678", map[string]string{
+		"patch": "kind: DaemonSet\npatch: {}\n",
+	}))
+	// Overrides must be in the containership namespace
+	outside := newOverrideConfigMap("outside", "1234", map[string]string{
+		"patch": "kind: DaemonSet\npatch: {}\n",
+	})
+	outside.Namespace = "default"
+	configMaps.Add(outside)
+
+	overrides, err := c.pluginOverrides(&csv3.Plugin{
+		ObjectMeta: metav1.ObjectMeta{Name: "1234"},
+		Spec: csv3.PluginSpec{
+			ID:   "1234",
+			Type: csv3.Logs,
+		},
+	})
+	assert.Nil(t, err)
+
+	sources := make([]string, 0)
+	for _, o := range overrides {
+		sources = append(sources, o.Source)
+	}
+	// Type overrides come first so ID overrides win
+	assert.Equal(t, []string{
+		"ConfigMap b-by-type key patch",
+		"ConfigMap a-by-id key a",
+		"ConfigMap a-by-id key b",
+	}, sources)
+
+	events := drainEvents(recorder)
+	assert.Len(t, events, 1)
+	assert.Contains(t, events[0], "InvalidOverride")
+	assert.Contains(t, events[0], "ConfigMap invalid key patch")
+}
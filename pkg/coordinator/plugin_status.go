@@ -0,0 +1,302 @@
+package coordinator
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/k8sutil/apply"
+	"github.com/containership/cluster-manager/pkg/log"
+	"github.com/containership/cluster-manager/pkg/resources"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+
+	appsv1 "k8s.io/api/apps/v1"
+	kubeerror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+// watchWorkloads sets up the workload informers used to determine the
+// readiness of plugins. Any change to a workload belonging to a plugin queues
+// a refresh of that plugin's status.
+func (c *PluginController) watchWorkloads(kubeInformerFactory kubeinformers.SharedInformerFactory) {
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueWorkloadPlugin,
+		UpdateFunc: func(old, new interface{}) {
+			c.enqueueWorkloadPlugin(new)
+
+			// Only changes to the spec can be drift, and those always
+			// change the generation
+			if old.(metav1.Object).GetGeneration() != new.(metav1.Object).GetGeneration() {
+				c.enqueueWorkloadDriftCheck(new)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.enqueueWorkloadPlugin(obj)
+			c.enqueueWorkloadDriftCheck(obj)
+		},
+	}
+
+	deploymentInformer := kubeInformerFactory.Apps().V1().Deployments()
+	deploymentInformer.Informer().AddEventHandler(handler)
+	c.deploymentLister = deploymentInformer.Lister()
+	c.deploymentsSynced = deploymentInformer.Informer().HasSynced
+
+	daemonSetInformer := kubeInformerFactory.Apps().V1().DaemonSets()
+	daemonSetInformer.Informer().AddEventHandler(handler)
+	c.daemonSetLister = daemonSetInformer.Lister()
+	c.daemonSetsSynced = daemonSetInformer.Informer().HasSynced
+
+	statefulSetInformer := kubeInformerFactory.Apps().V1().StatefulSets()
+	statefulSetInformer.Informer().AddEventHandler(handler)
+	c.statefulSetLister = statefulSetInformer.Lister()
+	c.statefulSetsSynced = statefulSetInformer.Informer().HasSynced
+}
+
+// enqueueWorkloadPlugin queues a status refresh for the plugin the workload
+// belongs to, if any
+func (c *PluginController) enqueueWorkloadPlugin(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	object, ok := obj.(metav1.Object)
+	if !ok {
+		log.Errorf("%s: expected workload but got %#v", pluginControllerName, obj)
+		return
+	}
+
+	// Plugins are named by their ID
+	id, ok := object.GetLabels()[pluginLabelKey]
+	if !ok {
+		return
+	}
+
+	c.statusWorkqueue.Add(constants.ContainershipNamespace + "/" + id)
+}
+
+// enqueueWorkloadDriftCheck queues a drift check for the plugin the workload
+// belongs to, if any
+func (c *PluginController) enqueueWorkloadDriftCheck(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	object, ok := obj.(metav1.Object)
+	if !ok {
+		log.Errorf("%s: expected workload but got %#v", pluginControllerName, obj)
+		return
+	}
+
+	if id, ok := object.GetLabels()[pluginLabelKey]; ok {
+		c.enqueueDriftCheck(id)
+	}
+}
+
+// runStatusWorker continually processes status refreshes from the status
+// workqueue
+func (c *PluginController) runStatusWorker() {
+	for c.processNextStatusItem() {
+	}
+}
+
+func (c *PluginController) processNextStatusItem() bool {
+	obj, shutdown := c.statusWorkqueue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.statusWorkqueue.Done(obj)
+
+	key, ok := obj.(string)
+	if !ok {
+		c.statusWorkqueue.Forget(obj)
+		log.Errorf("expected string in status workqueue but got %#v", obj)
+		return true
+	}
+
+	err := c.statusSyncHandler(key)
+	if err == nil {
+		c.statusWorkqueue.Forget(key)
+		return true
+	}
+
+	if c.statusWorkqueue.NumRequeues(key) < maxPluginControllerRetries {
+		c.statusWorkqueue.AddRateLimited(key)
+		return true
+	}
+
+	c.statusWorkqueue.Forget(key)
+	log.Infof("Dropping Plugin %q out of the status queue: %v", key, err)
+	return true
+}
+
+// statusSyncHandler refreshes the workload readiness in the status of the
+// plugin
+func (c *PluginController) statusSyncHandler(key string) error {
+	_, name, _ := cache.SplitMetaNamespaceKey(key)
+	plugin, err := c.pluginLister.Plugins(constants.ContainershipNamespace).Get(name)
+	if kubeerror.IsNotFound(err) {
+		// The workloads are being deleted along with the plugin
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "getting plugin failed with error other than not found")
+	}
+
+	workloads, err := c.workloadStatus(plugin.Spec.ID)
+	if err != nil {
+		return errors.Wrap(err, "getting workload status failed")
+	}
+
+	return c.updateStatus(plugin, func(status *csv3.PluginStatus) {
+		status.Workloads = workloads
+	})
+}
+
+// workloadStatus aggregates the readiness of the Deployments, DaemonSets and
+// StatefulSets belonging to the plugin with the given ID
+func (c *PluginController) workloadStatus(id string) (csv3.PluginWorkloadStatus, error) {
+	status := csv3.PluginWorkloadStatus{}
+	selector := labels.SelectorFromSet(labels.Set{pluginLabelKey: id})
+
+	add := func(kind string, object metav1.Object, ready bool) {
+		status.Total++
+		if ready {
+			status.Ready++
+			return
+		}
+
+		status.NotReady = append(status.NotReady,
+			fmt.Sprintf("%s %s/%s", kind, object.GetNamespace(), object.GetName()))
+	}
+
+	deployments, err := c.deploymentLister.List(selector)
+	if err != nil {
+		return status, err
+	}
+	for _, d := range deployments {
+		add("Deployment", d, deploymentReady(d))
+	}
+
+	daemonSets, err := c.daemonSetLister.List(selector)
+	if err != nil {
+		return status, err
+	}
+	for _, ds := range daemonSets {
+		add("DaemonSet", ds, daemonSetReady(ds))
+	}
+
+	statefulSets, err := c.statefulSetLister.List(selector)
+	if err != nil {
+		return status, err
+	}
+	for _, ss := range statefulSets {
+		add("StatefulSet", ss, statefulSetReady(ss))
+	}
+
+	// Listers return objects in no particular order
+	sort.Strings(status.NotReady)
+
+	return status, nil
+}
+
+// deploymentReady returns true if the latest spec of the deployment has been
+// rolled out and all of its replicas are available
+func deploymentReady(d *appsv1.Deployment) bool {
+	replicas := int32(1)
+	if d.Spec.Replicas != nil {
+		replicas = *d.Spec.Replicas
+	}
+
+	return d.Status.ObservedGeneration >= d.Generation &&
+		d.Status.UpdatedReplicas == replicas &&
+		d.Status.AvailableReplicas == replicas
+}
+
+// daemonSetReady returns true if the latest spec of the daemon set has been
+// rolled out and it's available on every node it should be scheduled on
+func daemonSetReady(ds *appsv1.DaemonSet) bool {
+	return ds.Status.ObservedGeneration >= ds.Generation &&
+		ds.Status.UpdatedNumberScheduled == ds.Status.DesiredNumberScheduled &&
+		ds.Status.NumberAvailable == ds.Status.DesiredNumberScheduled
+}
+
+// statefulSetReady returns true if the latest spec of the stateful set has
+// been rolled out and all of its replicas are ready
+func statefulSetReady(ss *appsv1.StatefulSet) bool {
+	replicas := int32(1)
+	if ss.Spec.Replicas != nil {
+		replicas = *ss.Spec.Replicas
+	}
+
+	return ss.Status.ObservedGeneration >= ss.Generation &&
+		ss.Status.UpdateRevision == ss.Status.CurrentRevision &&
+		ss.Status.ReadyReplicas == replicas
+}
+
+// setApplyResults records the results of applying the plugin in its status
+func setApplyResults(status *csv3.PluginStatus, results []apply.Result) {
+	status.LastApplyTime = time.Now().UTC().Format(time.RFC3339)
+	status.Objects = make([]csv3.PluginObjectStatus, 0, len(results))
+	// Applying replaces any drift
+	status.Drift = nil
+
+	for _, r := range results {
+		status.Objects = append(status.Objects, objectStatus(r))
+	}
+}
+
+// updateStatus changes the status of the plugin with mutate and writes it if
+// it changed, reporting it to Cloud. The sync, status and drift workers each
+// write their own part of the status, so on a conflict the latest plugin is
+// fetched and changed again instead of failing.
+func (c *PluginController) updateStatus(plugin *csv3.Plugin, mutate func(*csv3.PluginStatus)) error {
+	var written *csv3.PluginStatus
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		status := plugin.Status.DeepCopy()
+		mutate(status)
+		if reflect.DeepEqual(plugin.Status, *status) {
+			written = nil
+			return nil
+		}
+
+		pCopy := plugin.DeepCopy()
+		pCopy.Status = *status
+
+		_, err := c.clientset.ContainershipV3().Plugins(plugin.Namespace).UpdateStatus(pCopy)
+		if kubeerror.IsConflict(err) {
+			latest, getErr := c.clientset.ContainershipV3().Plugins(plugin.Namespace).Get(plugin.Name, metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+
+			plugin = latest
+		}
+
+		if err == nil {
+			written = status
+		}
+
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "updating plugin status failed")
+	}
+
+	if written == nil {
+		return nil
+	}
+
+	if err := resources.PostPluginCloudStatus(plugin.Spec.ID, *written); err != nil {
+		log.Errorf("Could not report status of Plugin %s to Cloud: %s", plugin.Name, err)
+	}
+
+	return nil
+}
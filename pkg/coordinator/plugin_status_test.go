@@ -0,0 +1,188 @@
+package coordinator
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/k8sutil/apply"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func workloadMeta(name string, pluginID string) metav1.ObjectMeta {
+	meta := metav1.ObjectMeta{
+		Name:       name,
+		Namespace:  "containership-core",
+		Generation: 2,
+	}
+
+	if pluginID != "" {
+		meta.Labels = map[string]string{pluginLabelKey: pluginID}
+	}
+
+	return meta
+}
+
+func TestDeploymentReady(t *testing.T) {
+	d := &appsv1.Deployment{
+		ObjectMeta: workloadMeta("deployment", ""),
+		Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(2)},
+		Status: appsv1.DeploymentStatus{
+			ObservedGeneration: 2,
+			UpdatedReplicas:    2,
+			AvailableReplicas:  2,
+		},
+	}
+	assert.True(t, deploymentReady(d))
+
+	d.Status.AvailableReplicas = 1
+	assert.False(t, deploymentReady(d))
+
+	// The latest spec hasn't been seen yet
+	d.Status.AvailableReplicas = 2
+	d.Status.ObservedGeneration = 1
+	assert.False(t, deploymentReady(d))
+}
+
+func TestDaemonSetReady(t *testing.T) {
+	ds := &appsv1.DaemonSet{
+		ObjectMeta: workloadMeta("daemonset", ""),
+		Status: appsv1.DaemonSetStatus{
+			ObservedGeneration:     2,
+			DesiredNumberScheduled: 3,
+			UpdatedNumberScheduled: 3,
+			NumberAvailable:        3,
+		},
+	}
+	assert.True(t, daemonSetReady(ds))
+
+	ds.Status.UpdatedNumberScheduled = 2
+	assert.False(t, daemonSetReady(ds))
+}
+
+func TestStatefulSetReady(t *testing.T) {
+	ss := &appsv1.StatefulSet{
+		ObjectMeta: workloadMeta("statefulset", ""),
+		Status: appsv1.StatefulSetStatus{
+			ObservedGeneration: 2,
+			ReadyReplicas:      1,
+			CurrentRevision:    "a",
+			UpdateRevision:     "a",
+		},
+	}
+	// Replicas default to 1
+	assert.True(t, statefulSetReady(ss))
+
+	ss.Status.UpdateRevision = "b"
+	assert.False(t, statefulSetReady(ss))
+}
+
+func TestWorkloadStatus(t *testing.T) {
+	factory := kubeinformers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	c := &PluginController{}
+	c.watchWorkloads(factory)
+
+	deployments := factory.Apps().V1().Deployments().Informer().GetIndexer()
+	deployments.Add(&appsv1.Deployment{
+		ObjectMeta: workloadMeta("ready", "1234"),
+		Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(1)},
+		Status: appsv1.DeploymentStatus{
+			ObservedGeneration: 2,
+			UpdatedReplicas:    1,
+			AvailableReplicas:  1,
+		},
+	})
+	deployments.Add(&appsv1.Deployment{
+		ObjectMeta: workloadMeta("not-ready", "1234"),
+		Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(1)},
+	})
+	// Belongs to another plugin
+	deployments.Add(&appsv1.Deployment{
+		ObjectMeta: workloadMeta("other", "5678"),
+	})
+
+	factory.Apps().V1().DaemonSets().Informer().GetIndexer().Add(&appsv1.DaemonSet{
+		ObjectMeta: workloadMeta("daemonset", "1234"),
+		Status: appsv1.DaemonSetStatus{
+			ObservedGeneration: 2,
+		},
+	})
+
+	factory.Apps().V1().StatefulSets().Informer().GetIndexer().Add(&appsv1.StatefulSet{
+		ObjectMeta: workloadMeta("statefulset", "1234"),
+	})
+
+	status, err := c.workloadStatus("1234")
+	assert.Nil(t, err)
+	assert.Equal(t, csv3.PluginWorkloadStatus{
+		Total: 4,
+		Ready: 2,
+		NotReady: []string{
+			"Deployment containership-core/not-ready",
+			"StatefulSet containership-core/statefulset",
+		},
+	}, status)
+
+	status, err = c.workloadStatus("none")
+	assert.Nil(t, err)
+	assert.Equal(t, csv3.PluginWorkloadStatus{}, status)
+}
+
+func TestEnqueueWorkloadPlugin(t *testing.T) {
+	c := &PluginController{
+		statusWorkqueue: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+
+	c.enqueueWorkloadPlugin(&appsv1.Deployment{ObjectMeta: workloadMeta("unlabeled", "")})
+	assert.Equal(t, 0, c.statusWorkqueue.Len())
+
+	c.enqueueWorkloadPlugin(&appsv1.Deployment{ObjectMeta: workloadMeta("labeled", "1234")})
+	c.enqueueWorkloadPlugin(cache.DeletedFinalStateUnknown{
+		Obj: &appsv1.DaemonSet{ObjectMeta: workloadMeta("deleted", "1234")},
+	})
+	assert.Equal(t, 1, c.statusWorkqueue.Len())
+
+	key, _ := c.statusWorkqueue.Get()
+	assert.Equal(t, constants.ContainershipNamespace+"/1234", key)
+}
+
+func TestSetApplyResults(t *testing.T) {
+	status := &csv3.PluginStatus{}
+	setApplyResults(status, []apply.Result{{
+		Kind:      "ConfigMap",
+		Namespace: "containership-core",
+		Name:      "config",
+		Action:    apply.ActionCreated,
+	}, {
+		Kind:   "ClusterRole",
+		Name:   "role",
+		Action: apply.ActionFailed,
+		Err:    errors.New("forbidden"),
+	}})
+
+	assert.NotEmpty(t, status.LastApplyTime)
+	assert.Equal(t, []csv3.PluginObjectStatus{{
+		Kind:      "ConfigMap",
+		Namespace: "containership-core",
+		Name:      "config",
+		Action:    "created",
+	}, {
+		Kind:    "ClusterRole",
+		Name:    "role",
+		Action:  "failed",
+		Message: "forbidden",
+	}}, status.Objects)
+}
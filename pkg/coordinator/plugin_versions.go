@@ -0,0 +1,376 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+
+	"github.com/pkg/errors"
+
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/k8sutil/apply"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// pluginVersionsLabelKey labels the ConfigMaps holding the manifests and
+	// jobs of a version of the plugin with the name in its value. Cloud only
+	// serves the current version of a plugin, so versions are stored once
+	// applied to be able to roll back to them, including after the
+	// coordinator restarts. Each version has its own ConfigMap so that a
+	// large version, e.g. one with a rendered Helm chart, can't push the
+	// others over the ConfigMap size limit.
+	pluginVersionsLabelKey = "containership.io/plugin-versions"
+
+	// pluginVersionAnnotation annotates the ConfigMap of a version with the
+	// version, since the name only holds a hash of it
+	pluginVersionAnnotation = "containership.io/plugin-version"
+
+	// pluginVersionKey is the key of the details in a version ConfigMap
+	pluginVersionKey = "details"
+
+	// pluginScopesLabelKey labels the ConfigMap holding the resources and
+	// namespaces the plugin with the name in its value applied objects to,
+	// so that only those are searched when pruning or deleting its objects
+	pluginScopesLabelKey = "containership.io/plugin-scopes"
+
+	// pluginScopesKey is the key of the scopes in a scopes ConfigMap
+	pluginScopesKey = "scopes"
+
+	// legacyPluginScopesAnnotation annotated the single ConfigMap older
+	// coordinators stored all versions of a plugin in with its scopes
+	legacyPluginScopesAnnotation = "containership.io/plugin-scopes"
+
+	// maxStoredPluginVersions is how many versions from the history of a
+	// plugin are kept for rolling back
+	maxStoredPluginVersions = 5
+
+	// maxConfigMapDataSize is the most data the API server accepts in a
+	// ConfigMap
+	maxConfigMapDataSize = 1024 * 1024
+)
+
+// pluginVersionConfigMapName returns the name of the ConfigMap holding the
+// version of the plugin. Versions may contain characters names can't, so
+// the name holds a hash of the version.
+func pluginVersionConfigMapName(plugin, version string) string {
+	h := fnv.New64a()
+	h.Write([]byte(version))
+
+	return fmt.Sprintf("plugin-version-%s-%x", plugin, h.Sum64())
+}
+
+// pluginScopesConfigMapName returns the name of the ConfigMap holding the
+// scopes of the plugin
+func pluginScopesConfigMapName(plugin string) string {
+	return "plugin-scopes-" + plugin
+}
+
+// legacyPluginVersionsConfigMapName returns the name of the single ConfigMap
+// older coordinators stored all versions of the plugin in, keyed by version
+func legacyPluginVersionsConfigMapName(plugin string) string {
+	return "plugin-versions-" + plugin
+}
+
+// rollbackVersions returns the versions the plugin may be rolled back to,
+// which are the version that was last applied and the most recent versions
+// in its history
+func rollbackVersions(plugin *csv3.Plugin) []string {
+	versions := make([]string, 0)
+	if plugin.Status.Version != "" {
+		versions = append(versions, plugin.Status.Version)
+	}
+
+	history := getPluginHistory(plugin)
+	if len(history) > maxStoredPluginVersions {
+		history = history[len(history)-maxStoredPluginVersions:]
+	}
+
+	for _, spec := range history {
+		versions = append(versions, spec.Version)
+	}
+
+	return versions
+}
+
+// copyPluginDetails returns a deep copy of the details, which are modified
+// when applied, e.g. when defaulting jobs
+func copyPluginDetails(details *jsonPluginsResponse) (*jsonPluginsResponse, error) {
+	data, err := json.Marshal(details)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePluginDetails(data)
+}
+
+// savePluginVersion stores the details of the version of the plugin. Only
+// the versions in keep are kept alongside it, so versions that can no longer
+// be rolled back to are removed.
+func (c *PluginController) savePluginVersion(plugin, version string, details *jsonPluginsResponse, keep []string) error {
+	data, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+
+	err = c.writePluginConfigMap(newPluginVersionConfigMap(plugin, version, string(data)))
+	if err != nil {
+		return errors.Wrap(err, "storing plugin version failed")
+	}
+
+	if err := c.migrateLegacyPluginVersions(plugin, keep); err != nil {
+		return errors.Wrap(err, "migrating stored plugin versions failed")
+	}
+
+	return errors.Wrap(c.prunePluginVersions(plugin, append(keep, version)), "removing stored plugin versions failed")
+}
+
+// newPluginVersionConfigMap returns the ConfigMap storing the details of the
+// version of the plugin
+func newPluginVersionConfigMap(plugin, version, details string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pluginVersionConfigMapName(plugin, version),
+			Namespace: constants.ContainershipNamespace,
+			Labels: map[string]string{
+				pluginVersionsLabelKey: plugin,
+			},
+			Annotations: map[string]string{
+				pluginVersionAnnotation: version,
+			},
+		},
+		Data: map[string]string{
+			pluginVersionKey: details,
+		},
+	}
+}
+
+// prunePluginVersions removes the stored versions of the plugin that aren't
+// kept. They're listed from the API rather than the cache so that versions
+// that were only just stored are removed too.
+func (c *PluginController) prunePluginVersions(plugin string, keep []string) error {
+	configMaps := c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace)
+	list, err := configMaps.List(metav1.ListOptions{
+		LabelSelector: pluginVersionsLabelKey + "=" + plugin,
+	})
+	if err != nil {
+		return err
+	}
+
+	kept := make(map[string]bool, len(keep))
+	for _, v := range keep {
+		kept[v] = true
+	}
+
+	for _, configMap := range list.Items {
+		// The legacy ConfigMap isn't a version
+		version, ok := configMap.Annotations[pluginVersionAnnotation]
+		if !ok || kept[version] {
+			continue
+		}
+
+		err := configMaps.Delete(configMap.Name, &metav1.DeleteOptions{})
+		if err != nil && !kubeerrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateLegacyPluginVersions moves the versions in keep and the scopes out
+// of the single ConfigMap older coordinators stored all versions of the
+// plugin in, then deletes it
+func (c *PluginController) migrateLegacyPluginVersions(plugin string, keep []string) error {
+	name := legacyPluginVersionsConfigMapName(plugin)
+	legacy, err := c.configMapLister.ConfigMaps(constants.ContainershipNamespace).Get(name)
+	if kubeerrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, v := range keep {
+		data, ok := legacy.Data[v]
+		if !ok {
+			continue
+		}
+
+		if err := c.writePluginConfigMap(newPluginVersionConfigMap(plugin, v, data)); err != nil {
+			return err
+		}
+	}
+
+	// Scopes written since are newer than the legacy ones
+	if data, ok := legacy.Annotations[legacyPluginScopesAnnotation]; ok {
+		_, err := c.configMapLister.ConfigMaps(constants.ContainershipNamespace).Get(pluginScopesConfigMapName(plugin))
+		if kubeerrors.IsNotFound(err) {
+			err = c.writePluginScopesData(plugin, data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace).Delete(name, &metav1.DeleteOptions{})
+	if kubeerrors.IsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+// savePluginScopes records the scopes the plugin applied objects to
+func (c *PluginController) savePluginScopes(plugin string, scopes []apply.Scope) error {
+	data, err := json.Marshal(scopes)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(c.writePluginScopesData(plugin, string(data)), "storing plugin scopes failed")
+}
+
+// writePluginScopesData writes the scopes ConfigMap of the plugin
+func (c *PluginController) writePluginScopesData(plugin, data string) error {
+	return c.writePluginConfigMap(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pluginScopesConfigMapName(plugin),
+			Namespace: constants.ContainershipNamespace,
+			Labels: map[string]string{
+				pluginScopesLabelKey: plugin,
+			},
+		},
+		Data: map[string]string{
+			pluginScopesKey: data,
+		},
+	})
+}
+
+// pluginScopes returns the scopes the plugin applied objects to. They are nil
+// if they were never recorded, e.g. because the plugin was applied before
+// they were.
+func (c *PluginController) pluginScopes(plugin string) ([]apply.Scope, error) {
+	configMaps := c.configMapLister.ConfigMaps(constants.ContainershipNamespace)
+
+	var data string
+	configMap, err := configMaps.Get(pluginScopesConfigMapName(plugin))
+	switch {
+	case err == nil:
+		data = configMap.Data[pluginScopesKey]
+	case kubeerrors.IsNotFound(err):
+		// The scopes may still be where older coordinators stored them
+		legacy, err := configMaps.Get(legacyPluginVersionsConfigMapName(plugin))
+		if kubeerrors.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = legacy.Annotations[legacyPluginScopesAnnotation]
+	default:
+		return nil, err
+	}
+
+	if data == "" {
+		return nil, nil
+	}
+
+	scopes := make([]apply.Scope, 0)
+	err = json.Unmarshal([]byte(data), &scopes)
+	return scopes, err
+}
+
+// writePluginConfigMap creates the ConfigMap, or replaces the labels,
+// annotations and data of the existing one if they differ. ConfigMaps too
+// large for the API server are rejected up front. On a conflict the latest
+// ConfigMap is fetched and replaced again instead of failing.
+func (c *PluginController) writePluginConfigMap(configMap *corev1.ConfigMap) error {
+	size := 0
+	for k, v := range configMap.Data {
+		size += len(k) + len(v)
+	}
+	if size > maxConfigMapDataSize {
+		return fmt.Errorf("ConfigMap %s would be %d bytes, more than the limit of %d bytes",
+			configMap.Name, size, maxConfigMapDataSize)
+	}
+
+	configMaps := c.kubeclientset.CoreV1().ConfigMaps(configMap.Namespace)
+
+	existing, err := c.configMapLister.ConfigMaps(configMap.Namespace).Get(configMap.Name)
+	if err != nil && !kubeerrors.IsNotFound(err) {
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if existing == nil {
+			_, err := configMaps.Create(configMap)
+			if !kubeerrors.IsAlreadyExists(err) {
+				return err
+			}
+
+			// The cache didn't have the ConfigMap yet
+			existing, err = configMaps.Get(configMap.Name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+		}
+
+		if reflect.DeepEqual(existing.Labels, configMap.Labels) &&
+			reflect.DeepEqual(existing.Annotations, configMap.Annotations) &&
+			reflect.DeepEqual(existing.Data, configMap.Data) {
+			return nil
+		}
+
+		cmCopy := existing.DeepCopy()
+		cmCopy.Labels = configMap.Labels
+		cmCopy.Annotations = configMap.Annotations
+		cmCopy.Data = configMap.Data
+
+		_, err := configMaps.Update(cmCopy)
+		if kubeerrors.IsConflict(err) {
+			latest, getErr := configMaps.Get(configMap.Name, metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			existing = latest
+		}
+
+		return err
+	})
+}
+
+// loadPluginVersion returns the stored details of the version of the plugin
+func (c *PluginController) loadPluginVersion(plugin, version string) (*jsonPluginsResponse, error) {
+	configMaps := c.configMapLister.ConfigMaps(constants.ContainershipNamespace)
+
+	configMap, err := configMaps.Get(pluginVersionConfigMapName(plugin, version))
+	if err != nil && !kubeerrors.IsNotFound(err) {
+		return nil, err
+	}
+	if configMap != nil && configMap.Annotations[pluginVersionAnnotation] == version {
+		if data, ok := configMap.Data[pluginVersionKey]; ok {
+			return parsePluginDetails([]byte(data))
+		}
+	}
+
+	// The version may still be where older coordinators stored it
+	legacy, err := configMaps.Get(legacyPluginVersionsConfigMapName(plugin))
+	if err != nil && !kubeerrors.IsNotFound(err) {
+		return nil, err
+	}
+	if legacy != nil {
+		if data, ok := legacy.Data[version]; ok {
+			return parsePluginDetails([]byte(data))
+		}
+	}
+
+	return nil, fmt.Errorf("version %s of plugin %s was never applied on this cluster", version, plugin)
+}
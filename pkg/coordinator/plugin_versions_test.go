@@ -0,0 +1,170 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/k8sutil/apply"
+
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRollbackVersions(t *testing.T) {
+	history := make([]csv3.PluginSpec, 0)
+	for _, v := range []string{"1.0.0", "2.0.0", "3.0.0", "4.0.0", "5.0.0", "6.0.0"} {
+		history = append(history, csv3.PluginSpec{Version: v})
+	}
+	data, _ := json.Marshal(history)
+
+	plugin := &csv3.Plugin{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				constants.PluginHistoryAnnotation: string(data),
+			},
+		},
+		Status: csv3.PluginStatus{Version: "6.0.0"},
+	}
+
+	assert.Equal(t, []string{"6.0.0", "2.0.0", "3.0.0", "4.0.0", "5.0.0", "6.0.0"}, rollbackVersions(plugin))
+	assert.Empty(t, rollbackVersions(&csv3.Plugin{}))
+}
+
+func TestSavePluginVersion(t *testing.T) {
+	plugin := &csv3.Plugin{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "1234",
+			Namespace: constants.ContainershipNamespace,
+			Annotations: map[string]string{
+				constants.PluginHistoryAnnotation: testPluginHistory,
+			},
+		},
+		Spec: csv3.PluginSpec{ID: "1234", Version: "2.0.0"},
+	}
+
+	c, _ := newBundleTestController(nil)
+	assert.Nil(t, c.savePluginVersion("1234", "1.0.0", testPluginDetails, nil))
+	// Versions don't have to be valid names
+	assert.Nil(t, c.savePluginVersion("1234", "1.0.0+build", testPluginDetails, []string{"1.0.0"}))
+
+	configMaps := c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace)
+	cm, err := configMaps.Get(pluginVersionConfigMapName("1234", "1.0.0"), metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "1234", cm.Labels[pluginVersionsLabelKey])
+	assert.Equal(t, "1.0.0", cm.Annotations[pluginVersionAnnotation])
+	build, err := configMaps.Get(pluginVersionConfigMapName("1234", "1.0.0+build"), metav1.GetOptions{})
+	assert.Nil(t, err)
+
+	// Versions other than the spec version are read from the ConfigMap
+	// instead of Cloud
+	c, _ = newBundleTestController([]*corev1.ConfigMap{cm, build})
+	details, err := c.getPluginDetails(plugin, "1.0.0")
+	assert.Nil(t, err)
+	assert.Len(t, details.Manifests, len(testPluginDetails.Manifests))
+
+	_, err = c.getPluginDetails(plugin, "0.1.0")
+	assert.NotNil(t, err)
+
+	// Versions that aren't kept are removed
+	assert.Nil(t, c.savePluginVersion("1234", "2.0.0", testPluginDetails, []string{"1.0.0"}))
+	list, err := c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace).List(metav1.ListOptions{
+		LabelSelector: pluginVersionsLabelKey + "=1234",
+	})
+	assert.Nil(t, err)
+	versions := make([]string, 0)
+	for _, cm := range list.Items {
+		versions = append(versions, cm.Annotations[pluginVersionAnnotation])
+	}
+	assert.ElementsMatch(t, []string{"1.0.0", "2.0.0"}, versions)
+}
+
+func TestSavePluginVersionTooLarge(t *testing.T) {
+	c, _ := newBundleTestController(nil)
+	assert.Nil(t, c.savePluginVersion("1234", "1.0.0", testPluginDetails, nil))
+
+	large := &jsonPluginsResponse{
+		Manifests: [][]interface{}{{map[string]interface{}{
+			"kind": "ConfigMap",
+			"data": map[string]interface{}{"large": strings.Repeat("x", maxConfigMapDataSize)},
+		}}},
+	}
+	assert.NotNil(t, c.savePluginVersion("1234", "2.0.0", large, []string{"1.0.0"}))
+
+	// The versions already stored are kept
+	_, err := c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace).Get(
+		pluginVersionConfigMapName("1234", "1.0.0"), metav1.GetOptions{})
+	assert.Nil(t, err)
+	_, err = c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace).Get(
+		pluginVersionConfigMapName("1234", "2.0.0"), metav1.GetOptions{})
+	assert.NotNil(t, err)
+}
+
+func TestSavePluginScopes(t *testing.T) {
+	c, _ := newBundleTestController(nil)
+
+	scopes, err := c.pluginScopes("1234")
+	assert.Nil(t, err)
+	assert.Nil(t, scopes, "scopes that were never recorded are unknown")
+
+	recorded := []apply.Scope{{Version: "v1", Resource: "configmaps", Namespace: "default"}}
+	assert.Nil(t, c.savePluginScopes("1234", recorded))
+
+	cm, err := c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace).Get(
+		pluginScopesConfigMapName("1234"), metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "1234", cm.Labels[pluginScopesLabelKey])
+
+	c, _ = newBundleTestController([]*corev1.ConfigMap{cm})
+	scopes, err = c.pluginScopes("1234")
+	assert.Nil(t, err)
+	assert.Equal(t, recorded, scopes)
+}
+
+func TestMigrateLegacyPluginVersions(t *testing.T) {
+	legacyScopes := []apply.Scope{{Version: "v1", Resource: "configmaps", Namespace: "default"}}
+	scopesData, _ := json.Marshal(legacyScopes)
+	legacy := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        legacyPluginVersionsConfigMapName("1234"),
+			Namespace:   constants.ContainershipNamespace,
+			Labels:      map[string]string{pluginVersionsLabelKey: "1234"},
+			Annotations: map[string]string{legacyPluginScopesAnnotation: string(scopesData)},
+		},
+		Data: map[string]string{
+			"1.0.0": `{"manifests": []}`,
+			"2.0.0": `{"manifests": [[{"kind": "ConfigMap"}]]}`,
+		},
+	}
+
+	c, _ := newBundleTestController([]*corev1.ConfigMap{legacy})
+
+	// Versions and scopes stored by older coordinators are still read
+	scopes, err := c.pluginScopes("1234")
+	assert.Nil(t, err)
+	assert.Equal(t, legacyScopes, scopes)
+	details, err := c.loadPluginVersion("1234", "2.0.0")
+	assert.Nil(t, err)
+	assert.Len(t, details.Manifests, 1)
+
+	assert.Nil(t, c.savePluginVersion("1234", "3.0.0", testPluginDetails, []string{"2.0.0"}))
+
+	configMaps := c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace)
+	_, err = configMaps.Get(legacyPluginVersionsConfigMapName("1234"), metav1.GetOptions{})
+	assert.True(t, kubeerrors.IsNotFound(err), "the legacy ConfigMap is deleted")
+
+	cm, err := configMaps.Get(pluginVersionConfigMapName("1234", "2.0.0"), metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, legacy.Data["2.0.0"], cm.Data[pluginVersionKey])
+	_, err = configMaps.Get(pluginVersionConfigMapName("1234", "1.0.0"), metav1.GetOptions{})
+	assert.True(t, kubeerrors.IsNotFound(err), "versions that aren't kept aren't migrated")
+
+	cm, err = configMaps.Get(pluginScopesConfigMapName("1234"), metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, string(scopesData), cm.Data[pluginScopesKey])
+}
@@ -1,7 +1,9 @@
 package coordinator
 
 import (
+	"encoding/json"
 	"fmt"
+	"reflect"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
@@ -22,7 +24,9 @@ import (
 	csinformers "github.com/containership/cluster-manager/pkg/client/informers/externalversions"
 	cslisters "github.com/containership/cluster-manager/pkg/client/listers/containership.io/v3"
 	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/env"
 	"github.com/containership/cluster-manager/pkg/log"
+	"github.com/containership/cluster-manager/pkg/resources/registry"
 	"github.com/containership/cluster-manager/pkg/tools"
 )
 
@@ -41,6 +45,25 @@ const (
 	DockerJSONStringFormat = `{"auths":{"%s":{"auth":"%s","email":"none"}}}`
 )
 
+const (
+	// CombinedRegistrySecretName is the name of the secret holding the
+	// credentials of every registry when combined registry secrets are enabled
+	CombinedRegistrySecretName = "containership-registries"
+)
+
+// dockerConfigJSON is the format of a ~/.docker/config.json file
+type dockerConfigJSON struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+// dockerConfigEntry is the auth for a single registry in a docker config
+type dockerConfigEntry struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+	Email    string `json:"email,omitempty"`
+}
+
 // RegistryController is the controller implementation for Registry resources
 type RegistryController struct {
 	// kubeclientset is a standard kubernetes clientset
@@ -426,6 +449,16 @@ func (c *RegistryController) getUpdatedImagePullSecrets() ([]corev1.LocalObjectR
 		return imagePullSecrets, err
 	}
 
+	if env.IsCombinedRegistrySecretEnabled() {
+		if len(registries) > 0 {
+			imagePullSecrets = append(imagePullSecrets, corev1.LocalObjectReference{
+				Name: CombinedRegistrySecretName,
+			})
+		}
+
+		return imagePullSecrets, nil
+	}
+
 	for _, registry := range registries {
 		imagePullSecrets = append(imagePullSecrets, corev1.LocalObjectReference{
 			Name: registry.Name,
@@ -454,6 +487,16 @@ func (c *RegistryController) registrySyncHandler(key string) error {
 		return err
 	}
 
+	// Every registry change affects the contents of the combined secret, so
+	// each namespace is re-synced rather than just this registry's secret
+	if env.IsCombinedRegistrySecretEnabled() {
+		for _, ns := range namespaces {
+			c.enqueueNamespace(ns)
+		}
+
+		return nil
+	}
+
 	// Get the Registry resource with this namespace/name
 	registry, err := c.registriesLister.Registries(namespace).Get(name)
 	if err != nil {
@@ -484,15 +527,24 @@ func (c *RegistryController) registrySyncHandler(key string) error {
 		return err
 	}
 
+	token, err := c.authToken(registry)
+	if err != nil {
+		c.recorder.Eventf(registry, corev1.EventTypeWarning, "GetCredentialsError",
+			"Error getting registry credentials: %s", err.Error())
+		return err
+	}
+
+	desired := newSecret(registry, token)
+
 	for _, ns := range namespaces {
 		log.Debugf("%s: Searching namespace %s, for secret %s", registryControllerName, ns.Name, registry.Name)
-		_, err = c.secretsLister.Secrets(ns.Name).Get(registry.Name)
+		existing, err := c.secretsLister.Secrets(ns.Name).Get(registry.Name)
 
 		if errors.IsNotFound(err) {
 			c.recorder.Eventf(registry, corev1.EventTypeNormal, "CreateSecret",
 				"Detected missing secret in namespace %s, creating", ns.Name)
 
-			_, err = c.kubeclientset.CoreV1().Secrets(ns.Name).Create(newSecret(registry))
+			_, err = c.kubeclientset.CoreV1().Secrets(ns.Name).Create(desired)
 
 			// Add service account for each namespace to queue so newly added secrets
 			// get their ID added to ImagePullSecrets
@@ -504,6 +556,21 @@ func (c *RegistryController) registrySyncHandler(key string) error {
 			c.recorder.Eventf(registry, corev1.EventTypeWarning, "ListSecretError",
 				"Error listing secrets in namespace %s: %s", ns.Name, err.Error())
 			return err
+		} else if !reflect.DeepEqual(existing.Data, desired.Data) {
+			// The token was regenerated since the secret was created
+			c.recorder.Eventf(registry, corev1.EventTypeNormal, "UpdateSecret",
+				"Detected out-of-date secret in namespace %s, updating", ns.Name)
+
+			sCopy := existing.DeepCopy()
+			sCopy.Data = desired.Data
+			sCopy.Type = desired.Type
+			_, err = c.kubeclientset.CoreV1().Secrets(ns.Name).Update(sCopy)
+		}
+
+		if err != nil {
+			c.recorder.Eventf(registry, corev1.EventTypeWarning, "UpdateSecretError",
+				"Error updating secret in namespace %s: %s", ns.Name, err.Error())
+			return err
 		}
 	}
 
@@ -528,8 +595,35 @@ func (c *RegistryController) namespaceSyncHandler(key string) error {
 		return err
 	}
 
+	if env.IsCombinedRegistrySecretEnabled() {
+		return c.syncCombinedSecret(ns, registries)
+	}
+
+	// The combined secret is left behind if combined mode was switched off
+	if _, err := c.secretsLister.Secrets(nsName).Get(CombinedRegistrySecretName); err == nil {
+		err = c.kubeclientset.CoreV1().Secrets(nsName).Delete(CombinedRegistrySecretName, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+
+		c.addServiceAccountToWorkqueue(nsName)
+	}
+
 	for _, registry := range registries {
-		_, err = c.kubeclientset.CoreV1().Secrets(nsName).Create(newSecret(registry))
+		// Don't bother resolving the token if the secret is already there
+		if _, err := c.secretsLister.Secrets(nsName).Get(registry.Name); err == nil {
+			continue
+		}
+
+		var token csv3.AuthTokenDef
+		token, err = c.authToken(registry)
+		if err != nil {
+			c.recorder.Eventf(ns, corev1.EventTypeWarning, "UpdateNamespaceSecretsError",
+				"Error getting credentials of registry %s: %s", registry.Name, err.Error())
+			break
+		}
+
+		_, err = c.kubeclientset.CoreV1().Secrets(nsName).Create(newSecret(registry, token))
 
 		// If the error is that the secret already exists, we want to clear the
 		// error so that it will be ignored
@@ -550,6 +644,93 @@ func (c *RegistryController) namespaceSyncHandler(key string) error {
 	return err
 }
 
+// syncCombinedSecret converges the combined registry secret in a namespace to
+// contain the credentials of all registries. The secret is removed if there are
+// no registries left.
+func (c *RegistryController) syncCombinedSecret(ns *corev1.Namespace, registries []*csv3.Registry) error {
+	tokens := make([]csv3.AuthTokenDef, 0)
+	for _, r := range registries {
+		token, err := c.authToken(r)
+		if err != nil {
+			c.recorder.Eventf(ns, corev1.EventTypeWarning, "UpdateNamespaceSecretsError",
+				"Error getting credentials of registry %s: %s", r.Name, err.Error())
+			return err
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	if err := c.deleteRegistrySecrets(ns, registries); err != nil {
+		return err
+	}
+
+	desired, err := newCombinedSecret(tokens)
+	if err != nil {
+		return err
+	}
+
+	existing, err := c.secretsLister.Secrets(ns.Name).Get(CombinedRegistrySecretName)
+	switch {
+	case errors.IsNotFound(err):
+		if len(registries) == 0 {
+			return nil
+		}
+
+		c.recorder.Event(ns, corev1.EventTypeNormal, "CreateSecret",
+			"Detected missing combined registry secret, creating")
+		_, err = c.kubeclientset.CoreV1().Secrets(ns.Name).Create(desired)
+	case err != nil:
+		return err
+	case len(registries) == 0:
+		err = c.kubeclientset.CoreV1().Secrets(ns.Name).Delete(CombinedRegistrySecretName, &metav1.DeleteOptions{})
+	case !reflect.DeepEqual(existing.Data, desired.Data):
+		c.recorder.Event(ns, corev1.EventTypeNormal, "UpdateSecret",
+			"Detected out-of-date combined registry secret, updating")
+		sCopy := existing.DeepCopy()
+		sCopy.Data = desired.Data
+		sCopy.Type = desired.Type
+		_, err = c.kubeclientset.CoreV1().Secrets(ns.Name).Update(sCopy)
+	default:
+		return nil
+	}
+
+	if err != nil {
+		c.recorder.Eventf(ns, corev1.EventTypeWarning, "UpdateNamespaceSecretsError",
+			"Error updating combined registry secret: %s", err.Error())
+		return err
+	}
+
+	// The combined secret was created or removed, so the service account may
+	// need its image pull secrets updated
+	c.addServiceAccountToWorkqueue(ns.Name)
+	return nil
+}
+
+// deleteRegistrySecrets removes the per-registry secrets from a namespace,
+// which are left behind when switching to the combined secret
+func (c *RegistryController) deleteRegistrySecrets(ns *corev1.Namespace, registries []*csv3.Registry) error {
+	for _, r := range registries {
+		_, err := c.secretsLister.Secrets(ns.Name).Get(r.Name)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = c.kubeclientset.CoreV1().Secrets(ns.Name).Delete(r.Name, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			c.recorder.Eventf(ns, corev1.EventTypeWarning, "UpdateNamespaceSecretsError",
+				"Error deleting secret of registry %s: %s", r.Name, err.Error())
+			return err
+		}
+
+		c.addServiceAccountToWorkqueue(ns.Name)
+	}
+
+	return nil
+}
+
 // enqueueRegistry takes a Registry resource and converts it into a kind/namespace/name
 // string which is then put onto the work queue. This method should *not* be
 // passed resources of any type other than Registry.
@@ -616,6 +797,19 @@ func (c *RegistryController) queueSecretOwnerRegistryIfApplicable(obj interface{
 
 	log.Debugf("%s: Processing object: %s in %s", registryControllerName, object.GetName(), object.GetNamespace())
 	if s, ok := obj.(*corev1.Secret); ok {
+		// The combined secret belongs to all registries, so the namespace it
+		// lives in is re-synced instead
+		if env.IsCombinedRegistrySecretEnabled() && s.Name == CombinedRegistrySecretName {
+			c.workqueue.AddRateLimited("namespace/" + s.Namespace)
+			return
+		}
+
+		// Registries that get their token from this secret need it copied to
+		// their image pull secrets
+		if s.Namespace == constants.ContainershipNamespace && c.queueCredentialsSecretRegistries(s) {
+			return
+		}
+
 		// registry will only ever belong to the containership core namespace
 		registry, err := c.registriesLister.Registries(constants.ContainershipNamespace).Get(s.Name)
 		if err != nil {
@@ -628,11 +822,51 @@ func (c *RegistryController) queueSecretOwnerRegistryIfApplicable(obj interface{
 	}
 }
 
-// newSecret creates a new Secret for a Registry resource. It sets name
-// to be the same as its parent registry to couple them together
-func newSecret(registry *csv3.Registry) *corev1.Secret {
-	rs := registry.Spec
-	rdt := rs.AuthToken.Type
+// queueCredentialsSecretRegistries enqueues the Registry resources that read
+// their auth token from the given secret. It returns true if there were any.
+func (c *RegistryController) queueCredentialsSecretRegistries(s *corev1.Secret) bool {
+	registries, err := c.registriesLister.Registries(constants.ContainershipNamespace).List(labels.NewSelector())
+	if err != nil {
+		log.Errorf("%s: Error listing registries: %v", registryControllerName, err)
+		return false
+	}
+
+	found := false
+	for _, r := range registries {
+		if r.Spec.CredentialsSecret == s.Name {
+			c.enqueueRegistry(r)
+			found = true
+		}
+	}
+
+	return found
+}
+
+// authToken returns the auth token of a registry with the token resolved from
+// its credentials secret. A regenerated token is picked up when the secret
+// update reaches the cache, since that re-syncs the registry.
+// Registries created before credentials were moved to a secret still hold the
+// token themselves.
+func (c *RegistryController) authToken(r *csv3.Registry) (csv3.AuthTokenDef, error) {
+	token := r.Spec.AuthToken
+	if r.Spec.CredentialsSecret == "" {
+		return token, nil
+	}
+
+	s, err := c.secretsLister.Secrets(r.Namespace).Get(r.Spec.CredentialsSecret)
+	if err != nil {
+		return token, err
+	}
+
+	token.Token, err = registry.TokenFromSecret(s)
+	return token, err
+}
+
+// newSecret creates a new Secret for a Registry resource using its resolved
+// auth token. It sets name to be the same as its parent registry to couple
+// them together
+func newSecret(registry *csv3.Registry, token csv3.AuthTokenDef) *corev1.Secret {
+	rdt := token.Type
 
 	labels := constants.BuildContainershipLabelMap(map[string]string{
 		"controller": registry.Name,
@@ -653,7 +887,7 @@ func newSecret(registry *csv3.Registry) *corev1.Secret {
 	// Build the data for the secret, containing the endpoint and token,
 	// using the docker template chosen, and set the correct data type
 	// according to the authtoken type.
-	data[fmt.Sprintf(".%s", rdt)] = []byte(fmt.Sprintf(template, rs.AuthToken.Endpoint, rs.AuthToken.Token))
+	data[fmt.Sprintf(".%s", rdt)] = []byte(fmt.Sprintf(template, token.Endpoint, token.Token))
 	return &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:   registry.Name,
@@ -663,3 +897,45 @@ func newSecret(registry *csv3.Registry) *corev1.Secret {
 		Type: t,
 	}
 }
+
+// newCombinedSecret creates a single dockerconfigjson Secret holding an auths
+// entry for every resolved registry auth token
+func newCombinedSecret(tokens []csv3.AuthTokenDef) (*corev1.Secret, error) {
+	config := dockerConfigJSON{
+		Auths: make(map[string]dockerConfigEntry),
+	}
+
+	for _, token := range tokens {
+		entry := dockerConfigEntry{
+			Auth:  token.Token,
+			Email: "none",
+		}
+
+		// Docker config tokens are a password rather than an auth
+		if token.Type == registry.DockerCFG {
+			entry = dockerConfigEntry{
+				Username: registry.DockerCFGUsername,
+				Password: registry.DockerCFGPassword(token),
+				Email:    "none",
+			}
+		}
+
+		config.Auths[token.Endpoint] = entry
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   CombinedRegistrySecretName,
+			Labels: constants.BuildContainershipLabelMap(nil),
+		},
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: data,
+		},
+		Type: corev1.SecretTypeDockerConfigJson,
+	}, nil
+}
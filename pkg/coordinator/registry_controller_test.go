@@ -6,6 +6,16 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/resources/registry"
 )
 
 var longLocalObjectReference = []corev1.LocalObjectReference{
@@ -55,3 +65,86 @@ func TestAreImagePullSecretsEqual(t *testing.T) {
 	emptyDiffOther := areImagePullSecretsEqual(shortLocalObjectReferenceDiff, empty)
 	assert.Equal(t, false, emptyDiffOther)
 }
+
+func TestNewCombinedSecret(t *testing.T) {
+	tokens := []csv3.AuthTokenDef{
+		{
+			Token:    "dXNlcjpwYXNz",
+			Endpoint: "registry.example.com",
+			Type:     "dockerconfigjson",
+		},
+		{
+			Token:    `{\"type\":\"service_account\"}`,
+			Endpoint: "https://gcr.io",
+			Type:     "dockercfg",
+		},
+	}
+
+	secret, err := newCombinedSecret(tokens)
+	assert.Nil(t, err)
+	assert.Equal(t, CombinedRegistrySecretName, secret.Name)
+	assert.Equal(t, corev1.SecretTypeDockerConfigJson, secret.Type)
+
+	expected := `{"auths":{"https://gcr.io":{"username":"_json_key","password":"{\"type\":\"service_account\"}","email":"none"},"registry.example.com":{"auth":"dXNlcjpwYXNz","email":"none"}}}`
+	assert.Equal(t, expected, string(secret.Data[corev1.DockerConfigJsonKey]))
+
+	empty, err := newCombinedSecret(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"auths":{}}`, string(empty.Data[corev1.DockerConfigJsonKey]))
+}
+
+func newRegistryTestController(secrets ...*corev1.Secret) *RegistryController {
+	kubeclient := fake.NewSimpleClientset()
+	secretInformer := kubeinformers.NewSharedInformerFactory(kubeclient, 0).Core().V1().Secrets()
+	for _, s := range secrets {
+		kubeclient.CoreV1().Secrets(s.Namespace).Create(s)
+		secretInformer.Informer().GetIndexer().Add(s)
+	}
+
+	return &RegistryController{
+		kubeclientset: kubeclient,
+		secretsLister: secretInformer.Lister(),
+		workqueue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Registry"),
+		recorder:      record.NewFakeRecorder(10),
+	}
+}
+
+func TestAuthToken(t *testing.T) {
+	credentials, _ := registry.NewCredentialsSecret("1234", map[string]string{}, "token")
+	c := newRegistryTestController(credentials)
+
+	r := &csv3.Registry{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "1234",
+			Namespace: constants.ContainershipNamespace,
+		},
+		Spec: csv3.RegistrySpec{
+			AuthToken:         csv3.AuthTokenDef{Endpoint: "registry.example.com"},
+			CredentialsSecret: credentials.Name,
+		},
+	}
+
+	token, err := c.authToken(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "token", token.Token)
+	assert.Equal(t, "registry.example.com", token.Endpoint)
+
+	r.Spec.CredentialsSecret = "missing"
+	_, err = c.authToken(r)
+	assert.True(t, kubeerrors.IsNotFound(err))
+}
+
+func TestDeleteRegistrySecrets(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	r := &csv3.Registry{ObjectMeta: metav1.ObjectMeta{Name: "1234"}}
+
+	stale := newSecret(r, csv3.AuthTokenDef{Type: "dockerconfigjson"})
+	stale.Namespace = ns.Name
+	c := newRegistryTestController(stale)
+
+	other := &csv3.Registry{ObjectMeta: metav1.ObjectMeta{Name: "5678"}}
+	assert.Nil(t, c.deleteRegistrySecrets(ns, []*csv3.Registry{r, other}))
+
+	_, err := c.kubeclientset.CoreV1().Secrets(ns.Name).Get(r.Name, metav1.GetOptions{})
+	assert.True(t, kubeerrors.IsNotFound(err))
+}
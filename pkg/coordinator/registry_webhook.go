@@ -0,0 +1,170 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/env"
+)
+
+const (
+	// dockerHubHostname is the hostname images without an explicit registry
+	// resolve to
+	dockerHubHostname = "docker.io"
+)
+
+// jsonPatchOperation is a single RFC 6902 operation used to mutate a pod
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// PodImagePullSecretsPatch returns a JSON patch adding the image pull secrets
+// of every Registry whose server address matches one of the pod's images. If
+// nothing needs to be added, the returned patch is nil.
+func PodImagePullSecretsPatch(pod *corev1.Pod) ([]byte, error) {
+	if regController == nil {
+		return nil, fmt.Errorf("registry controller is not initialized")
+	}
+
+	registries, err := regController.registriesLister.Registries(constants.ContainershipNamespace).List(labels.NewSelector())
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := imagePullSecretsForPod(pod, registries)
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+
+	// All credentials live in one secret, so it's all the pod needs
+	if env.IsCombinedRegistrySecretEnabled() {
+		if podHasImagePullSecret(pod, CombinedRegistrySecretName) {
+			return nil, nil
+		}
+
+		secrets = []corev1.LocalObjectReference{{Name: CombinedRegistrySecretName}}
+	}
+
+	return json.Marshal(buildImagePullSecretsPatch(pod, secrets))
+}
+
+// imagePullSecretsForPod returns the image pull secrets of registries that
+// match an image hostname used by the pod and that are not already referenced
+// by the pod
+func imagePullSecretsForPod(pod *corev1.Pod, registries []*csv3.Registry) []corev1.LocalObjectReference {
+	hostnames := make(map[string]bool)
+	for _, c := range pod.Spec.InitContainers {
+		hostnames[imageHostname(c.Image)] = true
+	}
+	for _, c := range pod.Spec.Containers {
+		hostnames[imageHostname(c.Image)] = true
+	}
+
+	existing := make(map[string]bool)
+	for _, s := range pod.Spec.ImagePullSecrets {
+		existing[s.Name] = true
+	}
+
+	secrets := make([]corev1.LocalObjectReference, 0)
+	for _, r := range registries {
+		if existing[r.Name] || !hostnames[registryHostname(r.Spec.Serveraddress)] {
+			continue
+		}
+
+		secrets = append(secrets, corev1.LocalObjectReference{
+			Name: r.Name,
+		})
+		existing[r.Name] = true
+	}
+
+	return secrets
+}
+
+// podHasImagePullSecret returns true if the pod already references the named
+// image pull secret, else false
+func podHasImagePullSecret(pod *corev1.Pod, name string) bool {
+	for _, s := range pod.Spec.ImagePullSecrets {
+		if s.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// buildImagePullSecretsPatch builds the patch operations needed to append
+// secrets to the pod's image pull secrets
+func buildImagePullSecretsPatch(pod *corev1.Pod, secrets []corev1.LocalObjectReference) []jsonPatchOperation {
+	// The array has to exist before we can append to it
+	if len(pod.Spec.ImagePullSecrets) == 0 {
+		return []jsonPatchOperation{{
+			Op:    "add",
+			Path:  "/spec/imagePullSecrets",
+			Value: secrets,
+		}}
+	}
+
+	patch := make([]jsonPatchOperation, 0)
+	for _, s := range secrets {
+		patch = append(patch, jsonPatchOperation{
+			Op:    "add",
+			Path:  "/spec/imagePullSecrets/-",
+			Value: s,
+		})
+	}
+
+	return patch
+}
+
+// imageHostname returns the registry hostname an image reference will be
+// pulled from, following the same rules as the docker client: the first
+// component is only a hostname if it looks like one
+func imageHostname(image string) string {
+	i := strings.Index(image, "/")
+	if i == -1 {
+		return dockerHubHostname
+	}
+
+	host := image[:i]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return dockerHubHostname
+	}
+
+	return normalizeHostname(host)
+}
+
+// registryHostname returns the hostname of a registry server address, which
+// may be given with or without a scheme and path
+func registryHostname(serveraddress string) string {
+	host := serveraddress
+	if i := strings.Index(host, "://"); i != -1 {
+		host = host[i+3:]
+	}
+
+	if i := strings.Index(host, "/"); i != -1 {
+		host = host[:i]
+	}
+
+	return normalizeHostname(host)
+}
+
+// normalizeHostname lowercases a hostname and collapses the Docker Hub aliases
+// into a single hostname
+func normalizeHostname(host string) string {
+	host = strings.ToLower(host)
+
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return dockerHubHostname
+	}
+
+	return host
+}
@@ -0,0 +1,116 @@
+package coordinator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+)
+
+type hostnameTest struct {
+	input    string
+	expected string
+}
+
+var imageHostnames = []hostnameTest{
+	{"nginx", "docker.io"},
+	{"nginx:1.15", "docker.io"},
+	{"library/nginx", "docker.io"},
+	{"containership/cloud-agent:v3", "docker.io"},
+	{"docker.io/containership/cloud-agent", "docker.io"},
+	{"index.docker.io/containership/cloud-agent", "docker.io"},
+	{"quay.io/coreos/etcd:v3.3", "quay.io"},
+	{"localhost/image", "localhost"},
+	{"localhost:5000/image", "localhost:5000"},
+	{"123456789.dkr.ecr.us-east-1.amazonaws.com/app:latest", "123456789.dkr.ecr.us-east-1.amazonaws.com"},
+	{"GCR.io/project/app", "gcr.io"},
+}
+
+var registryHostnames = []hostnameTest{
+	{"quay.io", "quay.io"},
+	{"https://quay.io", "quay.io"},
+	{"https://index.docker.io/v1/", "docker.io"},
+	{"https://123456789.dkr.ecr.us-east-1.amazonaws.com", "123456789.dkr.ecr.us-east-1.amazonaws.com"},
+	{"registry.example.com:5000/v2/", "registry.example.com:5000"},
+}
+
+func TestImageHostname(t *testing.T) {
+	for _, test := range imageHostnames {
+		assert.Equal(t, test.expected, imageHostname(test.input), test.input)
+	}
+}
+
+func TestRegistryHostname(t *testing.T) {
+	for _, test := range registryHostnames {
+		assert.Equal(t, test.expected, registryHostname(test.input), test.input)
+	}
+}
+
+var webhookRegistries = []*csv3.Registry{
+	{
+		ObjectMeta: metav1.ObjectMeta{Name: "quay"},
+		Spec:       csv3.RegistrySpec{Serveraddress: "quay.io"},
+	},
+	{
+		ObjectMeta: metav1.ObjectMeta{Name: "hub"},
+		Spec:       csv3.RegistrySpec{Serveraddress: "https://index.docker.io/v1/"},
+	},
+	{
+		ObjectMeta: metav1.ObjectMeta{Name: "private"},
+		Spec:       csv3.RegistrySpec{Serveraddress: "registry.example.com"},
+	},
+}
+
+func TestImagePullSecretsForPod(t *testing.T) {
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{
+				{Image: "quay.io/coreos/etcd"},
+			},
+			Containers: []corev1.Container{
+				{Image: "nginx"},
+				{Image: "quay.io/prometheus/node-exporter"},
+			},
+		},
+	}
+
+	secrets := imagePullSecretsForPod(pod, webhookRegistries)
+	assert.Equal(t, []corev1.LocalObjectReference{{Name: "quay"}, {Name: "hub"}}, secrets)
+
+	// Secrets already referenced by the pod should not be added again
+	pod.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "hub"}}
+	secrets = imagePullSecretsForPod(pod, webhookRegistries)
+	assert.Equal(t, []corev1.LocalObjectReference{{Name: "quay"}}, secrets)
+
+	// No matching registries means no secrets
+	pod.Spec.InitContainers = nil
+	pod.Spec.Containers = []corev1.Container{{Image: "gcr.io/project/app"}}
+	secrets = imagePullSecretsForPod(pod, webhookRegistries)
+	assert.Len(t, secrets, 0)
+}
+
+func TestBuildImagePullSecretsPatch(t *testing.T) {
+	secrets := []corev1.LocalObjectReference{{Name: "quay"}, {Name: "hub"}}
+
+	patch := buildImagePullSecretsPatch(&corev1.Pod{}, secrets)
+	assert.Len(t, patch, 1)
+	assert.Equal(t, "/spec/imagePullSecrets", patch[0].Path)
+	assert.Equal(t, secrets, patch[0].Value)
+
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "other"}},
+		},
+	}
+	patch = buildImagePullSecretsPatch(pod, secrets)
+	assert.Len(t, patch, 2)
+	for i, op := range patch {
+		assert.Equal(t, "add", op.Op)
+		assert.Equal(t, "/spec/imagePullSecrets/-", op.Path)
+		assert.Equal(t, secrets[i], op.Value)
+	}
+}
@@ -0,0 +1,311 @@
+package coordinator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	csclientset "github.com/containership/cluster-manager/pkg/client/clientset/versioned"
+	csinformers "github.com/containership/cluster-manager/pkg/client/informers/externalversions"
+	cslisters "github.com/containership/cluster-manager/pkg/client/listers/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/log"
+	"github.com/containership/cluster-manager/pkg/tools"
+)
+
+const (
+	// Type of agent that runs this controller
+	sshAccessControllerName = "SSHAccessController"
+	// number of times an object will be requeued if there is an error
+	maxRetriesSSHAccessController = 5
+)
+
+// SSHAccessController labels each User with the SSHAccessPolicies that grant
+// the user access, so that agents only need to match the node selectors of
+// the policies against their own node
+type SSHAccessController struct {
+	clientset csclientset.Interface
+
+	usersLister cslisters.UserLister
+	usersSynced cache.InformerSynced
+
+	policiesLister cslisters.SSHAccessPolicyLister
+	policiesSynced cache.InformerSynced
+
+	workqueue workqueue.RateLimitingInterface
+	recorder  record.EventRecorder
+}
+
+// NewSSHAccessController returns a new coordinator controller which watches
+// Users and SSHAccessPolicies
+func NewSSHAccessController(kubeclientset kubernetes.Interface, clientset csclientset.Interface, csInformerFactory csinformers.SharedInformerFactory) *SSHAccessController {
+	c := &SSHAccessController{
+		clientset: clientset,
+		workqueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "SSHAccess"),
+		recorder:  tools.CreateAndStartRecorder(kubeclientset, sshAccessControllerName),
+	}
+
+	userInformer := csInformerFactory.Containership().V3().Users()
+	policyInformer := csInformerFactory.Containership().V3().SSHAccessPolicies()
+
+	log.Info(sshAccessControllerName + ": Setting up event handlers")
+	userInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueUser,
+		UpdateFunc: func(old, new interface{}) {
+			if old.(*csv3.User).ResourceVersion == new.(*csv3.User).ResourceVersion {
+				return
+			}
+			c.enqueueUser(new)
+		},
+	})
+
+	// Any change to a policy may change the access of any user
+	policyInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.policyChanged,
+		UpdateFunc: func(old, new interface{}) {
+			if old.(*csv3.SSHAccessPolicy).ResourceVersion == new.(*csv3.SSHAccessPolicy).ResourceVersion {
+				return
+			}
+			c.policyChanged(new)
+		},
+		DeleteFunc: c.policyChanged,
+	})
+
+	c.usersLister = userInformer.Lister()
+	c.usersSynced = userInformer.Informer().HasSynced
+	c.policiesLister = policyInformer.Lister()
+	c.policiesSynced = policyInformer.Informer().HasSynced
+
+	return c
+}
+
+// Run starts the workers. It will block until stopCh is closed, at which
+// point it will shutdown the workqueue.
+func (c *SSHAccessController) Run(numWorkers int, stopCh chan struct{}) {
+	defer runtime.HandleCrash()
+	defer c.workqueue.ShutDown()
+
+	log.Info(sshAccessControllerName + ": Starting controller")
+
+	if ok := cache.WaitForCacheSync(stopCh, c.usersSynced, c.policiesSynced); !ok {
+		log.Error(sshAccessControllerName, ": failed to wait for caches to sync")
+		return
+	}
+
+	log.Info(sshAccessControllerName, ": Starting workers")
+	for i := 0; i < numWorkers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+
+	log.Info(sshAccessControllerName, ": Started workers")
+	<-stopCh
+	log.Info(sshAccessControllerName, ": Shutting down workers")
+}
+
+func (c *SSHAccessController) runWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *SSHAccessController) processNextWorkItem() bool {
+	obj, shutdown := c.workqueue.Get()
+
+	if shutdown {
+		return false
+	}
+
+	err := func(obj interface{}) error {
+		defer c.workqueue.Done(obj)
+		var key string
+		var ok bool
+		if key, ok = obj.(string); !ok {
+			c.workqueue.Forget(obj)
+			log.Errorf("expected string in workqueue but got %#v", obj)
+			return nil
+		}
+
+		err := c.userSyncHandler(key)
+		return c.handleErr(err, key)
+	}(obj)
+
+	if err != nil {
+		log.Error(err)
+		return true
+	}
+
+	return true
+}
+
+func (c *SSHAccessController) handleErr(err error, key interface{}) error {
+	if err == nil {
+		c.workqueue.Forget(key)
+		return nil
+	}
+
+	if c.workqueue.NumRequeues(key) < maxRetriesSSHAccessController {
+		c.workqueue.AddRateLimited(key)
+		return fmt.Errorf("error syncing '%v': %s. has been resynced %v times", key, err.Error(), c.workqueue.NumRequeues(key))
+	}
+
+	c.workqueue.Forget(key)
+	log.Infof("Dropping %q out of the queue: %v", key, err)
+	return err
+}
+
+func (c *SSHAccessController) enqueueUser(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	c.workqueue.AddRateLimited(key)
+}
+
+// policyChanged validates the policy and enqueues every user
+func (c *SSHAccessController) policyChanged(obj interface{}) {
+	if policy, ok := obj.(*csv3.SSHAccessPolicy); ok {
+		if err := validateSSHAccessPolicy(policy); err != nil {
+			c.recorder.Eventf(policy, corev1.EventTypeWarning, "InvalidPolicy",
+				"Policy is ignored: %s", err)
+		}
+	}
+
+	users, err := c.usersLister.Users(constants.ContainershipNamespace).List(labels.Everything())
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, user := range users {
+		c.enqueueUser(user)
+	}
+}
+
+// validateSSHAccessPolicy returns an error if the policy can't be used,
+// either because its name can't be part of a label key or because its node
+// selector is invalid
+func validateSSHAccessPolicy(policy *csv3.SSHAccessPolicy) error {
+	if errs := validation.IsQualifiedName(sshAccessPolicyLabelKey(policy.Name)); len(errs) > 0 {
+		return fmt.Errorf("name can't be used in a label key: %s", strings.Join(errs, ", "))
+	}
+
+	if _, err := metav1.LabelSelectorAsSelector(&policy.Spec.NodeSelector); err != nil {
+		return fmt.Errorf("invalid node selector: %s", err)
+	}
+
+	return nil
+}
+
+// sshAccessPolicyLabelKey returns the User label key for the policy
+func sshAccessPolicyLabelKey(name string) string {
+	return constants.SSHAccessPolicyLabelPrefix + name
+}
+
+// policyGrantsUser returns true if the policy lists the user or one of the
+// teams of the user
+func policyGrantsUser(policy *csv3.SSHAccessPolicy, user *csv3.User) bool {
+	for _, id := range policy.Spec.Users {
+		if id == user.Spec.ID {
+			return true
+		}
+	}
+
+	for _, team := range policy.Spec.Teams {
+		for _, id := range user.Spec.Teams {
+			if team == id {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// sshAccessLabels returns the labels of the user with a policy label for each
+// valid policy that grants the user access, and without any other policy
+// labels
+func sshAccessLabels(user *csv3.User, policies []*csv3.SSHAccessPolicy) map[string]string {
+	result := make(map[string]string)
+	for k, v := range user.Labels {
+		if !strings.HasPrefix(k, constants.SSHAccessPolicyLabelPrefix) {
+			result[k] = v
+		}
+	}
+
+	for _, policy := range policies {
+		if validateSSHAccessPolicy(policy) == nil && policyGrantsUser(policy, user) {
+			result[sshAccessPolicyLabelKey(policy.Name)] = "true"
+		}
+	}
+
+	return result
+}
+
+// userSyncHandler sets the policy labels of the user
+func (c *SSHAccessController) userSyncHandler(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("invalid resource key: %s", key))
+		return nil
+	}
+
+	user, err := c.usersLister.Users(namespace).Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	policies, err := c.policiesLister.SSHAccessPolicies(constants.ContainershipNamespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	desired := sshAccessLabels(user, policies)
+	if labels.Equals(desired, user.Labels) {
+		return nil
+	}
+
+	uCopy := user.DeepCopy()
+	uCopy.Labels = desired
+
+	_, err = c.clientset.ContainershipV3().Users(namespace).Update(uCopy)
+	if err != nil {
+		return err
+	}
+
+	granted := make([]string, 0)
+	for k := range desired {
+		if strings.HasPrefix(k, constants.SSHAccessPolicyLabelPrefix) {
+			granted = append(granted, strings.TrimPrefix(k, constants.SSHAccessPolicyLabelPrefix))
+		}
+	}
+	sort.Strings(granted)
+
+	if len(granted) == 0 {
+		c.recorder.Event(user, corev1.EventTypeNormal, "SSHAccessChanged",
+			"SSH access is not granted by any policy")
+		return nil
+	}
+
+	c.recorder.Eventf(user, corev1.EventTypeNormal, "SSHAccessChanged",
+		"SSH access is granted by policies %s", strings.Join(granted, ", "))
+	return nil
+}
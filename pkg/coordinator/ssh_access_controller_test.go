@@ -0,0 +1,121 @@
+package coordinator
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	csfake "github.com/containership/cluster-manager/pkg/client/clientset/versioned/fake"
+	csinformers "github.com/containership/cluster-manager/pkg/client/informers/externalversions"
+	"github.com/containership/cluster-manager/pkg/constants"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func newSSHAccessPolicy(name string, users, teams []string) *csv3.SSHAccessPolicy {
+	return &csv3.SSHAccessPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: constants.ContainershipNamespace,
+		},
+		Spec: csv3.SSHAccessPolicySpec{
+			Users: users,
+			Teams: teams,
+		},
+	}
+}
+
+func newSSHAccessUser(id string, teams []string, labels map[string]string) *csv3.User {
+	return &csv3.User{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      id,
+			Namespace: constants.ContainershipNamespace,
+			Labels:    labels,
+		},
+		Spec: csv3.UserSpec{ID: id, Teams: teams},
+	}
+}
+
+func TestValidateSSHAccessPolicy(t *testing.T) {
+	policy := newSSHAccessPolicy("ops", nil, nil)
+	assert.Nil(t, validateSSHAccessPolicy(policy))
+
+	policy.Name = strings.Repeat("a", 64)
+	assert.NotNil(t, validateSSHAccessPolicy(policy), "name is too long for a label")
+
+	policy = newSSHAccessPolicy("ops", nil, nil)
+	policy.Spec.NodeSelector.MatchExpressions = []metav1.LabelSelectorRequirement{{
+		Key:      "role",
+		Operator: "Unknown",
+	}}
+	assert.NotNil(t, validateSSHAccessPolicy(policy), "node selector is invalid")
+}
+
+func TestSSHAccessLabels(t *testing.T) {
+	policies := []*csv3.SSHAccessPolicy{
+		newSSHAccessPolicy("by-user", []string{"user-1"}, nil),
+		newSSHAccessPolicy("by-team", nil, []string{"team-1"}),
+		newSSHAccessPolicy(strings.Repeat("a", 64), []string{"user-1", "user-2"}, nil),
+	}
+
+	user := newSSHAccessUser("user-1", []string{"team-1"}, map[string]string{
+		"app": "test",
+		constants.SSHAccessPolicyLabelPrefix + "deleted": "true",
+	})
+	assert.Equal(t, map[string]string{
+		"app": "test",
+		constants.SSHAccessPolicyLabelPrefix + "by-user": "true",
+		constants.SSHAccessPolicyLabelPrefix + "by-team": "true",
+	}, sshAccessLabels(user, policies))
+
+	user = newSSHAccessUser("user-2", []string{"team-2"}, nil)
+	assert.Empty(t, sshAccessLabels(user, policies))
+}
+
+func TestSSHAccessUserSyncHandler(t *testing.T) {
+	user := newSSHAccessUser("user-1", []string{"team-1"}, nil)
+	policy := newSSHAccessPolicy("ops", nil, []string{"team-1"})
+
+	client := csfake.NewSimpleClientset(user, policy)
+	factory := csinformers.NewSharedInformerFactory(client, 0)
+	userInformer := factory.Containership().V3().Users()
+	userInformer.Informer().GetIndexer().Add(user)
+	policyInformer := factory.Containership().V3().SSHAccessPolicies()
+	policyInformer.Informer().GetIndexer().Add(policy)
+
+	recorder := record.NewFakeRecorder(10)
+	c := &SSHAccessController{
+		clientset:      client,
+		usersLister:    userInformer.Lister(),
+		policiesLister: policyInformer.Lister(),
+		workqueue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "SSHAccess"),
+		recorder:       recorder,
+	}
+
+	err := c.userSyncHandler("containership-core/user-1")
+	assert.Nil(t, err)
+
+	updated, err := client.ContainershipV3().Users(constants.ContainershipNamespace).Get("user-1", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		constants.SSHAccessPolicyLabelPrefix + "ops": "true",
+	}, updated.Labels)
+	assert.Equal(t, []string{
+		"Normal SSHAccessChanged SSH access is granted by policies ops",
+	}, drainEvents(recorder))
+
+	// Nothing changes once the user is labeled
+	userInformer.Informer().GetIndexer().Update(updated)
+	client.ClearActions()
+	err = c.userSyncHandler("containership-core/user-1")
+	assert.Nil(t, err)
+	assert.Empty(t, client.Actions())
+
+	// Deleted users are ignored
+	err = c.userSyncHandler("containership-core/user-2")
+	assert.Nil(t, err)
+}
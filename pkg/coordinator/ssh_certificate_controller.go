@@ -0,0 +1,559 @@
+package coordinator
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	csclientset "github.com/containership/cluster-manager/pkg/client/clientset/versioned"
+	csinformers "github.com/containership/cluster-manager/pkg/client/informers/externalversions"
+	cslisters "github.com/containership/cluster-manager/pkg/client/listers/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/env"
+	"github.com/containership/cluster-manager/pkg/log"
+	"github.com/containership/cluster-manager/pkg/resources/sshca"
+	"github.com/containership/cluster-manager/pkg/resources/sysuser"
+	"github.com/containership/cluster-manager/pkg/tools"
+)
+
+const (
+	// Type of agent that runs this controller
+	sshCertificateControllerName = "SSHCertificateController"
+	// number of times an object will be requeued if there is an error
+	maxRetriesSSHCertificateController = 5
+
+	// All certificates are synced together, so there is only ever one thing
+	// to sync
+	sshCertificatesSyncKey = "ssh-certificates"
+
+	// How often certificates are checked for renewal and expiry
+	sshCertificateCheckInterval = time.Minute
+
+	// Certificates are renewed once less than this fraction of their TTL is
+	// left, so that users have time to fetch the new certificate
+	sshCertificateRenewFraction = 4
+)
+
+// SSHCertificateController keeps an SSHCertificate signed by the cluster SSH
+// CA for each SSH key of each User. Certificates of keys that no longer exist
+// are revoked, and revoked certificates are deleted once they expire.
+type SSHCertificateController struct {
+	kubeclientset kubernetes.Interface
+	clientset     csclientset.Interface
+
+	usersLister cslisters.UserLister
+	usersSynced cache.InformerSynced
+
+	certificatesLister cslisters.SSHCertificateLister
+	certificatesSynced cache.InformerSynced
+
+	workqueue workqueue.RateLimitingInterface
+	recorder  record.EventRecorder
+}
+
+// sshKey is an SSH key of a user that should have a certificate
+type sshKey struct {
+	userID string
+	keyID  string
+	// publicKey is the key normalized by sysuser.NormalizeSSHKey
+	publicKey string
+	// principal is the username of the user, or empty if the user doesn't
+	// have a username yet
+	principal string
+}
+
+// NewSSHCertificateController returns a new coordinator controller which
+// watches Users and SSHCertificates
+func NewSSHCertificateController(kubeclientset kubernetes.Interface, clientset csclientset.Interface, csInformerFactory csinformers.SharedInformerFactory) *SSHCertificateController {
+	c := &SSHCertificateController{
+		kubeclientset: kubeclientset,
+		clientset:     clientset,
+		workqueue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "SSHCertificates"),
+		recorder:      tools.CreateAndStartRecorder(kubeclientset, sshCertificateControllerName),
+	}
+
+	userInformer := csInformerFactory.Containership().V3().Users()
+	certificateInformer := csInformerFactory.Containership().V3().SSHCertificates()
+
+	log.Info(sshCertificateControllerName + ": Setting up event handlers")
+	userInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueSync,
+		UpdateFunc: func(old, new interface{}) {
+			if old.(*csv3.User).ResourceVersion == new.(*csv3.User).ResourceVersion {
+				return
+			}
+			c.enqueueSync(new)
+		},
+		DeleteFunc: c.enqueueSync,
+	})
+
+	certificateInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueSync,
+		UpdateFunc: func(old, new interface{}) {
+			if old.(*csv3.SSHCertificate).ResourceVersion == new.(*csv3.SSHCertificate).ResourceVersion {
+				return
+			}
+			c.enqueueSync(new)
+		},
+		DeleteFunc: c.enqueueSync,
+	})
+
+	c.usersLister = userInformer.Lister()
+	c.usersSynced = userInformer.Informer().HasSynced
+	c.certificatesLister = certificateInformer.Lister()
+	c.certificatesSynced = certificateInformer.Informer().HasSynced
+
+	return c
+}
+
+// Run starts the workers. It will block until stopCh is closed, at which
+// point it will shutdown the workqueue.
+func (c *SSHCertificateController) Run(numWorkers int, stopCh chan struct{}) {
+	defer runtime.HandleCrash()
+	defer c.workqueue.ShutDown()
+
+	log.Info(sshCertificateControllerName + ": Starting controller")
+
+	if ok := cache.WaitForCacheSync(stopCh, c.usersSynced, c.certificatesSynced); !ok {
+		log.Error(sshCertificateControllerName, ": failed to wait for caches to sync")
+		return
+	}
+
+	log.Info(sshCertificateControllerName, ": Starting workers")
+	for i := 0; i < numWorkers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+
+	// Certificates need to be renewed and deleted as time passes even if
+	// nothing changes
+	go wait.Until(func() { c.enqueueSync(nil) }, sshCertificateCheckInterval, stopCh)
+
+	log.Info(sshCertificateControllerName, ": Started workers")
+	<-stopCh
+	log.Info(sshCertificateControllerName, ": Shutting down workers")
+}
+
+func (c *SSHCertificateController) runWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *SSHCertificateController) processNextWorkItem() bool {
+	obj, shutdown := c.workqueue.Get()
+
+	if shutdown {
+		return false
+	}
+
+	err := func(obj interface{}) error {
+		defer c.workqueue.Done(obj)
+		var key string
+		var ok bool
+		if key, ok = obj.(string); !ok {
+			c.workqueue.Forget(obj)
+			log.Errorf("expected string in workqueue but got %#v", obj)
+			return nil
+		}
+
+		err := c.syncHandler()
+		return c.handleErr(err, key)
+	}(obj)
+
+	if err != nil {
+		log.Error(err)
+		return true
+	}
+
+	return true
+}
+
+func (c *SSHCertificateController) handleErr(err error, key interface{}) error {
+	if err == nil {
+		c.workqueue.Forget(key)
+		return nil
+	}
+
+	if c.workqueue.NumRequeues(key) < maxRetriesSSHCertificateController {
+		c.workqueue.AddRateLimited(key)
+		return fmt.Errorf("error syncing '%v': %s. has been resynced %v times", key, err.Error(), c.workqueue.NumRequeues(key))
+	}
+
+	c.workqueue.Forget(key)
+	log.Infof("Dropping %q out of the queue: %v", key, err)
+	return err
+}
+
+// enqueueSync enqueues a sync of every certificate for any change
+func (c *SSHCertificateController) enqueueSync(obj interface{}) {
+	c.workqueue.AddRateLimited(sshCertificatesSyncKey)
+}
+
+// syncHandler makes sure the CA exists and brings the certificates in line
+// with the SSH keys of the users
+func (c *SSHCertificateController) syncHandler() error {
+	signer, err := c.ensureCA()
+	if err != nil {
+		return err
+	}
+
+	users, err := c.usersLister.Users(constants.ContainershipNamespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	certificates, err := c.certificatesLister.SSHCertificates(constants.ContainershipNamespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	usernames, err := c.usernames()
+	if err != nil {
+		return err
+	}
+
+	desired := desiredSSHCertificates(users, usernames)
+	now := time.Now()
+
+	for _, cert := range certificates {
+		key, ok := desired[cert.Name]
+		delete(desired, cert.Name)
+
+		switch {
+		case !ok && !cert.Spec.Revoked:
+			err = c.revokeCertificate(cert)
+
+		case !ok && cert.Spec.Revoked && now.After(cert.Status.ValidBefore.Time):
+			// Certificates of keys that still exist are kept after they
+			// expire so that revoked keys aren't signed again
+			log.Infof("Deleting expired revoked SSH certificate %s", cert.Name)
+			err = c.clientset.ContainershipV3().SSHCertificates(cert.Namespace).Delete(cert.Name, &metav1.DeleteOptions{})
+			if errors.IsNotFound(err) {
+				err = nil
+			}
+
+		case ok && key.principal == "":
+			// Keys of users without a username are kept but can't be
+			// signed until they have one
+
+		case ok && cert.Spec.Revoked && cert.Annotations[constants.SSHCertificateKeyRemovedAnnotation] == "true":
+			// The key was added back. Certificates signed before it was
+			// removed are for the same key and principal, so they may be
+			// valid again too.
+			restored := cert.DeepCopy()
+			restored.Spec.Revoked = false
+			delete(restored.Annotations, constants.SSHCertificateKeyRemovedAnnotation)
+			err = c.signCertificate(restored, key, signer, false)
+
+		case ok && !cert.Spec.Revoked && needsSigning(cert, key, signer, now):
+			err = c.signCertificate(cert, key, signer, false)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, key := range desired {
+		if key.principal == "" {
+			continue
+		}
+
+		cert := &csv3.SSHCertificate{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: constants.ContainershipNamespace,
+				Labels:    constants.BuildContainershipLabelMap(nil),
+			},
+			Spec: csv3.SSHCertificateSpec{
+				UserID: key.userID,
+				KeyID:  key.keyID,
+			},
+		}
+
+		if err := c.signCertificate(cert, key, signer, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ensureCA returns a signer for the CA key, generating the key if it doesn't
+// exist yet, and makes sure the CA public key is published for the agents
+func (c *SSHCertificateController) ensureCA() (ssh.Signer, error) {
+	secrets := c.kubeclientset.CoreV1().Secrets(constants.ContainershipNamespace)
+	secret, err := secrets.Get(sshca.SecretName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		log.Info("Generating SSH CA key")
+		private, public, err := sshca.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+
+		secret, err = secrets.Create(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      sshca.SecretName,
+				Namespace: constants.ContainershipNamespace,
+				Labels:    constants.BuildContainershipLabelMap(nil),
+			},
+			Data: map[string][]byte{
+				sshca.PrivateKeyKey: private,
+				sshca.PublicKeyKey:  []byte(public),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	signer, err := sshca.NewSigner(secret.Data[sshca.PrivateKeyKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH CA secret %s: %s", sshca.SecretName, err)
+	}
+
+	return signer, c.publishCAPublicKey(sshca.PublicKey(signer))
+}
+
+// publishCAPublicKey writes the CA public key to the ConfigMap the agents
+// read it from
+func (c *SSHCertificateController) publishCAPublicKey(public string) error {
+	configMaps := c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace)
+	cm, err := configMaps.Get(sshca.ConfigMapName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = configMaps.Create(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      sshca.ConfigMapName,
+				Namespace: constants.ContainershipNamespace,
+				Labels:    constants.BuildContainershipLabelMap(nil),
+			},
+			Data: map[string]string{
+				sshca.PublicKeyKey: public,
+			},
+		})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	if cm.Data[sshca.PublicKeyKey] == public {
+		return nil
+	}
+
+	cmCopy := cm.DeepCopy()
+	if cmCopy.Data == nil {
+		cmCopy.Data = make(map[string]string)
+	}
+	cmCopy.Data[sshca.PublicKeyKey] = public
+
+	_, err = configMaps.Update(cmCopy)
+	return err
+}
+
+// usernames returns the usernames persisted by the username controller. No
+// user has a username if they weren't persisted yet.
+func (c *SSHCertificateController) usernames() (*sysuser.UsernameMapping, error) {
+	cm, err := c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace).Get(sysuser.UsernamesConfigMapName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return sysuser.NewUsernameMapping(nil)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return sysuser.NewUsernameMapping(cm.Data)
+}
+
+// signCertificate signs a new certificate for the key and creates the
+// SSHCertificate with it if create is true, or updates it otherwise
+func (c *SSHCertificateController) signCertificate(cert *csv3.SSHCertificate, key sshKey, signer ssh.Signer, create bool) error {
+	validBefore := time.Now().Add(sshCertificateTTL(cert))
+	signed, err := sshca.SignUserKey(signer, key.publicKey, key.principal, key.userID, validBefore)
+	if err != nil {
+		return fmt.Errorf("signing SSH key %s of user %s: %s", key.keyID, key.userID, err)
+	}
+
+	now := time.Now()
+	serials := unexpiredSerials(certificateSerials(cert), now)
+	revokedSerials := unexpiredSerials(cert.Status.RevokedSerials, now)
+	if cert.Spec.PublicKey != "" && cert.Spec.PublicKey != key.publicKey {
+		// Certificates of the previous public key must not stay valid
+		revokedSerials = append(revokedSerials, serials...)
+		serials = nil
+	}
+
+	serials = append(serials, csv3.SSHCertificateSerial{
+		Serial:      signed.Serial,
+		ValidBefore: metav1.NewTime(validBefore),
+	})
+
+	certCopy := cert.DeepCopy()
+	certCopy.Spec.PublicKey = key.publicKey
+	certCopy.Status = csv3.SSHCertificateStatus{
+		Certificate:    sshca.MarshalCertificate(signed),
+		Serial:         signed.Serial,
+		ValidAfter:     metav1.NewTime(time.Unix(int64(signed.ValidAfter), 0)),
+		ValidBefore:    metav1.NewTime(validBefore),
+		Serials:        serials,
+		RevokedSerials: revokedSerials,
+	}
+
+	certificates := c.clientset.ContainershipV3().SSHCertificates(constants.ContainershipNamespace)
+	if create {
+		log.Infof("Creating SSH certificate %s for user %s", cert.Name, key.userID)
+		certCopy, err = certificates.Create(certCopy)
+	} else {
+		log.Infof("Renewing SSH certificate %s for user %s", cert.Name, key.userID)
+		certCopy, err = certificates.Update(certCopy)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.recorder.Eventf(certCopy, corev1.EventTypeNormal, "Signed",
+		"Signed certificate with serial %d valid until %s",
+		signed.Serial, validBefore.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// revokeCertificate revokes the certificate of a key that no longer exists
+func (c *SSHCertificateController) revokeCertificate(cert *csv3.SSHCertificate) error {
+	log.Infof("Revoking SSH certificate %s since its key no longer exists", cert.Name)
+
+	certCopy := cert.DeepCopy()
+	certCopy.Spec.Revoked = true
+	if certCopy.Annotations == nil {
+		certCopy.Annotations = make(map[string]string)
+	}
+	certCopy.Annotations[constants.SSHCertificateKeyRemovedAnnotation] = "true"
+
+	certCopy, err := c.clientset.ContainershipV3().SSHCertificates(cert.Namespace).Update(certCopy)
+	if err != nil {
+		return err
+	}
+
+	c.recorder.Event(certCopy, corev1.EventTypeNormal, "Revoked",
+		"Revoked certificate since the SSH key was removed from the user")
+	return nil
+}
+
+// desiredSSHCertificates returns the SSH keys that should have a
+// certificate by certificate name. Keys rejected by sysuser.NormalizeSSHKey
+// are ignored.
+func desiredSSHCertificates(users []*csv3.User, usernames *sysuser.UsernameMapping) map[string]sshKey {
+	desired := make(map[string]sshKey)
+	for _, u := range users {
+		principal, err := usernames.Username(u.Spec.ID)
+		if err != nil {
+			log.Infof("Not signing SSH keys of user %s yet: %s", u.Spec.ID, err)
+		}
+
+		for _, k := range u.Spec.SSHKeys {
+			publicKey, err := sysuser.NormalizeSSHKey(k)
+			if err != nil {
+				log.Errorf("Ignoring SSH key %s of user %s: %s", k.ID, u.Spec.ID, err)
+				continue
+			}
+
+			desired[sshCertificateName(u.Spec.ID, k.ID)] = sshKey{
+				userID:    u.Spec.ID,
+				keyID:     k.ID,
+				publicKey: publicKey,
+				principal: principal,
+			}
+		}
+	}
+
+	return desired
+}
+
+// sshCertificateName returns the name of the SSHCertificate of a key. Key
+// IDs are hashed since they aren't guaranteed to be valid in a name. The name
+// is built from the user ID rather than the username so that it's known
+// before the user has a username.
+func sshCertificateName(userID, keyID string) string {
+	return fmt.Sprintf("%s-%x", strings.Replace(userID, "-", "", -1),
+		sha256.Sum256([]byte(keyID)))[:49]
+}
+
+// certificateSerials returns the serials of the certificates signed for the
+// SSHCertificate. Only the last serial is known for SSHCertificates signed
+// before every serial was kept.
+func certificateSerials(cert *csv3.SSHCertificate) []csv3.SSHCertificateSerial {
+	if len(cert.Status.Serials) == 0 && cert.Status.Serial != 0 {
+		return []csv3.SSHCertificateSerial{{
+			Serial:      cert.Status.Serial,
+			ValidBefore: cert.Status.ValidBefore,
+		}}
+	}
+
+	return cert.Status.Serials
+}
+
+// unexpiredSerials returns the serials of the certificates that haven't
+// expired yet
+func unexpiredSerials(serials []csv3.SSHCertificateSerial, now time.Time) []csv3.SSHCertificateSerial {
+	unexpired := make([]csv3.SSHCertificateSerial, 0, len(serials))
+	for _, s := range serials {
+		if now.Before(s.ValidBefore.Time) {
+			unexpired = append(unexpired, s)
+		}
+	}
+
+	return unexpired
+}
+
+// sshCertificateTTL returns how long certificates of the SSHCertificate are
+// valid for
+func sshCertificateTTL(cert *csv3.SSHCertificate) time.Duration {
+	if cert.Spec.TTL.Duration > 0 {
+		return cert.Spec.TTL.Duration
+	}
+
+	return env.SSHCertificateTTL()
+}
+
+// needsSigning returns true if the certificate doesn't certify the current
+// public key of the key for the principal of the user, wasn't signed by the
+// current CA or is close to expiring
+func needsSigning(cert *csv3.SSHCertificate, key sshKey, signer ssh.Signer, now time.Time) bool {
+	if cert.Spec.PublicKey != key.publicKey || cert.Status.Certificate == "" {
+		return true
+	}
+
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cert.Status.Certificate))
+	if err != nil {
+		return true
+	}
+
+	signed, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return true
+	}
+
+	if len(signed.ValidPrincipals) != 1 || signed.ValidPrincipals[0] != key.principal {
+		return true
+	}
+
+	if string(signed.SignatureKey.Marshal()) != string(signer.PublicKey().Marshal()) {
+		return true
+	}
+
+	renewAt := cert.Status.ValidBefore.Add(-sshCertificateTTL(cert) / sshCertificateRenewFraction)
+	return !now.Before(renewAt)
+}
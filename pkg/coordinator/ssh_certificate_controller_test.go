@@ -0,0 +1,263 @@
+package coordinator
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	csfake "github.com/containership/cluster-manager/pkg/client/clientset/versioned/fake"
+	csinformers "github.com/containership/cluster-manager/pkg/client/informers/externalversions"
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/resources/sshca"
+	"github.com/containership/cluster-manager/pkg/resources/sysuser"
+)
+
+const (
+	testCertUserID   = "00000000-1111-2222-3333-000000000001"
+	testCertUsername = "jane"
+)
+
+func newTestSSHPublicKey(t *testing.T) string {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	key, err := ssh.NewPublicKey(public)
+	assert.Nil(t, err)
+
+	return string(ssh.MarshalAuthorizedKey(key))
+}
+
+func newSSHCertificateUser(keys ...csv3.SSHKeySpec) *csv3.User {
+	return &csv3.User{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testCertUserID,
+			Namespace: constants.ContainershipNamespace,
+		},
+		Spec: csv3.UserSpec{ID: testCertUserID, SSHKeys: keys},
+	}
+}
+
+type testSSHCertificateController struct {
+	*SSHCertificateController
+	kubeclient *fake.Clientset
+	client     *csfake.Clientset
+	users      cache.Indexer
+	certs      cache.Indexer
+}
+
+func newTestSSHCertificateController(users ...*csv3.User) testSSHCertificateController {
+	kubeclient := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sysuser.UsernamesConfigMapName,
+			Namespace: constants.ContainershipNamespace,
+		},
+		Data: map[string]string{testCertUserID: testCertUsername},
+	})
+	client := csfake.NewSimpleClientset()
+	factory := csinformers.NewSharedInformerFactory(client, 0)
+	userInformer := factory.Containership().V3().Users()
+	certInformer := factory.Containership().V3().SSHCertificates()
+
+	for _, u := range users {
+		userInformer.Informer().GetIndexer().Add(u)
+	}
+
+	return testSSHCertificateController{
+		SSHCertificateController: &SSHCertificateController{
+			kubeclientset:      kubeclient,
+			clientset:          client,
+			usersLister:        userInformer.Lister(),
+			certificatesLister: certInformer.Lister(),
+			workqueue:          workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "SSHCertificates"),
+			recorder:           record.NewFakeRecorder(10),
+		},
+		kubeclient: kubeclient,
+		client:     client,
+		users:      userInformer.Informer().GetIndexer(),
+		certs:      certInformer.Informer().GetIndexer(),
+	}
+}
+
+// syncCertificates runs a sync and returns the resulting certificates, also
+// updating the lister with them
+func (c testSSHCertificateController) syncCertificates(t *testing.T) []csv3.SSHCertificate {
+	assert.Nil(t, c.syncHandler())
+
+	list, err := c.client.ContainershipV3().SSHCertificates(constants.ContainershipNamespace).List(metav1.ListOptions{})
+	assert.Nil(t, err)
+
+	for _, obj := range c.certs.List() {
+		c.certs.Delete(obj)
+	}
+	for i := range list.Items {
+		c.certs.Add(&list.Items[i])
+	}
+
+	return list.Items
+}
+
+func TestSSHCertificateName(t *testing.T) {
+	name := sshCertificateName(testCertUserID, "key-1")
+	assert.Equal(t, "00000000111122223333000000000001-", name[:33])
+	assert.Len(t, name, 49)
+	assert.NotEqual(t, name, sshCertificateName(testCertUserID, "key-2"))
+}
+
+func TestSSHCertificateSync(t *testing.T) {
+	key := csv3.SSHKeySpec{ID: "key-1", Key: newTestSSHPublicKey(t)}
+	invalid := csv3.SSHKeySpec{ID: "key-2", Key: "ssh-rsa invalid"}
+	c := newTestSSHCertificateController(newSSHCertificateUser(key, invalid))
+
+	certs := c.syncCertificates(t)
+	assert.Len(t, certs, 1, "invalid keys are ignored")
+
+	cert := certs[0]
+	assert.Equal(t, sshCertificateName(testCertUserID, "key-1"), cert.Name)
+	assert.Equal(t, testCertUserID, cert.Spec.UserID)
+	assert.Equal(t, strings.TrimSpace(key.Key), cert.Spec.PublicKey, "public key is normalized")
+	assert.False(t, cert.Spec.Revoked)
+	assert.NotEmpty(t, cert.Status.Certificate)
+
+	secret, err := c.kubeclient.CoreV1().Secrets(constants.ContainershipNamespace).Get(sshca.SecretName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	cm, err := c.kubeclient.CoreV1().ConfigMaps(constants.ContainershipNamespace).Get(sshca.ConfigMapName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, string(secret.Data[sshca.PublicKeyKey]), cm.Data[sshca.PublicKeyKey])
+
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cert.Status.Certificate))
+	assert.Nil(t, err)
+	signed := parsed.(*ssh.Certificate)
+	assert.Equal(t, []string{testCertUsername}, signed.ValidPrincipals, "the username is the principal")
+	assert.Equal(t, cm.Data[sshca.PublicKeyKey], string(ssh.MarshalAuthorizedKey(signed.SignatureKey)))
+
+	// Nothing is signed again until the certificate is close to expiring
+	c.client.ClearActions()
+	certs = c.syncCertificates(t)
+	assert.Len(t, c.client.Actions(), 1, "only the list")
+	assert.Equal(t, cert.Status.Serial, certs[0].Status.Serial)
+
+	expiring := certs[0].DeepCopy()
+	expiring.Status.ValidBefore = metav1.NewTime(time.Now().Add(time.Minute))
+	c.certs.Update(expiring)
+	_, err = c.client.ContainershipV3().SSHCertificates(constants.ContainershipNamespace).Update(expiring)
+	assert.Nil(t, err)
+
+	certs = c.syncCertificates(t)
+	assert.NotEqual(t, cert.Status.Serial, certs[0].Status.Serial, "expiring certificates are renewed")
+
+	// Certificates of removed keys are revoked, and deleted once they expire
+	c.users.Update(newSSHCertificateUser())
+	certs = c.syncCertificates(t)
+	assert.Len(t, certs, 1)
+	assert.True(t, certs[0].Spec.Revoked)
+
+	expired := certs[0].DeepCopy()
+	expired.Status.ValidBefore = metav1.NewTime(time.Now().Add(-time.Minute))
+	c.certs.Update(expired)
+
+	certs = c.syncCertificates(t)
+	assert.Empty(t, certs)
+}
+
+func TestSSHCertificateSyncKeepsRevokedCertificates(t *testing.T) {
+	key := csv3.SSHKeySpec{ID: "key-1", Key: newTestSSHPublicKey(t)}
+	c := newTestSSHCertificateController(newSSHCertificateUser(key))
+
+	certs := c.syncCertificates(t)
+	revoked := certs[0].DeepCopy()
+	revoked.Spec.Revoked = true
+	revoked.Status.ValidBefore = metav1.NewTime(time.Now().Add(-time.Minute))
+	c.certs.Update(revoked)
+	_, err := c.client.ContainershipV3().SSHCertificates(constants.ContainershipNamespace).Update(revoked)
+	assert.Nil(t, err)
+
+	certs = c.syncCertificates(t)
+	assert.Len(t, certs, 1, "revoked certificates of existing keys are kept")
+	assert.True(t, certs[0].Spec.Revoked)
+	assert.Equal(t, revoked.Status.Serial, certs[0].Status.Serial, "revoked keys aren't signed")
+}
+
+func TestSSHCertificateSyncWaitsForUsername(t *testing.T) {
+	key := csv3.SSHKeySpec{ID: "key-1", Key: newTestSSHPublicKey(t)}
+	c := newTestSSHCertificateController(newSSHCertificateUser(key))
+
+	certs := c.syncCertificates(t)
+	assert.Len(t, certs, 1)
+
+	err := c.kubeclient.CoreV1().ConfigMaps(constants.ContainershipNamespace).Delete(sysuser.UsernamesConfigMapName, &metav1.DeleteOptions{})
+	assert.Nil(t, err)
+
+	expiring := certs[0].DeepCopy()
+	expiring.Status.ValidBefore = metav1.NewTime(time.Now().Add(time.Minute))
+	c.certs.Update(expiring)
+	_, err = c.client.ContainershipV3().SSHCertificates(constants.ContainershipNamespace).Update(expiring)
+	assert.Nil(t, err)
+
+	certs = c.syncCertificates(t)
+	assert.Len(t, certs, 1)
+	assert.False(t, certs[0].Spec.Revoked, "keys of users without a username aren't revoked")
+	assert.Equal(t, expiring.Status.Serial, certs[0].Status.Serial, "or signed")
+}
+
+func TestSSHCertificateSyncSerials(t *testing.T) {
+	key := csv3.SSHKeySpec{ID: "key-1", Key: newTestSSHPublicKey(t)}
+	c := newTestSSHCertificateController(newSSHCertificateUser(key))
+
+	certs := c.syncCertificates(t)
+	assert.Len(t, certs[0].Status.Serials, 1)
+	assert.Equal(t, certs[0].Status.Serial, certs[0].Status.Serials[0].Serial)
+	first := certs[0].Status.Serial
+
+	// Renewed certificates are kept until they expire
+	expiring := certs[0].DeepCopy()
+	expiring.Status.ValidBefore = metav1.NewTime(time.Now().Add(time.Minute))
+	c.certs.Update(expiring)
+
+	certs = c.syncCertificates(t)
+	assert.Len(t, certs[0].Status.Serials, 2)
+	assert.Empty(t, certs[0].Status.RevokedSerials)
+
+	// Certificates of a replaced public key are revoked
+	key.Key = newTestSSHPublicKey(t)
+	c.users.Update(newSSHCertificateUser(key))
+
+	certs = c.syncCertificates(t)
+	assert.Len(t, certs[0].Status.Serials, 1)
+	assert.Len(t, certs[0].Status.RevokedSerials, 2)
+	assert.Equal(t, first, certs[0].Status.RevokedSerials[0].Serial)
+}
+
+func TestSSHCertificateSyncKeyAddedBack(t *testing.T) {
+	key := csv3.SSHKeySpec{ID: "key-1", Key: newTestSSHPublicKey(t)}
+	c := newTestSSHCertificateController(newSSHCertificateUser(key))
+
+	certs := c.syncCertificates(t)
+	serial := certs[0].Status.Serial
+
+	c.users.Update(newSSHCertificateUser())
+	certs = c.syncCertificates(t)
+	assert.True(t, certs[0].Spec.Revoked)
+	assert.Equal(t, "true", certs[0].Annotations[constants.SSHCertificateKeyRemovedAnnotation])
+
+	// Adding the key back signs it again instead of refusing it until the
+	// revoked certificate expires
+	c.users.Update(newSSHCertificateUser(key))
+	certs = c.syncCertificates(t)
+	assert.Len(t, certs, 1)
+	assert.False(t, certs[0].Spec.Revoked)
+	assert.NotContains(t, certs[0].Annotations, constants.SSHCertificateKeyRemovedAnnotation)
+	assert.NotEqual(t, serial, certs[0].Status.Serial)
+}
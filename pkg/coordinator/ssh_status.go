@@ -0,0 +1,61 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/log"
+	"github.com/containership/cluster-manager/pkg/resources/sysuser"
+)
+
+// NodeSSHStatus is the SSH status an agent reported on its node
+type NodeSSHStatus struct {
+	Node string `json:"node"`
+	// Status is nil if the agent didn't report a valid status
+	Status *sysuser.SSHStatus `json:"status"`
+}
+
+// NodesSSHStatus returns the SSH status reported on every node, sorted by
+// node name
+func NodesSSHStatus() ([]NodeSSHStatus, error) {
+	if nodesLister == nil {
+		return nil, fmt.Errorf("nodes lister is not initialized")
+	}
+
+	nodes, err := nodesLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	return nodesSSHStatus(nodes), nil
+}
+
+// nodesSSHStatus parses the SSH status annotation of the nodes
+func nodesSSHStatus(nodes []*corev1.Node) []NodeSSHStatus {
+	statuses := make([]NodeSSHStatus, 0, len(nodes))
+	for _, node := range nodes {
+		s := NodeSSHStatus{Node: node.Name}
+
+		if annotation, ok := node.Annotations[constants.SSHStatusAnnotation]; ok {
+			status := &sysuser.SSHStatus{}
+			if err := json.Unmarshal([]byte(annotation), status); err != nil {
+				log.Errorf("Could not parse SSH status of node %s: %s", node.Name, err)
+			} else {
+				s.Status = status
+			}
+		}
+
+		statuses = append(statuses, s)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Node < statuses[j].Node
+	})
+
+	return statuses
+}
@@ -0,0 +1,55 @@
+package coordinator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/containership/cluster-manager/pkg/constants"
+)
+
+func newSSHStatusNode(name string, annotation *string) *corev1.Node {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{},
+		},
+	}
+
+	if annotation != nil {
+		node.Annotations[constants.SSHStatusAnnotation] = *annotation
+	}
+
+	return node
+}
+
+func TestNodesSSHStatus(t *testing.T) {
+	valid := `{"user_ids":["user-1"],"authorized_keys_written_at":"2018-10-01T12:00:00Z",` +
+		`"active_sessions":[{"event":"start","session_id":"session-1","user_id":"user-1"}]}`
+	invalid := "{"
+
+	statuses := nodesSSHStatus([]*corev1.Node{
+		newSSHStatusNode("node-c", &invalid),
+		newSSHStatusNode("node-a", &valid),
+		newSSHStatusNode("node-b", nil),
+	})
+
+	assert.Len(t, statuses, 3)
+	assert.Equal(t, "node-a", statuses[0].Node, "sorted by node name")
+	assert.Equal(t, "node-b", statuses[1].Node)
+	assert.Equal(t, "node-c", statuses[2].Node)
+
+	status := statuses[0].Status
+	if assert.NotNil(t, status) {
+		assert.Equal(t, []string{"user-1"}, status.UserIDs)
+		assert.Equal(t, 2018, status.AuthorizedKeysWrittenAt.Year())
+		assert.Len(t, status.ActiveSessions, 1)
+		assert.Equal(t, "session-1", status.ActiveSessions[0].SessionID)
+	}
+
+	assert.Nil(t, statuses[1].Status, "agent didn't report")
+	assert.Nil(t, statuses[2].Status, "invalid annotation")
+}
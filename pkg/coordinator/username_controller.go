@@ -0,0 +1,237 @@
+package coordinator
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	csinformers "github.com/containership/cluster-manager/pkg/client/informers/externalversions"
+	cslisters "github.com/containership/cluster-manager/pkg/client/listers/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/env"
+	"github.com/containership/cluster-manager/pkg/log"
+	"github.com/containership/cluster-manager/pkg/resources/sysuser"
+)
+
+const (
+	// Type of agent that runs this controller
+	usernameControllerName = "UsernameController"
+	// number of times an object will be requeued if there is an error
+	maxRetriesUsernameController = 5
+
+	// All usernames are synced together, so there is only ever one thing to
+	// sync
+	usernamesSyncKey = "usernames"
+
+	// How often the usernames ConfigMap is checked in case it was changed
+	usernamesCheckInterval = time.Minute
+)
+
+// UsernameController gives each User a username for its host users and
+// persists it in the usernames ConfigMap, which the agents and the SSH
+// certificate controller read usernames from. Usernames never change once
+// given, and usernames of removed users are kept so that they're never given
+// to another user while their host users may still exist.
+type UsernameController struct {
+	kubeclientset kubernetes.Interface
+
+	usersLister cslisters.UserLister
+	usersSynced cache.InformerSynced
+
+	// strategy is how usernames of new users are built
+	strategy sysuser.UsernameStrategy
+
+	workqueue workqueue.RateLimitingInterface
+}
+
+// NewUsernameController returns a new coordinator controller which watches
+// Users
+func NewUsernameController(kubeclientset kubernetes.Interface, csInformerFactory csinformers.SharedInformerFactory) *UsernameController {
+	c := &UsernameController{
+		kubeclientset: kubeclientset,
+		strategy:      sysuser.UsernameStrategy(env.SSHUsernameStrategy()),
+		workqueue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Usernames"),
+	}
+
+	userInformer := csInformerFactory.Containership().V3().Users()
+
+	// Only new users need a username, but the name of a user that couldn't be
+	// given one may be fixed by an update
+	log.Info(usernameControllerName + ": Setting up event handlers")
+	userInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueSync,
+		UpdateFunc: func(old, new interface{}) {
+			if old.(*csv3.User).ResourceVersion == new.(*csv3.User).ResourceVersion {
+				return
+			}
+			c.enqueueSync(new)
+		},
+	})
+
+	c.usersLister = userInformer.Lister()
+	c.usersSynced = userInformer.Informer().HasSynced
+
+	return c
+}
+
+// Run starts the workers. It will block until stopCh is closed, at which
+// point it will shutdown the workqueue.
+func (c *UsernameController) Run(numWorkers int, stopCh chan struct{}) {
+	defer runtime.HandleCrash()
+	defer c.workqueue.ShutDown()
+
+	log.Info(usernameControllerName + ": Starting controller")
+
+	if ok := cache.WaitForCacheSync(stopCh, c.usersSynced); !ok {
+		log.Error(usernameControllerName, ": failed to wait for caches to sync")
+		return
+	}
+
+	log.Info(usernameControllerName, ": Starting workers")
+	for i := 0; i < numWorkers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+
+	// The ConfigMap isn't watched, so it's periodically restored in case it
+	// was deleted
+	go wait.Until(func() { c.enqueueSync(nil) }, usernamesCheckInterval, stopCh)
+
+	log.Info(usernameControllerName, ": Started workers")
+	<-stopCh
+	log.Info(usernameControllerName, ": Shutting down workers")
+}
+
+func (c *UsernameController) runWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *UsernameController) processNextWorkItem() bool {
+	obj, shutdown := c.workqueue.Get()
+
+	if shutdown {
+		return false
+	}
+
+	err := func(obj interface{}) error {
+		defer c.workqueue.Done(obj)
+		var key string
+		var ok bool
+		if key, ok = obj.(string); !ok {
+			c.workqueue.Forget(obj)
+			log.Errorf("expected string in workqueue but got %#v", obj)
+			return nil
+		}
+
+		err := c.syncHandler()
+		return c.handleErr(err, key)
+	}(obj)
+
+	if err != nil {
+		log.Error(err)
+		return true
+	}
+
+	return true
+}
+
+func (c *UsernameController) handleErr(err error, key interface{}) error {
+	if err == nil {
+		c.workqueue.Forget(key)
+		return nil
+	}
+
+	if c.workqueue.NumRequeues(key) < maxRetriesUsernameController {
+		c.workqueue.AddRateLimited(key)
+		return fmt.Errorf("error syncing '%v': %s. has been resynced %v times", key, err.Error(), c.workqueue.NumRequeues(key))
+	}
+
+	c.workqueue.Forget(key)
+	log.Infof("Dropping %q out of the queue: %v", key, err)
+	return err
+}
+
+// enqueueSync enqueues a sync of every username for any change
+func (c *UsernameController) enqueueSync(obj interface{}) {
+	c.workqueue.AddRateLimited(usernamesSyncKey)
+}
+
+// syncHandler gives each user that doesn't have a username yet a username
+// built with the configured strategy, or built from its ID when the ConfigMap
+// is first created
+func (c *UsernameController) syncHandler() error {
+	users, err := c.usersLister.Users(constants.ContainershipNamespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	configMaps := c.kubeclientset.CoreV1().ConfigMaps(constants.ContainershipNamespace)
+	cm, err := configMaps.Get(sysuser.UsernamesConfigMapName, metav1.GetOptions{})
+	create := errors.IsNotFound(err)
+	if err != nil && !create {
+		return err
+	}
+
+	var data map[string]string
+	if !create {
+		data = cm.Data
+	}
+
+	usernames, err := sysuser.NewUsernameMapping(data)
+	if err != nil {
+		return fmt.Errorf("invalid usernames ConfigMap %s: %s", sysuser.UsernamesConfigMapName, err)
+	}
+
+	specs := make([]csv3.UserSpec, 0, len(users))
+	for _, u := range users {
+		specs = append(specs, u.Spec)
+	}
+
+	// Users that existed before usernames were mapped already have host
+	// users named after their ID, so only users added later get a username
+	// built with the configured strategy
+	strategy := c.strategy
+	if create {
+		strategy = sysuser.UsernameStrategyUID
+	}
+
+	assigned, failed := usernames.Assign(specs, strategy)
+	for id, err := range failed {
+		log.Errorf("Could not give user %s a username: %s", id, err)
+	}
+
+	if create {
+		log.Info("Creating usernames ConfigMap")
+		_, err = configMaps.Create(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      sysuser.UsernamesConfigMapName,
+				Namespace: constants.ContainershipNamespace,
+				Labels:    constants.BuildContainershipLabelMap(nil),
+			},
+			Data: assigned.Data(),
+		})
+		return err
+	}
+
+	if len(assigned.Data()) == len(data) {
+		// Usernames are only ever added
+		return nil
+	}
+
+	log.Infof("Updating usernames ConfigMap with %d new usernames", len(assigned.Data())-len(data))
+	cmCopy := cm.DeepCopy()
+	cmCopy.Data = assigned.Data()
+
+	_, err = configMaps.Update(cmCopy)
+	return err
+}
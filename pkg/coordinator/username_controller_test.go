@@ -0,0 +1,120 @@
+package coordinator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	csfake "github.com/containership/cluster-manager/pkg/client/clientset/versioned/fake"
+	csinformers "github.com/containership/cluster-manager/pkg/client/informers/externalversions"
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/resources/sysuser"
+)
+
+func newUsernameUser(id, name string) *csv3.User {
+	return &csv3.User{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      id,
+			Namespace: constants.ContainershipNamespace,
+		},
+		Spec: csv3.UserSpec{
+			ID:   id,
+			Name: name,
+		},
+	}
+}
+
+func newTestUsernameController() (*UsernameController, *fake.Clientset, cache.Indexer) {
+	kubeclient := fake.NewSimpleClientset()
+	factory := csinformers.NewSharedInformerFactory(csfake.NewSimpleClientset(), 0)
+	userInformer := factory.Containership().V3().Users()
+
+	c := &UsernameController{
+		kubeclientset: kubeclient,
+		usersLister:   userInformer.Lister(),
+		strategy:      sysuser.UsernameStrategyUID,
+		workqueue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Usernames"),
+	}
+
+	return c, kubeclient, userInformer.Informer().GetIndexer()
+}
+
+func getUsernamesData(t *testing.T, kubeclient *fake.Clientset) map[string]string {
+	cm, err := kubeclient.CoreV1().ConfigMaps(constants.ContainershipNamespace).Get(sysuser.UsernamesConfigMapName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	if err != nil {
+		return nil
+	}
+
+	return cm.Data
+}
+
+func TestUsernameSync(t *testing.T) {
+	const (
+		id1 = "00000000-1111-2222-3333-000000000001"
+		id2 = "00000000-1111-2222-3333-000000000002"
+	)
+
+	c, kubeclient, users := newTestUsernameController()
+	users.Add(newUsernameUser(id1, "Jane"))
+
+	// The ConfigMap is created on the first sync
+	assert.Nil(t, c.syncHandler())
+	assert.Equal(t, map[string]string{
+		id1: "00000000111122223333000000000001",
+	}, getUsernamesData(t, kubeclient))
+
+	// Usernames don't change when users are renamed
+	users.Update(newUsernameUser(id1, "Janet"))
+	kubeclient.ClearActions()
+	assert.Nil(t, c.syncHandler())
+	assert.Len(t, kubeclient.Actions(), 1, "only the get")
+
+	// New users are added, and usernames of removed users are kept
+	users.Delete(newUsernameUser(id1, "Janet"))
+	users.Add(newUsernameUser(id2, "John"))
+	assert.Nil(t, c.syncHandler())
+	assert.Equal(t, map[string]string{
+		id1: "00000000111122223333000000000001",
+		id2: "00000000111122223333000000000002",
+	}, getUsernamesData(t, kubeclient))
+}
+
+func TestUsernameSyncSkipsInvalidUsers(t *testing.T) {
+	c, kubeclient, users := newTestUsernameController()
+	users.Add(newUsernameUser("not-a-uuid", "Jane"))
+
+	assert.Nil(t, c.syncHandler(), "users that can't be given a username don't fail the sync")
+	assert.Empty(t, getUsernamesData(t, kubeclient))
+}
+
+func TestUsernameSyncSeedsExistingUsers(t *testing.T) {
+	const (
+		id1 = "00000000-1111-2222-3333-000000000001"
+		id2 = "00000000-1111-2222-3333-000000000002"
+	)
+
+	c, kubeclient, users := newTestUsernameController()
+	c.strategy = sysuser.UsernameStrategyName
+	users.Add(newUsernameUser(id1, "Jane"))
+
+	// Users that existed before the ConfigMap keep the usernames of the
+	// host users they already have
+	assert.Nil(t, c.syncHandler())
+	assert.Equal(t, map[string]string{
+		id1: "00000000111122223333000000000001",
+	}, getUsernamesData(t, kubeclient))
+
+	users.Add(newUsernameUser(id2, "John"))
+	assert.Nil(t, c.syncHandler())
+	assert.Equal(t, map[string]string{
+		id1: "00000000111122223333000000000001",
+		id2: "john",
+	}, getUsernamesData(t, kubeclient))
+}
@@ -2,6 +2,7 @@ package env
 
 import (
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,15 +25,38 @@ type environment struct {
 	nodeName                           string
 	organizationID                     string
 	kubeconfig                         string
-	kubectlPath                        string
+	registryWebhookPort                string
+	registryWebhookTLSCertFile         string
+	registryWebhookTLSKeyFile          string
 	enableClusterUpgrade               bool
 	disableClusterManagementPluginSync bool
+	enableRegistryWebhook              bool
+	enableCombinedRegistrySecret       bool
+	pluginJobLogsToConfigMap           bool
+	pluginJobParallelism               int
+	pluginBundleDir                    string
+	hostUserCleanup                    string
+	hostUserCleanupGracePeriod         time.Duration
+	sshAuditLogFile                    string
+	sshSessionMaxAge                   time.Duration
+	enableSSHCAMode                    bool
+	sshCertificateTTL                  time.Duration
+	enableSSHAuthorizedKeysCommand     bool
+	sshLoginAccount                    string
+	sshUsernameStrategy                string
 }
 
 const (
 	defaultAgentInformerSyncInterval       = time.Minute
 	defaultCoordinatorInformerSyncInterval = time.Minute
 	defaultContainershipCloudSyncInterval  = time.Second * 30
+	defaultPluginJobParallelism            = 1
+	defaultHostUserCleanup                 = "none"
+	defaultHostUserCleanupGracePeriod      = 24 * time.Hour
+	defaultSSHSessionMaxAge                = 24 * time.Hour
+	defaultSSHUsernameStrategy             = "uid"
+	defaultSSHLoginAccount                 = "containership"
+	defaultSSHCertificateTTL               = 8 * time.Hour
 )
 
 var env environment
@@ -89,11 +113,17 @@ func init() {
 		env.csServerPort = "8000"
 	}
 
-	env.kubectlPath = os.Getenv("KUBECTL_PATH")
-	if env.kubectlPath == "" {
-		env.kubectlPath = "kubectl"
+	// The registry webhook is served with TLS on its own port, since the API
+	// server only calls webhooks over TLS while Cloud talks to the server
+	// over plain HTTP
+	env.registryWebhookPort = os.Getenv("REGISTRY_WEBHOOK_PORT")
+	if env.registryWebhookPort == "" {
+		env.registryWebhookPort = "8443"
 	}
 
+	env.registryWebhookTLSCertFile = os.Getenv("REGISTRY_WEBHOOK_TLS_CERT_FILE")
+	env.registryWebhookTLSKeyFile = os.Getenv("REGISTRY_WEBHOOK_TLS_KEY_FILE")
+
 	env.kubeconfig = os.Getenv("KUBECONFIG")
 	env.nodeName = os.Getenv("NODE_NAME")
 
@@ -101,6 +131,56 @@ func init() {
 	env.enableClusterUpgrade = os.Getenv("ENABLE_CLUSTER_UPGRADE") == "true"
 
 	env.disableClusterManagementPluginSync = os.Getenv("DISABLE_CLUSTER_MANAGEMENT_PLUGIN_SYNC") == "true"
+
+	env.enableRegistryWebhook = os.Getenv("ENABLE_REGISTRY_WEBHOOK") == "true"
+
+	env.enableCombinedRegistrySecret = os.Getenv("ENABLE_COMBINED_REGISTRY_SECRET") == "true"
+
+	env.pluginJobLogsToConfigMap = os.Getenv("PLUGIN_JOB_LOGS_TO_CONFIGMAP") == "true"
+
+	env.pluginJobParallelism = getIntEnvOrDefault("PLUGIN_JOB_PARALLELISM", defaultPluginJobParallelism)
+
+	// Plugin bundles are only imported from a directory if it's set
+	env.pluginBundleDir = os.Getenv("PLUGIN_BUNDLE_DIR")
+
+	env.hostUserCleanup = strings.ToLower(os.Getenv("HOST_USER_CLEANUP"))
+	switch env.hostUserCleanup {
+	case "none", "lock", "delete":
+	case "":
+		env.hostUserCleanup = defaultHostUserCleanup
+	default:
+		log.Infof("Invalid HOST_USER_CLEANUP %q, defaulting to %q", env.hostUserCleanup, defaultHostUserCleanup)
+		env.hostUserCleanup = defaultHostUserCleanup
+	}
+
+	env.hostUserCleanupGracePeriod = getDurationEnvOrDefault("HOST_USER_CLEANUP_GRACE_PERIOD",
+		defaultHostUserCleanupGracePeriod)
+
+	// SSH sessions are only written to an audit log file if it's set
+	env.sshAuditLogFile = os.Getenv("SSH_AUDIT_LOG_FILE")
+
+	env.sshSessionMaxAge = getDurationEnvOrDefault("SSH_SESSION_MAX_AGE", defaultSSHSessionMaxAge)
+
+	env.enableSSHCAMode = os.Getenv("ENABLE_SSH_CA_MODE") == "true"
+
+	env.sshCertificateTTL = getDurationEnvOrDefault("SSH_CERTIFICATE_TTL", defaultSSHCertificateTTL)
+
+	env.enableSSHAuthorizedKeysCommand = os.Getenv("ENABLE_SSH_AUTHORIZED_KEYS_COMMAND") == "true"
+
+	env.sshLoginAccount = os.Getenv("SSH_LOGIN_ACCOUNT")
+	if env.sshLoginAccount == "" {
+		env.sshLoginAccount = defaultSSHLoginAccount
+	}
+
+	env.sshUsernameStrategy = strings.ToLower(os.Getenv("SSH_USERNAME_STRATEGY"))
+	switch env.sshUsernameStrategy {
+	case "uid", "name":
+	case "":
+		env.sshUsernameStrategy = defaultSSHUsernameStrategy
+	default:
+		log.Infof("Invalid SSH_USERNAME_STRATEGY %q, defaulting to %q", env.sshUsernameStrategy, defaultSSHUsernameStrategy)
+		env.sshUsernameStrategy = defaultSSHUsernameStrategy
+	}
 }
 
 // OrganizationID returns Containership Cloud organization id
@@ -158,16 +238,28 @@ func CSServerPort() string {
 	return env.csServerPort
 }
 
+// RegistryWebhookPort returns the port the registry webhook is served on
+func RegistryWebhookPort() string {
+	return env.registryWebhookPort
+}
+
+// RegistryWebhookTLSCertFile returns the path to the registry webhook TLS
+// certificate, if defined
+func RegistryWebhookTLSCertFile() string {
+	return env.registryWebhookTLSCertFile
+}
+
+// RegistryWebhookTLSKeyFile returns the path to the registry webhook TLS key,
+// if defined
+func RegistryWebhookTLSKeyFile() string {
+	return env.registryWebhookTLSKeyFile
+}
+
 // Kubeconfig returns kubeconfig file if defined
 func Kubeconfig() string {
 	return env.kubeconfig
 }
 
-// KubectlPath returns the path to use the kubectl command
-func KubectlPath() string {
-	return env.kubectlPath
-}
-
 // NodeName returns the name of the node that is running the process
 func NodeName() string {
 	return env.nodeName
@@ -183,6 +275,93 @@ func IsClusterManagementPluginSyncDisabled() bool {
 	return env.disableClusterManagementPluginSync
 }
 
+// IsRegistryWebhookEnabled returns true if the registry image pull secret
+// mutating webhook is enabled, else false
+func IsRegistryWebhookEnabled() bool {
+	return env.enableRegistryWebhook
+}
+
+// IsCombinedRegistrySecretEnabled returns true if a single docker config
+// secret covering all registries should be created per namespace instead of
+// one secret per registry, else false
+func IsCombinedRegistrySecretEnabled() bool {
+	return env.enableCombinedRegistrySecret
+}
+
+// IsPluginJobLogsToConfigMapEnabled returns true if the logs of plugin jobs
+// should be kept in a ConfigMap instead of being recorded as events, else
+// false
+func IsPluginJobLogsToConfigMapEnabled() bool {
+	return env.pluginJobLogsToConfigMap
+}
+
+// PluginJobParallelism returns how many independent plugin jobs may run at
+// the same time
+func PluginJobParallelism() int {
+	return env.pluginJobParallelism
+}
+
+// PluginBundleDir returns the directory plugin bundles are imported from, if
+// defined
+func PluginBundleDir() string {
+	return env.pluginBundleDir
+}
+
+// HostUserCleanup returns what the agent does with host users whose User no
+// longer exists: "none", "lock" or "delete"
+func HostUserCleanup() string {
+	return env.hostUserCleanup
+}
+
+// HostUserCleanupGracePeriod returns how long host users must have had no
+// User before they're cleaned up
+func HostUserCleanupGracePeriod() time.Duration {
+	return env.hostUserCleanupGracePeriod
+}
+
+// SSHAuditLogFile returns the file SSH session audit records are appended to,
+// if any
+func SSHAuditLogFile() string {
+	return env.sshAuditLogFile
+}
+
+// SSHSessionMaxAge returns how long an SSH session is reported as active at
+// most, in case its end was never recorded
+func SSHSessionMaxAge() time.Duration {
+	return env.sshSessionMaxAge
+}
+
+// IsSSHCAModeEnabled returns true if users log in with short-lived
+// certificates signed by the cluster SSH CA instead of their SSH keys
+func IsSSHCAModeEnabled() bool {
+	return env.enableSSHCAMode
+}
+
+// SSHCertificateTTL returns how long SSH certificates are valid for unless
+// their SSHCertificate sets a TTL
+func SSHCertificateTTL() time.Duration {
+	return env.sshCertificateTTL
+}
+
+// IsSSHAuthorizedKeysCommandEnabled returns true if sshd gets the keys of
+// users from the agent through an AuthorizedKeysCommand helper instead of the
+// shared authorized_keys file
+func IsSSHAuthorizedKeysCommandEnabled() bool {
+	return env.enableSSHAuthorizedKeysCommand
+}
+
+// SSHLoginAccount returns the host account users log in through before the
+// login script switches to their own host user
+func SSHLoginAccount() string {
+	return env.sshLoginAccount
+}
+
+// SSHUsernameStrategy returns how the coordinator builds the usernames of new
+// users: "uid" or "name"
+func SSHUsernameStrategy() string {
+	return env.sshUsernameStrategy
+}
+
 // Dump dumps the environment if we're in a development or stage environment
 func Dump() {
 	if env.csCloudEnvironment == "development" || env.csCloudEnvironment == "stage" {
@@ -198,3 +377,11 @@ func getDurationEnvOrDefault(key string, defaultVal time.Duration) time.Duration
 	}
 	return val
 }
+
+func getIntEnvOrDefault(key string, defaultVal int) int {
+	val, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || val <= 0 {
+		val = defaultVal
+	}
+	return val
+}
@@ -0,0 +1,571 @@
+package apply
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/pkg/errors"
+
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/jsonmergepatch"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/restmapper"
+)
+
+// LastAppliedConfigAnnotation is the annotation holding the configuration an
+// object was last applied with. It's the same annotation kubectl uses so that
+// objects previously applied with kubectl are updated correctly.
+const LastAppliedConfigAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// Action is what was done to an object
+type Action string
+
+const (
+	// ActionCreated means the object did not exist and was created
+	ActionCreated Action = "created"
+	// ActionConfigured means the object existed and was updated
+	ActionConfigured Action = "configured"
+	// ActionUnchanged means the object already matched what was applied
+	ActionUnchanged Action = "unchanged"
+	// ActionDeleted means the object was deleted
+	ActionDeleted Action = "deleted"
+	// ActionFailed means the object could not be applied or deleted
+	ActionFailed Action = "failed"
+	// ActionMissing means the object should exist but doesn't
+	ActionMissing Action = "missing"
+	// ActionDrifted means the live object no longer matches what was
+	// applied
+	ActionDrifted Action = "drifted"
+)
+
+// Result is the outcome of applying or deleting a single object
+type Result struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Action    Action
+	Err       error
+}
+
+// String formats the result similar to kubectl output
+func (r Result) String() string {
+	name := r.Name
+	if r.Namespace != "" {
+		name = r.Namespace + "/" + r.Name
+	}
+
+	if r.Err != nil {
+		return fmt.Sprintf("%s %s %s: %s", r.Kind, name, r.Action, r.Err)
+	}
+
+	return fmt.Sprintf("%s %s %s", r.Kind, name, r.Action)
+}
+
+// resettable is implemented by RESTMappers that cache discovery information
+type resettable interface {
+	Reset()
+}
+
+// Applier applies and deletes arbitrary objects using the dynamic client,
+// resolving their resources through discovery
+type Applier struct {
+	client    dynamic.Interface
+	mapper    meta.RESTMapper
+	discovery discovery.ServerResourcesInterface
+}
+
+// NewApplier returns an Applier using the given dynamic client and discovery
+// client. Discovery information is cached until an unknown kind is seen.
+func NewApplier(client dynamic.Interface, discoveryClient discovery.DiscoveryInterface) *Applier {
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(cached.NewMemCacheClient(discoveryClient))
+	return newApplier(client, mapper, discoveryClient)
+}
+
+func newApplier(client dynamic.Interface, mapper meta.RESTMapper, discoveryClient discovery.ServerResourcesInterface) *Applier {
+	return &Applier{
+		client:    client,
+		mapper:    mapper,
+		discovery: discoveryClient,
+	}
+}
+
+// ApplyAll applies each object in order. Failing to apply an object does not
+// stop the remaining objects from being applied. The returned error is nil
+// only if every object was applied.
+func (a *Applier) ApplyAll(objs []*unstructured.Unstructured) ([]Result, error) {
+	results := make([]Result, 0, len(objs))
+	failed := 0
+	for _, obj := range objs {
+		result := a.Apply(obj)
+		if result.Err != nil {
+			failed++
+		}
+
+		results = append(results, result)
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d objects failed to apply", failed, len(objs))
+	}
+
+	return results, nil
+}
+
+// Apply creates the object if it does not exist, otherwise it updates the
+// existing object using a three-way merge between the last applied
+// configuration, the new configuration and the live object, like
+// kubectl apply does
+func (a *Applier) Apply(obj *unstructured.Unstructured) Result {
+	result := newResult(obj)
+
+	resource, err := a.resourceFor(obj)
+	if err != nil {
+		return result.failed(err)
+	}
+	result.Namespace = obj.GetNamespace()
+
+	modified, err := withLastAppliedConfig(obj)
+	if err != nil {
+		return result.failed(err)
+	}
+
+	current, err := resource.Get(obj.GetName(), metav1.GetOptions{})
+	if kubeerrors.IsNotFound(err) {
+		_, err = resource.Create(modified, metav1.CreateOptions{})
+		if err != nil {
+			return result.failed(err)
+		}
+
+		result.Action = ActionCreated
+		return result
+	} else if err != nil {
+		return result.failed(err)
+	}
+
+	updated, changed, err := merge(current, modified)
+	if err != nil {
+		return result.failed(err)
+	}
+
+	if !changed {
+		result.Action = ActionUnchanged
+		return result
+	}
+
+	_, err = resource.Update(updated, metav1.UpdateOptions{})
+	if err != nil {
+		return result.failed(err)
+	}
+
+	result.Action = ActionConfigured
+	return result
+}
+
+// Diff compares the object with the live object without changing anything.
+// The result is ActionMissing if the live object doesn't exist, ActionDrifted
+// if applying the object would change the live object and ActionUnchanged
+// otherwise. Fields that are only set on the live object, e.g. defaults and
+// status, are not considered drift.
+func (a *Applier) Diff(obj *unstructured.Unstructured) Result {
+	result := newResult(obj)
+
+	resource, err := a.resourceFor(obj)
+	if err != nil {
+		return result.failed(err)
+	}
+	result.Namespace = obj.GetNamespace()
+
+	modified, err := withLastAppliedConfig(obj)
+	if err != nil {
+		return result.failed(err)
+	}
+
+	current, err := resource.Get(obj.GetName(), metav1.GetOptions{})
+	if kubeerrors.IsNotFound(err) {
+		result.Action = ActionMissing
+		return result
+	} else if err != nil {
+		return result.failed(err)
+	}
+
+	_, changed, err := merge(current, modified)
+	if err != nil {
+		return result.failed(err)
+	}
+
+	if changed {
+		result.Action = ActionDrifted
+		return result
+	}
+
+	result.Action = ActionUnchanged
+	return result
+}
+
+// Delete deletes the object, treating an object that is already gone as
+// deleted
+func (a *Applier) Delete(obj *unstructured.Unstructured) Result {
+	result := newResult(obj)
+
+	resource, err := a.resourceFor(obj)
+	if err != nil {
+		return result.failed(err)
+	}
+	result.Namespace = obj.GetNamespace()
+
+	err = resource.Delete(obj.GetName(), backgroundDeleteOptions())
+	if err != nil && !kubeerrors.IsNotFound(err) {
+		return result.failed(err)
+	}
+
+	result.Action = ActionDeleted
+	return result
+}
+
+// Scope is a resource in a namespace that objects were applied to. The
+// namespace is empty for cluster scoped resources, or to refer to every
+// namespace.
+type Scope struct {
+	Group     string `json:"group,omitempty"`
+	Version   string `json:"version"`
+	Resource  string `json:"resource"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+func (s Scope) groupVersionResource() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: s.Group, Version: s.Version, Resource: s.Resource}
+}
+
+// ScopesOf returns the scopes of the objects without duplicates. Objects
+// whose kind is unknown can't have been applied, so they're skipped.
+func (a *Applier) ScopesOf(objs []*unstructured.Unstructured) []Scope {
+	scopes := make([]Scope, 0)
+	for _, obj := range objs {
+		mapping, err := a.mappingFor(obj)
+		if err != nil {
+			continue
+		}
+
+		scope := Scope{
+			Group:    mapping.Resource.Group,
+			Version:  mapping.Resource.Version,
+			Resource: mapping.Resource.Resource,
+		}
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			scope.Namespace = obj.GetNamespace()
+			if scope.Namespace == "" {
+				scope.Namespace = metav1.NamespaceDefault
+			}
+		}
+
+		scopes = append(scopes, scope)
+	}
+
+	return MergeScopes(scopes)
+}
+
+// MergeScopes returns the scopes in all of the lists without duplicates
+func MergeScopes(lists ...[]Scope) []Scope {
+	seen := make(map[Scope]bool)
+	merged := make([]Scope, 0)
+	for _, scopes := range lists {
+		for _, scope := range scopes {
+			if seen[scope] {
+				continue
+			}
+			seen[scope] = true
+
+			merged = append(merged, scope)
+		}
+	}
+
+	return merged
+}
+
+// ListByLabel returns the objects matching the label selector in the given
+// scopes, or in every scope if scopes is nil
+func (a *Applier) ListByLabel(selector string, scopes []Scope) ([]*unstructured.Unstructured, error) {
+	objs := make([]*unstructured.Unstructured, 0)
+	err := a.eachByLabel(selector, scopes, func(_ schema.GroupVersionResource, item *unstructured.Unstructured) {
+		objs = append(objs, item)
+	})
+
+	return objs, err
+}
+
+// DeleteByLabel deletes the objects matching the label selector in the given
+// scopes. If scopes is nil, objects of every deletable resource type in all
+// namespaces are deleted instead, which is needed for objects whose scopes
+// were never recorded.
+func (a *Applier) DeleteByLabel(selector string, scopes []Scope) ([]Result, error) {
+	results := make([]Result, 0)
+	failed := 0
+	err := a.eachByLabel(selector, scopes, func(gvr schema.GroupVersionResource, item *unstructured.Unstructured) {
+		result := newResult(item)
+
+		err := a.client.Resource(gvr).Namespace(item.GetNamespace()).
+			Delete(item.GetName(), backgroundDeleteOptions())
+		if err != nil && !kubeerrors.IsNotFound(err) {
+			result = result.failed(err)
+			failed++
+		} else {
+			result.Action = ActionDeleted
+		}
+
+		results = append(results, result)
+	})
+	if err != nil {
+		return results, err
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("%d objects failed to delete", failed)
+	}
+
+	return results, nil
+}
+
+// eachByLabel calls fn with each object matching the label selector in the
+// given scopes, or in the scopes of every deletable resource type in all
+// namespaces if scopes is nil
+func (a *Applier) eachByLabel(selector string, scopes []Scope, fn func(schema.GroupVersionResource, *unstructured.Unstructured)) error {
+	if scopes == nil {
+		resources, err := a.deletableResources()
+		if err != nil {
+			return err
+		}
+
+		scopes = make([]Scope, 0, len(resources))
+		for _, gvr := range resources {
+			scopes = append(scopes, Scope{
+				Group:    gvr.Group,
+				Version:  gvr.Version,
+				Resource: gvr.Resource,
+			})
+		}
+	}
+
+	for _, scope := range scopes {
+		gvr := scope.groupVersionResource()
+		list, err := a.client.Resource(gvr).Namespace(scope.Namespace).List(metav1.ListOptions{
+			LabelSelector: selector,
+		})
+		// The resource is no longer served, e.g. because its CRD was
+		// deleted, so there is nothing left in it
+		if kubeerrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "listing %s failed", gvr.Resource)
+		}
+
+		for i := range list.Items {
+			fn(gvr, &list.Items[i])
+		}
+	}
+
+	return nil
+}
+
+// resourceFor returns the dynamic resource client for the object. Namespaced
+// objects without a namespace are defaulted to the default namespace like
+// kubectl does.
+func (a *Applier) resourceFor(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+	mapping, err := a.mappingFor(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		obj.SetNamespace("")
+		return a.client.Resource(mapping.Resource), nil
+	}
+
+	if obj.GetNamespace() == "" {
+		obj.SetNamespace(metav1.NamespaceDefault)
+	}
+
+	return a.client.Resource(mapping.Resource).Namespace(obj.GetNamespace()), nil
+}
+
+// mappingFor returns the REST mapping of the kind of the object
+func (a *Applier) mappingFor(obj *unstructured.Unstructured) (*meta.RESTMapping, error) {
+	gvk := obj.GroupVersionKind()
+	mapping, err := a.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		// Discovery is only cached once the mapper is first reset, and the
+		// kind may come from a CRD that was created after discovery was
+		// cached, e.g. by an earlier group of the same plugin
+		if r, ok := a.mapper.(resettable); ok {
+			r.Reset()
+			mapping, err = a.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		}
+	}
+
+	return mapping, err
+}
+
+// deletableResources returns one version of every top level resource that
+// can be both listed and deleted
+func (a *Applier) deletableResources() ([]schema.GroupVersionResource, error) {
+	lists, err := a.discovery.ServerResources()
+	// Discovery failing for some groups (e.g. an unavailable aggregated API)
+	// shouldn't stop us from deleting everything else
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return nil, err
+	}
+
+	lists = discovery.FilteredBy(discovery.SupportsAllVerbs{
+		Verbs: []string{"list", "delete"},
+	}, lists)
+
+	seen := make(map[schema.GroupResource]bool)
+	resources := make([]schema.GroupVersionResource, 0)
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+
+		for _, r := range list.APIResources {
+			// Skip subresources such as deployments/scale
+			if strings.Contains(r.Name, "/") {
+				continue
+			}
+
+			gr := schema.GroupResource{Group: gv.Group, Resource: r.Name}
+			if seen[gr] {
+				continue
+			}
+			seen[gr] = true
+
+			resources = append(resources, gv.WithResource(r.Name))
+		}
+	}
+
+	return resources, nil
+}
+
+// withLastAppliedConfig returns a copy of the object annotated with its own
+// configuration
+func withLastAppliedConfig(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	modified := obj.DeepCopy()
+
+	// The annotation must not contain itself
+	annotations := modified.GetAnnotations()
+	delete(annotations, LastAppliedConfigAnnotation)
+	modified.SetAnnotations(annotations)
+
+	config, err := modified.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[LastAppliedConfigAnnotation] = string(config)
+	modified.SetAnnotations(annotations)
+
+	return modified, nil
+}
+
+// merge computes the three-way merge of the modified object onto the current
+// object. It returns the merged object and whether it differs from the
+// current object. Built in kinds are merged with a strategic merge patch like
+// kubectl does, so that e.g. containers are merged by name instead of
+// replacing the list along with every defaulted field in it. Other kinds,
+// such as custom resources, are merged with a JSON merge patch.
+func merge(current, modified *unstructured.Unstructured) (*unstructured.Unstructured, bool, error) {
+	currentJSON, err := current.MarshalJSON()
+	if err != nil {
+		return nil, false, err
+	}
+
+	modifiedJSON, err := modified.MarshalJSON()
+	if err != nil {
+		return nil, false, err
+	}
+
+	original := []byte(current.GetAnnotations()[LastAppliedConfigAnnotation])
+
+	lookup, strategic := patchMetaFor(current)
+
+	var patch []byte
+	if strategic {
+		patch, err = strategicpatch.CreateThreeWayMergePatch(original, modifiedJSON, currentJSON, lookup, true)
+	} else {
+		patch, err = jsonmergepatch.CreateThreeWayJSONMergePatch(original, modifiedJSON, currentJSON)
+	}
+	if err != nil {
+		return nil, false, errors.Wrap(err, "creating patch failed")
+	}
+
+	if string(patch) == "{}" {
+		return current, false, nil
+	}
+
+	var mergedJSON []byte
+	if strategic {
+		mergedJSON, err = strategicpatch.StrategicMergePatchUsingLookupPatchMeta(currentJSON, patch, lookup)
+	} else {
+		mergedJSON, err = jsonpatch.MergePatch(currentJSON, patch)
+	}
+	if err != nil {
+		return nil, false, errors.Wrap(err, "applying patch failed")
+	}
+
+	merged := &unstructured.Unstructured{}
+	if err := json.Unmarshal(mergedJSON, &merged.Object); err != nil {
+		return nil, false, err
+	}
+
+	return merged, true, nil
+}
+
+// patchMetaFor returns the strategic merge patch metadata for the kind of the
+// object, if it's a kind known to the Kubernetes scheme
+func patchMetaFor(obj *unstructured.Unstructured) (strategicpatch.LookupPatchMeta, bool) {
+	typed, err := scheme.Scheme.New(obj.GroupVersionKind())
+	if err != nil {
+		return nil, false
+	}
+
+	lookup, err := strategicpatch.NewPatchMetaFromStruct(typed)
+	if err != nil {
+		return nil, false
+	}
+
+	return lookup, true
+}
+
+func newResult(obj *unstructured.Unstructured) Result {
+	return Result{
+		Kind:      obj.GetKind(),
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+	}
+}
+
+func (r Result) failed(err error) Result {
+	r.Action = ActionFailed
+	r.Err = err
+	return r
+}
+
+func backgroundDeleteOptions() *metav1.DeleteOptions {
+	propagationPolicy := metav1.DeletePropagationBackground
+	return &metav1.DeleteOptions{
+		PropagationPolicy: &propagationPolicy,
+	}
+}
@@ -0,0 +1,334 @@
+package apply
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var (
+	configMapGVR  = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	roleGVR       = schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"}
+	deploymentGVR = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+)
+
+func newTestMapper() meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"}, meta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, meta.RESTScopeNamespace)
+	return mapper
+}
+
+func newTestDiscovery() *fakediscovery.FakeDiscovery {
+	return &fakediscovery.FakeDiscovery{
+		Fake: &k8stesting.Fake{
+			Resources: []*metav1.APIResourceList{
+				{
+					GroupVersion: "v1",
+					APIResources: []metav1.APIResource{
+						{Name: "configmaps", Namespaced: true, Kind: "ConfigMap", Verbs: []string{"list", "delete"}},
+						// Can't be deleted so should be skipped
+						{Name: "bindings", Namespaced: true, Kind: "Binding", Verbs: []string{"create"}},
+					},
+				},
+				{
+					GroupVersion: "rbac.authorization.k8s.io/v1",
+					APIResources: []metav1.APIResource{
+						{Name: "clusterroles", Kind: "ClusterRole", Verbs: []string{"list", "delete"}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func newConfigMap(namespace, name string, data map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata": map[string]interface{}{
+				"name": name,
+			},
+			"data": data,
+		},
+	}
+
+	if namespace != "" {
+		obj.SetNamespace(namespace)
+	}
+
+	return obj
+}
+
+func newClusterRole(name string, labels map[string]string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       "ClusterRole",
+			"metadata": map[string]interface{}{
+				"name": name,
+			},
+		},
+	}
+	obj.SetLabels(labels)
+
+	return obj
+}
+
+func TestApply(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	a := newApplier(client, newTestMapper(), newTestDiscovery())
+
+	result := a.Apply(newConfigMap("test", "config", map[string]interface{}{
+		"a": "1",
+		"b": "2",
+	}))
+	assert.Nil(t, result.Err)
+	assert.Equal(t, ActionCreated, result.Action)
+	assert.Equal(t, "ConfigMap test/config created", result.String())
+
+	result = a.Apply(newConfigMap("test", "config", map[string]interface{}{
+		"a": "1",
+		"b": "2",
+	}))
+	assert.Nil(t, result.Err)
+	assert.Equal(t, ActionUnchanged, result.Action)
+
+	// Simulate something else adding a key that was never applied, which
+	// should be left alone
+	live, err := client.Resource(configMapGVR).Namespace("test").Get("config", metav1.GetOptions{})
+	assert.Nil(t, err)
+	unstructured.SetNestedField(live.Object, "external", "data", "c")
+	_, err = client.Resource(configMapGVR).Namespace("test").Update(live, metav1.UpdateOptions{})
+	assert.Nil(t, err)
+
+	// Removing a previously applied key should remove it from the live object
+	result = a.Apply(newConfigMap("test", "config", map[string]interface{}{
+		"a": "changed",
+	}))
+	assert.Nil(t, result.Err)
+	assert.Equal(t, ActionConfigured, result.Action)
+
+	live, err = client.Resource(configMapGVR).Namespace("test").Get("config", metav1.GetOptions{})
+	assert.Nil(t, err)
+	data, _, _ := unstructured.NestedStringMap(live.Object, "data")
+	assert.Equal(t, map[string]string{"a": "changed", "c": "external"}, data)
+	assert.NotEmpty(t, live.GetAnnotations()[LastAppliedConfigAnnotation])
+}
+
+func newDeployment(image string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{
+			"name":      "deployment",
+			"namespace": "test",
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{
+							"name":  "app",
+							"image": image,
+						},
+					},
+				},
+			},
+		},
+	}}
+}
+
+func TestApplyMergesBuiltInKindsStrategically(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	a := newApplier(client, newTestMapper(), newTestDiscovery())
+
+	result := a.Apply(newDeployment("app:1"))
+	assert.Nil(t, result.Err)
+
+	// Simulate the API server defaulting a field of the container
+	live, err := client.Resource(deploymentGVR).Namespace("test").Get("deployment", metav1.GetOptions{})
+	assert.Nil(t, err)
+	containers, _, _ := unstructured.NestedSlice(live.Object, "spec", "template", "spec", "containers")
+	containers[0].(map[string]interface{})["terminationMessagePath"] = "/dev/termination-log"
+	unstructured.SetNestedSlice(live.Object, containers, "spec", "template", "spec", "containers")
+	_, err = client.Resource(deploymentGVR).Namespace("test").Update(live, metav1.UpdateOptions{})
+	assert.Nil(t, err)
+
+	// The defaulted field isn't a change
+	result = a.Apply(newDeployment("app:1"))
+	assert.Nil(t, result.Err)
+	assert.Equal(t, ActionUnchanged, result.Action)
+
+	// Containers are merged by name, keeping the defaulted field
+	result = a.Apply(newDeployment("app:2"))
+	assert.Nil(t, result.Err)
+	assert.Equal(t, ActionConfigured, result.Action)
+
+	live, err = client.Resource(deploymentGVR).Namespace("test").Get("deployment", metav1.GetOptions{})
+	assert.Nil(t, err)
+	containers, _, _ = unstructured.NestedSlice(live.Object, "spec", "template", "spec", "containers")
+	assert.Len(t, containers, 1)
+	assert.Equal(t, "app:2", containers[0].(map[string]interface{})["image"])
+	assert.Equal(t, "/dev/termination-log", containers[0].(map[string]interface{})["terminationMessagePath"])
+}
+
+func TestDiff(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	a := newApplier(client, newTestMapper(), newTestDiscovery())
+
+	result := a.Diff(newDeployment("app:1"))
+	assert.Nil(t, result.Err)
+	assert.Equal(t, ActionMissing, result.Action)
+
+	a.Apply(newDeployment("app:1"))
+
+	result = a.Diff(newDeployment("app:1"))
+	assert.Nil(t, result.Err)
+	assert.Equal(t, ActionUnchanged, result.Action)
+
+	// Something else changes the image
+	live, err := client.Resource(deploymentGVR).Namespace("test").Get("deployment", metav1.GetOptions{})
+	assert.Nil(t, err)
+	containers, _, _ := unstructured.NestedSlice(live.Object, "spec", "template", "spec", "containers")
+	containers[0].(map[string]interface{})["image"] = "other:1"
+	unstructured.SetNestedSlice(live.Object, containers, "spec", "template", "spec", "containers")
+	_, err = client.Resource(deploymentGVR).Namespace("test").Update(live, metav1.UpdateOptions{})
+	assert.Nil(t, err)
+
+	result = a.Diff(newDeployment("app:1"))
+	assert.Nil(t, result.Err)
+	assert.Equal(t, ActionDrifted, result.Action)
+	assert.Equal(t, "Deployment test/deployment drifted", result.String())
+
+	// Diff never changes the live object
+	live, err = client.Resource(deploymentGVR).Namespace("test").Get("deployment", metav1.GetOptions{})
+	assert.Nil(t, err)
+	containers, _, _ = unstructured.NestedSlice(live.Object, "spec", "template", "spec", "containers")
+	assert.Equal(t, "other:1", containers[0].(map[string]interface{})["image"])
+}
+
+func TestApplyDefaultsNamespace(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	a := newApplier(client, newTestMapper(), newTestDiscovery())
+
+	result := a.Apply(newConfigMap("", "config", nil))
+	assert.Nil(t, result.Err)
+	assert.Equal(t, "default", result.Namespace)
+
+	_, err := client.Resource(configMapGVR).Namespace("default").Get("config", metav1.GetOptions{})
+	assert.Nil(t, err)
+
+	// Cluster scoped objects never have a namespace
+	role := newClusterRole("role", nil)
+	role.SetNamespace("test")
+	result = a.Apply(role)
+	assert.Nil(t, result.Err)
+	assert.Equal(t, "", result.Namespace)
+}
+
+func TestApplyAll(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	a := newApplier(client, newTestMapper(), newTestDiscovery())
+
+	unknown := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "example.com/v1",
+			"kind":       "Unknown",
+			"metadata": map[string]interface{}{
+				"name": "unknown",
+			},
+		},
+	}
+
+	results, err := a.ApplyAll([]*unstructured.Unstructured{
+		newConfigMap("test", "first", nil),
+		unknown,
+		newClusterRole("last", nil),
+	})
+	assert.NotNil(t, err)
+	assert.Len(t, results, 3)
+	assert.Equal(t, ActionCreated, results[0].Action)
+	assert.Equal(t, ActionFailed, results[1].Action)
+	assert.NotNil(t, results[1].Err)
+	// Objects after a failure are still applied
+	assert.Equal(t, ActionCreated, results[2].Action)
+}
+
+func TestDeleteByLabel(t *testing.T) {
+	labels := map[string]string{"plugin": "test"}
+
+	labeledConfigMap := newConfigMap("test", "labeled", nil)
+	labeledConfigMap.SetLabels(labels)
+
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme(),
+		labeledConfigMap,
+		newConfigMap("test", "unlabeled", nil),
+		newClusterRole("labeled", labels),
+	)
+	a := newApplier(client, newTestMapper(), newTestDiscovery())
+
+	// Only the given scopes are searched
+	scopes := []Scope{{Version: "v1", Resource: "configmaps", Namespace: "other"}}
+	results, err := a.DeleteByLabel("plugin=test", scopes)
+	assert.Nil(t, err)
+	assert.Len(t, results, 0)
+
+	results, err = a.DeleteByLabel("plugin=test", nil)
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+
+	_, err = client.Resource(configMapGVR).Namespace("test").Get("labeled", metav1.GetOptions{})
+	assert.NotNil(t, err)
+
+	_, err = client.Resource(configMapGVR).Namespace("test").Get("unlabeled", metav1.GetOptions{})
+	assert.Nil(t, err)
+
+	_, err = client.Resource(roleGVR).Get("labeled", metav1.GetOptions{})
+	assert.NotNil(t, err)
+}
+
+func TestScopesOf(t *testing.T) {
+	a := newApplier(fake.NewSimpleDynamicClient(runtime.NewScheme()), newTestMapper(), newTestDiscovery())
+
+	unknown := newConfigMap("test", "unknown", nil)
+	unknown.SetKind("Unknown")
+
+	scopes := a.ScopesOf([]*unstructured.Unstructured{
+		newConfigMap("test", "first", nil),
+		newConfigMap("test", "second", nil),
+		newConfigMap("", "defaulted", nil),
+		newClusterRole("role", nil),
+		unknown,
+	})
+
+	assert.Equal(t, []Scope{
+		{Version: "v1", Resource: "configmaps", Namespace: "test"},
+		{Version: "v1", Resource: "configmaps", Namespace: "default"},
+		{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"},
+	}, scopes)
+}
+
+func TestDelete(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme(), newConfigMap("test", "config", nil))
+	a := newApplier(client, newTestMapper(), newTestDiscovery())
+
+	result := a.Delete(newConfigMap("test", "config", nil))
+	assert.Nil(t, result.Err)
+	assert.Equal(t, ActionDeleted, result.Action)
+
+	// Deleting something that's already gone is fine
+	result = a.Delete(newConfigMap("test", "config", nil))
+	assert.Nil(t, result.Err)
+}
@@ -0,0 +1,30 @@
+package k8sutil
+
+import (
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// DynamicKubeAPI is an object for interacting with arbitrary resources,
+// including ones that are not known until runtime
+type DynamicKubeAPI struct {
+	client dynamic.Interface
+	config *rest.Config
+}
+
+var dynamicAPI *DynamicKubeAPI
+
+func newDynamicClient(config *rest.Config) (dynamic.Interface, error) {
+	return dynamic.NewForConfig(config)
+}
+
+// DynamicAPI returns the instance of DynamicKubeAPI
+func DynamicAPI() *DynamicKubeAPI {
+	return dynamicAPI
+}
+
+// Client returns the dynamic client which can be used to interact with any
+// resource
+func (k DynamicKubeAPI) Client() dynamic.Interface {
+	return k.client
+}
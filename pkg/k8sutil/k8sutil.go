@@ -52,9 +52,15 @@ func Initialize() error {
 		return errors.Wrap(err, "create Kubernetes extensions clientset failed")
 	}
 
+	dynamicclient, err := newDynamicClient(config)
+	if err != nil {
+		return errors.Wrap(err, "create Kubernetes dynamic client failed")
+	}
+
 	kubeAPI = &KubeAPI{clientset, config}
 	csAPI = &CSKubeAPI{csclientset, config}
 	kubeExtensionsAPI = &KubeExtensionsAPI{extclientset, config}
+	dynamicAPI = &DynamicKubeAPI{dynamicclient, config}
 
 	return nil
 }
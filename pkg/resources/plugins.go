@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/request"
 )
 
 // CsPlugins defines the Containership Cloud Plugins resource
@@ -34,6 +35,35 @@ func (us *CsPlugins) Cache() []csv3.PluginSpec {
 	return us.cache
 }
 
+// PluginCloudStatusMessage is the message posted to Cloud to update a plugin
+// status
+type PluginCloudStatusMessage struct {
+	Status csv3.PluginStatus `json:"status"`
+}
+
+// PostPluginCloudStatus reports the status of the plugin with the given ID
+// back to Cloud
+func PostPluginCloudStatus(id string, status csv3.PluginStatus) error {
+	path := fmt.Sprintf("/organizations/{{.OrganizationID}}/clusters/{{.ClusterID}}/plugins/%s/status", id)
+
+	body, err := json.Marshal(PluginCloudStatusMessage{status})
+	if err != nil {
+		return err
+	}
+
+	req, err := request.New(request.CloudServiceAPI, path, "PUT", body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := req.MakeRequest()
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	return err
+}
+
 // IsEqual compares a PluginSpec to another Plugin
 func (us *CsPlugins) IsEqual(specObj interface{}, parentSpecObj interface{}) (bool, error) {
 	spec, ok := specObj.(csv3.PluginSpec)
@@ -50,5 +80,15 @@ func (us *CsPlugins) IsEqual(specObj interface{}, parentSpecObj interface{}) (bo
 		return false, nil
 	}
 
+	if len(plugin.Spec.DependsOn) != len(spec.DependsOn) {
+		return false, nil
+	}
+
+	for i, dependency := range spec.DependsOn {
+		if plugin.Spec.DependsOn[i] != dependency {
+			return false, nil
+		}
+	}
+
 	return true, nil
 }
@@ -36,6 +36,15 @@ var plugin2spec = csv3.PluginSpec{
 	Implementation: "implementation",
 }
 
+var plugin2DependentSpec = csv3.PluginSpec{
+	ID:             "2",
+	Description:    "description 2",
+	Type:           "type",
+	Version:        "1.0.2",
+	Implementation: "implementation",
+	DependsOn:      []string{"cni"},
+}
+
 var plugin1 = &csv3.Plugin{
 	ObjectMeta: metav1.ObjectMeta{
 		Name:      "plugin1",
@@ -92,6 +101,12 @@ var tests = []buildIsEqualTest{
 		expected:    false,
 		message:     "Spec different from Object",
 	},
+	{
+		inputSpec:   plugin2DependentSpec,
+		inputObject: plugin2,
+		expected:    false,
+		message:     "Spec dependencies different from Object",
+	},
 }
 
 func TestPluginIsEqual(t *testing.T) {
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 
+	"github.com/containership/cluster-manager/pkg/request"
 	"github.com/containership/cluster-manager/pkg/resources/registry"
 
 	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
@@ -42,6 +43,41 @@ func (rs *CsRegistries) GetAuthToken(spec csv3.RegistrySpec) (csv3.AuthTokenDef,
 	return generator.CreateAuthToken()
 }
 
+// ValidateAuthToken tests an AuthToken against the registry it was generated
+// for, returning registry.ErrInvalidCredentials if it was rejected
+func (rs *CsRegistries) ValidateAuthToken(token csv3.AuthTokenDef) error {
+	return registry.Validate(token)
+}
+
+// RegistryCloudStatusMessage is the message posted to Cloud to update a
+// registry status
+type RegistryCloudStatusMessage struct {
+	Status csv3.RegistryStatus `json:"status"`
+}
+
+// PostRegistryCloudStatus reports the status of the registry with the given ID
+// back to Cloud
+func PostRegistryCloudStatus(id string, status csv3.RegistryStatus) error {
+	path := fmt.Sprintf("/organizations/{{.OrganizationID}}/registries/%s/status", id)
+
+	body, err := json.Marshal(RegistryCloudStatusMessage{status})
+	if err != nil {
+		return err
+	}
+
+	req, err := request.New(request.CloudServiceAPI, path, "PUT", body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := req.MakeRequest()
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	return err
+}
+
 // IsEqual take a Registry Spec and compares it to a Registry to see if they are
 // the same, returns an error if the objects are of the inforect type
 func (rs *CsRegistries) IsEqual(specObj interface{}, parentSpecObj interface{}) (bool, error) {
@@ -60,7 +96,9 @@ func (rs *CsRegistries) IsEqual(specObj interface{}, parentSpecObj interface{})
 		spec.Email == user.Spec.Email &&
 		spec.Serveraddress == user.Spec.Serveraddress &&
 		spec.Provider == user.Spec.Provider &&
-		spec.Owner == user.Spec.Owner
+		spec.Owner == user.Spec.Owner &&
+		spec.Role == user.Spec.Role &&
+		spec.MirrorOf == user.Spec.MirrorOf
 
 	if !equal {
 		return false, nil
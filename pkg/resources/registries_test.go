@@ -77,4 +77,11 @@ func TestRegistryIsEqual(t *testing.T) {
 	same, err := c.IsEqual(registry1spec, registry1)
 	assert.Nil(t, err)
 	assert.Equal(t, same, true)
+
+	// a change of role alone should be detected
+	mirrorSpec := registry1spec
+	mirrorSpec.Role = csv3.RegistryRoleMirror
+	roleDiff, err := c.IsEqual(mirrorSpec, registry1)
+	assert.Nil(t, err)
+	assert.Equal(t, roleDiff, false)
 }
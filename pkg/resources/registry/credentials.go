@@ -0,0 +1,73 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/containership/cluster-manager/pkg/constants"
+)
+
+const (
+	credentialsSecretPrefix = "registry-credentials-"
+
+	// Keys of the credentials Secret data
+	credentialsKey = "credentials"
+	tokenKey       = "token"
+)
+
+// CredentialsSecretName returns the name of the Secret holding the credentials
+// and auth token of the Registry with the given name. It must not collide with
+// the name of the Registry itself, since that is the name of its image pull
+// secrets.
+func CredentialsSecretName(registryName string) string {
+	return credentialsSecretPrefix + registryName
+}
+
+// NewCredentialsSecret creates a Secret holding the credentials of a Registry
+// and the auth token generated from them, so that neither has to be stored in
+// the Registry itself
+func NewCredentialsSecret(registryName string, credentials map[string]string, token string) (*corev1.Secret, error) {
+	creds, err := json.Marshal(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      CredentialsSecretName(registryName),
+			Namespace: constants.ContainershipNamespace,
+			Labels:    constants.BuildContainershipLabelMap(nil),
+		},
+		Data: map[string][]byte{
+			credentialsKey: creds,
+			tokenKey:       []byte(token),
+		},
+		Type: corev1.SecretTypeOpaque,
+	}, nil
+}
+
+// CredentialsFromSecret returns the registry credentials stored in a
+// credentials Secret
+func CredentialsFromSecret(s *corev1.Secret) (map[string]string, error) {
+	data, ok := s.Data[credentialsKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no %s", s.Name, credentialsKey)
+	}
+
+	credentials := make(map[string]string)
+	err := json.Unmarshal(data, &credentials)
+	return credentials, err
+}
+
+// TokenFromSecret returns the auth token stored in a credentials Secret
+func TokenFromSecret(s *corev1.Secret) (string, error) {
+	data, ok := s.Data[tokenKey]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no %s", s.Name, tokenKey)
+	}
+
+	return string(data), nil
+}
@@ -0,0 +1,35 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestCredentialsSecret(t *testing.T) {
+	credentials := map[string]string{
+		"aws_access_key_id":     "key",
+		"aws_secret_access_key": "secret",
+	}
+
+	s, err := NewCredentialsSecret("1234", credentials, "token")
+	assert.Nil(t, err)
+	assert.Equal(t, "registry-credentials-1234", s.Name)
+	assert.NotEqual(t, "1234", s.Name, "must not collide with image pull secrets")
+
+	c, err := CredentialsFromSecret(s)
+	assert.Nil(t, err)
+	assert.Equal(t, credentials, c)
+
+	token, err := TokenFromSecret(s)
+	assert.Nil(t, err)
+	assert.Equal(t, "token", token)
+
+	_, err = CredentialsFromSecret(&corev1.Secret{})
+	assert.NotNil(t, err)
+
+	_, err = TokenFromSecret(&corev1.Secret{})
+	assert.NotNil(t, err)
+}
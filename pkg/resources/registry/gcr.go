@@ -7,6 +7,9 @@ import (
 	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
 )
 
+// DockerCFGUsername is the user whose password DockerCFG tokens are
+const DockerCFGUsername = "_json_key"
+
 // GCR is a google container registry which needs a different kind of auth token
 // created to work as an image pull secret
 type GCR struct {
@@ -26,3 +29,10 @@ func (g GCR) CreateAuthToken() (csv3.AuthTokenDef, error) {
 		Type:     DockerCFG,
 	}, nil
 }
+
+// DockerCFGPassword returns the password a DockerCFG token is for the
+// DockerCFGUsername user. Tokens are stored escaped for use in a JSON string,
+// which is undone here.
+func DockerCFGPassword(token csv3.AuthTokenDef) string {
+	return strings.Replace(token.Token, `\"`, `"`, -1)
+}
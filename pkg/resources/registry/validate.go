@@ -0,0 +1,155 @@
+package registry
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+)
+
+// ErrInvalidCredentials is returned by Validate when the registry rejected the
+// credentials, as opposed to the registry being unreachable
+var ErrInvalidCredentials = fmt.Errorf("registry rejected credentials")
+
+// Validate tests an auth token against the Docker Registry v2 API of the
+// endpoint it was generated for. Registries that use token authentication are
+// followed through to their token service.
+func Validate(token csv3.AuthTokenDef) error {
+	return validate(&http.Client{Timeout: 10 * time.Second}, token)
+}
+
+func validate(client *http.Client, token csv3.AuthTokenDef) error {
+	authHeader, err := basicAuthHeader(token)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", v2URL(token.Endpoint), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authHeader)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized:
+		challenge := resp.Header.Get("WWW-Authenticate")
+		if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+			return ErrInvalidCredentials
+		}
+
+		return validateBearer(client, challenge, authHeader)
+	case resp.StatusCode == http.StatusForbidden:
+		return ErrInvalidCredentials
+	}
+
+	return fmt.Errorf("registry responded with status code %d", resp.StatusCode)
+}
+
+// validateBearer requests a token from the realm in a bearer challenge using
+// basic auth. A token being issued means the credentials are valid.
+func validateBearer(client *http.Client, challenge, authHeader string) error {
+	params := parseChallengeParams(challenge[len("bearer "):])
+
+	realm, ok := params["realm"]
+	if !ok {
+		return fmt.Errorf("bearer challenge has no realm")
+	}
+
+	u, err := url.Parse(realm)
+	if err != nil {
+		return err
+	}
+
+	q := u.Query()
+	for _, p := range []string{"service", "scope"} {
+		if v, ok := params[p]; ok {
+			q.Set(p, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authHeader)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrInvalidCredentials
+	}
+
+	return fmt.Errorf("registry token service responded with status code %d", resp.StatusCode)
+}
+
+// basicAuthHeader builds the basic Authorization header for an auth token
+func basicAuthHeader(token csv3.AuthTokenDef) (string, error) {
+	switch token.Type {
+	case DockerJSON:
+		// The token is already base64 encoded username:password
+		return "Basic " + token.Token, nil
+	case DockerCFG:
+		auth := base64.StdEncoding.EncodeToString([]byte(DockerCFGUsername + ":" + DockerCFGPassword(token)))
+		return "Basic " + auth, nil
+	}
+
+	return "", fmt.Errorf("unknown auth token type %q", token.Type)
+}
+
+// v2URL returns the URL of the v2 API base for a registry endpoint, which may
+// be given with or without a scheme and path
+func v2URL(endpoint string) string {
+	scheme := "https"
+	host := endpoint
+	if i := strings.Index(host, "://"); i != -1 {
+		scheme = host[:i]
+		host = host[i+3:]
+	}
+
+	if i := strings.Index(host, "/"); i != -1 {
+		host = host[:i]
+	}
+
+	// Docker Hub serves its API from a different host than its index
+	if host == "index.docker.io" || host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+
+	return fmt.Sprintf("%s://%s/v2/", scheme, host)
+}
+
+// parseChallengeParams parses the comma separated key="value" pairs of a
+// WWW-Authenticate challenge
+func parseChallengeParams(s string) map[string]string {
+	params := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+
+	return params
+}
@@ -0,0 +1,135 @@
+package registry
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+)
+
+const (
+	testUsername = "user"
+	testPassword = "pass"
+)
+
+func basicAuthValid(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	return ok && username == testUsername && password == testPassword
+}
+
+// newBasicAuthRegistry returns a registry stand-in that authenticates /v2/
+// requests itself
+func newBasicAuthRegistry() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !basicAuthValid(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+// newTokenAuthRegistry returns a registry stand-in that sends clients to a
+// token service on the same server, like Docker Hub does
+func newTokenAuthRegistry() *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.Header().Set("WWW-Authenticate",
+				fmt.Sprintf(`Bearer realm="%s/token",service="registry.test"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/token":
+			if r.URL.Query().Get("service") != "registry.test" || !basicAuthValid(r) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			w.Write([]byte(`{"token":"abc"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	return server
+}
+
+func tokenFor(endpoint, username, password string) csv3.AuthTokenDef {
+	return csv3.AuthTokenDef{
+		Token:    base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+		Endpoint: endpoint,
+		Type:     DockerJSON,
+	}
+}
+
+func TestValidateBasicAuth(t *testing.T) {
+	server := newBasicAuthRegistry()
+	defer server.Close()
+
+	err := validate(server.Client(), tokenFor(server.URL, testUsername, testPassword))
+	assert.Nil(t, err)
+
+	err = validate(server.Client(), tokenFor(server.URL, testUsername, "wrong"))
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestValidateTokenAuth(t *testing.T) {
+	server := newTokenAuthRegistry()
+	defer server.Close()
+
+	err := validate(server.Client(), tokenFor(server.URL, testUsername, testPassword))
+	assert.Nil(t, err)
+
+	err = validate(server.Client(), tokenFor(server.URL, "wrong", testPassword))
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestValidateUnexpectedStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	err := validate(server.Client(), tokenFor(server.URL, testUsername, testPassword))
+	assert.NotNil(t, err)
+	assert.NotEqual(t, ErrInvalidCredentials, err)
+}
+
+func TestBasicAuthHeader(t *testing.T) {
+	header, err := basicAuthHeader(csv3.AuthTokenDef{
+		Token: "dXNlcjpwYXNz",
+		Type:  DockerJSON,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "Basic dXNlcjpwYXNz", header)
+
+	header, err = basicAuthHeader(csv3.AuthTokenDef{
+		Token: `{\"key\":\"value\"}`,
+		Type:  DockerCFG,
+	})
+	assert.Nil(t, err)
+	expected := base64.StdEncoding.EncodeToString([]byte(`_json_key:{"key":"value"}`))
+	assert.Equal(t, "Basic "+expected, header)
+
+	_, err = basicAuthHeader(csv3.AuthTokenDef{Type: "unknown"})
+	assert.NotNil(t, err)
+}
+
+func TestV2URL(t *testing.T) {
+	assert.Equal(t, "https://quay.io/v2/", v2URL("quay.io"))
+	assert.Equal(t, "https://gcr.io/v2/", v2URL("https://gcr.io"))
+	assert.Equal(t, "https://registry-1.docker.io/v2/", v2URL("https://index.docker.io/v1/"))
+	assert.Equal(t, "http://127.0.0.1:5000/v2/", v2URL("http://127.0.0.1:5000"))
+}
@@ -0,0 +1,197 @@
+package registrymirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/log"
+	"github.com/containership/cluster-manager/pkg/tools/fsutil"
+)
+
+const (
+	// Host filesystem paths (relative to containership mount)
+	mirrorConfigDir      = "/registry-mirrors"
+	dockerConfigFile     = "docker-daemon.json"
+	containerdConfigFile = "containerd-mirrors.toml"
+	// reloadFile is watched on the host, which merges the config files into
+	// the container runtime configuration, reloads the runtime and then
+	// removes reloadFile
+	reloadFile = "reload"
+
+	mirrorConfigDirPermissions = os.ModeDir | os.FileMode(0755)
+	mirrorConfigPermissions    = os.FileMode(0644)
+	reloadFilePermissions      = os.FileMode(0600)
+
+	// dockerHub is the upstream registry that Docker itself supports mirrors for
+	dockerHub = "docker.io"
+)
+
+// This is a no-op and always references the same underlying OS filesystem, so
+// it's fine to do it any file that has file operations that we'd like to make
+// testable.
+var osFs = afero.NewOsFs()
+
+// Mirror is a pull-through mirror for an upstream registry
+type Mirror struct {
+	// Upstream is the hostname of the registry being mirrored
+	Upstream string
+	// Endpoint is the URL of the mirror
+	Endpoint string
+}
+
+// Write writes the docker and containerd mirror configuration for the given
+// mirrors to the host and requests that the host reload it if anything changed
+func Write(mirrors []Mirror) error {
+	return write(osFs, mirrors)
+}
+
+// GetMirrorConfigFullPath returns the full path to a mirror config file
+func GetMirrorConfigFullPath(filename string) string {
+	return path.Join(getMirrorConfigDir(), filename)
+}
+
+func write(fs afero.Fs, mirrors []Mirror) error {
+	err := fsutil.EnsureDirExistsWithCorrectPermissions(fs, getMirrorConfigDir(), mirrorConfigDirPermissions)
+	if err != nil {
+		return err
+	}
+
+	dockerConfig, err := buildDockerConfig(mirrors)
+	if err != nil {
+		return err
+	}
+
+	dockerChanged, err := writeIfChanged(fs, GetMirrorConfigFullPath(dockerConfigFile), dockerConfig)
+	if err != nil {
+		return err
+	}
+
+	containerdChanged, err := writeIfChanged(fs, GetMirrorConfigFullPath(containerdConfigFile), buildContainerdConfig(mirrors))
+	if err != nil {
+		return err
+	}
+
+	if !dockerChanged && !containerdChanged {
+		return nil
+	}
+
+	return requestReload(fs)
+}
+
+// writeIfChanged atomically writes data to filename unless it already contains
+// exactly that data. A file that does not exist is treated as empty so that
+// having no mirrors does not create empty files. Returns true if the file was
+// written.
+func writeIfChanged(fs afero.Fs, filename string, data []byte) (bool, error) {
+	existing, err := afero.ReadFile(fs, filename)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if bytes.Equal(existing, data) {
+		return false, nil
+	}
+
+	log.Infof("Registry mirror config %s changed, writing", filename)
+	return true, fsutil.WriteFileAtomic(fs, filename, data, mirrorConfigPermissions)
+}
+
+// requestReload signals the host to reload the mirror configuration. If a
+// reload is already pending it will pick up the latest configuration, so we
+// leave it alone.
+func requestReload(fs afero.Fs) error {
+	reloadPath := GetMirrorConfigFullPath(reloadFile)
+	if fsutil.FileExists(fs, reloadPath) {
+		log.Debug("Registry mirror reload already pending")
+		return nil
+	}
+
+	return fsutil.WriteNewFileAtomic(fs, reloadPath,
+		[]byte(time.Now().UTC().Format(time.RFC3339)), reloadFilePermissions)
+}
+
+// buildDockerConfig builds the daemon.json fragment for the mirrors. Docker
+// only supports mirroring Docker Hub, so mirrors of other registries are
+// only configured for containerd.
+func buildDockerConfig(mirrors []Mirror) ([]byte, error) {
+	endpoints := mirrorsByUpstream(mirrors)[dockerHub]
+	if len(endpoints) == 0 {
+		return []byte{}, nil
+	}
+
+	return json.MarshalIndent(map[string][]string{
+		"registry-mirrors": endpoints,
+	}, "", "  ")
+}
+
+// buildContainerdConfig builds the CRI plugin registry mirrors section of the
+// containerd config for the mirrors
+func buildContainerdConfig(mirrors []Mirror) []byte {
+	byUpstream := mirrorsByUpstream(mirrors)
+	if len(byUpstream) == 0 {
+		return []byte{}
+	}
+
+	upstreams := make([]string, 0, len(byUpstream))
+	for upstream := range byUpstream {
+		upstreams = append(upstreams, upstream)
+	}
+	sort.Strings(upstreams)
+
+	var b bytes.Buffer
+	b.WriteString("[plugins.cri.registry.mirrors]\n")
+	for _, upstream := range upstreams {
+		quoted := make([]string, 0)
+		for _, e := range byUpstream[upstream] {
+			quoted = append(quoted, fmt.Sprintf("%q", e))
+		}
+
+		fmt.Fprintf(&b, "  [plugins.cri.registry.mirrors.%q]\n", upstream)
+		fmt.Fprintf(&b, "    endpoint = [%s]\n", strings.Join(quoted, ", "))
+	}
+
+	return b.Bytes()
+}
+
+// mirrorsByUpstream groups the mirror endpoints by the registry they mirror,
+// sorting endpoints so that the generated config is stable
+func mirrorsByUpstream(mirrors []Mirror) map[string][]string {
+	byUpstream := make(map[string][]string)
+	for _, m := range mirrors {
+		upstream := m.Upstream
+		if upstream == "" {
+			upstream = dockerHub
+		}
+
+		byUpstream[upstream] = append(byUpstream[upstream], endpointURL(m.Endpoint))
+	}
+
+	for _, endpoints := range byUpstream {
+		sort.Strings(endpoints)
+	}
+
+	return byUpstream
+}
+
+// endpointURL makes sure the endpoint has a scheme, defaulting to https
+func endpointURL(endpoint string) string {
+	if strings.Contains(endpoint, "://") {
+		return endpoint
+	}
+
+	return "https://" + endpoint
+}
+
+// getMirrorConfigDir returns the directory the mirror config is written to
+func getMirrorConfigDir() string {
+	return path.Join(constants.ContainershipMount, mirrorConfigDir)
+}
@@ -0,0 +1,92 @@
+package registrymirror
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// TODO similar to upgrade_script_test.go, paths here are hardcoded
+const (
+	dockerConfigPath     = "/etc/containership/registry-mirrors/docker-daemon.json"
+	containerdConfigPath = "/etc/containership/registry-mirrors/containerd-mirrors.toml"
+	reloadPath           = "/etc/containership/registry-mirrors/reload"
+)
+
+var mirrors = []Mirror{
+	{Upstream: "quay.io", Endpoint: "quay-mirror.internal"},
+	{Endpoint: "https://hub-mirror-b.internal"},
+	{Upstream: "docker.io", Endpoint: "http://hub-mirror-a.internal:5000"},
+}
+
+const expectedDockerConfig = `{
+  "registry-mirrors": [
+    "http://hub-mirror-a.internal:5000",
+    "https://hub-mirror-b.internal"
+  ]
+}`
+
+const expectedContainerdConfig = `[plugins.cri.registry.mirrors]
+  [plugins.cri.registry.mirrors."docker.io"]
+    endpoint = ["http://hub-mirror-a.internal:5000", "https://hub-mirror-b.internal"]
+  [plugins.cri.registry.mirrors."quay.io"]
+    endpoint = ["https://quay-mirror.internal"]
+`
+
+func TestBuildDockerConfig(t *testing.T) {
+	config, err := buildDockerConfig(mirrors)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedDockerConfig, string(config))
+
+	// Docker only supports Docker Hub mirrors
+	config, err = buildDockerConfig([]Mirror{{Upstream: "quay.io", Endpoint: "mirror"}})
+	assert.Nil(t, err)
+	assert.Empty(t, config)
+}
+
+func TestBuildContainerdConfig(t *testing.T) {
+	assert.Equal(t, expectedContainerdConfig, string(buildContainerdConfig(mirrors)))
+	assert.Empty(t, buildContainerdConfig(nil))
+}
+
+func TestWrite(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	// No mirrors on a fresh host should not touch anything
+	err := write(fs, nil)
+	assert.Nil(t, err)
+	exists, _ := afero.Exists(fs, reloadPath)
+	assert.False(t, exists)
+
+	err = write(fs, mirrors)
+	assert.Nil(t, err)
+
+	contents, err := afero.ReadFile(fs, dockerConfigPath)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedDockerConfig, string(contents))
+
+	contents, err = afero.ReadFile(fs, containerdConfigPath)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedContainerdConfig, string(contents))
+
+	exists, _ = afero.Exists(fs, reloadPath)
+	assert.True(t, exists)
+
+	// Simulate the host reloading, then verify that writing the same mirrors
+	// does not request another reload
+	fs.Remove(reloadPath)
+	err = write(fs, mirrors)
+	assert.Nil(t, err)
+	exists, _ = afero.Exists(fs, reloadPath)
+	assert.False(t, exists)
+
+	// Removing all mirrors should clear the config and request a reload
+	err = write(fs, nil)
+	assert.Nil(t, err)
+	empty, err := afero.IsEmpty(fs, containerdConfigPath)
+	assert.Nil(t, err)
+	assert.True(t, empty)
+	exists, _ = afero.Exists(fs, reloadPath)
+	assert.True(t, exists)
+}
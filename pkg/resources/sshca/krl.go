@@ -0,0 +1,101 @@
+package sshca
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// The key revocation list format is described in PROTOCOL.krl of OpenSSH
+const (
+	krlMagic         = 0x5353484b524c0a00
+	krlFormatVersion = 1
+
+	krlSectionCertificates    = 1
+	krlSectionCertSerialsList = 0x20
+)
+
+// BuildKRL builds a key revocation list revoking the certificates with the
+// given serials signed by the CA, for use as the sshd RevokedKeys file. Unlike
+// revoking public keys, this only refuses the revoked certificates and not
+// new certificates for the same keys. The list revokes nothing if the CA
+// public key is empty.
+func BuildKRL(caPublicKey string, serials []uint64) ([]byte, error) {
+	var b bytes.Buffer
+	writeUint64(&b, krlMagic)
+	writeUint32(&b, krlFormatVersion)
+	// KRL version, which sshd doesn't use
+	writeUint64(&b, 0)
+	writeUint64(&b, uint64(time.Now().Unix()))
+	// Flags
+	writeUint64(&b, 0)
+	// Reserved
+	writeString(&b, nil)
+	// Comment
+	writeString(&b, nil)
+
+	if caPublicKey == "" {
+		return b.Bytes(), nil
+	}
+
+	ca, _, _, _, err := ssh.ParseAuthorizedKey([]byte(caPublicKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing CA public key")
+	}
+
+	// Serial 0 is invalid, and sshd expects no duplicates
+	unique := make([]uint64, 0, len(serials))
+	seen := make(map[uint64]bool)
+	for _, s := range serials {
+		if s != 0 && !seen[s] {
+			seen[s] = true
+			unique = append(unique, s)
+		}
+	}
+
+	if len(unique) == 0 {
+		return b.Bytes(), nil
+	}
+
+	sort.Slice(unique, func(i, j int) bool {
+		return unique[i] < unique[j]
+	})
+
+	var serialsList bytes.Buffer
+	for _, s := range unique {
+		writeUint64(&serialsList, s)
+	}
+
+	var certificates bytes.Buffer
+	writeString(&certificates, ca.Marshal())
+	// Reserved
+	writeString(&certificates, nil)
+	certificates.WriteByte(krlSectionCertSerialsList)
+	writeString(&certificates, serialsList.Bytes())
+
+	b.WriteByte(krlSectionCertificates)
+	writeString(&b, certificates.Bytes())
+
+	return b.Bytes(), nil
+}
+
+func writeUint32(b *bytes.Buffer, v uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	b.Write(buf[:])
+}
+
+func writeUint64(b *bytes.Buffer, v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	b.Write(buf[:])
+}
+
+func writeString(b *bytes.Buffer, s []byte) {
+	writeUint32(b, uint32(len(s)))
+	b.Write(s)
+}
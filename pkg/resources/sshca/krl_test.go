@@ -0,0 +1,75 @@
+package sshca
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readKRLString reads a length prefixed string from the start of data and
+// returns it along with the rest of data
+func readKRLString(t *testing.T, data []byte) ([]byte, []byte) {
+	if !assert.True(t, len(data) >= 4) {
+		return nil, nil
+	}
+
+	n := binary.BigEndian.Uint32(data)
+	if !assert.True(t, len(data) >= 4+int(n)) {
+		return nil, nil
+	}
+
+	return data[4 : 4+n], data[4+n:]
+}
+
+// krlHeaderLength is the length of a KRL header with an empty reserved
+// string and comment
+const krlHeaderLength = 8 + 4 + 8 + 8 + 8 + 4 + 4
+
+func TestBuildKRL(t *testing.T) {
+	private, public, err := GenerateKey()
+	assert.Nil(t, err)
+	signer, err := NewSigner(private)
+	assert.Nil(t, err)
+
+	krl, err := BuildKRL(public, []uint64{3, 0, 1, 3})
+	assert.Nil(t, err)
+
+	assert.Equal(t, uint64(krlMagic), binary.BigEndian.Uint64(krl))
+	assert.Equal(t, uint32(krlFormatVersion), binary.BigEndian.Uint32(krl[8:]))
+
+	rest := krl[krlHeaderLength:]
+	assert.Equal(t, byte(krlSectionCertificates), rest[0])
+	section, rest := readKRLString(t, rest[1:])
+	assert.Empty(t, rest)
+
+	ca, section := readKRLString(t, section)
+	assert.Equal(t, signer.PublicKey().Marshal(), ca)
+	reserved, section := readKRLString(t, section)
+	assert.Empty(t, reserved)
+
+	assert.Equal(t, byte(krlSectionCertSerialsList), section[0])
+	serials, section := readKRLString(t, section[1:])
+	assert.Empty(t, section)
+
+	// Invalid and duplicate serials are left out
+	assert.Len(t, serials, 16)
+	assert.Equal(t, uint64(1), binary.BigEndian.Uint64(serials))
+	assert.Equal(t, uint64(3), binary.BigEndian.Uint64(serials[8:]))
+}
+
+func TestBuildKRLRevokesNothing(t *testing.T) {
+	_, public, err := GenerateKey()
+	assert.Nil(t, err)
+
+	krl, err := BuildKRL("", []uint64{1})
+	assert.Nil(t, err)
+	assert.Len(t, krl, krlHeaderLength, "nothing is revoked without a CA")
+
+	krl, err = BuildKRL(public, nil)
+	assert.Nil(t, err)
+	assert.Len(t, krl, krlHeaderLength)
+
+	_, err = BuildKRL("invalid", []uint64{1})
+	assert.NotNil(t, err)
+}
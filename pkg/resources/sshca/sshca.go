@@ -0,0 +1,122 @@
+package sshca
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// SecretName is the name of the Secret holding the CA key
+	SecretName = "containership-ssh-ca"
+	// ConfigMapName is the name of the ConfigMap holding the CA public key
+	// for the agents
+	ConfigMapName = "containership-ssh-ca"
+
+	// PrivateKeyKey is the key of the CA private key in the CA Secret
+	PrivateKeyKey = "ca"
+	// PublicKeyKey is the key of the CA public key in the CA Secret and
+	// ConfigMap
+	PublicKeyKey = "ca.pub"
+
+	// clockSkew is how long before it was signed a certificate is valid, to
+	// allow for clocks of nodes being behind
+	clockSkew = 5 * time.Minute
+)
+
+// extensions are the permissions ssh-keygen gives user certificates by default
+var extensions = map[string]string{
+	"permit-X11-forwarding":   "",
+	"permit-agent-forwarding": "",
+	"permit-port-forwarding":  "",
+	"permit-pty":              "",
+	"permit-user-rc":          "",
+}
+
+// GenerateKey generates a new CA key. It returns the private key as it should
+// be stored and the public key in authorized_keys format.
+func GenerateKey() ([]byte, string, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return private, string(ssh.MarshalAuthorizedKey(sshPublic)), nil
+}
+
+// NewSigner returns a signer for a private key generated by GenerateKey
+func NewSigner(privateKey []byte) (ssh.Signer, error) {
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return nil, errors.Errorf("CA private key is %d bytes instead of %d",
+			len(privateKey), ed25519.PrivateKeySize)
+	}
+
+	return ssh.NewSignerFromKey(ed25519.PrivateKey(privateKey))
+}
+
+// PublicKey returns the public key of the signer in authorized_keys format
+func PublicKey(signer ssh.Signer) string {
+	return string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+}
+
+// SignUserKey signs a user certificate for the authorized_keys format public
+// key that is valid for the given principal until validBefore
+func SignUserKey(signer ssh.Signer, publicKey, principal, keyID string, validBefore time.Time) (*ssh.Certificate, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing public key")
+	}
+
+	if _, ok := key.(*ssh.Certificate); ok {
+		return nil, errors.New("public key is already a certificate")
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: []string{principal},
+		ValidAfter:      uint64(time.Now().Add(-clockSkew).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: extensions,
+		},
+	}
+
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		return nil, errors.Wrap(err, "signing certificate")
+	}
+
+	return cert, nil
+}
+
+// MarshalCertificate returns the certificate in authorized_keys format, which
+// is what ssh expects in the -cert.pub file next to a private key
+func MarshalCertificate(cert *ssh.Certificate) string {
+	return string(ssh.MarshalAuthorizedKey(cert))
+}
+
+// randomSerial returns a random certificate serial number
+func randomSerial() (uint64, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint64(b), nil
+}
@@ -0,0 +1,82 @@
+package sshca
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func newUserPublicKey(t *testing.T) string {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	key, err := ssh.NewPublicKey(public)
+	assert.Nil(t, err)
+
+	return string(ssh.MarshalAuthorizedKey(key))
+}
+
+func TestGenerateKey(t *testing.T) {
+	private, public, err := GenerateKey()
+	assert.Nil(t, err)
+
+	signer, err := NewSigner(private)
+	assert.Nil(t, err)
+	assert.Equal(t, public, PublicKey(signer))
+
+	_, err = NewSigner([]byte("short"))
+	assert.NotNil(t, err)
+}
+
+func TestSignUserKey(t *testing.T) {
+	private, _, err := GenerateKey()
+	assert.Nil(t, err)
+	signer, err := NewSigner(private)
+	assert.Nil(t, err)
+
+	publicKey := newUserPublicKey(t)
+	validBefore := time.Now().Add(time.Hour)
+	cert, err := SignUserKey(signer, publicKey, "00000000111122223333000000000001", "key-id", validBefore)
+	assert.Nil(t, err)
+
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(MarshalCertificate(cert)))
+	assert.Nil(t, err)
+	parsedCert, ok := parsed.(*ssh.Certificate)
+	assert.True(t, ok)
+
+	assert.Equal(t, uint32(ssh.UserCert), parsedCert.CertType)
+	assert.Equal(t, []string{"00000000111122223333000000000001"}, parsedCert.ValidPrincipals)
+	assert.Equal(t, "key-id", parsedCert.KeyId)
+	assert.Equal(t, uint64(validBefore.Unix()), parsedCert.ValidBefore)
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return string(auth.Marshal()) == string(signer.PublicKey().Marshal())
+		},
+	}
+	_, err = checker.Authenticate(fakeConnMetadata("00000000111122223333000000000001"), parsedCert)
+	assert.Nil(t, err, "certificate is accepted for the principal")
+	_, err = checker.Authenticate(fakeConnMetadata("root"), parsedCert)
+	assert.NotNil(t, err, "certificate is rejected for other principals")
+
+	_, err = SignUserKey(signer, "invalid", "principal", "key-id", validBefore)
+	assert.NotNil(t, err)
+
+	_, err = SignUserKey(signer, MarshalCertificate(cert), "principal", "key-id", validBefore)
+	assert.NotNil(t, err, "certificates can't be signed again")
+}
+
+// fakeConnMetadata is the connection metadata of a login as the user
+type fakeConnMetadata string
+
+func (m fakeConnMetadata) User() string          { return string(m) }
+func (m fakeConnMetadata) SessionID() []byte     { return nil }
+func (m fakeConnMetadata) ClientVersion() []byte { return nil }
+func (m fakeConnMetadata) ServerVersion() []byte { return nil }
+func (m fakeConnMetadata) RemoteAddr() net.Addr  { return nil }
+func (m fakeConnMetadata) LocalAddr() net.Addr   { return nil }
@@ -87,6 +87,12 @@ func (c *PluginSyncController) doSync() {
 		}
 
 		pluginCR := item[0]
+		if isBundlePlugin(pluginCR) {
+			// Plugins imported from a bundle are managed locally
+			log.Debugf("Plugin %s was imported from a bundle - not syncing", cloudItem.ID)
+			continue
+		}
+
 		if equal, err := c.cloudResource.IsEqual(cloudItem, pluginCR); err == nil && !equal {
 			log.Debugf("Cloud Plugin %s does not match CR - updating", cloudItem.ID)
 			err = c.Update(cloudItem, pluginCR)
@@ -105,6 +111,10 @@ func (c *PluginSyncController) doSync() {
 
 	// Find CRs that do not exist in cloud
 	for _, u := range allCRs {
+		if isBundlePlugin(u) {
+			continue
+		}
+
 		if _, exists := cloudCacheByID[u.Name]; !exists {
 			log.Debugf("CR Plugin %s does not exist in cloud - deleting", u.Name)
 			err = c.Delete(u.Namespace, u.Name)
@@ -115,6 +125,18 @@ func (c *PluginSyncController) doSync() {
 	}
 }
 
+// isBundlePlugin returns true if the plugin CR was imported from a plugin
+// bundle instead of being synced from cloud
+func isBundlePlugin(obj interface{}) bool {
+	plugin, ok := obj.(*csv3.Plugin)
+	if !ok {
+		return false
+	}
+
+	_, ok = plugin.Annotations[constants.PluginBundleAnnotation]
+	return ok
+}
+
 // Create takes a plugin spec in cache and creates the CRD
 func (c *PluginSyncController) Create(p csv3.PluginSpec) error {
 	plugin, err := c.clientset.ContainershipV3().Plugins(constants.ContainershipNamespace).Create(&csv3.Plugin{
@@ -148,7 +170,7 @@ func (c *PluginSyncController) Update(p csv3.PluginSpec, obj interface{}) error
 
 	pCopy := plugin.DeepCopy()
 	pCopy.Spec = p
-	setPluginHistoryAnnotation(plugin, pCopy)
+	SetPluginHistoryAnnotation(plugin, pCopy)
 
 	_, err := c.clientset.ContainershipV3().Plugins(constants.ContainershipNamespace).Update(pCopy)
 
@@ -160,7 +182,9 @@ func (c *PluginSyncController) Update(p csv3.PluginSpec, obj interface{}) error
 	return err
 }
 
-func setPluginHistoryAnnotation(plugin *csv3.Plugin, pCopy *csv3.Plugin) {
+// SetPluginHistoryAnnotation appends the spec of the plugin to the history
+// annotation of its copy, which is about to be updated with a new spec
+func SetPluginHistoryAnnotation(plugin *csv3.Plugin, pCopy *csv3.Plugin) {
 	history := make([]csv3.PluginSpec, 0)
 	ann, ok := plugin.Annotations[constants.PluginHistoryAnnotation]
 	var err error
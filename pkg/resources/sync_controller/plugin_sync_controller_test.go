@@ -1,6 +1,6 @@
 package synccontroller
 
-//TODO write tests for setPluginHistoryAnnotation
+//TODO write tests for SetPluginHistoryAnnotation
 // test set empty
 // test append
 import (
@@ -71,7 +71,7 @@ var setAnnotation = []historyAnnotationTest{
 func TestSetPluginHistoryAnnotation(t *testing.T) {
 	for _, test := range setAnnotation {
 		pCopy := test.inputPlugin.DeepCopy()
-		setPluginHistoryAnnotation(test.inputPlugin, pCopy)
+		SetPluginHistoryAnnotation(test.inputPlugin, pCopy)
 		assert.Equal(t, test.expect, pCopy.Annotations[constants.PluginHistoryAnnotation])
 	}
 
@@ -4,9 +4,12 @@ import (
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelistersv1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 
 	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
@@ -17,6 +20,7 @@ import (
 	"github.com/containership/cluster-manager/pkg/constants"
 	"github.com/containership/cluster-manager/pkg/log"
 	"github.com/containership/cluster-manager/pkg/resources"
+	"github.com/containership/cluster-manager/pkg/resources/registry"
 	"github.com/containership/cluster-manager/pkg/tools"
 )
 
@@ -24,10 +28,20 @@ import (
 type RegistrySyncController struct {
 	*syncController
 
+	// kubeclientset is used to manage the Secrets holding registry
+	// credentials
+	kubeclientset kubernetes.Interface
+	secretLister  corelistersv1.SecretLister
+
 	lister        cslisters.RegistryLister
 	cloudResource *resources.CsRegistries
 
 	tokenRegenerationByID map[string]chan bool
+
+	// validatedSecrets holds the resource version of the credentials secret
+	// of each registry when its credentials were last validated, so that
+	// they're validated again whenever the secret changes
+	validatedSecrets map[string]string
 }
 
 const (
@@ -36,25 +50,36 @@ const (
 
 // NewRegistry returns a RegistrySyncController that will be in control of pulling from cloud
 // comparing to the CRD cache and modifying based on those compares
-func NewRegistry(kubeclientset kubernetes.Interface, clientset csclientset.Interface, csInformerFactory csinformers.SharedInformerFactory) *RegistrySyncController {
+func NewRegistry(kubeclientset kubernetes.Interface, clientset csclientset.Interface, kubeInformerFactory kubeinformers.SharedInformerFactory, csInformerFactory csinformers.SharedInformerFactory) *RegistrySyncController {
 	registryInformer := csInformerFactory.Containership().V3().Registries()
+	secretInformer := kubeInformerFactory.Core().V1().Secrets()
 
 	registryInformer.Informer().AddIndexers(tools.IndexByIDKeyFun())
 
+	// Credentials secrets are read from the cache, so it has to be synced
+	// along with the registries
+	registriesAndSecretsSynced := func() bool {
+		return registryInformer.Informer().HasSynced() &&
+			secretInformer.Informer().HasSynced()
+	}
+
 	// Create the registry controller
 	c := &RegistrySyncController{
 		syncController: &syncController{
 			name:      registrySyncControllerName,
 			clientset: clientset,
-			synced:    registryInformer.Informer().HasSynced,
+			synced:    registriesAndSecretsSynced,
 			informer:  registryInformer.Informer(),
 			recorder:  tools.CreateAndStartRecorder(kubeclientset, registrySyncControllerName),
 		},
 
+		kubeclientset: kubeclientset,
+		secretLister:  secretInformer.Lister(),
 		lister:        registryInformer.Lister(),
 		cloudResource: resources.NewCsRegistries(),
 
 		tokenRegenerationByID: make(map[string]chan bool, 0),
+		validatedSecrets:      make(map[string]string),
 	}
 
 	registryInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -107,9 +132,45 @@ func (c *RegistrySyncController) doSync() {
 
 		// We only need to pass in the first index of item since the key by function
 		// is keying by a unique value
+		reg, ok := item[0].(*csv3.Registry)
+		if !ok {
+			continue
+		}
+
+		// Registries created before credentials were moved to a Secret
+		// store them in plaintext, so they are moved to a Secret in place
+		// along with the token they already have
+		if reg.Spec.CredentialsSecret == "" {
+			log.Infof("Registry %s stores credentials in plaintext - moving them to a secret", cloudItem.ID)
+			err = c.moveCredentialsToSecret(reg, reg.Spec.Credentials, reg.Spec.AuthToken)
+			if err != nil {
+				log.Error("Registry credentials migration failed: ", err.Error())
+			}
+			continue
+		}
+
+		secret, err := c.credentialsSecret(reg)
+		if errors.IsNotFound(err) {
+			log.Infof("Registry %s credentials secret is missing - regenerating", cloudItem.ID)
+			err = c.regenerateCredentialsSecret(reg, cloudItem)
+			if err != nil {
+				log.Error("Registry credentials regeneration failed: ", err.Error())
+			}
+			continue
+		} else if err != nil {
+			log.Error("Could not get Registry credentials: ", err.Error())
+			continue
+		}
+
+		withCredentials, err := withCredentials(reg, secret)
+		if err != nil {
+			log.Error("Could not get Registry credentials: ", err.Error())
+			continue
+		}
+
 		// Only update if err == nil because if err != nil then the types are
 		// incorrect somehow and we shouldn't update.
-		if equal, err := c.cloudResource.IsEqual(cloudItem, item[0]); err == nil && !equal {
+		if equal, err := c.cloudResource.IsEqual(cloudItem, withCredentials); err == nil && !equal {
 			log.Debugf("Cloud Registry %s does not match CR - updating", cloudItem.ID)
 			log.Debugf("Cloud: %+v, Cache: %+v", cloudItem, item[0])
 			// Delete the registry so that all secrets get deleted and regenerated.
@@ -117,6 +178,10 @@ func (c *RegistrySyncController) doSync() {
 			c.Delete(constants.ContainershipNamespace, cloudItem.ID)
 			continue
 		}
+
+		if err := c.revalidateCredentials(reg, secret); err != nil {
+			log.Errorf("Could not update credentials status of Registry %s: %s", reg.Name, err)
+		}
 	}
 
 	allCRs, err := c.lister.List(labels.NewSelector())
@@ -145,12 +210,37 @@ func (c *RegistrySyncController) Create(u csv3.RegistrySpec) error {
 		return err
 	}
 
-	u.AuthToken = token
+	// Credentials are only ever stored in a Secret that the Registry
+	// references, never in the Registry itself
+	credentialsSecret, err := registry.NewCredentialsSecret(u.ID, u.Credentials, token.Token)
+	if err != nil {
+		return err
+	}
+
+	credentialsSecret, err = c.applyCredentialsSecret(credentialsSecret)
+	if err != nil {
+		return err
+	}
+
+	spec := u
+	spec.Credentials = nil
+	spec.AuthToken = token
+	spec.AuthToken.Token = ""
+	spec.CredentialsSecret = credentialsSecret.Name
+
+	// Invalid credentials still result in a Registry so that the failure is
+	// visible on it, rather than the Registry silently never being created
+	condition := credentialsCondition(c.cloudResource.ValidateAuthToken(token))
+	status := csv3.RegistryStatus{
+		Conditions: []csv3.RegistryCondition{condition},
+	}
+
 	newReg, err := c.clientset.ContainershipV3().Registries(constants.ContainershipNamespace).Create(&csv3.Registry{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: u.ID,
 		},
-		Spec: u,
+		Spec:   spec,
+		Status: status,
 	})
 	if err != nil {
 		return err
@@ -161,6 +251,17 @@ func (c *RegistrySyncController) Create(u csv3.RegistrySpec) error {
 	c.recorder.Event(newReg, corev1.EventTypeNormal, "SyncCreate",
 		"Detected missing CR")
 
+	c.validatedSecrets[newReg.Name] = credentialsSecret.ResourceVersion
+
+	if condition.Status != corev1.ConditionTrue {
+		c.recorder.Eventf(newReg, corev1.EventTypeWarning, condition.Reason,
+			"Registry credentials could not be validated: %s", condition.Message)
+	}
+
+	if err := resources.PostRegistryCloudStatus(newReg.Name, status); err != nil {
+		log.Errorf("Could not report status of Registry %s to Cloud: %s", newReg.Name, err)
+	}
+
 	if newReg.Spec.Provider == constants.EC2Registry {
 		c.tokenRegenerationByID[newReg.Name] = c.watchToken(newReg)
 	}
@@ -168,6 +269,189 @@ func (c *RegistrySyncController) Create(u csv3.RegistrySpec) error {
 	return nil
 }
 
+// credentialsCondition builds the credentials condition for a Registry from
+// the result of validating its auth token
+func credentialsCondition(err error) csv3.RegistryCondition {
+	condition := csv3.RegistryCondition{
+		Type:               csv3.RegistryCredentialsValid,
+		LastTransitionTime: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	switch {
+	case err == nil:
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = "CredentialsValid"
+	case err == registry.ErrInvalidCredentials:
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "CredentialsInvalid"
+		condition.Message = err.Error()
+	default:
+		// The registry may just be unreachable from here, so we can't say
+		// the credentials are wrong
+		condition.Status = corev1.ConditionUnknown
+		condition.Reason = "CredentialsValidationFailed"
+		condition.Message = err.Error()
+	}
+
+	return condition
+}
+
+// revalidateCredentials validates the credentials of the registry again if
+// its credentials secret changed since they were last validated, e.g. because
+// its token was regenerated. Credentials of registries that weren't validated
+// since the coordinator started are validated as well, which includes
+// registries created before credentials were validated at all.
+func (c *RegistrySyncController) revalidateCredentials(r *csv3.Registry, s *corev1.Secret) error {
+	if version, ok := c.validatedSecrets[r.Name]; ok && version == s.ResourceVersion {
+		return nil
+	}
+
+	token := r.Spec.AuthToken
+	var err error
+	token.Token, err = registry.TokenFromSecret(s)
+	if err != nil {
+		return err
+	}
+
+	condition := credentialsCondition(c.cloudResource.ValidateAuthToken(token))
+	if err := c.setCredentialsCondition(r, condition); err != nil {
+		return err
+	}
+
+	c.validatedSecrets[r.Name] = s.ResourceVersion
+	return nil
+}
+
+// setCredentialsCondition writes the credentials condition to the registry
+// and reports the status to Cloud if the condition changed
+func (c *RegistrySyncController) setCredentialsCondition(r *csv3.Registry, condition csv3.RegistryCondition) error {
+	rCopy := r.DeepCopy()
+	conditions := make([]csv3.RegistryCondition, 0, len(rCopy.Status.Conditions)+1)
+	for _, existing := range rCopy.Status.Conditions {
+		if existing.Type != condition.Type {
+			conditions = append(conditions, existing)
+			continue
+		}
+
+		if existing.Status == condition.Status {
+			if existing.Reason == condition.Reason && existing.Message == condition.Message {
+				return nil
+			}
+
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+	}
+	rCopy.Status.Conditions = append(conditions, condition)
+
+	updated, err := c.clientset.ContainershipV3().Registries(rCopy.Namespace).Update(rCopy)
+	if err != nil {
+		return err
+	}
+
+	if condition.Status != corev1.ConditionTrue {
+		c.recorder.Eventf(updated, corev1.EventTypeWarning, condition.Reason,
+			"Registry credentials could not be validated: %s", condition.Message)
+	}
+
+	if err := resources.PostRegistryCloudStatus(updated.Name, updated.Status); err != nil {
+		log.Errorf("Could not report status of Registry %s to Cloud: %s", updated.Name, err)
+	}
+
+	return nil
+}
+
+// applyCredentialsSecret creates the credentials secret, or updates it if it
+// was left behind by a Registry that was deleted to regenerate its token or
+// is being replaced
+func (c *RegistrySyncController) applyCredentialsSecret(s *corev1.Secret) (*corev1.Secret, error) {
+	secrets := c.kubeclientset.CoreV1().Secrets(s.Namespace)
+
+	created, err := secrets.Create(s)
+	if !errors.IsAlreadyExists(err) {
+		return created, err
+	}
+
+	existing, err := secrets.Get(s.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	sCopy := existing.DeepCopy()
+	sCopy.Data = s.Data
+	return secrets.Update(sCopy)
+}
+
+// credentialsSecret returns the credentials secret of the registry. The
+// cache may not have caught up with a secret that was just created, so a
+// secret missing from it is looked up in the API before it's reported as
+// missing.
+func (c *RegistrySyncController) credentialsSecret(r *csv3.Registry) (*corev1.Secret, error) {
+	s, err := c.secretLister.Secrets(r.Namespace).Get(r.Spec.CredentialsSecret)
+	if errors.IsNotFound(err) {
+		return c.kubeclientset.CoreV1().Secrets(r.Namespace).Get(r.Spec.CredentialsSecret, metav1.GetOptions{})
+	}
+
+	return s, err
+}
+
+// regenerateCredentialsSecret generates a new auth token for a registry whose
+// credentials secret went missing and stores it in a new credentials secret
+func (c *RegistrySyncController) regenerateCredentialsSecret(r *csv3.Registry, u csv3.RegistrySpec) error {
+	token, err := c.cloudResource.GetAuthToken(u)
+	if err != nil {
+		return err
+	}
+
+	return c.moveCredentialsToSecret(r, u.Credentials, token)
+}
+
+// moveCredentialsToSecret stores the credentials and auth token in the
+// credentials secret of the registry, and updates the registry in place to
+// reference it instead of holding them itself. Updating rather than
+// recreating the registry keeps its image pull secrets in place.
+func (c *RegistrySyncController) moveCredentialsToSecret(r *csv3.Registry, credentials map[string]string, token csv3.AuthTokenDef) error {
+	credentialsSecret, err := registry.NewCredentialsSecret(r.Name, credentials, token.Token)
+	if err != nil {
+		return err
+	}
+
+	credentialsSecret, err = c.applyCredentialsSecret(credentialsSecret)
+	if err != nil {
+		return err
+	}
+
+	rCopy := r.DeepCopy()
+	rCopy.Spec.Credentials = nil
+	rCopy.Spec.AuthToken = token
+	rCopy.Spec.AuthToken.Token = ""
+	rCopy.Spec.CredentialsSecret = credentialsSecret.Name
+
+	updated, err := c.clientset.ContainershipV3().Registries(rCopy.Namespace).Update(rCopy)
+	if err != nil {
+		return err
+	}
+
+	c.recorder.Event(updated, corev1.EventTypeNormal, "MoveCredentials",
+		"Stored registry credentials in a secret")
+
+	// The token is validated on the next sync now that it's in the secret
+	delete(c.validatedSecrets, updated.Name)
+	return nil
+}
+
+// withCredentials returns a copy of the registry with the credentials from its
+// credentials secret filled in, so that it can be compared to the cloud spec
+func withCredentials(r *csv3.Registry, s *corev1.Secret) (*csv3.Registry, error) {
+	credentials, err := registry.CredentialsFromSecret(s)
+	if err != nil {
+		return nil, err
+	}
+
+	rCopy := r.DeepCopy()
+	rCopy.Spec.Credentials = credentials
+	return rCopy, nil
+}
+
 // Delete takes a name or the CRD and deletes it
 func (c *RegistrySyncController) Delete(namespace, name string) error {
 	err := c.clientset.ContainershipV3().Registries(namespace).Delete(name, &metav1.DeleteOptions{})
@@ -176,6 +460,16 @@ func (c *RegistrySyncController) Delete(namespace, name string) error {
 		return err
 	}
 
+	// The credentials secret has no owner reference, so it's deleted along
+	// with the registry here
+	err = c.kubeclientset.CoreV1().Secrets(namespace).
+		Delete(registry.CredentialsSecretName(name), &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		log.Errorf("Could not delete credentials of Registry %s: %s", name, err)
+	}
+
+	delete(c.validatedSecrets, name)
+
 	// If there was not an issue deleting the registry, if there is a routine to
 	// sync auth token, stop it
 	if t, ok := c.tokenRegenerationByID[name]; ok {
@@ -0,0 +1,132 @@
+package synccontroller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	csfake "github.com/containership/cluster-manager/pkg/client/clientset/versioned/fake"
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/resources/registry"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestSetCredentialsCondition(t *testing.T) {
+	reg := &csv3.Registry{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "1234",
+			Namespace: constants.ContainershipNamespace,
+		},
+	}
+
+	client := csfake.NewSimpleClientset(reg)
+	recorder := record.NewFakeRecorder(10)
+	c := &RegistrySyncController{
+		syncController: &syncController{
+			clientset: client,
+			recorder:  recorder,
+		},
+	}
+
+	valid := csv3.RegistryCondition{
+		Type:               csv3.RegistryCredentialsValid,
+		Status:             corev1.ConditionTrue,
+		Reason:             "CredentialsValid",
+		LastTransitionTime: "2018-10-01T12:00:00Z",
+	}
+
+	// Registries created before credentials were validated have no
+	// condition yet
+	assert.Nil(t, c.setCredentialsCondition(reg, valid))
+	updated, err := client.ContainershipV3().Registries(constants.ContainershipNamespace).Get("1234", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []csv3.RegistryCondition{valid}, updated.Status.Conditions)
+	assert.Empty(t, recorder.Events)
+
+	// Nothing is written if the condition didn't change
+	client.ClearActions()
+	stillValid := valid
+	stillValid.LastTransitionTime = "2018-10-01T13:00:00Z"
+	assert.Nil(t, c.setCredentialsCondition(updated, stillValid))
+	assert.Len(t, client.Actions(), 0)
+
+	invalid := csv3.RegistryCondition{
+		Type:               csv3.RegistryCredentialsValid,
+		Status:             corev1.ConditionFalse,
+		Reason:             "CredentialsInvalid",
+		Message:            "invalid credentials",
+		LastTransitionTime: "2018-10-01T14:00:00Z",
+	}
+	assert.Nil(t, c.setCredentialsCondition(updated, invalid))
+	updated, err = client.ContainershipV3().Registries(constants.ContainershipNamespace).Get("1234", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []csv3.RegistryCondition{invalid}, updated.Status.Conditions)
+	assert.Len(t, recorder.Events, 1)
+}
+
+func TestMoveCredentialsToSecret(t *testing.T) {
+	credentials := map[string]string{"password": "secret"}
+	token := csv3.AuthTokenDef{
+		Token:    "token",
+		Endpoint: "registry.example.com",
+		Type:     "dockerconfigjson",
+	}
+
+	// Registries created before credentials were moved to a Secret store
+	// them in plaintext
+	reg := &csv3.Registry{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "1234",
+			Namespace: constants.ContainershipNamespace,
+		},
+		Spec: csv3.RegistrySpec{
+			ID:          "1234",
+			Credentials: credentials,
+			AuthToken:   token,
+		},
+	}
+
+	client := csfake.NewSimpleClientset(reg)
+	kubeclient := fake.NewSimpleClientset()
+	c := &RegistrySyncController{
+		syncController: &syncController{
+			clientset: client,
+			recorder:  record.NewFakeRecorder(10),
+		},
+		kubeclientset:    kubeclient,
+		secretLister:     kubeinformers.NewSharedInformerFactory(kubeclient, 0).Core().V1().Secrets().Lister(),
+		validatedSecrets: make(map[string]string),
+	}
+
+	assert.Nil(t, c.moveCredentialsToSecret(reg, reg.Spec.Credentials, reg.Spec.AuthToken))
+
+	// The registry is updated in place rather than recreated
+	for _, action := range client.Actions() {
+		assert.NotEqual(t, "delete", action.GetVerb())
+	}
+
+	updated, err := client.ContainershipV3().Registries(constants.ContainershipNamespace).Get("1234", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, updated.Spec.Credentials)
+	assert.Empty(t, updated.Spec.AuthToken.Token)
+	assert.Equal(t, token.Endpoint, updated.Spec.AuthToken.Endpoint)
+	assert.Equal(t, registry.CredentialsSecretName("1234"), updated.Spec.CredentialsSecret)
+
+	// The secret isn't in the cache yet, but is still found
+	secret, err := c.credentialsSecret(updated)
+	assert.Nil(t, err)
+
+	stored, err := registry.CredentialsFromSecret(secret)
+	assert.Nil(t, err)
+	assert.Equal(t, credentials, stored)
+
+	storedToken, err := registry.TokenFromSecret(secret)
+	assert.Nil(t, err)
+	assert.Equal(t, "token", storedToken)
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/containership/cluster-manager/pkg/constants"
 	"github.com/containership/cluster-manager/pkg/log"
 	"github.com/containership/cluster-manager/pkg/resources"
+	"github.com/containership/cluster-manager/pkg/resources/sysuser"
 	"github.com/containership/cluster-manager/pkg/tools"
 )
 
@@ -134,6 +135,8 @@ func (c *UserSyncController) Create(u csv3.UserSpec) error {
 	c.recorder.Event(user, corev1.EventTypeNormal, "SyncCreate",
 		"Detected missing CR")
 
+	c.recordInvalidSSHKeys(user)
+
 	return nil
 }
 
@@ -161,7 +164,21 @@ func (c *UserSyncController) Update(u csv3.UserSpec, obj interface{}) error {
 	if err != nil {
 		c.recorder.Eventf(user, corev1.EventTypeNormal, "SyncUpdateError",
 			"Error updating: %s", err.Error())
+		return err
 	}
 
-	return err
+	c.recordInvalidSSHKeys(uCopy)
+
+	return nil
+}
+
+// recordInvalidSSHKeys emits a warning event for each SSH key of the user
+// that agents won't authorize
+func (c *UserSyncController) recordInvalidSSHKeys(user *csv3.User) {
+	for _, k := range user.Spec.SSHKeys {
+		if _, err := sysuser.NormalizeSSHKey(k); err != nil {
+			c.recorder.Eventf(user, corev1.EventTypeWarning, "InvalidSSHKey",
+				"SSH key %s (%s) is rejected: %s", k.ID, k.Name, err)
+		}
+	}
 }
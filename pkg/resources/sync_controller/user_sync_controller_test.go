@@ -0,0 +1,46 @@
+package synccontroller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	csv3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/apis/containership.io/v3/v3test"
+	csfake "github.com/containership/cluster-manager/pkg/client/clientset/versioned/fake"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestUserSyncCreateRecordsInvalidSSHKeys(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	c := &UserSyncController{
+		syncController: &syncController{
+			clientset: csfake.NewSimpleClientset(),
+			recorder:  recorder,
+		},
+	}
+
+	spec := csv3.UserSpec{
+		ID: "00000000-1111-2222-3333-000000000001",
+		SSHKeys: []csv3.SSHKeySpec{
+			{ID: "valid", Name: "laptop", Key: v3test.KeyString, Fingerprint: v3test.FingerprintString},
+			{ID: "invalid", Name: "desktop", Key: "ssh-rsa ABCDEF"},
+		},
+	}
+
+	assert.Nil(t, c.Create(spec))
+
+	events := make([]string, 0)
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+
+	assert.Len(t, events, 2)
+	assert.Equal(t, "Normal SyncCreate Detected missing CR", events[0])
+	assert.Contains(t, events[1], "Warning InvalidSSHKey SSH key invalid (desktop) is rejected")
+
+	_, err := c.clientset.ContainershipV3().Users("containership-core").Get(spec.ID, metav1.GetOptions{})
+	assert.Nil(t, err)
+}
@@ -1,9 +1,12 @@
 package sysuser
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"os"
 	"path"
+	"regexp"
 	"sync"
 
 	"github.com/spf13/afero"
@@ -21,6 +24,7 @@ const (
 	// Host
 	loginScriptFilename       = "containership_login.sh"
 	authorizedKeysFilename    = "authorized_keys"
+	authorizedKeysBackupName  = "authorized_keys.bak"
 	authorizedKeysPermissions = os.FileMode(0600)
 	sshDirPermissions         = os.ModeDir | os.FileMode(0755)
 	scriptsDirPermissions     = os.ModeDir | os.FileMode(0755)
@@ -32,14 +36,22 @@ const (
 // testable.
 var osFs = afero.NewOsFs()
 
+// validFingerprint matches the MD5 and SHA256 fingerprint formats
+var validFingerprint = regexp.MustCompile(`^[A-Za-z0-9:+/=]+$`)
+
 // This mutex protects against simultaneous write attempts to authorized_keys.
 // Note that the zero-value for a mutex is unlocked.
 var writeMutex sync.Mutex
 
+// authorizedKeysChecksum is the checksum of what was last written to
+// authorized_keys, or nil if nothing was written yet. It's protected by
+// writeMutex.
+var authorizedKeysChecksum []byte
+
 // WriteAuthorizedKeys writes the authorized keys for the given users to the
 // authorized_keys file, stomping on the existing file.
-func WriteAuthorizedKeys(users []v3.UserSpec) error {
-	return writeAuthorizedKeys(osFs, users)
+func WriteAuthorizedKeys(users []v3.UserSpec, usernames *UsernameMapping) error {
+	return writeAuthorizedKeys(osFs, users, usernames)
 }
 
 // GetAuthorizedKeysFullPath returns the full path to the authorized_keys file.
@@ -68,20 +80,31 @@ func initializeAuthorizedKeysFileStructure(fs afero.Fs) error {
 		return err
 	}
 
-	// Create empty authorized_keys if needed (this is just to simplify other
-	// logic down the line)
+	// Restore the last known good authorized_keys if it's missing, so that
+	// SSH keeps working until the first write. Otherwise create an empty one
+	// if needed (this is just to simplify other logic down the line).
 	akFile := GetAuthorizedKeysFullPath()
-	if !fsutil.FileExists(fs, akFile) {
+	backupFile := getAuthorizedKeysBackupFullPath()
+	if !fsutil.FileExists(fs, akFile) && fsutil.FileExists(fs, backupFile) {
+		log.Info("authorized_keys file didn't exist so we're restoring it from backup")
+		data, err := afero.ReadFile(fs, backupFile)
+		if err != nil {
+			return err
+		}
+
+		err = fsutil.WriteNewFileAtomic(fs, akFile, data, authorizedKeysPermissions)
+		if err != nil {
+			return err
+		}
+	} else if !fsutil.FileExists(fs, akFile) {
 		log.Info("authorized_keys file didn't exist so we're creating it")
-		f, err := fs.OpenFile(akFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC,
-			authorizedKeysPermissions)
+		err := fsutil.WriteNewFileAtomic(fs, akFile, nil, authorizedKeysPermissions)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
 	} else {
 		// Ensure permissions of existing file are correct
-		if err := fs.Chmod(akFile, sshDirPermissions); err != nil {
+		if err := fs.Chmod(akFile, authorizedKeysPermissions); err != nil {
 			return err
 		}
 	}
@@ -95,6 +118,12 @@ func initializeAuthorizedKeysFileStructure(fs afero.Fs) error {
 	return nil
 }
 
+// getAuthorizedKeysBackupFullPath returns the full path to the last known good
+// authorized_keys
+func getAuthorizedKeysBackupFullPath() string {
+	return path.Join(getSSHDir(), authorizedKeysBackupName)
+}
+
 // getSSHDir returns the SSH directory built from the environment
 func getSSHDir() string {
 	return path.Join(constants.ContainershipMount, "home", ".ssh")
@@ -112,7 +141,7 @@ func getLoginScriptFullPath() string {
 
 // writeAuthorizedKeys is the same as WriteAuthorizedKeys but takes a
 // filesystem argument for testing purposes.
-func writeAuthorizedKeys(fs afero.Fs, users []v3.UserSpec) error {
+func writeAuthorizedKeys(fs afero.Fs, users []v3.UserSpec, usernames *UsernameMapping) error {
 	filename := GetAuthorizedKeysFullPath()
 
 	// Prevent against ssh dir deletion or permissions changes
@@ -121,50 +150,120 @@ func writeAuthorizedKeys(fs afero.Fs, users []v3.UserSpec) error {
 		return err
 	}
 
-	s := buildAllKeysString(users)
+	data := []byte(buildAllKeysString(users, usernames))
 
 	writeMutex.Lock()
 	defer writeMutex.Unlock()
 
-	// O_TRUNC so we clear the file contents if there are no keys to write
-	f, err := fs.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC,
-		authorizedKeysPermissions)
+	// The current file is only backed up if it's what we last wrote, so that
+	// the backup is always known to be good
+	if tampered, err := authorizedKeysTampered(fs); err == nil && !tampered && authorizedKeysChecksum != nil {
+		current, err := afero.ReadFile(fs, filename)
+		if err != nil {
+			return err
+		}
+
+		err = fsutil.WriteFileAtomic(fs, getAuthorizedKeysBackupFullPath(), current, authorizedKeysPermissions)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The file is replaced atomically so that sshd never sees a partial file
+	// and a crash mid-write can't leave SSH broken
+	err = fsutil.WriteFileAtomic(fs, filename, data, authorizedKeysPermissions)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	_, err = f.Write([]byte(s))
+	checksum := sha256.Sum256(data)
+	authorizedKeysChecksum = checksum[:]
+
+	return nil
+}
+
+// AuthorizedKeysTampered returns true if authorized_keys no longer has the
+// contents and permissions it was last written with, e.g. because it was
+// edited by hand. It always returns false if it wasn't written yet.
+func AuthorizedKeysTampered() (bool, error) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	return authorizedKeysTampered(osFs)
+}
+
+// authorizedKeysTampered is the same as AuthorizedKeysTampered but takes a
+// filesystem argument for testing purposes. writeMutex must be held.
+func authorizedKeysTampered(fs afero.Fs) (bool, error) {
+	if authorizedKeysChecksum == nil {
+		return false, nil
+	}
+
+	filename := GetAuthorizedKeysFullPath()
+	info, err := fs.Stat(filename)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if info.Mode() != authorizedKeysPermissions {
+		return true, nil
+	}
+
+	data, err := afero.ReadFile(fs, filename)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	// If OpenFile() above didn't create the file, there's a chance the file
-	// existed already but with incorrect permissions - fix them.
-	return fs.Chmod(filename, authorizedKeysPermissions)
+	checksum := sha256.Sum256(data)
+	return !bytes.Equal(checksum[:], authorizedKeysChecksum), nil
 }
 
 // buildKeysStringForUser builds a string containing all authorized_keys lines
-// for a single user
-func buildKeysStringForUser(user v3.UserSpec) string {
-	username := UsernameFromContainershipUID(user.ID)
-
+// for a single user. The fingerprint of each key is passed to the login script
+// so that it can record which key a session used. Keys rejected by
+// NormalizeSSHKey are left out.
+func buildKeysStringForUser(user v3.UserSpec, username string) string {
 	// TODO concatenation using + is terribly inefficient
 	s := ""
 	for _, k := range user.SSHKeys {
-		s += fmt.Sprintf("command=\"%s %s\" %s\n",
-			getLoginScriptFullPath(), username, k.Key)
+		key, err := NormalizeSSHKey(k)
+		if err != nil {
+			log.Errorf("Ignoring SSH key %s of user %s: %s", k.ID, user.ID, err)
+			continue
+		}
+
+		s += fmt.Sprintf("command=\"%s %s %s\" %s\n",
+			getLoginScriptFullPath(), username, loginScriptFingerprint(k.Fingerprint), key)
 	}
 
 	return s
 }
 
-// buildAllKeysString builds the entire authorized_keys contents into a string
-func buildAllKeysString(users []v3.UserSpec) string {
+// loginScriptFingerprint returns the fingerprint if it's safe to pass to the
+// login script, and "unknown" otherwise
+func loginScriptFingerprint(fingerprint string) string {
+	if !validFingerprint.MatchString(fingerprint) {
+		return "unknown"
+	}
+
+	return fingerprint
+}
+
+// buildAllKeysString builds the entire authorized_keys contents into a string.
+// Users that don't have a username yet are left out.
+func buildAllKeysString(users []v3.UserSpec, usernames *UsernameMapping) string {
 	// TODO concatenation using + is terribly inefficient
 	s := ""
 	for _, u := range users {
-		s += buildKeysStringForUser(u)
+		username, err := usernames.Username(u.ID)
+		if err != nil {
+			log.Errorf("Ignoring SSH keys of user %s: %s", u.ID, err)
+			continue
+		}
+
+		s += buildKeysStringForUser(u, username)
 	}
 	return s
 }
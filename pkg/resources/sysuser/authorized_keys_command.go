@@ -0,0 +1,97 @@
+package sysuser
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/spf13/afero"
+
+	v3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/tools/fsutil"
+)
+
+const (
+	// Container
+	authorizedKeysCommandContainerPath = "/scripts/containership_authorized_keys"
+
+	// Host
+	authorizedKeysCommandFilename           = "containership_authorized_keys"
+	authorizedKeysCommandSSHDConfigFilename = "sshd_config_authorized_keys_command"
+	agentSocketFilename                     = "agent.sock"
+)
+
+// InstallAuthorizedKeysCommand puts the AuthorizedKeysCommand helper in place
+// along with an sshd configuration snippet using it, to be included from the
+// host sshd_config. The helper asks the agent for the keys to authorize over
+// the agent socket, so no keys are kept in a shared file.
+func InstallAuthorizedKeysCommand() error {
+	return installAuthorizedKeysCommand(osFs)
+}
+
+// installAuthorizedKeysCommand is the same as InstallAuthorizedKeysCommand
+// but takes a filesystem argument for testing purposes.
+func installAuthorizedKeysCommand(fs afero.Fs) error {
+	err := fsutil.EnsureDirExistsWithCorrectPermissions(fs, getScriptsDir(), scriptsDirPermissions)
+	if err != nil {
+		return err
+	}
+
+	// sshd requires the helper to be owned by root and not writable by
+	// anyone else, which the scripts dir and permissions satisfy. It's
+	// replaced atomically since sshd may be running it.
+	helper, err := afero.ReadFile(fs, authorizedKeysCommandContainerPath)
+	if err != nil {
+		return err
+	}
+
+	err = fsutil.WriteFileAtomic(fs, getAuthorizedKeysCommandFullPath(), helper, scriptPermissions)
+	if err != nil {
+		return err
+	}
+
+	err = fsutil.EnsureDirExistsWithCorrectPermissions(fs, getSSHDir(), sshDirPermissions)
+	if err != nil {
+		return err
+	}
+
+	return fsutil.WriteFileAtomic(fs, path.Join(getSSHDir(), authorizedKeysCommandSSHDConfigFilename),
+		[]byte(buildAuthorizedKeysCommandSSHDConfigString()), sshCAFilePermissions)
+}
+
+// AuthorizedKeysForAccount returns the authorized keys sshd should accept
+// for logging in as the given host account, in authorized_keys format. Users
+// log in through the login account, which the shared authorized_keys file
+// belongs to, and the login script switches to their own host user. No other
+// account accepts any keys.
+func AuthorizedKeysForAccount(users []v3.UserSpec, usernames *UsernameMapping, loginAccount, account string) string {
+	if account != loginAccount || account == "root" || isContainershipUsername(account, usernames) {
+		return ""
+	}
+
+	return buildAllKeysString(users, usernames)
+}
+
+// GetAgentSocketPath returns the full path to the unix socket the agent
+// serves the AuthorizedKeysCommand helper on
+func GetAgentSocketPath() string {
+	return path.Join(constants.ContainershipMount, agentSocketFilename)
+}
+
+// getAuthorizedKeysCommandFullPath returns the full path to the
+// AuthorizedKeysCommand helper
+func getAuthorizedKeysCommandFullPath() string {
+	return path.Join(getScriptsDir(), authorizedKeysCommandFilename)
+}
+
+// buildAuthorizedKeysCommandSSHDConfigString builds the sshd configuration
+// snippet that enables the AuthorizedKeysCommand helper. The agent socket is
+// only accessible by root, so the helper runs as root.
+func buildAuthorizedKeysCommandSSHDConfigString() string {
+	return fmt.Sprintf(`# Written by the Containership agent. Include these options from the host
+# sshd_config to get the keys of users from the agent.
+AuthorizedKeysCommand %s -socket %s %%u
+AuthorizedKeysCommandUser root
+`,
+		getAuthorizedKeysCommandFullPath(), GetAgentSocketPath())
+}
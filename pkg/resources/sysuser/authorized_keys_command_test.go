@@ -0,0 +1,63 @@
+package sysuser
+
+import (
+	"path"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+)
+
+func TestInstallAuthorizedKeysCommand(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	err := installAuthorizedKeysCommand(fs)
+	assert.NotNil(t, err, "helper isn't in the container")
+
+	err = afero.WriteFile(fs, authorizedKeysCommandContainerPath, []byte("helper"), scriptPermissions)
+	assert.Nil(t, err)
+
+	err = installAuthorizedKeysCommand(fs)
+	assert.Nil(t, err)
+
+	info, err := fs.Stat(getAuthorizedKeysCommandFullPath())
+	assert.Nil(t, err)
+	assert.Equal(t, scriptPermissions, info.Mode())
+
+	data, err := afero.ReadFile(fs, getAuthorizedKeysCommandFullPath())
+	assert.Nil(t, err)
+	assert.Equal(t, "helper", string(data))
+
+	config, err := afero.ReadFile(fs, path.Join(getSSHDir(), authorizedKeysCommandSSHDConfigFilename))
+	assert.Nil(t, err)
+	assert.Contains(t, string(config),
+		"AuthorizedKeysCommand /etc/containership/scripts/containership_authorized_keys -socket /etc/containership/agent.sock %u\n")
+	assert.Contains(t, string(config), "AuthorizedKeysCommandUser root\n")
+
+	// Installing again replaces the helper
+	err = afero.WriteFile(fs, authorizedKeysCommandContainerPath, []byte("new helper"), scriptPermissions)
+	assert.Nil(t, err)
+	err = installAuthorizedKeysCommand(fs)
+	assert.Nil(t, err)
+	data, err = afero.ReadFile(fs, getAuthorizedKeysCommandFullPath())
+	assert.Nil(t, err)
+	assert.Equal(t, "new helper", string(data))
+}
+
+func TestAuthorizedKeysForAccount(t *testing.T) {
+	usernames := newTestUsernames(t, allUsers...)
+	assert.Equal(t, allUsersExpected, AuthorizedKeysForAccount(allUsers, usernames, "containership", "containership"))
+	assert.Empty(t, AuthorizedKeysForAccount(nil, usernames, "containership", "containership"))
+
+	assert.Empty(t, AuthorizedKeysForAccount(allUsers, usernames, "containership", "ubuntu"),
+		"unrelated accounts never accept keys")
+	assert.Empty(t, AuthorizedKeysForAccount(allUsers, usernames, "containership", "nobody"))
+
+	assert.Empty(t, AuthorizedKeysForAccount(allUsers, usernames, "root", "root"), "root never accepts keys")
+
+	username := testUsername(t, testUserOneKey)
+	assert.Empty(t, AuthorizedKeysForAccount([]v3.UserSpec{testUserOneKey}, usernames, "containership", username),
+		"users are only switched to through the login script")
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
@@ -19,13 +20,13 @@ var testUserNoKeys = *v3test.NewFakeUserSpec(0)
 var testUserNoKeysExpected = ""
 
 var testUserOneKey = *v3test.NewFakeUserSpec(1)
-var testUserOneKeyExpected = `command="/etc/containership/scripts/containership_login.sh 00000000111122223333000000000001" ssh-rsa ABCDEF
+var testUserOneKeyExpected = `command="/etc/containership/scripts/containership_login.sh 00000000111122223333000000000001 9f:38:c4:ba:d2:e6:c6:5f:32:0f:aa:17:c7:c1:de:89" ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMcHJZYtwl35ECewWUX5JChxpUxfvRr6ic+dML+iGuW
 `
 
 var testUserManyKeys = *v3test.NewFakeUserSpec(3)
-var testUserManyKeysExpected = `command="/etc/containership/scripts/containership_login.sh 00000000111122223333000000000002" ssh-rsa ABCDEF
-command="/etc/containership/scripts/containership_login.sh 00000000111122223333000000000002" ssh-rsa ABCDEF
-command="/etc/containership/scripts/containership_login.sh 00000000111122223333000000000002" ssh-rsa ABCDEF
+var testUserManyKeysExpected = `command="/etc/containership/scripts/containership_login.sh 00000000111122223333000000000002 9f:38:c4:ba:d2:e6:c6:5f:32:0f:aa:17:c7:c1:de:89" ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMcHJZYtwl35ECewWUX5JChxpUxfvRr6ic+dML+iGuW
+command="/etc/containership/scripts/containership_login.sh 00000000111122223333000000000002 9f:38:c4:ba:d2:e6:c6:5f:32:0f:aa:17:c7:c1:de:89" ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMcHJZYtwl35ECewWUX5JChxpUxfvRr6ic+dML+iGuW
+command="/etc/containership/scripts/containership_login.sh 00000000111122223333000000000002 9f:38:c4:ba:d2:e6:c6:5f:32:0f:aa:17:c7:c1:de:89" ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMcHJZYtwl35ECewWUX5JChxpUxfvRr6ic+dML+iGuW
 `
 
 var allUsers = []v3.UserSpec{
@@ -47,17 +48,17 @@ var allUsersExpected = strings.Join([]string{
 }, "")
 
 func testBuildKeysStringNoKeys(t *testing.T) {
-	s := buildKeysStringForUser(testUserNoKeys)
+	s := buildKeysStringForUser(testUserNoKeys, testUsername(t, testUserNoKeys))
 	assert.Equal(t, testUserNoKeysExpected, s)
 }
 
 func testBuildKeysStringOneKey(t *testing.T) {
-	s := buildKeysStringForUser(testUserOneKey)
+	s := buildKeysStringForUser(testUserOneKey, testUsername(t, testUserOneKey))
 	assert.Equal(t, testUserOneKeyExpected, s)
 }
 
 func testBuildKeysStringManyKeys(t *testing.T) {
-	s := buildKeysStringForUser(testUserManyKeys)
+	s := buildKeysStringForUser(testUserManyKeys, testUsername(t, testUserManyKeys))
 	assert.Equal(t, testUserManyKeysExpected, s)
 }
 
@@ -67,8 +68,16 @@ func TestBuildKeysStringForUser(t *testing.T) {
 	t.Run("ManyKeys", testBuildKeysStringManyKeys)
 }
 
+func TestLoginScriptFingerprint(t *testing.T) {
+	assert.Equal(t, "00:11:22", loginScriptFingerprint("00:11:22"))
+	assert.Equal(t, "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8",
+		loginScriptFingerprint("SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8"))
+	assert.Equal(t, "unknown", loginScriptFingerprint(""))
+	assert.Equal(t, "unknown", loginScriptFingerprint(`00" ssh-rsa AAAA`))
+}
+
 func TestBuildAllKeysString(t *testing.T) {
-	s := buildAllKeysString(allUsers)
+	s := buildAllKeysString(allUsers, newTestUsernames(t, allUsers...))
 	assert.Equal(t, allUsersExpected, s)
 }
 
@@ -99,6 +108,7 @@ func TestInitializeAuthorizedKeysFileStructure(t *testing.T) {
 
 func TestWriteAuthorizedKeys(t *testing.T) {
 	fs := afero.NewMemMapFs()
+	usernames := newTestUsernames(t, allUsers...)
 
 	// Init is covered by a different test, assume it works
 	err := writeDummyContainerLoginScript(fs)
@@ -109,7 +119,7 @@ func TestWriteAuthorizedKeys(t *testing.T) {
 	filename := GetAuthorizedKeysFullPath()
 
 	// Verify that we can write a bunch of keys properly
-	err = writeAuthorizedKeys(fs, allUsers)
+	err = writeAuthorizedKeys(fs, allUsers, usernames)
 	assert.Nil(t, err)
 
 	match, err := afero.FileContainsBytes(fs, filename,
@@ -119,14 +129,14 @@ func TestWriteAuthorizedKeys(t *testing.T) {
 
 	// Verify that file contents are cleared if no keys users to write
 	noUsers := make([]v3.UserSpec, 0)
-	err = writeAuthorizedKeys(fs, noUsers)
+	err = writeAuthorizedKeys(fs, noUsers, usernames)
 
 	empty, err := afero.IsEmpty(fs, filename)
 	assert.True(t, empty)
 	assert.Nil(t, err)
 
 	// Re-verify that we can write a bunch of keys properly after truncate
-	err = writeAuthorizedKeys(fs, allUsers)
+	err = writeAuthorizedKeys(fs, allUsers, usernames)
 	assert.Nil(t, err)
 
 	match, err = afero.FileContainsBytes(fs, filename,
@@ -137,20 +147,129 @@ func TestWriteAuthorizedKeys(t *testing.T) {
 	// Mess up permissions and verify that a write fixes them
 	fs.Chmod(getSSHDir(), os.ModeDir|os.FileMode(0777))
 	fs.Chmod(filename, os.FileMode(0777))
-	err = writeAuthorizedKeys(fs, allUsers)
+	err = writeAuthorizedKeys(fs, allUsers, usernames)
 	assert.Nil(t, err)
 	verifyAllKnownPermissions(t, fs)
 
 	// Verify that file contents are cleared if there are users but no keys to
 	// write
 	oneUserNoKeys := []v3.UserSpec{testUserNoKeys}
-	err = writeAuthorizedKeys(fs, oneUserNoKeys)
+	err = writeAuthorizedKeys(fs, oneUserNoKeys, usernames)
 
 	empty, err = afero.IsEmpty(fs, filename)
 	assert.True(t, empty)
 	assert.Nil(t, err)
 }
 
+func TestInitializeAuthorizedKeysFileStructureFixesPermissions(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	err := writeDummyContainerLoginScript(fs)
+	assert.Nil(t, err)
+	err = fs.MkdirAll(getSSHDir(), sshDirPermissions)
+	assert.Nil(t, err)
+	err = afero.WriteFile(fs, GetAuthorizedKeysFullPath(), nil, os.FileMode(0777))
+	assert.Nil(t, err)
+
+	err = initializeAuthorizedKeysFileStructure(fs)
+	assert.Nil(t, err)
+	verifyAllKnownPermissions(t, fs)
+}
+
+func TestAuthorizedKeysBackup(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	authorizedKeysChecksum = nil
+	usernames := newTestUsernames(t, allUsers...)
+
+	err := writeDummyContainerLoginScript(fs)
+	assert.Nil(t, err)
+	err = initializeAuthorizedKeysFileStructure(fs)
+	assert.Nil(t, err)
+
+	filename := GetAuthorizedKeysFullPath()
+	backup := getAuthorizedKeysBackupFullPath()
+
+	err = writeAuthorizedKeys(fs, []v3.UserSpec{testUserOneKey}, usernames)
+	assert.Nil(t, err)
+	exists, err := afero.Exists(fs, backup)
+	assert.Nil(t, err)
+	assert.False(t, exists, "nothing known to be good to back up yet")
+
+	err = writeAuthorizedKeys(fs, allUsers, usernames)
+	assert.Nil(t, err)
+	data, err := afero.ReadFile(fs, backup)
+	assert.Nil(t, err)
+	assert.Equal(t, testUserOneKeyExpected, string(data), "previous write is backed up")
+
+	// A tampered file is never backed up
+	err = afero.WriteFile(fs, filename, []byte("tampered\n"), authorizedKeysPermissions)
+	assert.Nil(t, err)
+	err = writeAuthorizedKeys(fs, []v3.UserSpec{testUserOneKey}, usernames)
+	assert.Nil(t, err)
+	data, err = afero.ReadFile(fs, backup)
+	assert.Nil(t, err)
+	assert.Equal(t, testUserOneKeyExpected, string(data))
+
+	// A missing authorized_keys is restored from the backup
+	err = fs.Remove(filename)
+	assert.Nil(t, err)
+	err = initializeAuthorizedKeysFileStructure(fs)
+	assert.Nil(t, err)
+	data, err = afero.ReadFile(fs, filename)
+	assert.Nil(t, err)
+	assert.Equal(t, testUserOneKeyExpected, string(data))
+	verifyAllKnownPermissions(t, fs)
+}
+
+func TestAuthorizedKeysTampered(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	authorizedKeysChecksum = nil
+	usernames := newTestUsernames(t, allUsers...)
+
+	err := writeDummyContainerLoginScript(fs)
+	assert.Nil(t, err)
+	err = initializeAuthorizedKeysFileStructure(fs)
+	assert.Nil(t, err)
+
+	filename := GetAuthorizedKeysFullPath()
+
+	tampered, err := authorizedKeysTampered(fs)
+	assert.Nil(t, err)
+	assert.False(t, tampered, "nothing was written yet")
+
+	err = writeAuthorizedKeys(fs, allUsers, usernames)
+	assert.Nil(t, err)
+	tampered, err = authorizedKeysTampered(fs)
+	assert.Nil(t, err)
+	assert.False(t, tampered)
+
+	err = fs.Chtimes(filename, time.Now(), time.Now())
+	assert.Nil(t, err)
+	tampered, err = authorizedKeysTampered(fs)
+	assert.Nil(t, err)
+	assert.False(t, tampered, "touching the file is benign")
+
+	err = fs.Chmod(filename, os.FileMode(0666))
+	assert.Nil(t, err)
+	tampered, err = authorizedKeysTampered(fs)
+	assert.Nil(t, err)
+	assert.True(t, tampered, "permissions changed")
+
+	err = writeAuthorizedKeys(fs, allUsers, usernames)
+	assert.Nil(t, err)
+	err = afero.WriteFile(fs, filename, []byte(allUsersExpected+"ssh-rsa AAAA\n"), authorizedKeysPermissions)
+	assert.Nil(t, err)
+	tampered, err = authorizedKeysTampered(fs)
+	assert.Nil(t, err)
+	assert.True(t, tampered, "contents changed")
+
+	err = fs.Remove(filename)
+	assert.Nil(t, err)
+	tampered, err = authorizedKeysTampered(fs)
+	assert.Nil(t, err)
+	assert.True(t, tampered, "file removed")
+}
+
 func verifyAllKnownPermissions(t *testing.T, fs afero.Fs) {
 	// TODO maybe add scripts stuff
 	sshDir := getSSHDir()
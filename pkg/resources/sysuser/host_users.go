@@ -0,0 +1,386 @@
+package sysuser
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+
+	v3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/tools/fsutil"
+)
+
+const (
+	// Container path of the host /etc
+	hostEtcDir = "/host/etc"
+
+	// Container path of the host root, through the host init process
+	hostRootDir = "/proc/1/root"
+
+	// The account expiration field of shadow entries
+	shadowExpireField = 7
+)
+
+// hostCommandDirs are the host directories host commands are looked up in
+var hostCommandDirs = []string{"/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// HostUserCleanupPolicy is what is done with the host user of a Containership
+// user that no longer exists
+type HostUserCleanupPolicy string
+
+const (
+	// HostUserCleanupNone leaves host users as they are
+	HostUserCleanupNone HostUserCleanupPolicy = "none"
+	// HostUserCleanupLock locks and expires host users and removes their sudo
+	// access, keeping their home directory
+	HostUserCleanupLock HostUserCleanupPolicy = "lock"
+	// HostUserCleanupDelete deletes host users along with their group, home
+	// directory and sudo access
+	HostUserCleanupDelete HostUserCleanupPolicy = "delete"
+)
+
+// ErrHostEtcNotMounted is returned when host users can't be cleaned up
+// because the host /etc isn't mounted
+var ErrHostEtcNotMounted = fmt.Errorf("host /etc is not mounted at %s", hostEtcDir)
+
+// CleanupHostUsers locks or deletes the host users created by the login
+// script that haven't belonged to any of the given users for at least the
+// grace period, so that a user that is only briefly missing, e.g. while being
+// synced again, keeps its host user. It returns the names of the host users
+// that were changed.
+func CleanupHostUsers(users []v3.UserSpec, usernames *UsernameMapping, policy HostUserCleanupPolicy, gracePeriod time.Duration) ([]string, error) {
+	return cleanupHostUsers(osFs, users, usernames, policy, gracePeriod, time.Now())
+}
+
+// cleanupHostUsers is the same as CleanupHostUsers but takes a filesystem
+// argument and the current time for testing purposes.
+func cleanupHostUsers(fs afero.Fs, users []v3.UserSpec, usernames *UsernameMapping, policy HostUserCleanupPolicy, gracePeriod time.Duration, now time.Time) ([]string, error) {
+	if policy == HostUserCleanupNone {
+		return nil, nil
+	}
+
+	if exists, _ := afero.DirExists(fs, hostEtcDir); !exists {
+		return nil, ErrHostEtcNotMounted
+	}
+
+	// Users without a username yet can't have a host user
+	keep := make(map[string]bool)
+	for _, u := range users {
+		if username, err := usernames.Username(u.ID); err == nil {
+			keep[username] = true
+		}
+	}
+
+	orphans, err := orphanedHostUsers(fs, keep, usernames)
+	if err != nil {
+		return nil, err
+	}
+
+	orphans, err = expiredOrphans(fs, orphans, gracePeriod, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(orphans) == 0 {
+		return nil, nil
+	}
+
+	switch policy {
+	case HostUserCleanupLock:
+		return lockHostUsers(fs, orphans)
+	case HostUserCleanupDelete:
+		return deleteHostUsers(fs, orphans)
+	default:
+		return nil, fmt.Errorf("unknown host user cleanup policy %q", policy)
+	}
+}
+
+// orphanedHostUsers returns the home directories of the host users created by
+// the login script that aren't kept, by name. Host users are only considered
+// to be created by the login script if both their name and their home
+// directory are what the login script uses.
+func orphanedHostUsers(fs afero.Fs, keep map[string]bool, usernames *UsernameMapping) (map[string]string, error) {
+	data, err := afero.ReadFile(fs, path.Join(hostEtcDir, "passwd"))
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 7 {
+			continue
+		}
+
+		name := fields[0]
+		if keep[name] || !isContainershipUsername(name, usernames) || fields[5] != getHomeDir(name) {
+			continue
+		}
+
+		orphans[name] = fields[5]
+	}
+
+	return orphans, nil
+}
+
+// expiredOrphans returns the orphans that have been orphaned for at least the
+// grace period. When each host user was first seen orphaned is kept in a file
+// so that restarting the agent doesn't restart the grace period.
+func expiredOrphans(fs afero.Fs, orphans map[string]string, gracePeriod time.Duration, now time.Time) (map[string]string, error) {
+	filename := getOrphanedHostUsersFilename()
+
+	previous := make(map[string]time.Time)
+	data, err := afero.ReadFile(fs, filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		// The grace period starts over if the file is corrupted
+		if err := json.Unmarshal(data, &previous); err != nil {
+			previous = make(map[string]time.Time)
+		}
+	}
+
+	since := make(map[string]time.Time, len(orphans))
+	expired := make(map[string]string)
+	for name, home := range orphans {
+		t, ok := previous[name]
+		if !ok {
+			t = now
+		}
+		since[name] = t
+
+		if now.Sub(t) >= gracePeriod {
+			expired[name] = home
+		}
+	}
+
+	if !reflect.DeepEqual(previous, since) {
+		data, err := json.Marshal(since)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := fs.MkdirAll(path.Dir(filename), os.ModeDir|os.FileMode(0755)); err != nil {
+			return nil, err
+		}
+
+		if err := fsutil.WriteFileAtomic(fs, filename, data, os.FileMode(0644)); err != nil {
+			return nil, err
+		}
+	}
+
+	return expired, nil
+}
+
+// getOrphanedHostUsersFilename returns the file holding when each orphaned
+// host user was first seen
+func getOrphanedHostUsersFilename() string {
+	return path.Join(constants.ContainershipMount, "orphaned_host_users.json")
+}
+
+// isContainershipUsername returns true if the name is the username of a
+// user, including users that were removed, or was built from a user ID
+// before usernames were mapped
+func isContainershipUsername(name string, usernames *UsernameMapping) bool {
+	if _, err := usernames.UserID(name); err == nil {
+		return true
+	}
+
+	return validUIDUsername.MatchString(name)
+}
+
+// lockHostUsers locks the password and expires the account of each user with
+// the host usermod so that su to the user fails, and removes their sudo
+// access. Users that are already locked are skipped.
+func lockHostUsers(fs afero.Fs, orphans map[string]string) ([]string, error) {
+	alreadyLocked, err := lockedHostUsers(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	locked := make([]string, 0)
+	for _, name := range sortedNames(orphans) {
+		if alreadyLocked[name] {
+			continue
+		}
+
+		if err := runHostCommand("usermod", "-L", "-e", "1", name); err != nil {
+			return locked, err
+		}
+		locked = append(locked, name)
+	}
+
+	return locked, removeHostSudoers(fs, orphans)
+}
+
+// lockedHostUsers returns the host users whose password is locked and whose
+// account is expired, as lockHostUsers leaves them
+func lockedHostUsers(fs afero.Fs) (map[string]bool, error) {
+	data, err := afero.ReadFile(fs, path.Join(hostEtcDir, "shadow"))
+	if err != nil {
+		return nil, err
+	}
+
+	locked := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) > shadowExpireField && strings.HasPrefix(fields[1], "!") && fields[shadowExpireField] == "1" {
+			locked[fields[0]] = true
+		}
+	}
+
+	return locked, nil
+}
+
+// deleteHostUsers deletes each user along with its group and home directory
+// with the host userdel, and removes their sudo access. Since userdel removes
+// the home directory in the host passwd, users are only deleted if that is a
+// home directory the login script created.
+func deleteHostUsers(fs afero.Fs, orphans map[string]string) ([]string, error) {
+	deleted := make([]string, 0)
+	for _, name := range sortedNames(orphans) {
+		if home := orphans[name]; !isLoginScriptHomeDir(home) {
+			return deleted, fmt.Errorf("not deleting host user %s since its home directory %s is not under %s",
+				name, home, getHomeRootDir())
+		}
+
+		if err := runHostCommand("userdel", "-r", name); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, name)
+	}
+
+	return deleted, removeHostSudoers(fs, orphans)
+}
+
+// sortedNames returns the names of the orphans in order so that they're
+// always cleaned up in the same order
+func sortedNames(orphans map[string]string) []string {
+	names := make([]string, 0, len(orphans))
+	for name := range orphans {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// removeHostSudoers removes the sudoers drop-ins the login script installed
+// for the users, as well as the lines older login scripts added to sudoers
+func removeHostSudoers(fs afero.Fs, users map[string]string) error {
+	for name := range users {
+		err := fs.Remove(path.Join(getHostSudoersDir(), hostSudoersPrefix+name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return editHostSudoers(fs, func(line string) bool {
+		for name := range users {
+			if line == buildLegacySudoersLine(name) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// editHostSudoers removes the lines of the host sudoers for which keep
+// returns false. The sudoers is only replaced if any line was removed, and
+// only once the host visudo accepts the result. A missing sudoers is ignored.
+func editHostSudoers(fs afero.Fs, keep func(line string) bool) error {
+	filename := path.Join(hostEtcDir, "sudoers")
+	info, err := fs.Stat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	data, err := afero.ReadFile(fs, filename)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if keep(line) {
+			kept = append(kept, line)
+		}
+	}
+
+	if len(kept) == len(lines) {
+		return nil
+	}
+
+	return writeHostSudoersFile(fs, filename, strings.Join(kept, "\n"), info.Mode().Perm())
+}
+
+// runHostCommand runs a command of the host rather than of the agent image.
+// It's a variable so that tests can replace it.
+var runHostCommand = runChrootedHostCommand
+
+// runChrootedHostCommand runs a command of the host chrooted to the host
+// root, which the agent can reach through the host init process since it
+// shares the host PID namespace. The host tools take care of locking and
+// syncing the files they edit.
+func runChrootedHostCommand(name string, args ...string) error {
+	bin := ""
+	for _, dir := range hostCommandDirs {
+		// Lstat since absolute symlinks only resolve inside the chroot
+		if info, err := os.Lstat(path.Join(hostRootDir, dir, name)); err == nil && !info.IsDir() {
+			bin = path.Join(dir, name)
+			break
+		}
+	}
+	if bin == "" {
+		return fmt.Errorf("%s not found on the host", name)
+	}
+
+	cmd := exec.Command(bin, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: hostRootDir}
+	cmd.Dir = "/"
+	cmd.Env = []string{"PATH=" + strings.Join(hostCommandDirs, ":")}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %s: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// getHostEtcPath returns the host path of a file in the host /etc
+func getHostEtcPath(filename string) string {
+	return path.Join("/etc", strings.TrimPrefix(filename, hostEtcDir))
+}
+
+// isLoginScriptHomeDir returns true if dir is a home directory the login
+// script creates
+func isLoginScriptHomeDir(dir string) bool {
+	dir = path.Clean(dir)
+	return path.Dir(dir) == getHomeRootDir() && path.Base(dir) != ".."
+}
+
+// getHomeRootDir returns the directory the login script creates home
+// directories in
+func getHomeRootDir() string {
+	return path.Join(constants.ContainershipMount, "home")
+}
+
+// getHomeDir returns the home directory the login script creates for the
+// user
+func getHomeDir(name string) string {
+	return path.Join(getHomeRootDir(), name)
+}
@@ -0,0 +1,252 @@
+package sysuser
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+)
+
+const (
+	keptUser    = "00000000111122223333000000000001"
+	removedUser = "00000000111122223333000000000002"
+)
+
+var testPasswd = `root:x:0:0:root:/root:/bin/bash
+` + keptUser + `:x:1001:1001::/etc/containership/home/` + keptUser + `:/bin/sh
+` + removedUser + `:x:1002:1002::/etc/containership/home/` + removedUser + `:/bin/sh
+ffffffffffffffffffffffffffffffff:x:1003:1003::/home/other:/bin/sh
+`
+
+var testShadow = `root:*:17000:0:99999:7:::
+` + keptUser + `:!:17000:0:99999:7:::
+` + removedUser + `:!:17000:0:99999:7:::
+ffffffffffffffffffffffffffffffff:!:17000:0:99999:7:::
+`
+
+// fakeHostCommands replaces the host commands until the returned function is
+// called, recording each command that is run. Commands named in fail fail.
+func fakeHostCommands(fail ...string) (*[]string, func()) {
+	run := make([]string, 0)
+	original := runHostCommand
+	runHostCommand = func(name string, args ...string) error {
+		run = append(run, strings.Join(append([]string{name}, args...), " "))
+		for _, f := range fail {
+			if f == name {
+				return errors.New(name + " failed")
+			}
+		}
+		return nil
+	}
+
+	return &run, func() { runHostCommand = original }
+}
+
+func newHostUsersFs(t *testing.T) afero.Fs {
+	fs := afero.NewMemMapFs()
+	for name, data := range map[string]string{
+		"passwd": testPasswd,
+		"shadow": testShadow,
+		path.Join("sudoers.d", "containership-"+removedUser): "",
+		"sudoers": "root ALL=(ALL) ALL\n" + removedUser + " ALL=(ALL) NOPASSWD:ALL\n",
+	} {
+		assert.Nil(t, afero.WriteFile(fs, path.Join(hostEtcDir, name), []byte(data), 0640))
+	}
+
+	assert.Nil(t, fs.MkdirAll(getHomeDir(removedUser), 0755))
+
+	return fs
+}
+
+func readHostFile(t *testing.T, fs afero.Fs, name string) string {
+	data, err := afero.ReadFile(fs, path.Join(hostEtcDir, name))
+	assert.Nil(t, err)
+	return string(data)
+}
+
+var testKeptUsers = []v3.UserSpec{{ID: "00000000-1111-2222-3333-000000000001"}}
+
+// hostCommandsOtherThanVisudo filters out the visudo checks
+func hostCommandsOtherThanVisudo(commands []string) []string {
+	result := make([]string, 0)
+	for _, c := range commands {
+		if !strings.HasPrefix(c, "visudo ") {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func TestCleanupHostUsersLock(t *testing.T) {
+	commands, restore := fakeHostCommands()
+	defer restore()
+	fs := newHostUsersFs(t)
+
+	cleaned, err := cleanupHostUsers(fs, testKeptUsers, newTestUsernames(t, testKeptUsers...), HostUserCleanupLock, 0, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{removedUser}, cleaned)
+	assert.Equal(t, []string{"usermod -L -e 1 " + removedUser}, hostCommandsOtherThanVisudo(*commands))
+
+	exists, _ := afero.Exists(fs, path.Join(hostEtcDir, "sudoers.d", "containership-"+removedUser))
+	assert.False(t, exists)
+	assert.Equal(t, "root ALL=(ALL) ALL\n", readHostFile(t, fs, "sudoers"))
+	assert.Equal(t, 1, len(*commands)-len(hostCommandsOtherThanVisudo(*commands)), "sudoers is checked before it's replaced")
+	exists, _ = afero.DirExists(fs, getHomeDir(removedUser))
+	assert.True(t, exists, "home is kept")
+
+	// Locked users aren't locked again
+	assert.Nil(t, afero.WriteFile(fs, path.Join(hostEtcDir, "shadow"),
+		[]byte(removedUser+":!!:17000:0:99999:7::1:\n"), 0640))
+	*commands = (*commands)[:0]
+	cleaned, err = cleanupHostUsers(fs, testKeptUsers, newTestUsernames(t, testKeptUsers...), HostUserCleanupLock, 0, time.Now())
+	assert.Nil(t, err)
+	assert.Empty(t, cleaned)
+	assert.Empty(t, *commands)
+}
+
+func TestCleanupHostUsersDelete(t *testing.T) {
+	commands, restore := fakeHostCommands()
+	defer restore()
+	fs := newHostUsersFs(t)
+
+	cleaned, err := cleanupHostUsers(fs, testKeptUsers, newTestUsernames(t, testKeptUsers...), HostUserCleanupDelete, 0, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{removedUser}, cleaned)
+	assert.Equal(t, []string{"userdel -r " + removedUser}, hostCommandsOtherThanVisudo(*commands))
+
+	exists, _ := afero.Exists(fs, path.Join(hostEtcDir, "sudoers.d", "containership-"+removedUser))
+	assert.False(t, exists)
+	assert.Equal(t, "root ALL=(ALL) ALL\n", readHostFile(t, fs, "sudoers"))
+
+	info, err := fs.Stat(path.Join(hostEtcDir, "sudoers"))
+	assert.Nil(t, err)
+	assert.Equal(t, "-rw-r-----", info.Mode().String(), "permissions are kept")
+}
+
+func TestDeleteHostUsersChecksHomeDir(t *testing.T) {
+	commands, restore := fakeHostCommands()
+	defer restore()
+	fs := newHostUsersFs(t)
+
+	for _, home := range []string{"/root", "/etc/containership/home", "/etc/containership/home/../../../root"} {
+		deleted, err := deleteHostUsers(fs, map[string]string{removedUser: home})
+		assert.NotNil(t, err, home)
+		assert.Empty(t, deleted, home)
+	}
+	assert.Empty(t, *commands, "userdel is never run")
+}
+
+func TestCleanupHostUsersHostCommandFails(t *testing.T) {
+	_, restore := fakeHostCommands("usermod")
+	defer restore()
+	fs := newHostUsersFs(t)
+
+	cleaned, err := cleanupHostUsers(fs, testKeptUsers, newTestUsernames(t, testKeptUsers...), HostUserCleanupLock, 0, time.Now())
+	assert.NotNil(t, err)
+	assert.Empty(t, cleaned)
+}
+
+func TestEditHostSudoersRejectedByVisudo(t *testing.T) {
+	_, restore := fakeHostCommands("visudo")
+	defer restore()
+	fs := newHostUsersFs(t)
+
+	err := removeHostSudoers(fs, map[string]string{removedUser: getHomeDir(removedUser)})
+	assert.NotNil(t, err)
+	assert.Equal(t, "root ALL=(ALL) ALL\n"+removedUser+" ALL=(ALL) NOPASSWD:ALL\n", readHostFile(t, fs, "sudoers"))
+
+	files, err := afero.ReadDir(fs, hostEtcDir)
+	assert.Nil(t, err)
+	for _, f := range files {
+		assert.False(t, strings.HasPrefix(f.Name(), ".containership-"), "temp file is removed")
+	}
+}
+
+func TestCleanupHostUsersNone(t *testing.T) {
+	commands, restore := fakeHostCommands()
+	defer restore()
+	fs := newHostUsersFs(t)
+
+	cleaned, err := cleanupHostUsers(fs, nil, newTestUsernames(t, testKeptUsers...), HostUserCleanupNone, 0, time.Now())
+	assert.Nil(t, err)
+	assert.Empty(t, cleaned)
+	assert.Empty(t, *commands)
+
+	_, err = cleanupHostUsers(afero.NewMemMapFs(), nil, newTestUsernames(t, testKeptUsers...), HostUserCleanupLock, 0, time.Now())
+	assert.Equal(t, ErrHostEtcNotMounted, err)
+}
+
+func TestCleanupHostUsersMappedUsernames(t *testing.T) {
+	_, restore := fakeHostCommands()
+	defer restore()
+	fs := afero.NewMemMapFs()
+	passwd := `jane:x:1001:1001::/etc/containership/home/jane:/bin/sh
+john:x:1002:1002::/etc/containership/home/john:/bin/sh
+ubuntu:x:1000:1000::/home/ubuntu:/bin/sh
+other:x:1003:1003::/etc/containership/home/other:/bin/sh
+`
+	assert.Nil(t, afero.WriteFile(fs, path.Join(hostEtcDir, "passwd"), []byte(passwd), 0644))
+	assert.Nil(t, afero.WriteFile(fs, path.Join(hostEtcDir, "shadow"), []byte(`jane:!:17000:0:99999:7:::
+john:!:17000:0:99999:7:::
+ubuntu:!:17000:0:99999:7:::
+other:!:17000:0:99999:7:::
+`), 0640))
+
+	usernames, err := NewUsernameMapping(map[string]string{"id-1": "jane", "id-2": "john"})
+	assert.Nil(t, err)
+
+	cleaned, err := cleanupHostUsers(fs, []v3.UserSpec{{ID: "id-1"}}, usernames, HostUserCleanupLock, 0, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"john"}, cleaned, "only host users of removed users with a username are cleaned up")
+}
+
+func TestCleanupHostUsersGracePeriod(t *testing.T) {
+	commands, restore := fakeHostCommands()
+	defer restore()
+	fs := newHostUsersFs(t)
+	usernames := newTestUsernames(t, testKeptUsers...)
+	now := time.Now()
+
+	cleaned, err := cleanupHostUsers(fs, testKeptUsers, usernames, HostUserCleanupLock, time.Hour, now)
+	assert.Nil(t, err)
+	assert.Empty(t, cleaned, "users that were just removed are kept")
+	assert.Empty(t, *commands)
+
+	cleaned, err = cleanupHostUsers(fs, testKeptUsers, usernames, HostUserCleanupLock, time.Hour, now.Add(30*time.Minute))
+	assert.Nil(t, err)
+	assert.Empty(t, cleaned)
+
+	cleaned, err = cleanupHostUsers(fs, testKeptUsers, usernames, HostUserCleanupLock, time.Hour, now.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{removedUser}, cleaned)
+}
+
+func TestCleanupHostUsersGracePeriodRestartsForReturningUsers(t *testing.T) {
+	_, restore := fakeHostCommands()
+	defer restore()
+	fs := newHostUsersFs(t)
+	now := time.Now()
+
+	removed := v3.UserSpec{ID: "00000000-1111-2222-3333-000000000002"}
+	all := append([]v3.UserSpec{removed}, testKeptUsers...)
+	usernames := newTestUsernames(t, all...)
+
+	cleaned, err := cleanupHostUsers(fs, testKeptUsers, usernames, HostUserCleanupLock, time.Hour, now)
+	assert.Nil(t, err)
+	assert.Empty(t, cleaned)
+
+	// The user came back before the grace period was over
+	cleaned, err = cleanupHostUsers(fs, all, usernames, HostUserCleanupLock, time.Hour, now.Add(30*time.Minute))
+	assert.Nil(t, err)
+	assert.Empty(t, cleaned)
+
+	cleaned, err = cleanupHostUsers(fs, testKeptUsers, usernames, HostUserCleanupLock, time.Hour, now.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Empty(t, cleaned, "the grace period starts over")
+}
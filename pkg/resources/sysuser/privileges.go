@@ -0,0 +1,404 @@
+package sysuser
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	v3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/log"
+	"github.com/containership/cluster-manager/pkg/tools/fsutil"
+)
+
+const (
+	// Host
+	sudoersDirPermissions = os.ModeDir | os.FileMode(0750)
+	sudoersPermissions    = os.FileMode(0440)
+	groupsDirPermissions  = os.ModeDir | os.FileMode(0755)
+	groupsPermissions     = os.FileMode(0644)
+)
+
+// hostSudoersPrefix is the prefix of the sudoers drop-ins the login script
+// installs in the host /etc/sudoers.d
+const hostSudoersPrefix = "containership-"
+
+// ErrSudoersDirNotIncluded is returned when the host sudoers drop-ins can't
+// be written because the host sudoers doesn't include /etc/sudoers.d
+var ErrSudoersDirNotIncluded = fmt.Errorf("host sudoers does not include /etc/sudoers.d")
+
+// validGroupName matches the group names that are safe to pass to the
+// login script
+var validGroupName = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+// privilegedGroups are the groups whose members have root or near-root
+// access, e.g. through sudo, raw disks or the Docker socket. Only users with
+// full sudo access may be members, since membership would otherwise bypass
+// their sudo level.
+var privilegedGroups = map[string]bool{
+	"root":   true,
+	"sudo":   true,
+	"wheel":  true,
+	"admin":  true,
+	"adm":    true,
+	"disk":   true,
+	"kmem":   true,
+	"shadow": true,
+	"docker": true,
+	"lxd":    true,
+}
+
+// WritePrivileges writes a sudoers drop-in and a groups file for each of the
+// given users and removes the files of every other user. The login script
+// applies them to the host user each time the user logs in.
+func WritePrivileges(users []v3.UserSpec, usernames *UsernameMapping) error {
+	return writePrivileges(osFs, users, usernames)
+}
+
+// writePrivileges is the same as WritePrivileges but takes a filesystem
+// argument for testing purposes.
+func writePrivileges(fs afero.Fs, users []v3.UserSpec, usernames *UsernameMapping) error {
+	err := fsutil.EnsureDirExistsWithCorrectPermissions(fs, getSudoersDir(), sudoersDirPermissions)
+	if err != nil {
+		return err
+	}
+
+	err = fsutil.EnsureDirExistsWithCorrectPermissions(fs, getGroupsDir(), groupsDirPermissions)
+	if err != nil {
+		return err
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	sudoers := make(map[string]bool)
+	groups := make(map[string]bool)
+	for _, u := range users {
+		username, err := usernames.Username(u.ID)
+		if err != nil {
+			log.Errorf("Ignoring privileges of user %s: %s", u.ID, err)
+			continue
+		}
+
+		if s := buildSudoersString(u, username); s != "" {
+			err := fsutil.WriteFileAtomic(fs, path.Join(getSudoersDir(), username), []byte(s), sudoersPermissions)
+			if err != nil {
+				return err
+			}
+			sudoers[username] = true
+		}
+
+		if s := buildGroupsString(u); s != "" {
+			err := fsutil.WriteFileAtomic(fs, path.Join(getGroupsDir(), username), []byte(s), groupsPermissions)
+			if err != nil {
+				return err
+			}
+			groups[username] = true
+		}
+	}
+
+	if err := removeFilesExcept(fs, getSudoersDir(), sudoers); err != nil {
+		return err
+	}
+
+	return removeFilesExcept(fs, getGroupsDir(), groups)
+}
+
+// WriteHostSudoers brings the sudoers drop-ins the login script installed in
+// the host /etc/sudoers.d up to date with the sudo access of the given users,
+// so that reduced or removed sudo access takes effect without the user
+// logging in again. Drop-ins of every other user are removed. New drop-ins
+// are only written for users with the full sudo access older login scripts
+// added to the host sudoers, which is then removed.
+func WriteHostSudoers(users []v3.UserSpec, usernames *UsernameMapping) error {
+	return writeHostSudoers(osFs, users, usernames)
+}
+
+// writeHostSudoers is the same as WriteHostSudoers but takes a filesystem
+// argument for testing purposes.
+func writeHostSudoers(fs afero.Fs, users []v3.UserSpec, usernames *UsernameMapping) error {
+	if exists, _ := afero.DirExists(fs, hostEtcDir); !exists {
+		return ErrHostEtcNotMounted
+	}
+
+	// Drop-ins have no effect otherwise, and the legacy lines must be kept
+	included, err := sudoersIncludesDir(fs)
+	if err != nil {
+		return err
+	}
+	if !included {
+		return ErrSudoersDirNotIncluded
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	legacy, err := legacySudoersUsers(fs)
+	if err != nil {
+		return err
+	}
+
+	dir := getHostSudoersDir()
+	installed := make(map[string]bool)
+	files, err := afero.ReadDir(fs, dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), hostSudoersPrefix) {
+			installed[strings.TrimPrefix(f.Name(), hostSudoersPrefix)] = true
+		}
+	}
+
+	sudoers := make(map[string]string)
+	for _, u := range users {
+		username, err := usernames.Username(u.ID)
+		if err != nil {
+			continue
+		}
+
+		if installed[username] || legacy[username] {
+			sudoers[username] = buildSudoersString(u, username)
+		}
+	}
+
+	for name := range installed {
+		if _, ok := sudoers[name]; ok || !isContainershipUsername(name, usernames) {
+			continue
+		}
+
+		if err := fs.Remove(path.Join(dir, hostSudoersPrefix+name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	for name, s := range sudoers {
+		filename := path.Join(dir, hostSudoersPrefix+name)
+		if s == "" {
+			if err := fs.Remove(filename); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+
+		if current, err := afero.ReadFile(fs, filename); err == nil && string(current) == s {
+			continue
+		}
+
+		if err := writeHostSudoersFile(fs, filename, s, sudoersPermissions); err != nil {
+			return err
+		}
+	}
+
+	// The drop-ins replace the legacy lines
+	return editHostSudoers(fs, func(line string) bool {
+		for name := range sudoers {
+			if line == buildLegacySudoersLine(name) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// writeHostSudoersFile atomically writes a file of the host sudoers
+// configuration. It's first written to a temporary file, which sudo ignores
+// in sudoers.d since its name contains a dot, and only replaces filename once
+// the host visudo accepts it, since a sudoers file that doesn't parse breaks
+// sudo for everyone. The temporary file is removed if any step fails.
+func writeHostSudoersFile(fs afero.Fs, filename string, s string, perms os.FileMode) (err error) {
+	dir := path.Dir(filename)
+	if err = fs.MkdirAll(dir, sudoersDirPermissions); err != nil {
+		return err
+	}
+
+	tmpFile, err := afero.TempFile(fs, dir, ".containership-")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+
+	defer func() {
+		if err != nil {
+			tmpFile.Close()
+			fs.Remove(tmpName)
+		}
+	}()
+
+	if err = fs.Chmod(tmpName, perms); err != nil {
+		return err
+	}
+
+	if _, err = tmpFile.WriteString(s); err != nil {
+		return err
+	}
+
+	if err = tmpFile.Sync(); err != nil {
+		return err
+	}
+
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if err = runHostCommand("visudo", "-cf", getHostEtcPath(tmpName)); err != nil {
+		return fmt.Errorf("host visudo rejected %s: %s", getHostEtcPath(filename), err)
+	}
+
+	if err = fs.Rename(tmpName, filename); err != nil {
+		return err
+	}
+
+	return fsutil.SyncDir(fs, dir)
+}
+
+// sudoersIncludesDir returns true if the host sudoers includes the drop-ins
+// in /etc/sudoers.d
+func sudoersIncludesDir(fs afero.Fs) (bool, error) {
+	data, err := afero.ReadFile(fs, path.Join(hostEtcDir, "sudoers"))
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && (fields[0] == "#includedir" || fields[0] == "@includedir") &&
+			strings.TrimSuffix(fields[1], "/") == "/etc/sudoers.d" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// legacySudoersUsers returns the users given full sudo access in the host
+// sudoers itself by older login scripts
+func legacySudoersUsers(fs afero.Fs) (map[string]bool, error) {
+	data, err := afero.ReadFile(fs, path.Join(hostEtcDir, "sudoers"))
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && line == buildLegacySudoersLine(fields[0]) {
+			users[fields[0]] = true
+		}
+	}
+
+	return users, nil
+}
+
+// buildLegacySudoersLine returns the line older login scripts added to the
+// host sudoers for the user
+func buildLegacySudoersLine(username string) string {
+	return username + " ALL=(ALL) NOPASSWD:ALL"
+}
+
+// removeFilesExcept removes every file in the directory that isn't kept
+func removeFilesExcept(fs afero.Fs, dir string, keep map[string]bool) error {
+	files, err := afero.ReadDir(fs, dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || keep[f.Name()] {
+			continue
+		}
+
+		if err := fs.Remove(path.Join(dir, f.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// buildSudoersString builds the sudoers drop-in for a single user. It returns
+// an empty string if the user may not run sudo.
+func buildSudoersString(user v3.UserSpec, username string) string {
+	switch user.Sudo {
+	case "", v3.SudoFull:
+		return fmt.Sprintf("%s ALL=(ALL) NOPASSWD:ALL\n", username)
+
+	case v3.SudoRestricted:
+		commands := make([]string, 0)
+		for _, command := range user.SudoCommands {
+			if !strings.HasPrefix(command, "/") || strings.ContainsAny(command, "\n\r") {
+				log.Errorf("Ignoring invalid sudo command %q of user %s", command, user.ID)
+				continue
+			}
+
+			commands = append(commands, escapeSudoersCommand(command))
+		}
+
+		if len(commands) == 0 {
+			return ""
+		}
+
+		return fmt.Sprintf("%s ALL=(ALL) NOPASSWD: %s\n", username, strings.Join(commands, ", "))
+
+	case v3.SudoNone:
+		return ""
+
+	default:
+		log.Errorf("Unknown sudo level %q of user %s, not allowing sudo", user.Sudo, user.ID)
+		return ""
+	}
+}
+
+// escapeSudoersCommand escapes the characters that are special in a sudoers
+// command
+func escapeSudoersCommand(command string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		`,`, `\,`,
+		`:`, `\:`,
+		`=`, `\=`,
+	).Replace(command)
+}
+
+// buildGroupsString builds the groups file for a single user, with one group
+// per line. Privileged groups are only included for users with full sudo
+// access.
+func buildGroupsString(user v3.UserSpec) string {
+	fullSudo := user.Sudo == "" || user.Sudo == v3.SudoFull
+
+	s := ""
+	for _, group := range user.Groups {
+		if !validGroupName.MatchString(group) {
+			log.Errorf("Ignoring invalid group %q of user %s", group, user.ID)
+			continue
+		}
+
+		if privilegedGroups[group] && !fullSudo {
+			log.Errorf("Ignoring privileged group %q of user %s without full sudo access", group, user.ID)
+			continue
+		}
+
+		s += group + "\n"
+	}
+
+	return s
+}
+
+// getSudoersDir returns the directory of the sudoers drop-ins of users
+func getSudoersDir() string {
+	return path.Join(constants.ContainershipMount, "sudoers.d")
+}
+
+// getHostSudoersDir returns where the host /etc/sudoers.d is mounted
+func getHostSudoersDir() string {
+	return path.Join(hostEtcDir, "sudoers.d")
+}
+
+// getGroupsDir returns the directory of the groups files of users
+func getGroupsDir() string {
+	return path.Join(constants.ContainershipMount, "groups")
+}
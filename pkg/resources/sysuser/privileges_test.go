@@ -0,0 +1,185 @@
+package sysuser
+
+import (
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+)
+
+func TestBuildSudoersString(t *testing.T) {
+	user := v3.UserSpec{ID: "00000000-1111-2222-3333-000000000001"}
+	assert.Equal(t, "00000000111122223333000000000001 ALL=(ALL) NOPASSWD:ALL\n",
+		buildSudoersString(user, testUsername(t, user)), "full sudo by default")
+
+	user.Sudo = v3.SudoFull
+	assert.Equal(t, "00000000111122223333000000000001 ALL=(ALL) NOPASSWD:ALL\n",
+		buildSudoersString(user, testUsername(t, user)))
+
+	user.Sudo = v3.SudoRestricted
+	user.SudoCommands = []string{
+		"/usr/bin/systemctl restart kubelet",
+		"docker ps",
+		"/usr/bin/env A=b,c:d",
+		"/bin/true\nroot ALL=(ALL) ALL",
+	}
+	assert.Equal(t, "00000000111122223333000000000001 ALL=(ALL) NOPASSWD: "+
+		`/usr/bin/systemctl restart kubelet, /usr/bin/env A\=b\,c\:d`+"\n",
+		buildSudoersString(user, testUsername(t, user)))
+
+	user.SudoCommands = nil
+	assert.Empty(t, buildSudoersString(user, testUsername(t, user)), "no commands allowed")
+
+	user.Sudo = v3.SudoNone
+	assert.Empty(t, buildSudoersString(user, testUsername(t, user)))
+
+	user.Sudo = "unknown"
+	assert.Empty(t, buildSudoersString(user, testUsername(t, user)))
+}
+
+func TestBuildGroupsString(t *testing.T) {
+	user := v3.UserSpec{
+		ID:     "00000000-1111-2222-3333-000000000001",
+		Groups: []string{"docker", "adm", "$(reboot)", "systemd-journal"},
+	}
+	assert.Equal(t, "docker\nadm\nsystemd-journal\n", buildGroupsString(user))
+
+	// Privileged groups would bypass reduced sudo access
+	user.Groups = []string{"sudo", "wheel", "root", "adm", "disk", "docker", "systemd-journal"}
+	user.Sudo = v3.SudoFull
+	assert.Equal(t, "sudo\nwheel\nroot\nadm\ndisk\ndocker\nsystemd-journal\n", buildGroupsString(user))
+	user.Sudo = v3.SudoRestricted
+	assert.Equal(t, "systemd-journal\n", buildGroupsString(user))
+	user.Sudo = v3.SudoNone
+	assert.Equal(t, "systemd-journal\n", buildGroupsString(user))
+
+	user.Groups = nil
+	assert.Empty(t, buildGroupsString(user))
+}
+
+func TestWritePrivileges(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	full := v3.UserSpec{
+		ID:     "00000000-1111-2222-3333-000000000001",
+		Groups: []string{"docker"},
+	}
+	none := v3.UserSpec{
+		ID:   "00000000-1111-2222-3333-000000000002",
+		Sudo: v3.SudoNone,
+	}
+
+	usernames := newTestUsernames(t, full, none)
+	err := writePrivileges(fs, []v3.UserSpec{full, none}, usernames)
+	assert.Nil(t, err)
+
+	fullSudoers := path.Join(getSudoersDir(), "00000000111122223333000000000001")
+	fullGroups := path.Join(getGroupsDir(), "00000000111122223333000000000001")
+	noneSudoers := path.Join(getSudoersDir(), "00000000111122223333000000000002")
+	noneGroups := path.Join(getGroupsDir(), "00000000111122223333000000000002")
+
+	info, err := fs.Stat(fullSudoers)
+	assert.Nil(t, err)
+	assert.Equal(t, sudoersPermissions.String(), info.Mode().String())
+
+	match, err := afero.FileContainsBytes(fs, fullGroups, []byte("docker\n"))
+	assert.Nil(t, err)
+	assert.True(t, match)
+
+	exists, _ := afero.Exists(fs, noneSudoers)
+	assert.False(t, exists)
+	exists, _ = afero.Exists(fs, noneGroups)
+	assert.False(t, exists)
+
+	// Removed users have their files removed
+	err = writePrivileges(fs, []v3.UserSpec{none}, usernames)
+	assert.Nil(t, err)
+
+	exists, _ = afero.Exists(fs, fullSudoers)
+	assert.False(t, exists)
+	exists, _ = afero.Exists(fs, fullGroups)
+	assert.False(t, exists)
+}
+
+func TestWriteHostSudoers(t *testing.T) {
+	commands, restore := fakeHostCommands()
+	defer restore()
+	fs := afero.NewMemMapFs()
+
+	full := v3.UserSpec{ID: "00000000-1111-2222-3333-000000000001"}
+	none := v3.UserSpec{
+		ID:   "00000000-1111-2222-3333-000000000002",
+		Sudo: v3.SudoNone,
+	}
+	legacy := v3.UserSpec{
+		ID:           "00000000-1111-2222-3333-000000000003",
+		Sudo:         v3.SudoRestricted,
+		SudoCommands: []string{"/usr/bin/docker ps"},
+	}
+	notLoggedIn := v3.UserSpec{ID: "00000000-1111-2222-3333-000000000004"}
+	removed := v3.UserSpec{ID: "00000000-1111-2222-3333-000000000005"}
+	usernames := newTestUsernames(t, full, none, legacy, notLoggedIn, removed)
+
+	assert.Equal(t, ErrHostEtcNotMounted, writeHostSudoers(fs, []v3.UserSpec{full}, usernames))
+
+	sudoers := "root ALL=(ALL) ALL\n" +
+		buildLegacySudoersLine(testUsername(t, legacy)) + "\n"
+	assert.Nil(t, afero.WriteFile(fs, path.Join(hostEtcDir, "sudoers"), []byte(sudoers), 0440))
+
+	// The legacy lines are kept if the drop-ins have no effect
+	assert.Equal(t, ErrSudoersDirNotIncluded, writeHostSudoers(fs, []v3.UserSpec{legacy}, usernames))
+
+	sudoers = "#includedir /etc/sudoers.d\n" + sudoers
+	assert.Nil(t, afero.WriteFile(fs, path.Join(hostEtcDir, "sudoers"), []byte(sudoers), 0440))
+
+	dropIn := func(user v3.UserSpec) string {
+		return path.Join(getHostSudoersDir(), hostSudoersPrefix+testUsername(t, user))
+	}
+	for _, u := range []v3.UserSpec{full, none, removed} {
+		assert.Nil(t, afero.WriteFile(fs, dropIn(u), []byte(buildLegacySudoersLine(testUsername(t, u))+"\n"), 0440))
+	}
+	other := path.Join(getHostSudoersDir(), "other")
+	assert.Nil(t, afero.WriteFile(fs, other, []byte("other ALL=(ALL) ALL\n"), 0440))
+
+	err := writeHostSudoers(fs, []v3.UserSpec{full, none, legacy, notLoggedIn}, usernames)
+	assert.Nil(t, err)
+
+	data, err := afero.ReadFile(fs, dropIn(full))
+	assert.Nil(t, err)
+	assert.Equal(t, buildSudoersString(full, testUsername(t, full)), string(data))
+
+	// Sudo access that was removed is removed from the host right away
+	exists, _ := afero.Exists(fs, dropIn(none))
+	assert.False(t, exists)
+	exists, _ = afero.Exists(fs, dropIn(removed))
+	assert.False(t, exists)
+
+	// The legacy line is replaced by a drop-in
+	data, err = afero.ReadFile(fs, dropIn(legacy))
+	assert.Nil(t, err)
+	assert.Equal(t, buildSudoersString(legacy, testUsername(t, legacy)), string(data))
+	data, err = afero.ReadFile(fs, path.Join(hostEtcDir, "sudoers"))
+	assert.Nil(t, err)
+	assert.Equal(t, "#includedir /etc/sudoers.d\nroot ALL=(ALL) ALL\n", string(data))
+
+	// Drop-ins are only installed on login
+	exists, _ = afero.Exists(fs, dropIn(notLoggedIn))
+	assert.False(t, exists)
+
+	exists, _ = afero.Exists(fs, other)
+	assert.True(t, exists)
+
+	files, err := afero.ReadDir(fs, getHostSudoersDir())
+	assert.Nil(t, err)
+	assert.Len(t, files, 3, "no temporary files are left")
+
+	// Every file is checked with the host visudo before it's written
+	assert.NotEmpty(t, *commands)
+	for _, c := range *commands {
+		assert.True(t, strings.HasPrefix(c, "visudo -cf /etc/"), c)
+	}
+}
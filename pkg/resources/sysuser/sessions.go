@@ -0,0 +1,206 @@
+package sysuser
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/containership/cluster-manager/pkg/constants"
+	"github.com/containership/cluster-manager/pkg/log"
+	"github.com/containership/cluster-manager/pkg/tools/fsutil"
+)
+
+const (
+	// Host
+	sessionsDirPermissions = os.ModeDir | os.FileMode(0700)
+	auditLogPermissions    = os.FileMode(0600)
+
+	// The agent shares the host PID namespace, so these are host processes
+	procDir = "/proc"
+)
+
+const (
+	// SessionStart is the event of a record written when a session starts
+	SessionStart = "start"
+	// SessionEnd is the event of a record written when a session ends
+	SessionEnd = "end"
+)
+
+// SessionRecord is the start or end of an SSH session, as recorded by the
+// login script
+type SessionRecord struct {
+	Event       string    `json:"event"`
+	SessionID   string    `json:"session_id"`
+	Username    string    `json:"username"`
+	UserID      string    `json:"user_id"`
+	Fingerprint string    `json:"fingerprint"`
+	SourceIP    string    `json:"source_ip"`
+	Time        time.Time `json:"time"`
+	Node        string    `json:"node,omitempty"`
+
+	// PID is the process of the login script, which lives as long as the
+	// session. It's zero for records of older login scripts.
+	PID int `json:"pid,omitempty"`
+
+	// filename is the spool file the record was read from
+	filename string
+}
+
+// ReadSessionRecords returns the session records the login script spooled
+// that haven't been removed yet, oldest first. Invalid records, including
+// records of usernames that don't belong to any user, are removed.
+func ReadSessionRecords(usernames *UsernameMapping) ([]SessionRecord, error) {
+	return readSessionRecords(osFs, usernames)
+}
+
+// readSessionRecords is the same as ReadSessionRecords but takes a filesystem
+// argument for testing purposes.
+func readSessionRecords(fs afero.Fs, usernames *UsernameMapping) ([]SessionRecord, error) {
+	err := fsutil.EnsureDirExistsWithCorrectPermissions(fs, getSessionsDir(), sessionsDirPermissions)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := afero.ReadDir(fs, getSessionsDir())
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]SessionRecord, 0)
+	for _, f := range files {
+		// The login script writes records to dotfiles and renames them once
+		// they're complete
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+
+		filename := path.Join(getSessionsDir(), f.Name())
+		record, err := readSessionRecord(fs, filename, usernames)
+		if err != nil {
+			log.Errorf("Removing invalid session record %s: %s", f.Name(), err)
+			if err := fs.Remove(filename); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		records = append(records, record)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+
+	return records, nil
+}
+
+// readSessionRecord reads and validates a single spooled session record
+func readSessionRecord(fs afero.Fs, filename string, usernames *UsernameMapping) (SessionRecord, error) {
+	var record SessionRecord
+
+	data, err := afero.ReadFile(fs, filename)
+	if err != nil {
+		return record, err
+	}
+
+	if err := json.Unmarshal(data, &record); err != nil {
+		return record, err
+	}
+
+	if record.Event != SessionStart && record.Event != SessionEnd {
+		return record, fmt.Errorf("unknown event %q", record.Event)
+	}
+
+	record.UserID, err = usernames.UserID(record.Username)
+	if err != nil {
+		return record, err
+	}
+
+	record.filename = filename
+
+	return record, nil
+}
+
+// RemoveSessionRecord removes a record from the spool once it has been
+// handled
+func RemoveSessionRecord(record SessionRecord) error {
+	return removeSessionRecord(osFs, record)
+}
+
+// removeSessionRecord is the same as RemoveSessionRecord but takes a
+// filesystem argument for testing purposes.
+func removeSessionRecord(fs afero.Fs, record SessionRecord) error {
+	err := fs.Remove(record.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// AppendSessionRecord appends a record to an audit log file as a single line
+// of JSON
+func AppendSessionRecord(filename string, record SessionRecord) error {
+	return appendSessionRecord(osFs, filename, record)
+}
+
+// appendSessionRecord is the same as AppendSessionRecord but takes a
+// filesystem argument for testing purposes.
+func appendSessionRecord(fs afero.Fs, filename string, record SessionRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f, err := fs.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, auditLogPermissions)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// SessionProcessExists returns false if the login script process of the
+// session no longer exists, e.g. because it was killed before it could
+// record the end of the session. Sessions whose process isn't known are
+// assumed to exist.
+func SessionProcessExists(record SessionRecord) bool {
+	return sessionProcessExists(osFs, record)
+}
+
+// sessionProcessExists is the same as SessionProcessExists but takes a
+// filesystem argument for testing purposes.
+func sessionProcessExists(fs afero.Fs, record SessionRecord) bool {
+	if record.PID <= 0 {
+		return true
+	}
+
+	cmdline, err := afero.ReadFile(fs, path.Join(procDir, strconv.Itoa(record.PID), "cmdline"))
+	if os.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		// Better to keep reporting the session than to hide it
+		log.Errorf("Error checking process of SSH session %s: %s", record.SessionID, err)
+		return true
+	}
+
+	// The PID may have been reused by another process
+	return strings.Contains(string(cmdline), loginScriptFilename) &&
+		strings.Contains(string(cmdline), record.Username)
+}
+
+// getSessionsDir returns the directory the login script spools session
+// records to
+func getSessionsDir() string {
+	return path.Join(constants.ContainershipMount, "sessions")
+}
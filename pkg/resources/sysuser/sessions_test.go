@@ -0,0 +1,111 @@
+package sysuser
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+)
+
+const testSessionStart = `{"event":"start","session_id":"1","username":"00000000111122223333000000000001",` +
+	`"fingerprint":"00:11:22","source_ip":"10.0.0.1","time":"2018-10-01T12:00:00Z"}`
+
+const testSessionEnd = `{"event":"end","session_id":"1","username":"00000000111122223333000000000001",` +
+	`"fingerprint":"00:11:22","source_ip":"10.0.0.1","time":"2018-10-01T12:30:00Z"}`
+
+// testSessionUsernames maps the user of the test sessions
+func testSessionUsernames(t *testing.T) *UsernameMapping {
+	return newTestUsernames(t, v3.UserSpec{ID: "00000000-1111-2222-3333-000000000001"})
+}
+
+func writeSessionRecord(t *testing.T, fs afero.Fs, name, data string) {
+	err := afero.WriteFile(fs, path.Join(getSessionsDir(), name), []byte(data), 0600)
+	assert.Nil(t, err)
+}
+
+func TestReadSessionRecords(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	records, err := readSessionRecords(fs, testSessionUsernames(t))
+	assert.Nil(t, err)
+	assert.Empty(t, records)
+
+	writeSessionRecord(t, fs, "b", testSessionEnd)
+	writeSessionRecord(t, fs, "a", testSessionStart)
+	writeSessionRecord(t, fs, ".c", testSessionStart)
+	writeSessionRecord(t, fs, "invalid", `{"event":"start","username":"root"}`)
+	writeSessionRecord(t, fs, "unknown", `{"event":"start","username":"00000000111122223333000000000002"}`)
+	writeSessionRecord(t, fs, "garbage", "{")
+
+	records, err = readSessionRecords(fs, testSessionUsernames(t))
+	assert.Nil(t, err)
+	assert.Len(t, records, 2, "incomplete and invalid records are skipped")
+
+	assert.Equal(t, SessionStart, records[0].Event)
+	assert.Equal(t, SessionEnd, records[1].Event, "records are sorted by time")
+	assert.Equal(t, "00000000-1111-2222-3333-000000000001", records[0].UserID)
+	assert.Equal(t, "00:11:22", records[0].Fingerprint)
+	assert.Equal(t, "10.0.0.1", records[0].SourceIP)
+	assert.Equal(t, time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC), records[0].Time)
+
+	exists, _ := afero.Exists(fs, path.Join(getSessionsDir(), "invalid"))
+	assert.False(t, exists, "invalid records are removed")
+
+	assert.Nil(t, removeSessionRecord(fs, records[0]))
+	assert.Nil(t, removeSessionRecord(fs, records[0]), "removing twice is fine")
+
+	records, err = readSessionRecords(fs, testSessionUsernames(t))
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+}
+
+func TestAppendSessionRecord(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	writeSessionRecord(t, fs, "a", testSessionStart)
+
+	records, err := readSessionRecords(fs, testSessionUsernames(t))
+	assert.Nil(t, err)
+
+	record := records[0]
+	record.Node = "node-1"
+
+	filename := "/var/log/ssh-audit.log"
+	assert.Nil(t, appendSessionRecord(fs, filename, record))
+	assert.Nil(t, appendSessionRecord(fs, filename, record))
+
+	data, err := afero.ReadFile(fs, filename)
+	assert.Nil(t, err)
+
+	line := `{"event":"start","session_id":"1","username":"00000000111122223333000000000001",` +
+		`"user_id":"00000000-1111-2222-3333-000000000001","fingerprint":"00:11:22",` +
+		`"source_ip":"10.0.0.1","time":"2018-10-01T12:00:00Z","node":"node-1"}` + "\n"
+	assert.Equal(t, line+line, string(data))
+}
+
+func TestSessionProcessExists(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	record := SessionRecord{
+		SessionID: "1",
+		PID:       1234,
+		Username:  "00000000111122223333000000000001",
+	}
+
+	assert.False(t, sessionProcessExists(fs, record), "the process is gone")
+
+	cmdline := path.Join(procDir, "1234", "cmdline")
+	err := afero.WriteFile(fs, cmdline, []byte("/bin/sh\x00/etc/containership/scripts/containership_login.sh\x00"+
+		"00000000111122223333000000000001\x00certificate\x00"), 0444)
+	assert.Nil(t, err)
+	assert.True(t, sessionProcessExists(fs, record))
+
+	err = afero.WriteFile(fs, cmdline, []byte("nginx: worker process\x00"), 0444)
+	assert.Nil(t, err)
+	assert.False(t, sessionProcessExists(fs, record), "the PID was reused")
+
+	record.PID = 0
+	assert.True(t, sessionProcessExists(fs, record), "records of older login scripts have no PID")
+}
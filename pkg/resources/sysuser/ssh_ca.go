@@ -0,0 +1,205 @@
+package sysuser
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	v3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/log"
+	"github.com/containership/cluster-manager/pkg/resources/sshca"
+	"github.com/containership/cluster-manager/pkg/tools/fsutil"
+)
+
+const (
+	// Host
+	authorizedPrincipalsFilename = "authorized_principals"
+	trustedUserCAKeysFilename    = "trusted_user_ca_keys"
+	revokedKeysFilename          = "revoked_keys"
+	sshdConfigFilename           = "sshd_config"
+	sshCAFilePermissions         = os.FileMode(0644)
+
+	// hostSSHDConfig is the main sshd configuration file on the host
+	hostSSHDConfig = "/etc/ssh/sshd_config"
+	// maxSSHDConfigIncludeDepth is how deeply sshd_config includes are
+	// followed, which is as deep as sshd follows them
+	maxSSHDConfigIncludeDepth = 16
+
+	// certificateFingerprint is passed to the login script in place of a key
+	// fingerprint for certificate logins
+	certificateFingerprint = "certificate"
+)
+
+// WriteSSHCAConfig writes what sshd needs to accept certificates signed by
+// the cluster SSH CA instead of the keys in authorized_keys: the principal of
+// each of the given users, the CA public key and a key revocation list of the
+// revoked certificate serials. An sshd configuration snippet using them is
+// written alongside them to be included from the host sshd_config.
+func WriteSSHCAConfig(users []v3.UserSpec, usernames *UsernameMapping, caPublicKey string, revokedSerials []uint64) error {
+	return writeSSHCAConfig(osFs, users, usernames, caPublicKey, revokedSerials)
+}
+
+// writeSSHCAConfig is the same as WriteSSHCAConfig but takes a filesystem
+// argument for testing purposes.
+func writeSSHCAConfig(fs afero.Fs, users []v3.UserSpec, usernames *UsernameMapping, caPublicKey string, revokedSerials []uint64) error {
+	err := fsutil.EnsureDirExistsWithCorrectPermissions(fs, getSSHDir(), sshDirPermissions)
+	if err != nil {
+		return err
+	}
+
+	krl, err := sshca.BuildKRL(caPublicKey, revokedSerials)
+	if err != nil {
+		return err
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	// sshd refuses every key if the revoked keys file is missing, so it's
+	// written first
+	files := []struct {
+		name string
+		data string
+		perm os.FileMode
+	}{
+		{revokedKeysFilename, string(krl), sshCAFilePermissions},
+		{trustedUserCAKeysFilename, caPublicKey, sshCAFilePermissions},
+		{authorizedPrincipalsFilename, buildAllPrincipalsString(users, usernames), authorizedKeysPermissions},
+		{sshdConfigFilename, buildSSHDConfigString(), sshCAFilePermissions},
+	}
+
+	for _, f := range files {
+		err := fsutil.WriteFileAtomic(fs, path.Join(getSSHDir(), f.name), []byte(f.data), f.perm)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// buildAllPrincipalsString builds the authorized_principals contents. Each
+// user logs in with the principal of their certificate, which is their
+// username, and the login script is forced just like for authorized_keys.
+// Users that don't have a username yet are left out.
+func buildAllPrincipalsString(users []v3.UserSpec, usernames *UsernameMapping) string {
+	var b strings.Builder
+	for _, u := range users {
+		username, err := usernames.Username(u.ID)
+		if err != nil {
+			log.Errorf("Ignoring principal of user %s: %s", u.ID, err)
+			continue
+		}
+		fmt.Fprintf(&b, "command=\"%s %s %s\" %s\n",
+			getLoginScriptFullPath(), username, certificateFingerprint, username)
+	}
+
+	return b.String()
+}
+
+// buildSSHDConfigString builds the sshd configuration snippet that enables
+// the SSH CA files
+func buildSSHDConfigString() string {
+	return fmt.Sprintf(`# Written by the Containership agent. Include these options from the host
+# sshd_config in a Match block for the account users log in as.
+TrustedUserCAKeys %s
+RevokedKeys %s
+AuthorizedPrincipalsFile %s
+`,
+		getTrustedUserCAKeysFullPath(),
+		path.Join(getSSHDir(), revokedKeysFilename),
+		path.Join(getSSHDir(), authorizedPrincipalsFilename))
+}
+
+// GetSSHCASSHDConfigFullPath returns the full path to the sshd configuration
+// snippet that enables the SSH CA files
+func GetSSHCASSHDConfigFullPath() string {
+	return path.Join(getSSHDir(), sshdConfigFilename)
+}
+
+// getTrustedUserCAKeysFullPath returns the full path to the CA public key
+// file
+func getTrustedUserCAKeysFullPath() string {
+	return path.Join(getSSHDir(), trustedUserCAKeysFilename)
+}
+
+// SSHDTrustsCA returns true if the host sshd_config, or a file it includes
+// such as the snippet written by WriteSSHCAConfig, sets TrustedUserCAKeys to
+// the CA public key file. Users can't log in with certificates until it does,
+// and sshd must have been reloaded since for it to take effect. Only files in
+// the host /etc can be checked.
+func SSHDTrustsCA() (bool, error) {
+	return sshdTrustsCA(osFs)
+}
+
+// sshdTrustsCA is the same as SSHDTrustsCA but takes a filesystem argument
+// for testing purposes.
+func sshdTrustsCA(fs afero.Fs) (bool, error) {
+	if exists, _ := afero.DirExists(fs, hostEtcDir); !exists {
+		return false, ErrHostEtcNotMounted
+	}
+
+	return sshdConfigTrustsCA(fs, hostSSHDConfig, 0)
+}
+
+// sshdConfigTrustsCA returns true if the sshd configuration file on the host,
+// or a file it includes, sets TrustedUserCAKeys to the CA public key file
+func sshdConfigTrustsCA(fs afero.Fs, filename string, depth int) (bool, error) {
+	if depth > maxSSHDConfigIncludeDepth {
+		return false, nil
+	}
+
+	data, err := afero.ReadFile(fs, hostEtcPath(filename))
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		// Keywords may be separated from their arguments by an equals sign
+		fields := strings.Fields(strings.Replace(line, "=", " ", 1))
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch strings.ToLower(fields[0]) {
+		case "trustedusercakeys":
+			if fields[1] == getTrustedUserCAKeysFullPath() {
+				return true, nil
+			}
+
+		case "include":
+			for _, pattern := range fields[1:] {
+				// Relative includes are relative to /etc/ssh
+				if !path.IsAbs(pattern) {
+					pattern = path.Join(path.Dir(hostSSHDConfig), pattern)
+				}
+
+				if !strings.HasPrefix(pattern, "/etc/") {
+					continue
+				}
+
+				matches, err := afero.Glob(fs, hostEtcPath(pattern))
+				if err != nil {
+					continue
+				}
+
+				for _, m := range matches {
+					included := path.Join("/etc", strings.TrimPrefix(m, hostEtcDir))
+					if trusted, _ := sshdConfigTrustsCA(fs, included, depth+1); trusted {
+						return true, nil
+					}
+				}
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// hostEtcPath returns where a file in the host /etc is mounted
+func hostEtcPath(filename string) string {
+	return path.Join(hostEtcDir, strings.TrimPrefix(filename, "/etc"))
+}
@@ -0,0 +1,116 @@
+package sysuser
+
+import (
+	"path"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/resources/sshca"
+)
+
+func TestBuildAllPrincipalsString(t *testing.T) {
+	assert.Empty(t, buildAllPrincipalsString(nil, newTestUsernames(t, testUserOneKey)))
+
+	assert.Equal(t, `command="/etc/containership/scripts/containership_login.sh 00000000111122223333000000000001 certificate" 00000000111122223333000000000001
+`, buildAllPrincipalsString([]v3.UserSpec{testUserOneKey}, newTestUsernames(t, testUserOneKey)))
+}
+
+func TestWriteSSHCAConfig(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	_, caPublicKey, err := sshca.GenerateKey()
+	assert.Nil(t, err)
+
+	err = writeSSHCAConfig(fs, []v3.UserSpec{testUserOneKey}, newTestUsernames(t, testUserOneKey), "invalid", []uint64{1})
+	assert.NotNil(t, err, "a revocation list can't be built for an invalid CA")
+
+	err = writeSSHCAConfig(fs, []v3.UserSpec{testUserOneKey}, newTestUsernames(t, testUserOneKey), caPublicKey,
+		[]uint64{1, 2})
+	assert.Nil(t, err)
+
+	read := func(name string) string {
+		data, err := afero.ReadFile(fs, path.Join(getSSHDir(), name))
+		assert.Nil(t, err)
+		return string(data)
+	}
+
+	krl, err := sshca.BuildKRL(caPublicKey, []uint64{1, 2})
+	assert.Nil(t, err)
+
+	assert.Equal(t, caPublicKey, read(trustedUserCAKeysFilename))
+	// The generation time may differ, so only the revoked serials are
+	// compared
+	revoked := read(revokedKeysFilename)
+	assert.Equal(t, string(krl[len(krl)-16:]), revoked[len(revoked)-16:])
+	assert.Contains(t, read(authorizedPrincipalsFilename), "00000000111122223333000000000001 certificate")
+	assert.Contains(t, read(sshdConfigFilename),
+		"TrustedUserCAKeys /etc/containership/home/.ssh/trusted_user_ca_keys\n")
+
+	info, err := fs.Stat(path.Join(getSSHDir(), authorizedPrincipalsFilename))
+	assert.Nil(t, err)
+	assert.Equal(t, authorizedKeysPermissions, info.Mode())
+
+	// Nothing is allowed once every user is removed, but the revoked keys
+	// file must still exist
+	err = writeSSHCAConfig(fs, nil, newTestUsernames(t, testUserOneKey), "", nil)
+	assert.Nil(t, err)
+	assert.Empty(t, read(authorizedPrincipalsFilename))
+	assert.NotEmpty(t, read(revokedKeysFilename))
+}
+
+func TestSSHDTrustsCA(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	_, err := sshdTrustsCA(fs)
+	assert.Equal(t, ErrHostEtcNotMounted, err)
+
+	err = fs.MkdirAll(path.Join(hostEtcDir, "ssh", "sshd_config.d"), 0755)
+	assert.Nil(t, err)
+
+	_, err = sshdTrustsCA(fs)
+	assert.NotNil(t, err, "sshd_config doesn't exist")
+
+	write := func(filename, data string) {
+		err := afero.WriteFile(fs, path.Join(hostEtcDir, filename), []byte(data), 0644)
+		assert.Nil(t, err)
+	}
+
+	write("ssh/sshd_config", "PermitRootLogin no\n# TrustedUserCAKeys /etc/containership/home/.ssh/trusted_user_ca_keys\n")
+	trusted, err := sshdTrustsCA(fs)
+	assert.Nil(t, err)
+	assert.False(t, trusted, "comments are ignored")
+
+	write("ssh/sshd_config", "TrustedUserCAKeys /etc/ssh/other_ca\n")
+	trusted, err = sshdTrustsCA(fs)
+	assert.Nil(t, err)
+	assert.False(t, trusted, "other CAs don't count")
+
+	write("ssh/sshd_config", "TrustedUserCAKeys=/etc/containership/home/.ssh/trusted_user_ca_keys\n")
+	trusted, err = sshdTrustsCA(fs)
+	assert.Nil(t, err)
+	assert.True(t, trusted)
+
+	// Including the snippet directly or through another include works. The
+	// agent reads it through the host /etc like any other file.
+	write("containership/home/.ssh/sshd_config", buildSSHDConfigString())
+
+	write("ssh/sshd_config", "Include /etc/containership/home/.ssh/sshd_config\n")
+	trusted, err = sshdTrustsCA(fs)
+	assert.Nil(t, err)
+	assert.True(t, trusted)
+
+	write("ssh/sshd_config", "Include sshd_config.d/*.conf\n")
+	write("ssh/sshd_config.d/containership.conf", "Match User containership\n  Include /etc/containership/home/.ssh/sshd_config\n")
+	trusted, err = sshdTrustsCA(fs)
+	assert.Nil(t, err)
+	assert.True(t, trusted)
+
+	// Includes can't loop forever
+	write("ssh/sshd_config", "Include /etc/ssh/sshd_config\n")
+	trusted, err = sshdTrustsCA(fs)
+	assert.Nil(t, err)
+	assert.False(t, trusted)
+}
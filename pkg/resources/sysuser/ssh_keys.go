@@ -0,0 +1,98 @@
+package sysuser
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	v3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+)
+
+// minRSAKeyBits is the minimum size of RSA keys users may log in with
+const minRSAKeyBits = 2048
+
+// allowedKeyTypes are the types of keys users may log in with. DSA keys are
+// limited to 1024 bits and disabled by OpenSSH, so they aren't allowed.
+var allowedKeyTypes = map[string]bool{
+	ssh.KeyAlgoRSA:      true,
+	ssh.KeyAlgoECDSA256: true,
+	ssh.KeyAlgoECDSA384: true,
+	ssh.KeyAlgoECDSA521: true,
+	ssh.KeyAlgoED25519:  true,
+}
+
+// NormalizeSSHKey strictly parses the key of the SSH key and returns it as
+// "<type> <base64 key>", without any options or comment. An error is returned
+// if the key isn't exactly one valid public key, isn't allowed by the key
+// type and size policy, or doesn't match the fingerprint of the SSH key.
+func NormalizeSSHKey(key v3.SSHKeySpec) (string, error) {
+	trimmed := strings.TrimSpace(key.Key)
+	if strings.ContainsAny(trimmed, "\r\n") {
+		return "", fmt.Errorf("key spans multiple lines")
+	}
+
+	public, _, options, _, err := ssh.ParseAuthorizedKey([]byte(trimmed))
+	if err != nil {
+		return "", fmt.Errorf("key can't be parsed: %s", err)
+	}
+
+	if len(options) > 0 {
+		return "", fmt.Errorf("key has options")
+	}
+
+	if err := checkKeyPolicy(public); err != nil {
+		return "", err
+	}
+
+	if !fingerprintMatches(key.Fingerprint, public) {
+		return "", fmt.Errorf("key doesn't match fingerprint %s", key.Fingerprint)
+	}
+
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(public))), nil
+}
+
+// checkKeyPolicy returns an error if the key type isn't allowed or the key
+// is too small
+func checkKeyPolicy(public ssh.PublicKey) error {
+	if !allowedKeyTypes[public.Type()] {
+		return fmt.Errorf("key type %s isn't allowed", public.Type())
+	}
+
+	if public.Type() != ssh.KeyAlgoRSA {
+		return nil
+	}
+
+	cryptoKey, ok := public.(ssh.CryptoPublicKey)
+	if !ok {
+		return fmt.Errorf("key size can't be determined")
+	}
+
+	rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("key size can't be determined")
+	}
+
+	if bits := rsaKey.N.BitLen(); bits < minRSAKeyBits {
+		return fmt.Errorf("RSA key is %d bits, less than the minimum of %d", bits, minRSAKeyBits)
+	}
+
+	return nil
+}
+
+// fingerprintMatches returns true if the fingerprint is the MD5 or SHA256
+// fingerprint of the key, in the formats ssh-keygen prints them in. An empty
+// fingerprint can't be checked, so it always matches.
+func fingerprintMatches(fingerprint string, public ssh.PublicKey) bool {
+	if fingerprint == "" {
+		return true
+	}
+
+	if strings.HasPrefix(fingerprint, "SHA256:") {
+		return fingerprint == ssh.FingerprintSHA256(public)
+	}
+
+	md5 := strings.ToLower(strings.TrimPrefix(fingerprint, "MD5:"))
+	return md5 == ssh.FingerprintLegacyMD5(public)
+}
@@ -0,0 +1,82 @@
+package sysuser
+
+import (
+	"crypto/dsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
+	"github.com/containership/cluster-manager/pkg/apis/containership.io/v3/v3test"
+)
+
+func marshalTestKey(t *testing.T, key interface{}) string {
+	public, err := ssh.NewPublicKey(key)
+	assert.Nil(t, err)
+
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(public)))
+}
+
+func TestNormalizeSSHKey(t *testing.T) {
+	key := v3.SSHKeySpec{
+		Key:         v3test.KeyString + " user@host\n",
+		Fingerprint: v3test.FingerprintString,
+	}
+
+	normalized, err := NormalizeSSHKey(key)
+	assert.Nil(t, err)
+	assert.Equal(t, v3test.KeyString, normalized, "comment and whitespace are removed")
+
+	key.Fingerprint = "MD5:" + strings.ToUpper(v3test.FingerprintString)
+	_, err = NormalizeSSHKey(key)
+	assert.Nil(t, err, "ssh-keygen MD5 format is accepted")
+
+	key.Fingerprint = "SHA256:zMyXPHjrxjd544xHVo0pSXiPXo4VUNL1BXM6qb1gqw0"
+	_, err = NormalizeSSHKey(key)
+	assert.Nil(t, err, "SHA256 format is accepted")
+
+	key.Fingerprint = ""
+	_, err = NormalizeSSHKey(key)
+	assert.Nil(t, err, "keys without a fingerprint can't be checked")
+
+	key.Fingerprint = "00:11:22"
+	_, err = NormalizeSSHKey(key)
+	assert.NotNil(t, err, "fingerprint doesn't match")
+}
+
+func TestNormalizeSSHKeyRejectsInvalidKeys(t *testing.T) {
+	for name, key := range map[string]string{
+		"malformed":      "ssh-rsa ABCDEF",
+		"empty":          "",
+		"options":        `command="/bin/sh" ` + v3test.KeyString,
+		"multiple lines": v3test.KeyString + "\n" + v3test.KeyString,
+		"injected line":  "invalid\n" + v3test.KeyString,
+	} {
+		_, err := NormalizeSSHKey(v3.SSHKeySpec{Key: key})
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestNormalizeSSHKeyPolicy(t *testing.T) {
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(t, err)
+	_, err = NormalizeSSHKey(v3.SSHKeySpec{Key: marshalTestKey(t, &small.PublicKey)})
+	assert.NotNil(t, err, "RSA keys must be at least 2048 bits")
+
+	large, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	_, err = NormalizeSSHKey(v3.SSHKeySpec{Key: marshalTestKey(t, &large.PublicKey)})
+	assert.Nil(t, err)
+
+	dsaKey := &dsa.PublicKey{
+		Parameters: dsa.Parameters{P: big.NewInt(23), Q: big.NewInt(11), G: big.NewInt(4)},
+		Y:          big.NewInt(8),
+	}
+	_, err = NormalizeSSHKey(v3.SSHKeySpec{Key: marshalTestKey(t, dsaKey)})
+	assert.NotNil(t, err, "DSA keys aren't allowed")
+}
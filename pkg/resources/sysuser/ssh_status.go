@@ -0,0 +1,21 @@
+package sysuser
+
+import (
+	"time"
+)
+
+// SSHStatus is the SSH status of a node as reported by its agent
+type SSHStatus struct {
+	// UserIDs are the IDs of the users configured on the node
+	UserIDs []string `json:"user_ids"`
+	// AuthorizedKeysWrittenAt is when authorized_keys was last written, or
+	// the zero time if it wasn't written yet
+	AuthorizedKeysWrittenAt time.Time `json:"authorized_keys_written_at"`
+	// ActiveSessions are the start records of the sessions that haven't
+	// ended yet, oldest first. Only the most recent sessions are listed if
+	// there are too many to fit in the node annotation.
+	ActiveSessions []SessionRecord `json:"active_sessions"`
+	// ActiveSessionCount is the number of sessions that haven't ended yet,
+	// including those that aren't listed
+	ActiveSessionCount int `json:"active_session_count"`
+}
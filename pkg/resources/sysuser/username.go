@@ -2,21 +2,251 @@ package sysuser
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
 	"strings"
+
+	v3 "github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
 )
 
-// UsernameFromContainershipUID returns the system username that the passed UID maps to
-// TODO error handling needed? Probably.
-func UsernameFromContainershipUID(uid string) string {
-	return strings.Replace(uid, "-", "", -1)
+// UsernamesConfigMapName is the name of the ConfigMap the coordinator
+// persists the username of each user in, keyed by user ID
+const UsernamesConfigMapName = "containership-usernames"
+
+// maxUsernameLength is the longest username useradd accepts
+const maxUsernameLength = 32
+
+// UsernameStrategy is how the username of a user that doesn't have one yet is
+// built
+type UsernameStrategy string
+
+const (
+	// UsernameStrategyUID builds usernames from user IDs by removing the
+	// dashes
+	UsernameStrategyUID UsernameStrategy = "uid"
+	// UsernameStrategyName builds usernames by sanitizing the names of users.
+	// A number is appended to names that are already taken.
+	UsernameStrategyName UsernameStrategy = "name"
+)
+
+// validUID matches Containership UIDs, which are UUIDs
+var validUID = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// validUIDUsername matches usernames built from Containership UIDs
+var validUIDUsername = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// validUsername matches the usernames users may be mapped to. They're passed
+// to the login script and used in paths, so they're kept strict.
+var validUsername = regexp.MustCompile(`^[a-z0-9_][a-z0-9_-]*$`)
+
+// reservedUsernames are the names of system accounts and of the default
+// accounts of common distributions, which users must never be mapped to
+var reservedUsernames = map[string]bool{
+	"adm": true, "admin": true, "backup": true, "bin": true, "centos": true,
+	"containership": true, "core": true, "daemon": true, "debian": true,
+	"docker": true, "ec2-user": true, "fedora": true, "ftp": true,
+	"games": true, "gnats": true, "halt": true, "irc": true, "list": true,
+	"lp": true, "mail": true, "man": true, "messagebus": true, "news": true,
+	"nobody": true, "operator": true, "proxy": true, "root": true,
+	"shutdown": true, "sshd": true, "sync": true, "sys": true,
+	"syslog": true, "ubuntu": true, "uucp": true, "www-data": true,
+}
+
+// isReservedUsername returns true if the username may belong to a system
+// account
+func isReservedUsername(username string) bool {
+	return reservedUsernames[username] || strings.HasPrefix(username, "systemd-") ||
+		strings.HasPrefix(username, "_")
+}
+
+// UsernameFromContainershipUID returns the system username that the passed
+// UID maps to with the uid strategy
+func UsernameFromContainershipUID(uid string) (string, error) {
+	if !validUID.MatchString(uid) {
+		return "", fmt.Errorf("user ID %q is not a UUID", uid)
+	}
+
+	return strings.Replace(uid, "-", "", -1), nil
 }
 
-// UsernameToContainershipUID returns the Containership UID that the passed system username maps to
-func UsernameToContainershipUID(username string) string {
+// UsernameToContainershipUID returns the Containership UID that the passed
+// system username maps to with the uid strategy
+func UsernameToContainershipUID(username string) (string, error) {
+	if !validUIDUsername.MatchString(username) {
+		return "", fmt.Errorf("username %q is not built from a user ID", username)
+	}
+
 	return fmt.Sprintf("%s-%s-%s-%s-%s",
 		username[0:8],
 		username[8:12],
 		username[12:16],
 		username[16:20],
-		username[20:32])
+		username[20:32]), nil
+}
+
+// usernameFromName returns the name sanitized into a username. Characters
+// that can't be used are replaced by dashes.
+func usernameFromName(name string) (string, error) {
+	var b strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '_' {
+			if dash && b.Len() > 0 {
+				b.WriteRune('-')
+			}
+			b.WriteRune(c)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+
+	username := b.String()
+	if username == "" {
+		return "", fmt.Errorf("name %q has no characters usable in a username", name)
+	}
+
+	if len(username) > maxUsernameLength {
+		username = strings.TrimRight(username[:maxUsernameLength], "-")
+	}
+
+	return username, nil
+}
+
+// UsernameMapping maps the IDs of users to the usernames of their host users
+type UsernameMapping struct {
+	usernames map[string]string
+	userIDs   map[string]string
+}
+
+// NewUsernameMapping returns the mapping of the ConfigMap data, which maps
+// user IDs to usernames. An error is returned if any username is invalid or
+// used by more than one user.
+func NewUsernameMapping(data map[string]string) (*UsernameMapping, error) {
+	m := &UsernameMapping{
+		usernames: make(map[string]string, len(data)),
+		userIDs:   make(map[string]string, len(data)),
+	}
+
+	for id, username := range data {
+		if len(username) > maxUsernameLength || !validUsername.MatchString(username) {
+			return nil, fmt.Errorf("username %q of user %s is invalid", username, id)
+		}
+
+		if other, ok := m.userIDs[username]; ok {
+			return nil, fmt.Errorf("username %q is used by both user %s and user %s", username, other, id)
+		}
+
+		m.usernames[id] = username
+		m.userIDs[username] = id
+	}
+
+	return m, nil
+}
+
+// Username returns the username of the user
+func (m *UsernameMapping) Username(userID string) (string, error) {
+	username, ok := m.usernames[userID]
+	if !ok {
+		return "", fmt.Errorf("user %s has no username yet", userID)
+	}
+
+	return username, nil
+}
+
+// UserID returns the ID of the user with the username
+func (m *UsernameMapping) UserID(username string) (string, error) {
+	id, ok := m.userIDs[username]
+	if !ok {
+		return "", fmt.Errorf("username %q doesn't belong to any user", username)
+	}
+
+	return id, nil
+}
+
+// Data returns the mapping as ConfigMap data
+func (m *UsernameMapping) Data() map[string]string {
+	data := make(map[string]string, len(m.usernames))
+	for id, username := range m.usernames {
+		data[id] = username
+	}
+
+	return data
+}
+
+// Assign returns a copy of the mapping in which each of the users that
+// doesn't have a username yet is given one built with the strategy. Existing
+// usernames never change, so that host users stay the same when users are
+// renamed or the strategy changes. The users that couldn't be given a
+// username are returned with the reason by ID.
+func (m *UsernameMapping) Assign(users []v3.UserSpec, strategy UsernameStrategy) (*UsernameMapping, map[string]error) {
+	assigned, _ := NewUsernameMapping(m.Data())
+	failed := make(map[string]error)
+
+	// Users are assigned in order of ID so that the same user wins a
+	// contested name on every sync
+	sorted := append([]v3.UserSpec(nil), users...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	for _, u := range sorted {
+		if _, ok := assigned.usernames[u.ID]; ok {
+			continue
+		}
+
+		username, err := assigned.buildUsername(u, strategy)
+		if err != nil {
+			failed[u.ID] = err
+			continue
+		}
+
+		assigned.usernames[u.ID] = username
+		assigned.userIDs[username] = u.ID
+	}
+
+	return assigned, failed
+}
+
+// buildUsername builds a username for the user that isn't taken yet
+func (m *UsernameMapping) buildUsername(user v3.UserSpec, strategy UsernameStrategy) (string, error) {
+	switch strategy {
+	case UsernameStrategyUID:
+		username, err := UsernameFromContainershipUID(user.ID)
+		if err != nil {
+			return "", err
+		}
+
+		if _, taken := m.userIDs[username]; taken {
+			return "", fmt.Errorf("username %q is already taken", username)
+		}
+
+		return username, nil
+
+	case UsernameStrategyName:
+		base, err := usernameFromName(user.Name)
+		if err != nil {
+			return "", err
+		}
+
+		if isReservedUsername(base) {
+			return "", fmt.Errorf("username %q is reserved for system accounts", base)
+		}
+
+		username := base
+		for i := 2; ; i++ {
+			if _, taken := m.userIDs[username]; !taken {
+				return username, nil
+			}
+
+			suffix := fmt.Sprintf("-%d", i)
+			if len(base)+len(suffix) > maxUsernameLength {
+				base = strings.TrimRight(base[:maxUsernameLength-len(suffix)], "-")
+			}
+			username = base + suffix
+		}
+
+	default:
+		return "", fmt.Errorf("unknown username strategy %q", strategy)
+	}
 }
@@ -1,9 +1,12 @@
 package sysuser
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/containership/cluster-manager/pkg/apis/containership.io/v3"
 )
 
 const (
@@ -11,12 +14,167 @@ const (
 	testUsernameFromUID = "123456781234123412341234567890ab"
 )
 
+// newTestUsernames maps the users to usernames with the uid strategy
+func newTestUsernames(t *testing.T, users ...v3.UserSpec) *UsernameMapping {
+	m, err := NewUsernameMapping(nil)
+	assert.Nil(t, err)
+
+	assigned, failed := m.Assign(users, UsernameStrategyUID)
+	assert.Empty(t, failed)
+
+	return assigned
+}
+
+// testUsername returns the username of the user with the uid strategy
+func testUsername(t *testing.T, user v3.UserSpec) string {
+	username, err := UsernameFromContainershipUID(user.ID)
+	assert.Nil(t, err)
+
+	return username
+}
+
 func TestUsernameFromContainershipUID(t *testing.T) {
-	username := UsernameFromContainershipUID(testUID)
+	username, err := UsernameFromContainershipUID(testUID)
+	assert.Nil(t, err)
 	assert.Equal(t, testUsernameFromUID, username, "")
+
+	for _, uid := range []string{"", "1234", testUsernameFromUID, strings.ToUpper(testUID), testUID + "0"} {
+		_, err := UsernameFromContainershipUID(uid)
+		assert.NotNil(t, err, uid)
+	}
 }
 
 func TestUsernameToContainershipUID(t *testing.T) {
-	uid := UsernameToContainershipUID(testUsernameFromUID)
+	uid, err := UsernameToContainershipUID(testUsernameFromUID)
+	assert.Nil(t, err)
 	assert.Equal(t, testUID, uid, "")
+
+	for _, username := range []string{"", "root", testUID, testUsernameFromUID[:31], testUsernameFromUID + "0"} {
+		_, err := UsernameToContainershipUID(username)
+		assert.NotNil(t, err, username)
+	}
+}
+
+func TestUsernameFromName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"jane":                         "jane",
+		"Jane Doe":                     "jane-doe",
+		"  Jane   O'Doe-Smith ":        "jane-o-doe-smith",
+		"jane_doe2":                    "jane_doe2",
+		"José":                         "jos",
+		strings.Repeat("a", 40):        strings.Repeat("a", 32),
+		strings.Repeat("a", 31) + " b": strings.Repeat("a", 31),
+	} {
+		username, err := usernameFromName(name)
+		assert.Nil(t, err, name)
+		assert.Equal(t, expected, username, name)
+	}
+
+	for _, name := range []string{"", "   ", "../", "ñ"} {
+		_, err := usernameFromName(name)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestNewUsernameMapping(t *testing.T) {
+	m, err := NewUsernameMapping(map[string]string{"id-1": "jane", "id-2": "john"})
+	assert.Nil(t, err)
+
+	username, err := m.Username("id-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "jane", username)
+
+	id, err := m.UserID("john")
+	assert.Nil(t, err)
+	assert.Equal(t, "id-2", id)
+
+	_, err = m.Username("id-3")
+	assert.NotNil(t, err)
+	_, err = m.UserID("root")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, map[string]string{"id-1": "jane", "id-2": "john"}, m.Data())
+
+	for _, data := range []map[string]string{
+		{"id-1": "jane", "id-2": "jane"},
+		{"id-1": "../jane"},
+		{"id-1": "-jane"},
+		{"id-1": ""},
+		{"id-1": strings.Repeat("a", 33)},
+	} {
+		_, err := NewUsernameMapping(data)
+		assert.NotNil(t, err, data)
+	}
+}
+
+func TestUsernameMappingAssign(t *testing.T) {
+	m, err := NewUsernameMapping(map[string]string{
+		"00000000-1111-2222-3333-000000000001": "jane",
+		"00000000-1111-2222-3333-000000000009": "removed",
+	})
+	assert.Nil(t, err)
+
+	users := []v3.UserSpec{
+		{ID: "00000000-1111-2222-3333-000000000003", Name: "Jane"},
+		{ID: "00000000-1111-2222-3333-000000000001", Name: "Jane Renamed"},
+		{ID: "00000000-1111-2222-3333-000000000002", Name: "jane"},
+		{ID: "00000000-1111-2222-3333-000000000004", Name: "Removed"},
+		{ID: "00000000-1111-2222-3333-000000000005", Name: "!!!"},
+	}
+
+	assigned, failed := m.Assign(users, UsernameStrategyName)
+	assert.Equal(t, map[string]string{
+		"00000000-1111-2222-3333-000000000001": "jane",
+		"00000000-1111-2222-3333-000000000002": "jane-2",
+		"00000000-1111-2222-3333-000000000003": "jane-3",
+		"00000000-1111-2222-3333-000000000004": "removed-2",
+		"00000000-1111-2222-3333-000000000009": "removed",
+	}, assigned.Data(), "existing usernames are kept and collisions are numbered in order of ID")
+	assert.Len(t, failed, 1)
+	assert.NotNil(t, failed["00000000-1111-2222-3333-000000000005"])
+
+	assert.Len(t, m.Data(), 2, "the mapping is copied")
+
+	assigned, failed = assigned.Assign(users, UsernameStrategyUID)
+	assert.Empty(t, failed)
+	username, err := assigned.Username("00000000-1111-2222-3333-000000000005")
+	assert.Nil(t, err)
+	assert.Equal(t, "00000000111122223333000000000005", username)
+	username, err = assigned.Username("00000000-1111-2222-3333-000000000002")
+	assert.Nil(t, err)
+	assert.Equal(t, "jane-2", username, "changing the strategy doesn't change usernames")
+
+	_, failed = m.Assign([]v3.UserSpec{{ID: "not-a-uuid"}}, UsernameStrategyUID)
+	assert.NotNil(t, failed["not-a-uuid"])
+}
+
+func TestUsernameMappingAssignTruncates(t *testing.T) {
+	long := strings.Repeat("a", 40)
+	m, err := NewUsernameMapping(map[string]string{"id-0": strings.Repeat("a", 32)})
+	assert.Nil(t, err)
+
+	assigned, failed := m.Assign([]v3.UserSpec{{ID: "id-1", Name: long}}, UsernameStrategyName)
+	assert.Empty(t, failed)
+
+	username, err := assigned.Username("id-1")
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat("a", 30)+"-2", username)
+}
+
+func TestUsernameMappingAssignRejectsReservedNames(t *testing.T) {
+	m, err := NewUsernameMapping(nil)
+	assert.Nil(t, err)
+
+	users := []v3.UserSpec{
+		{ID: "00000000-1111-2222-3333-000000000001", Name: "Root"},
+		{ID: "00000000-1111-2222-3333-000000000002", Name: "ubuntu"},
+		{ID: "00000000-1111-2222-3333-000000000003", Name: "systemd network"},
+		{ID: "00000000-1111-2222-3333-000000000004", Name: "Rooted"},
+	}
+
+	assigned, failed := m.Assign(users, UsernameStrategyName)
+	assert.Len(t, failed, 3)
+	assert.Equal(t, map[string]string{
+		"00000000-1111-2222-3333-000000000004": "rooted",
+	}, assigned.Data())
 }
@@ -59,6 +59,28 @@ func sshKeysEqualCompare(specSSHKeys []csv3.SSHKeySpec, userSSHKeysByID map[stri
 	return true
 }
 
+// stringSetsAreEqual returns true if both slices hold the same strings the
+// same number of times, in any order
+func stringSetsAreEqual(strs []string, otherStrs []string) bool {
+	if len(strs) != len(otherStrs) {
+		return false
+	}
+
+	counts := make(map[string]int, len(strs))
+	for _, str := range strs {
+		counts[str]++
+	}
+
+	for _, str := range otherStrs {
+		if counts[str] == 0 {
+			return false
+		}
+		counts[str]--
+	}
+
+	return true
+}
+
 // IsEqual compares a UserSpec to another User
 func (us *CsUsers) IsEqual(specObj interface{}, parentSpecObj interface{}) (bool, error) {
 	spec, ok := specObj.(csv3.UserSpec)
@@ -75,6 +97,16 @@ func (us *CsUsers) IsEqual(specObj interface{}, parentSpecObj interface{}) (bool
 		return false, nil
 	}
 
+	if !stringSetsAreEqual(user.Spec.Teams, spec.Teams) {
+		return false, nil
+	}
+
+	if user.Spec.Sudo != spec.Sudo ||
+		!stringSetsAreEqual(user.Spec.SudoCommands, spec.SudoCommands) ||
+		!stringSetsAreEqual(user.Spec.Groups, spec.Groups) {
+		return false, nil
+	}
+
 	if len(user.Spec.SSHKeys) != len(spec.SSHKeys) {
 		return false, nil
 	}
@@ -159,4 +159,47 @@ func TestIsEqual(t *testing.T) {
 	diffLengths, err := c.IsEqual(user2specDiff, user1)
 	assert.Nil(t, err)
 	assert.Equal(t, diffLengths, false)
+
+	// check with different teams
+	teamsSpec := user1spec
+	teamsSpec.Teams = []string{"team-1", "team-2"}
+	teamsUser := user1.DeepCopy()
+	teamsUser.Spec.Teams = []string{"team-2", "team-1"}
+	sameTeams, err := c.IsEqual(teamsSpec, teamsUser)
+	assert.Nil(t, err)
+	assert.Equal(t, sameTeams, true)
+
+	teamsUser.Spec.Teams = []string{"team-1"}
+	diffTeams, err := c.IsEqual(teamsSpec, teamsUser)
+	assert.Nil(t, err)
+	assert.Equal(t, diffTeams, false)
+
+	// check with duplicates, which must differ both ways
+	teamsUser.Spec.Teams = []string{"team-1", "team-1"}
+	dupTeams, err := c.IsEqual(teamsSpec, teamsUser)
+	assert.Nil(t, err)
+	assert.Equal(t, dupTeams, false)
+	dupTeamsSpec := user1spec
+	dupTeamsSpec.Teams = []string{"team-1", "team-1"}
+	teamsUser.Spec.Teams = []string{"team-1", "team-2"}
+	dupTeams, err = c.IsEqual(dupTeamsSpec, teamsUser)
+	assert.Nil(t, err)
+	assert.Equal(t, dupTeams, false)
+
+	// check with duplicate groups and sudo commands
+	groupsSpec := user1spec
+	groupsSpec.Groups = []string{"docker", "docker"}
+	groupsUser := user1.DeepCopy()
+	groupsUser.Spec.Groups = []string{"docker", "adm"}
+	diffGroups, err := c.IsEqual(groupsSpec, groupsUser)
+	assert.Nil(t, err)
+	assert.Equal(t, diffGroups, false)
+
+	commandsSpec := user1spec
+	commandsSpec.SudoCommands = []string{"/usr/bin/docker ps", "/usr/bin/docker ps"}
+	commandsUser := user1.DeepCopy()
+	commandsUser.Spec.SudoCommands = []string{"/usr/bin/docker ps", "/sbin/reboot"}
+	diffCommands, err := c.IsEqual(commandsSpec, commandsUser)
+	assert.Nil(t, err)
+	assert.Equal(t, diffCommands, false)
 }
@@ -11,6 +11,12 @@ type Metadata struct{}
 // Terminate is exported for access to handler methods
 type Terminate struct{}
 
+// RegistryWebhook is exported for access to handler methods
+type RegistryWebhook struct{}
+
+// SSHStatus is exported for access to handler methods
+type SSHStatus struct{}
+
 // RespondWithError is a shared function to have handler respond with error
 func RespondWithError(w http.ResponseWriter, code int, message string) {
 	respondWithJSON(w, code, map[string]string{"error": message})
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/containership/cluster-manager/pkg/coordinator"
+	"github.com/containership/cluster-manager/pkg/log"
+)
+
+// Mutate handles an AdmissionReview for a pod and responds with a patch adding
+// the image pull secrets of any matching registries. Pods are always allowed,
+// a failure to build a patch only means the pod is admitted unmodified.
+func (rw *RegistryWebhook) Mutate(w http.ResponseWriter, r *http.Request) {
+	review := admissionv1beta1.AdmissionReview{}
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if review.Request == nil {
+		RespondWithError(w, http.StatusBadRequest, "AdmissionReview has no request")
+		return
+	}
+
+	review.Response = mutatePod(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+
+	respondWithJSON(w, http.StatusOK, review)
+}
+
+func mutatePod(req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	pod := corev1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		return &admissionv1beta1.AdmissionResponse{
+			Allowed: true,
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	patch, err := coordinator.PodImagePullSecretsPatch(&pod)
+	if err != nil {
+		log.Errorf("Could not build image pull secrets patch for pod %s/%s: %s", req.Namespace, pod.Name, err)
+		return &admissionv1beta1.AdmissionResponse{
+			Allowed: true,
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	resp := &admissionv1beta1.AdmissionResponse{
+		Allowed: true,
+	}
+
+	if patch != nil {
+		patchType := admissionv1beta1.PatchTypeJSONPatch
+		resp.Patch = patch
+		resp.PatchType = &patchType
+	}
+
+	return resp
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/containership/cluster-manager/pkg/coordinator"
+)
+
+type sshStatus struct {
+	Nodes []coordinator.NodeSSHStatus `json:"nodes"`
+	// ActiveSessions is the number of active sessions on all nodes
+	ActiveSessions int       `json:"active_sessions"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// Get returns the SSH status reported by the agent of every node
+func (s *SSHStatus) Get(w http.ResponseWriter, r *http.Request) {
+	nodes, err := coordinator.NodesSSHStatus()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	status := &sshStatus{
+		Nodes:     nodes,
+		Timestamp: time.Now().UTC(),
+	}
+
+	for _, n := range nodes {
+		if n.Status == nil {
+			continue
+		}
+
+		// Older agents don't report the count, but also never limit the
+		// sessions they list
+		count := n.Status.ActiveSessionCount
+		if count < len(n.Status.ActiveSessions) {
+			count = len(n.Status.ActiveSessions)
+		}
+		status.ActiveSessions += count
+	}
+
+	respondWithJSON(w, http.StatusOK, status)
+}
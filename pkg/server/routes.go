@@ -3,6 +3,7 @@ package server
 import (
 	"net/http"
 
+	"github.com/containership/cluster-manager/pkg/env"
 	"github.com/containership/cluster-manager/pkg/server/handlers"
 )
 
@@ -10,6 +11,7 @@ import (
 func (s *CSServer) initializeRoutes() {
 	m := &handlers.Metadata{}
 	c := &handlers.Terminate{}
+	ss := &handlers.SSHStatus{}
 
 	s.router.Handle("/metadata", chainHandlers(http.HandlerFunc(m.Get),
 		[]HandlerFunc{
@@ -23,6 +25,21 @@ func (s *CSServer) initializeRoutes() {
 			jwtSignedForTerminate,
 		}...,
 	)).Methods("DELETE")
+
+	s.router.Handle("/ssh/status", chainHandlers(http.HandlerFunc(ss.Get),
+		[]HandlerFunc{
+			isAuthed,
+		}...,
+	)).Methods("GET")
+
+	// The webhook is called by the Kubernetes API server, which doesn't send
+	// a Containership token. It isn't authenticated at all: it only returns
+	// the pull secrets to add to the pod in the request and has no side
+	// effects. TLS only lets the API server verify the coordinator.
+	if env.IsRegistryWebhookEnabled() {
+		rw := &handlers.RegistryWebhook{}
+		s.webhookRouter.Handle("/webhooks/registries", http.HandlerFunc(rw.Mutate)).Methods("POST")
+	}
 }
 
 // HandlerFunc defines the function signature for a middleware function
@@ -13,6 +13,10 @@ import (
 // CSServer defines the server
 type CSServer struct {
 	router *mux.Router
+
+	// webhookRouter serves the admission webhooks called by the Kubernetes
+	// API server, which is done over TLS on a separate port
+	webhookRouter *mux.Router
 }
 
 // New creates a new server
@@ -28,14 +32,33 @@ func New() *CSServer {
 func (cs *CSServer) Run() {
 	port := env.CSServerPort()
 
+	if env.IsRegistryWebhookEnabled() {
+		go cs.runWebhooks(fmt.Sprintf(":%s", env.RegistryWebhookPort()))
+	}
+
 	cs.run(fmt.Sprintf(":%s", port))
 }
 
 func (cs *CSServer) initialize() {
 	cs.router = mux.NewRouter()
+	cs.webhookRouter = mux.NewRouter()
 	cs.initializeRoutes()
 }
 
 func (cs *CSServer) run(addr string) {
 	log.Fatal(http.ListenAndServe(addr, cs.router))
 }
+
+// runWebhooks serves the webhooks with TLS. Webhooks are optional, so the
+// rest of the server keeps running if they can't be served.
+func (cs *CSServer) runWebhooks(addr string) {
+	certFile := env.RegistryWebhookTLSCertFile()
+	keyFile := env.RegistryWebhookTLSKeyFile()
+
+	if certFile == "" || keyFile == "" {
+		log.Error("Not serving the registry webhook: REGISTRY_WEBHOOK_TLS_CERT_FILE and REGISTRY_WEBHOOK_TLS_KEY_FILE must be set")
+		return
+	}
+
+	log.Error("Error serving webhooks: ", http.ListenAndServeTLS(addr, certFile, keyFile, cs.webhookRouter))
+}
@@ -122,20 +122,65 @@ func WriteNewFileAtomic(fs afero.Fs, filename string, data []byte, perms os.File
 		return os.ErrExist
 	}
 
+	return WriteFileAtomic(fs, filename, data, perms)
+}
+
+// WriteFileAtomic is the same as WriteNewFileAtomic except that an existing
+// file is replaced rather than returning an error. The temporary file is
+// synced before it's renamed and the directory is synced after, so a crash
+// can't leave filename empty or truncated. The temporary file is removed if
+// any step fails.
+func WriteFileAtomic(fs afero.Fs, filename string, data []byte, perms os.FileMode) (err error) {
 	dir, tmpPrefix := filepath.Split(filename)
 	tmpFile, err := afero.TempFile(fs, dir, tmpPrefix)
 	if err != nil {
 		return err
 	}
-	defer tmpFile.Close()
+	tmpName := tmpFile.Name()
+
+	defer func() {
+		if err != nil {
+			// Close may have already been called; the error is irrelevant
+			// either way
+			tmpFile.Close()
+			fs.Remove(tmpName)
+		}
+	}()
+
+	if err = fs.Chmod(tmpName, perms); err != nil {
+		return err
+	}
+
+	if _, err = tmpFile.Write(data); err != nil {
+		return err
+	}
+
+	if err = tmpFile.Sync(); err != nil {
+		return err
+	}
+
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
 
-	if err := fs.Chmod(tmpFile.Name(), perms); err != nil {
+	if err = fs.Rename(tmpName, filename); err != nil {
 		return err
 	}
 
-	if _, err := tmpFile.Write(data); err != nil {
+	return SyncDir(fs, dir)
+}
+
+// SyncDir flushes dir itself to disk so that a rename into it is durable
+func SyncDir(fs afero.Fs, dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+
+	d, err := fs.Open(dir)
+	if err != nil {
 		return err
 	}
+	defer d.Close()
 
-	return fs.Rename(tmpFile.Name(), filename)
+	return d.Sync()
 }
@@ -1,7 +1,9 @@
 package fsutil
 
 import (
+	"errors"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/spf13/afero"
@@ -52,3 +54,44 @@ func TestWriteNewFileAtomic(t *testing.T) {
 	err = WriteNewFileAtomic(fs, filename, data, os.FileMode(0600))
 	assert.Equal(t, os.ErrExist, err)
 }
+
+func TestWriteFileAtomic(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	err := WriteFileAtomic(fs, filename, data, os.FileMode(0600))
+	assert.Nil(t, err)
+
+	// Should replace the contents if file already exists
+	newData := []byte("new test data")
+	err = WriteFileAtomic(fs, filename, newData, os.FileMode(0600))
+	assert.Nil(t, err)
+
+	contents, err := afero.ReadFile(fs, filename)
+	assert.Nil(t, err)
+	assert.Equal(t, newData, contents)
+
+	stat, err := fs.Stat(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, permissions.String(), stat.Mode().String())
+}
+
+// failingRenameFs is a MemMapFs whose Rename always fails
+type failingRenameFs struct {
+	afero.Fs
+}
+
+func (fs failingRenameFs) Rename(oldname, newname string) error {
+	return errors.New("rename failed")
+}
+
+func TestWriteFileAtomicFailureLeavesNoTempFile(t *testing.T) {
+	fs := failingRenameFs{afero.NewMemMapFs()}
+
+	err := WriteFileAtomic(fs, filename, data, os.FileMode(0600))
+	assert.NotNil(t, err)
+
+	dir, _ := filepath.Split(filename)
+	infos, err := afero.ReadDir(fs, dir)
+	assert.Nil(t, err)
+	assert.Empty(t, infos, "temp file should be removed on failure")
+}
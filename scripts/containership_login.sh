@@ -1,12 +1,44 @@
 #!/bin/sh
 
 USER=$1
+FINGERPRINT=${2:-unknown}
 USER_HOME=/etc/containership/home/$USER
 
+# Written by the agent for each user. /etc/sudoers must include /etc/sudoers.d
+# for the sudoers drop-in to have any effect. The agent also keeps installed
+# drop-ins up to date if it has the host /etc mounted.
+SUDOERS=/etc/containership/sudoers.d/$USER
+GROUPS_FILE=/etc/containership/groups/$USER
+HOST_SUDOERS=/etc/sudoers.d/containership-$USER
+
+# Session records are spooled here for the agent to pick up
+SESSIONS_DIR=/etc/containership/sessions
+SESSION_ID=$(cat /proc/sys/kernel/random/uuid 2> /dev/null || echo "$(date +%s)-$$")
+SOURCE_IP=${SSH_CLIENT%% *}
+
+# Records are written to a dotfile first so that the agent never reads a
+# partial record. The PID of this script lets the agent tell whether the
+# session is still active if its end is never recorded.
+record_session() {
+    RECORD_NAME=$SESSION_ID-$1
+    sudo mkdir -p -m 0700 $SESSIONS_DIR
+    printf '{"event":"%s","session_id":"%s","pid":%d,"username":"%s","fingerprint":"%s","source_ip":"%s","time":"%s"}\n' \
+        "$1" "$SESSION_ID" $$ "$USER" "$FINGERPRINT" "$SOURCE_IP" "$(date -u +%Y-%m-%dT%H:%M:%SZ)" |
+        sudo tee $SESSIONS_DIR/.$RECORD_NAME > /dev/null &&
+        sudo mv $SESSIONS_DIR/.$RECORD_NAME $SESSIONS_DIR/$RECORD_NAME
+}
+
 if [ $# -eq 0 ]; then
     exit 1
 fi
 
+# Usernames may be built from names, so an existing host account is only used
+# if it was created by this script
+if id $USER > /dev/null 2>&1 && [ "$(getent passwd $USER | cut -d: -f6)" != "$USER_HOME" ]; then
+    echo "Host account $USER is not managed by Containership" >&2
+    exit 1
+fi
+
 if ! id $USER > /dev/null 2>&1; then
     if command -v useradd > /dev/null 2>&1; then
         sudo useradd -m -d $USER_HOME $USER
@@ -16,8 +48,59 @@ if ! id $USER > /dev/null 2>&1; then
     else
         exit 1
     fi
+elif command -v usermod > /dev/null 2>&1; then
+    # The agent locks users that are removed, and they may have been added back
+    sudo usermod -U -e "" $USER > /dev/null 2>&1
+else
+    sudo passwd -u $USER > /dev/null 2>&1
+fi
 
-    echo "$USER ALL=(ALL) NOPASSWD:ALL" | sudo EDITOR="tee -a" visudo > /dev/null 2>&1
+if sudo test -f $SUDOERS; then
+    if sudo visudo -cf $SUDOERS > /dev/null 2>&1; then
+        sudo install -m 0440 $SUDOERS $HOST_SUDOERS
+    fi
+else
+    sudo rm -f $HOST_SUDOERS
 fi
 
+# Users used to be given full sudo access in /etc/sudoers itself. The line is
+# only removed once the drop-in replaces it, which requires /etc/sudoers to
+# include the drop-ins.
+SUDOERS_LINE="$USER ALL=(ALL) NOPASSWD:ALL"
+if ! sudo grep -Eq '^[#@]includedir[[:space:]]+/etc/sudoers\.d/?[[:space:]]*$' /etc/sudoers; then
+    echo "/etc/sudoers does not include /etc/sudoers.d, sudo access of $USER is not updated" >&2
+elif sudo grep -qx "$SUDOERS_LINE" /etc/sudoers; then
+    TMP_SUDOERS=$(mktemp)
+    sudo grep -vx "$SUDOERS_LINE" /etc/sudoers > $TMP_SUDOERS
+    if sudo visudo -cf $TMP_SUDOERS > /dev/null 2>&1; then
+        sudo cp $TMP_SUDOERS /etc/sudoers
+    fi
+    rm -f $TMP_SUDOERS
+fi
+
+USER_GROUPS=""
+if [ -f $GROUPS_FILE ]; then
+    for GROUP in $(cat $GROUPS_FILE); do
+        if getent group $GROUP > /dev/null 2>&1; then
+            USER_GROUPS="$USER_GROUPS${USER_GROUPS:+,}$GROUP"
+        fi
+    done
+fi
+
+if command -v usermod > /dev/null 2>&1; then
+    sudo usermod -G "$USER_GROUPS" $USER
+else
+    # Groups can only be added without usermod
+    for GROUP in $(echo $USER_GROUPS | tr ',' ' '); do
+        sudo addgroup $USER $GROUP > /dev/null 2>&1
+    done
+fi
+
+record_session start
+
+# The end of the session is also recorded if the connection is dropped
+trap 'record_session end' EXIT
+trap 'exit 129' HUP
+trap 'exit 143' TERM
+
 sudo su - $USER